@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// benchPace is how often a rate limited bench connection sends what's due.
+const benchPace = 10 * time.Millisecond
+
+// runBench implements the "bench" subcommand.
+// It loads a running server the way producers do: -conns connections
+// send -rate values per second between them for -duration, drawn from
+// a seeded corpus with -dup repeats and -malformed bad lines, so runs
+// are reproducible. It reports the throughput achieved, how many of the
+// lines sent were valid by ParseLine, and every reply that isn't a
+// greeting or PONG, e.g. busy or rate limited ones.
+func runBench(args []string) (err error) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:3280", "server to load")
+	conns := fs.Int("conns", 6, "concurrent connections")
+	rate := fs.Int("rate", 0, "values per second over all connections, 0 sends as fast as possible")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send")
+	dup := fs.Float64("dup", 0.1, "ratio of valid lines that repeat an earlier value (0-1)")
+	bad := fs.Float64("malformed", 0, "ratio of lines that are malformed (0-1)")
+	dist := fs.String("dist", "uniform", "value distribution: uniform, sequential or zipf")
+	seed := fs.Int64("seed", 1, "random seed, connection i uses seed+i")
+	fs.Parse(args)
+
+	if *conns < 1 || *rate < 0 {
+		return fmt.Errorf("-conns must be at least 1 and -rate can't be negative")
+	}
+	if *dup < 0 || *dup > 1 || *bad < 0 || *bad > 1 {
+		return fmt.Errorf("ratios must be between 0 and 1")
+	}
+
+	b := &bench{addr: *addr, replies: make(map[string]int64)}
+	corpora := make([]*corpus, *conns)
+	for i := range corpora {
+		if corpora[i], err = newCorpus(*seed+int64(i), *dist, *dup, *bad); err != nil {
+			return
+		}
+	}
+
+	start := time.Now()
+	end := start.Add(*duration)
+	var wg sync.WaitGroup
+	for i, c := range corpora {
+		// Spread the rate, the first connections take the remainder.
+		perConn := *rate / *conns
+		if i < *rate%*conns {
+			perConn++
+		}
+		wg.Add(1)
+		go func(c *corpus, perConn int) {
+			defer wg.Done()
+			b.run(c, perConn, end)
+		}(c, perConn)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	target := "as fast as possible"
+	if *rate > 0 {
+		target = fmt.Sprintf("target %d", *rate)
+	}
+	fmt.Printf(
+		"Sent        : %d lines, %d valid, in %v over %d connections\n"+
+			"Throughput  : %.0f lines/sec, %s\n"+
+			"Connects    : %d, %d failed, %d closed by the server\n",
+		b.sent, b.valid, elapsed.Round(time.Millisecond), *conns,
+		float64(b.sent)/elapsed.Seconds(), target,
+		b.connects, b.failed, b.closed)
+
+	var replies []string
+	for r := range b.replies {
+		replies = append(replies, r)
+	}
+	sort.Strings(replies)
+	for _, r := range replies {
+		fmt.Printf("Reply       : %d %q\n", b.replies[r], r)
+	}
+	if b.sent == 0 {
+		return fmt.Errorf("nothing could be sent to %s", *addr)
+	}
+	return nil
+}
+
+// bench is the state of a bench run, shared by its connections.
+type bench struct {
+	addr string
+
+	sent     int64
+	valid    int64
+	connects int64
+	failed   int64
+	closed   int64
+
+	mu      sync.Mutex
+	replies map[string]int64
+}
+
+// run sends lines of c at perConn lines per second, or as fast as
+// possible if 0, until end, reconnecting when the server hangs up.
+// Lines sent on a connection the server closed count as sent.
+func (b *bench) run(c *corpus, perConn int, end time.Time) {
+	for time.Now().Before(end) {
+		conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+		if err != nil {
+			atomic.AddInt64(&b.failed, 1)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		atomic.AddInt64(&b.connects, 1)
+		if b.send(conn, c, perConn, end) {
+			// Likely busy, don't hammer it with reconnects.
+			atomic.AddInt64(&b.closed, 1)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// send sends over conn until end, then waits for the PONG of a final
+// PING, so everything sent was processed. It reports whether the
+// server closed the connection first.
+func (b *bench) send(conn net.Conn, c *corpus, perConn int, end time.Time) (closed bool) {
+	defer conn.Close()
+
+	ponged := make(chan bool)
+	hungUp := make(chan bool)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if line = strings.TrimSpace(line); line != "" {
+				switch {
+				case line == "PONG":
+					close(ponged)
+					return
+				case strings.HasPrefix(line, "WELCOME"):
+				default:
+					b.reply(line)
+				}
+			}
+			if err != nil {
+				close(hungUp)
+				return
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	start := time.Now()
+	sent := 0
+	for now := start; now.Before(end); now = time.Now() {
+		due := 100
+		if perConn > 0 {
+			due = int(now.Sub(start).Seconds()*float64(perConn)) - sent
+		}
+		valid := 0
+		for i := 0; i < due; i++ {
+			line := c.line() + "\n"
+			if _, err := server.ParseLine([]byte(line)); err == nil {
+				valid++
+			}
+			w.WriteString(line)
+		}
+		if err := w.Flush(); err != nil {
+			return true
+		}
+		sent += due
+		atomic.AddInt64(&b.sent, int64(due))
+		atomic.AddInt64(&b.valid, int64(valid))
+
+		select {
+		case <-hungUp:
+			return true
+		default:
+		}
+		if perConn > 0 {
+			time.Sleep(benchPace)
+		}
+	}
+
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		return true
+	}
+	select {
+	case <-ponged:
+		return false
+	case <-hungUp:
+		return true
+	case <-time.After(5 * time.Second):
+		fmt.Fprintf(os.Stderr, "no PONG from %s within 5s\n", conn.LocalAddr())
+		return false
+	}
+}
+
+// reply counts an unexpected reply.
+func (b *bench) reply(line string) {
+	b.mu.Lock()
+	b.replies[line]++
+	b.mu.Unlock()
+}
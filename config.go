@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/conf"
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+var configFile = flag.String("config", "", "read flags from this TOML file, the command line and environment win over it, reread on SIGHUP")
+
+// repeatable is a flag that collects every time it's given, e.g. -stream,
+// each element of an array in the config file is one.
+type repeatable interface {
+	values() []string
+}
+
+// applyConfigFile sets the flags of fs named in the config file, except
+// the pinned ones given on the command line or in the environment.
+// Settings of flags fs doesn't define are skipped, so the server's own
+// can be read into a set of their own, see reloadConfig.
+// Arrays are joined with commas for the comma separated flags.
+func applyConfigFile(fs *flag.FlagSet, name string) error {
+	settings, err := conf.ParseFile(name)
+	if err != nil {
+		return err
+	}
+	// Check every key before changing a flag, a typo shouldn't leave half a file applied.
+	for _, st := range settings {
+		if flag.Lookup(st.Key) == nil || st.Key == "config" {
+			return fmt.Errorf("%s line %d: unknown setting %s", name, st.Line, st.Key)
+		}
+	}
+
+	for _, st := range settings {
+		f := fs.Lookup(st.Key)
+		if f == nil || pinned[st.Key] {
+			continue
+		}
+		if err = setFlag(f, st.Values); err != nil {
+			return fmt.Errorf("%s line %d: %s: %v", name, st.Line, st.Key, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets f to vals.
+func setFlag(f *flag.Flag, vals []string) error {
+	if _, ok := f.Value.(repeatable); !ok {
+		return f.Value.Set(strings.Join(vals, ","))
+	}
+	for _, v := range vals {
+		if err := f.Value.Set(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagValues are the values f was set to, one per time for a repeatable flag.
+func flagValues(f *flag.Flag) []string {
+	if r, ok := f.Value.(repeatable); ok {
+		return r.values()
+	}
+	return []string{f.Value.String()}
+}
+
+// reloadConfig rereads the config file and applies what can change
+// while the server runs, reporting the changes that need a restart.
+//
+// The file is read into a fresh set of the server's flags, holding the
+// pinned values and otherwise the defaults, so flags the file no longer
+// names go back to them as after a restart. The flags main parsed are
+// only read: other goroutines read them without a lock, and a file that
+// is rejected can't leave half of it applied.
+func reloadConfig(srv *server.Server) error {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	config := defineServerFlags(fs)
+	for name := range pinned {
+		if f := fs.Lookup(name); f != nil {
+			if err := setFlag(f, flagValues(flag.Lookup(name))); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	if err := applyConfigFile(fs, *configFile); err != nil {
+		return err
+	}
+
+	restart, err := srv.Reload(config())
+	if err != nil {
+		return err
+	}
+	if len(restart) > 0 {
+		slog.Warn("config changes need a restart", "settings", strings.Join(restart, ","))
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// conformanceConfig is shared by every conformance check.
+type conformanceConfig struct {
+	addr      string
+	connLimit int
+	logDir    string
+	settle    time.Duration
+	logWait   time.Duration
+	rnd       *rand.Rand
+}
+
+type checkResult struct {
+	// status is one of PASS, FAIL or SKIP.
+	status string
+	detail string
+}
+
+func pass(format string, a ...interface{}) checkResult {
+	return checkResult{"PASS", fmt.Sprintf(format, a...)}
+}
+
+func fail(format string, a ...interface{}) checkResult {
+	return checkResult{"FAIL", fmt.Sprintf(format, a...)}
+}
+
+func skip(format string, a ...interface{}) checkResult {
+	return checkResult{"SKIP", fmt.Sprintf(format, a...)}
+}
+
+// conformanceChecks is the battery run by the conformance subcommand, in order.
+// Each check only relies on behavior the spec in the README requires,
+// so it can be pointed at any implementation of the protocol.
+var conformanceChecks = []struct {
+	name string
+	run  func(cfg *conformanceConfig) checkResult
+}{
+	{"valid value accepted", func(cfg *conformanceConfig) checkResult {
+		return expectOpen(cfg, cfg.value()+"\n")
+	}},
+	{"minimum value with leading zeros accepted", func(cfg *conformanceConfig) checkResult {
+		return expectOpen(cfg, fmt.Sprintf("%0*d\n", server.ValidLen, server.MinValue))
+	}},
+	{"maximum value accepted", func(cfg *conformanceConfig) checkResult {
+		return expectOpen(cfg, strings.Repeat("9", server.ValidLen)+"\n")
+	}},
+	{"below minimum rejected", func(cfg *conformanceConfig) checkResult {
+		return expectClosed(cfg, fmt.Sprintf("%0*d\n", server.ValidLen, server.MinValue-1))
+	}},
+	{"one digit short rejected", func(cfg *conformanceConfig) checkResult {
+		return expectClosed(cfg, cfg.value()[1:]+"\n")
+	}},
+	{"one digit long rejected", func(cfg *conformanceConfig) checkResult {
+		return expectClosed(cfg, cfg.value()+"0\n")
+	}},
+	{"non-numeric rejected", func(cfg *conformanceConfig) checkResult {
+		return expectClosed(cfg, strings.Repeat("x", server.ValidLen)+"\n")
+	}},
+	{"empty line rejected", func(cfg *conformanceConfig) checkResult {
+		return expectClosed(cfg, "\n")
+	}},
+	{"CRLF terminated value accepted", func(cfg *conformanceConfig) checkResult {
+		return expectOpen(cfg, cfg.value()+"\r\n")
+	}},
+	{"busy beyond connection limit", checkBusy},
+	{"duplicates logged once", checkDuplicates},
+}
+
+// value returns a random valid value, unlikely to have been seen by the server before.
+func (cfg *conformanceConfig) value() string {
+	return fmt.Sprintf("%0*d", server.ValidLen, server.MinValue+cfg.rnd.Intn(server.MaxValue-server.MinValue+1))
+}
+
+// probe sends input on a fresh connection and reports whether
+// the server closed it within the settle period.
+func probe(cfg *conformanceConfig, input string) (closed bool, err error) {
+	conn, err := net.DialTimeout("tcp", cfg.addr, cfg.settle)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = io.WriteString(conn, input); err != nil {
+		return false, err
+	}
+
+	return waitClosed(conn, cfg.settle), nil
+}
+
+// waitClosed reads until the peer closes the connection or d elapses.
+// Anything the server writes back is ignored.
+func waitClosed(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	buf := make([]byte, 512)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		var nerr net.Error
+		return !(errors.As(err, &nerr) && nerr.Timeout())
+	}
+}
+
+func expectOpen(cfg *conformanceConfig, input string) checkResult {
+	closed, err := probe(cfg, input)
+	switch {
+	case err != nil:
+		return fail("%v", err)
+	case closed:
+		return fail("server closed the connection after %q", input)
+	}
+	return pass("connection kept open after %q", input)
+}
+
+func expectClosed(cfg *conformanceConfig, input string) checkResult {
+	closed, err := probe(cfg, input)
+	switch {
+	case err != nil:
+		return fail("%v", err)
+	case !closed:
+		return fail("connection still open %v after %q", cfg.settle, input)
+	}
+	return pass("server closed the connection after %q", input)
+}
+
+func checkBusy(cfg *conformanceConfig) checkResult {
+	if cfg.connLimit <= 0 {
+		return skip("no connection limit given")
+	}
+
+	var held []net.Conn
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < cfg.connLimit; i++ {
+		conn, err := net.DialTimeout("tcp", cfg.addr, cfg.settle)
+		if err != nil {
+			return fail("could not open connection %d of %d: %v", i+1, cfg.connLimit, err)
+		}
+		held = append(held, conn)
+	}
+
+	// Give the server a moment to account for the held connections.
+	time.Sleep(cfg.settle / 2)
+	for i, conn := range held {
+		if waitClosed(conn, time.Millisecond) {
+			return fail("connection %d of %d was closed before the limit was reached", i+1, cfg.connLimit)
+		}
+	}
+
+	extra, err := net.DialTimeout("tcp", cfg.addr, cfg.settle)
+	if err != nil {
+		// Refusing outright is as good as accepting and closing.
+		return pass("connection %d refused: %v", cfg.connLimit+1, err)
+	}
+	defer extra.Close()
+
+	if !waitClosed(extra, cfg.settle) {
+		return fail("connection %d still open %v after connecting", cfg.connLimit+1, cfg.settle)
+	}
+	return pass("connection %d closed by the server", cfg.connLimit+1)
+}
+
+func checkDuplicates(cfg *conformanceConfig) checkResult {
+	if cfg.logDir == "" {
+		return skip("no -logs directory given")
+	}
+
+	v := cfg.value()
+	for i := 0; i < 2; i++ {
+		if closed, err := probe(cfg, v+"\n"); err != nil || closed {
+			return fail("could not submit %s (closed: %v, err: %v)", v, closed, err)
+		}
+	}
+
+	// Values only hit the disk when the log is flushed,
+	// which may take up to a full rotation interval.
+	deadline := time.Now().Add(cfg.logWait)
+	for {
+		n, err := countLogged(cfg.logDir, v)
+		switch {
+		case err != nil:
+			return fail("%v", err)
+		case n > 1:
+			return fail("%s logged %d times", v, n)
+		case n == 1:
+			return pass("%s submitted twice, logged once", v)
+		case time.Now().After(deadline):
+			return fail("%s not logged within %v", v, cfg.logWait)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// countLogged counts how often v appears across every log file in dir.
+// Logged values may or may not keep their leading zeros.
+func countLogged(dir, v string) (n int, err error) {
+	want, _ := strconv.Atoi(v)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, fmt.Errorf("could not open log file: %v", err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if got, err := strconv.Atoi(strings.TrimSpace(scanner.Text())); err == nil && got == want {
+				n++
+			}
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return 0, fmt.Errorf("could not read log file: %v", err)
+		}
+	}
+
+	return
+}
+
+// runConformance implements the "conformance" subcommand.
+func runConformance(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	cfg := &conformanceConfig{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	fs.StringVar(&cfg.addr, "addr", fmt.Sprintf("localhost:%d", server.DefaultPort), "server address to check")
+	fs.IntVar(&cfg.connLimit, "conns", server.DefaultMaxConns, "connection limit the server should enforce, 0 skips the busy check")
+	fs.StringVar(&cfg.logDir, "logs", "", "server log directory, enables the duplicate checks when the server runs locally")
+	fs.DurationVar(&cfg.settle, "settle", 500*time.Millisecond, "how long to wait for the server to react to input")
+	fs.DurationVar(&cfg.logWait, "log-wait", server.DefaultLogInterval+2*time.Second, "how long to wait for values to reach the log")
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+
+	failed := 0
+	for _, check := range conformanceChecks {
+		res := check.run(cfg)
+		if res.status == "FAIL" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.name, res.status, res.detail)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(conformanceChecks))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+var (
+	debugOn   = flag.Bool("debug", false, "serve pprof, expvar and goroutine dumps over HTTP on -debug-addr")
+	debugAddr = flag.String("debug-addr", "127.0.0.1:6060", "address of the -debug server, anyone who can reach it can profile the server")
+)
+
+// serveDebug serves the runtime debug endpoints on -debug-addr,
+// if -debug is set, for the lifetime of the process:
+// /debug/pprof/ the profiles, /debug/vars expvar with the server's
+// counters, and /debug/goroutines every goroutine's stack.
+func serveDebug(srv *server.Server) error {
+	if !*debugOn {
+		return nil
+	}
+	l, err := net.Listen("tcp", *debugAddr)
+	if err != nil {
+		return fmt.Errorf("could not listen for debug: %v", err)
+	}
+
+	expvar.Publish("counts", expvar.Func(func() interface{} {
+		uniq, total, intvl := srv.Counts()
+		return map[string]int64{"unique": int64(uniq), "total": int64(total), "interval": int64(intvl), "errors": srv.Errors()}
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	go http.Serve(l, mux)
+
+	slog.Info("serving debug endpoints", "url", "http://"+l.Addr().String()+"/debug/")
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// watchDiagSignal writes a diagnostic dump on every SIGQUIT,
+// instead of the runtime's default of dumping stacks and exiting.
+// Must be run on go routine.
+func watchDiagSignal(srv *server.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGQUIT)
+	for range sig {
+		name, err := srv.WriteDiagnostics()
+		if err != nil {
+			slog.Error("could not write diagnostics", "err", err)
+			continue
+		}
+		slog.Info("wrote diagnostics", "file", name)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// chaos enables failpoints in main, it isn't part of the server's Config.
+var chaos = flag.String("chaos", "", "inject faults to test clients against, failpoints like GO_FAILPOINTS, e.g. 'conn.read=5%delay(200ms);log.write=1%error', never in production")
+
+// serverConfig builds the server's Config from the command line's flags.
+var serverConfig = defineServerFlags(flag.CommandLine)
+
+// defineServerFlags defines the server's flags on fs, each maps to a field
+// of server.Config, and returns the func building the Config from them.
+// Reloading the config file reads it into flags of its own, so the ones
+// the server started with are never written after main parsed them.
+func defineServerFlags(fs *flag.FlagSet) (config func() server.Config) {
+	var (
+		listenAddr  = fs.String("addr", "", "host or IP to listen on, e.g. 127.0.0.1 or 0.0.0.0, all interfaces if empty")
+		listenPort  = fs.Int("port", server.DefaultPort, "TCP port to listen on")
+		listenMore  = fs.String("listen", "", "comma separated more addresses to listen on, host:port or unix:<path>, e.g. 10.0.0.5:3280,unix:/var/run/numbers.sock")
+		maxConns    = fs.Int("max-conns", server.DefaultMaxConns, "connections served at once, more are turned away as busy")
+		busyWait    = fs.Duration("busy-wait", 0, "how long connections over -max-conns wait for a free slot before they're turned away, e.g. 200ms, 0 turns them away right away")
+		busyQueue   = fs.Int("busy-queue", server.DefaultBusyQueue, "connections waiting for a free slot at once, more are turned away right away")
+		reportIntvl = fs.Duration("report-interval", server.DefaultOutputInterval, "how often the counters are printed")
+		logIntvl    = fs.Duration("log-interval", server.DefaultLogInterval, "how often the log is rotated")
+		logBuffer   = fs.Int("log-buffer", server.DefaultLogBuffer, "bytes of unique values each log file batches before writing them out")
+		logFlush    = fs.Duration("log-flush", server.DefaultLogFlush, "how often the batched log values are written out, whether or not -log-buffer is full")
+		logSync     = fs.String("log-sync", "none", "when the log is fsynced: none leaves it to the OS, interval every -log-sync-interval, always every unique value before it's acknowledged")
+		syncIntvl   = fs.Duration("log-sync-interval", server.DefaultLogSyncInterval, "how often the log is fsynced with -log-sync interval")
+		logMaxSize  = fs.Int64("log-max-size", 0, "rotate the log early once a segment has this many bytes of values, 0 rotates every -log-interval only")
+		logCompress = fs.Bool("log-compress", false, "gzip rotated log segments")
+		logRetain   = fs.Int("log-retain", 0, "keep only the newest this many rotated log segments, 0 keeps them all")
+		recoverLog  = fs.Bool("recover", false, "rebuild the unique set from the log segments of earlier runs on startup and carry on after them, instead of starting over at data.0.log")
+		recoverBg   = fs.Bool("recover-background", false, "with -recover, listen right away and recover in the background, values that may be in the log still being recovered are refused meanwhile")
+		logDir      = fs.String("log-dir", "logs", "directory the log segments and diagnostic dumps are written to")
+		dedup       = fs.String("dedup", "map", "how unique values are kept: map grows with them, bitset takes a bit per valid value up front and dedups lock free, redis shares them with other servers in a Redis set, postgres in a PostgreSQL table, dynamodb in a DynamoDB table, pebble keeps them on local disk")
+		dedupShards = fs.Int("dedup-shards", 0, "shards of the -dedup map set, each with its own lock, 0 is one per CPU")
+		dedupAffine = fs.Bool("dedup-affine", false, "have a worker thread pinned to a CPU of its own do the lookups of each -dedup-shards shard, for hosts with many cores")
+		dedupWindow = fs.Duration("dedup-window", 0, "only keep values unique for this long with -dedup map, e.g. 24h, then they expire and are logged again, 0 keeps them unique forever")
+		topDups     = fs.Int("top-dups", 0, "track how often duplicates are resubmitted and report this many of the most resubmitted values, 0 turns it off")
+		redisAddr   = fs.String("redis-addr", "", "Redis server (host:port) of -dedup redis")
+		redisDB     = fs.Int("redis-db", 0, "Redis database of -dedup redis")
+		redisKey    = fs.String("redis-key", "go-simple-tcp-server", "prefix of the Redis keys of -dedup redis, followed by :<stream>")
+		redisShards = fs.String("redis-shards", "", "comma separated more Redis servers (host:port) to split the sets of -dedup redis across, with -redis-addr")
+		redisShard  = fs.String("redis-shard-by", "hash", "how values are split across -redis-shards: hash spreads them evenly, range gives each server a slice of the valid values")
+		pgURL       = fs.String("postgres-url", "", "database of -dedup postgres, e.g. postgres://numbers@db:5432/numbers?sslmode=require")
+		pgTable     = fs.String("postgres-table", "go_simple_tcp_server", "table of -dedup postgres, created if it doesn't exist")
+		mcAddrs     = fs.String("memcached-addrs", "", "comma separated memcached servers (host:port) caching the values known to be in the sets of -dedup redis or postgres")
+		mcTTL       = fs.Duration("memcached-ttl", time.Hour, "how long a value stays in the -memcached-addrs cache")
+		mcKey       = fs.String("memcached-key", "go-simple-tcp-server", "prefix of the -memcached-addrs keys, followed by :<stream>:<value>")
+		bitSetDir   = fs.String("bitset-dir", "", "keep the -dedup bitset of each stream in a file in this directory, mapped into memory and kept across restarts")
+		bitSetSync  = fs.Duration("bitset-sync", 0, "how often the -bitset-dir files are written back to disk, 0 leaves it to the OS, they're always written on shutdown")
+		dynamoTable = fs.String("dynamodb-table", "", "DynamoDB table of -dedup dynamodb, with the string partition key stream and the number sort key value")
+		dynamoRgn   = fs.String("dynamodb-region", "", "AWS region of -dynamodb-table, the one of the AWS configuration if empty")
+		dynamoURL   = fs.String("dynamodb-endpoint", "", "URL of the DynamoDB API instead of AWS's, e.g. of DynamoDB Local")
+		dynamoCache = fs.Int("dynamodb-cache", 65536, "values known to be in -dynamodb-table kept in memory so resending them costs no call, negative keeps none")
+		pebbleDir   = fs.String("pebble-dir", "", "directory of the databases of -dedup pebble, one per stream, <log-dir>/pebble if empty")
+		peers       = fs.String("peers", "", "comma separated -peer-addr of the other servers of a cluster, every value logged here is sent to them and is a duplicate there too")
+		peerAddr    = fs.String("peer-addr", "", "receive the values the peers log on this address (host:port)")
+		peerQueue   = fs.Int("peer-queue", 65536, "values waiting to be sent to a peer, one that falls further behind is caught up from the log")
+		valueLen    = fs.Int("value-len", server.ValidLen, "digits of a valid value")
+		minValue    = fs.Int("min-value", server.MinValue, "smallest valid value")
+		maxValue    = fs.Int("max-value", 0, "largest valid value, 0 for the largest of -value-len digits")
+		zeros       = fs.String("leading-zeros", "", "what values starting with 0 are: accept takes them whatever -min-value says, reject turns them away, empty checks them against -min-value like any other")
+
+		serverName = fs.String("name", "go-simple-tcp-server", "server name announced in the connection greeting")
+		noGreeting = fs.Bool("no-greeting", false, "don't greet new connections, for throughput sensitive producers")
+		errReplies = fs.Bool("error-replies", false, "answer invalid values with ERR 001 malformed, ERR 002 out-of-range or ERR 007 rejected before hanging up, or skipping them with -skip-invalid")
+		quiet      = fs.Bool("quiet", false, "hang up on clients that send invalid input without a word, as the classic spec has it")
+		skipBad    = fs.Bool("skip-invalid", false, "count invalid lines and carry on with the connection, instead of hanging up at the first one")
+		strict     = fs.Bool("strict-lines", false, "take lines byte for byte, a trailing CR or space makes a value malformed, instead of trimming them")
+		maxBatch   = fs.Int("max-batch", 0, "let clients send up to this many comma separated values on one line, answered with a summary, 0 turns batches off")
+		terminate  = fs.Bool("allow-terminate", false, "let clients shut the server down by sending terminate, for test harnesses")
+
+		idleTimeout = fs.Duration("idle-timeout", 0, "close connections that send nothing for this long, e.g. 5m, 0 keeps them open")
+		readTimeout = fs.Duration("read-timeout", 0, "close connections that take longer than this to send a whole line, e.g. 30s, 0 for no limit")
+
+		logPartitions  = fs.Int("log-partitions", 1, "split every log segment into this many files, each with its own writer goroutine")
+		logPartitionBy = fs.String("log-partition-by", "hash", "how values are assigned to log partitions: hash or range")
+		logQueue       = fs.Int("log-queue", 4096, "values each log partition buffers before -log-queue-policy applies")
+		logQueuePolicy = fs.String("log-queue-policy", "block", "what to do when a log partition's queue is full: block or drop")
+		logKeyFile     = fs.String("log-key", "", "encrypt log segments with the newest key in this key file, reread on SIGHUP")
+
+		auditFile      = fs.String("audit-log", "", "append security relevant events to this hash chained audit log")
+		auditMalformed = fs.Int("audit-malformed", 100, "malformed lines on one connection that count as a flood in the audit log, with -skip-invalid")
+
+		dailyQuota = fs.Int("daily-quota", 0, "values each stream takes in a UTC day, those over it are answered ERR 009 quota-exceeded, 0 for no limit")
+		usageFile  = fs.String("usage-file", "", "append what each stream took in every UTC day to this file, as JSON lines")
+
+		rdnsEnabled = fs.Bool("rdns", false, "resolve remote addresses to host names for the audit log, asynchronously")
+		rdnsTimeout = fs.Duration("rdns-timeout", 2*time.Second, "timeout of a single reverse DNS lookup")
+		rdnsTTL     = fs.Duration("rdns-ttl", 10*time.Minute, "how long reverse DNS results are cached")
+
+		geoipFiles = fs.String("geoip", "", "comma separated MaxMind databases, e.g. GeoLite2 Country and ASN, to break stats down by origin")
+
+		mqttBroker   = fs.String("mqtt-broker", "", "MQTT broker address (host:port) to ingest values from")
+		mqttTopics   = fs.String("mqtt-topics", "", "comma separated MQTT topic filters to subscribe to")
+		mqttQoS      = fs.Int("mqtt-qos", 1, "MQTT subscription QoS, 0 or 1")
+		mqttClientID = fs.String("mqtt-client-id", "go-simple-tcp-server", "MQTT client id")
+		mqttUser     = fs.String("mqtt-user", "", "MQTT user name")
+
+		captureFile = fs.String("capture", "", "record inbound traffic to this capture file")
+
+		tlsCert = fs.String("tls-cert", "", "also serve over TLS with this PEM certificate (chain), reloaded when it changes and on SIGHUP")
+		tlsKey  = fs.String("tls-key", "", "PEM private key of -tls-cert")
+		tlsPort = fs.Int("tls-port", server.DefaultTLSPort, "TCP port of the TLS listener, next to the plain one")
+
+		quicPort = fs.Int("quic-port", 0, "also serve QUIC with -tls-cert on this UDP port, e.g. 3443, every stream like a TCP connection")
+
+		allowNets = fs.String("allow", "", "comma separated CIDR ranges or IPs that may connect, everyone if empty")
+		denyNets  = fs.String("deny", "", "comma separated CIDR ranges or IPs that may not connect, this wins over -allow")
+		logDenied = fs.Bool("log-denied", false, "record connections turned away by -allow and -deny in the audit log")
+		tarpitFor = fs.Duration("tarpit", 0, "hold connections turned away by -allow and -deny open this long, trickling a reply, to slow scanners down, 0 hangs up right away")
+		tarpitMax = fs.Int("tarpit-max", 256, "connections the tarpit holds at once, more are hung up on")
+
+		maxConnsPerIP = fs.Int("max-conns-per-ip", 0, "connections one remote IP may have open at once, 0 for no limit")
+		rateLimit     = fs.Float64("rate-limit", 0, "lines per second one remote IP may send over all its connections, 0 for no limit")
+		rateBurst     = fs.Int("rate-burst", 0, "lines one remote IP may send at once over -rate-limit, one second's worth if 0")
+
+		workers     = fs.Int("workers", 0, "serve connections on a fixed pool of this many goroutines, for high connection churn, 0 for a goroutine per connection")
+		workerQueue = fs.Int("worker-queue", server.DefaultWorkerQueue, "connections waiting for a free worker, more are turned away as busy")
+
+		proxyTrusted  = fs.String("proxy-trusted", "", "comma separated CIDR ranges or IPs of the load balancers allowed to send -proxy-protocol headers, any if empty")
+		proxyProtocol = fs.Bool("proxy-protocol", false, "read a HAProxy PROXY header (v1 or v2) off every connection for the real client address, for running behind a load balancer")
+
+		udpPort = fs.Int("udp-port", 0, "also take newline separated values in UDP datagrams on this port, e.g. 3280, nothing is sent back")
+
+		grpcAddr = fs.String("grpc-addr", "", "also serve the gRPC service of server/numbers.proto on this address (host:port), over HTTP/2 without TLS")
+		grpcAcks = fs.Int("grpc-ack-window", 1024, "values a SubmitAcked call reads ahead of their acks")
+
+		unixSocket = fs.String("unix", "", "also listen on this Unix domain socket, e.g. /var/run/numbers.sock, for co-located producers")
+		tcp        = fs.Bool("tcp", true, "listen on -addr and -port, -tcp=false with -unix serves the socket only")
+
+		pipeName = fs.String("pipe", "", `also listen on this Windows named pipe, e.g. \\.\pipe\numbers`)
+		pipeSDDL = fs.String("pipe-sddl", "", "security descriptor (SDDL) of the named pipe, the default grants the creator and local system full access")
+
+		socketActivation = fs.Bool("socket-activation", true, "when socket activated by systemd, serve on the sockets it passes instead of -addr and the streams' ports")
+
+		busyPoll = fs.Duration("busy-poll", 0, "spin this long polling for new connections and input before parking, linux only, for dedicated low latency hosts")
+
+		instrumentFlag = fs.Bool("instrument", false, "start with request instrumentation on, it can be toggled at runtime with SIGUSR2")
+		instrumentSlow = fs.Duration("instrument-slow", time.Millisecond, "while instrumented, log requests slower than this")
+
+		traceFile = fs.String("trace-file", "", "write sampled request traces to this file as JSON lines")
+		traceRate = fs.Float64("trace-rate", 0, "fraction of requests to trace (0-1), connections can also opt in with the trace capability")
+
+		maintFile  = fs.String("maintenance-file", "", "enter maintenance mode while this file exists, e.g. for storage migrations")
+		maintDrain = fs.Duration("maintenance-drain", 30*time.Second, "how long entering maintenance waits for open connections to finish")
+
+		validatorNames = fs.String("validators", "", "comma separated registered validators every valid value must also pass")
+		sinkNames      = fs.String("sinks", "", "comma separated registered sinks every unique value is sent to")
+		sidecarCmd     = fs.String("sidecar", "", "command of the sidecar process behind the sidecar validator and sink")
+
+		kafkaBrokers  = fs.String("kafka-brokers", "", "comma separated bootstrap brokers (host:port) of the kafka sink")
+		kafkaTopic    = fs.String("kafka-topic", "", "topic the kafka sink produces every unique value to, keyed by its stream")
+		natsAddr      = fs.String("nats-addr", "", "NATS server (host:port) of the nats sink")
+		natsSubject   = fs.String("nats-subject", "", "subject the nats sink publishes every unique value on, followed by .<stream>")
+		natsUser      = fs.String("nats-user", "", "NATS user name")
+		pubsubProject = fs.String("pubsub-project", "", "Google Cloud project of the pubsub sink's topic")
+		pubsubTopic   = fs.String("pubsub-topic", "", "Pub/Sub topic the pubsub sink publishes every unique value to, ordered by its stream")
+		pubsubCreds   = fs.String("pubsub-credentials", "", "service account key file of the pubsub sink, GOOGLE_APPLICATION_CREDENTIALS or the instance's account if empty")
+		pubsubURL     = fs.String("pubsub-endpoint", "", "Pub/Sub API URL, e.g. https://europe-west1-pubsub.googleapis.com, the global one if empty")
+		amqpURL       = fs.String("amqp-url", "", "broker of the amqp sink, e.g. amqp://numbers@rabbit:5672/vhost, with the password in AMQP_PASSWORD")
+		amqpExchange  = fs.String("amqp-exchange", "", "exchange the amqp sink publishes every unique value to, the default exchange if empty")
+		amqpKey       = fs.String("amqp-routing-key", "", "routing key of the amqp sink's messages, the value's stream if empty")
+		sinkBatch     = fs.Int("sink-batch", 100, "values the broker sinks send at once")
+		sinkLinger    = fs.Duration("sink-linger", 100*time.Millisecond, "how long a value waits for a broker sink's batch to fill")
+		sinkQueue     = fs.Int("sink-queue", 65536, "values waiting while a broker sink's broker can't be reached, more are dropped")
+
+		metricsAddr = fs.String("metrics-addr", "", "serve Prometheus metrics at /metrics and health probes at /healthz and /readyz over HTTP on this address, e.g. :9100")
+		httpIngest  = fs.Bool("http-ingest", false, "also take values POSTed to /numbers on -metrics-addr, one per line, answered with a JSON result per value")
+		adminAddr   = fs.String("admin-addr", "", "serve the admin protocol on this address, host:port or unix:<path>")
+	)
+
+	// streamSpecs are the -stream flags, one per named stream.
+	var streamSpecs streamFlags
+	fs.Var(&streamSpecs, "stream", "add a named value stream, e.g. orders:port=3281,len=9,min=100000000 or refunds:prefix=REF, repeatable")
+
+	// udpAddr is the address of the UDP receiver, empty if it's off.
+	udpAddr := func() string {
+		if *udpPort == 0 {
+			return ""
+		}
+		return net.JoinHostPort(*listenAddr, strconv.Itoa(*udpPort))
+	}
+	quicAddr := func() string {
+		if *quicPort == 0 {
+			return ""
+		}
+		return net.JoinHostPort(*listenAddr, strconv.Itoa(*quicPort))
+	}
+
+	return func() server.Config {
+		cfg := server.Config{
+			Addr:             net.JoinHostPort(*listenAddr, strconv.Itoa(*listenPort)),
+			Listen:           splitList(*listenMore),
+			MaxConns:         *maxConns,
+			BusyWait:         *busyWait,
+			BusyQueue:        *busyQueue,
+			LogDir:           *logDir,
+			Dedup:            *dedup,
+			DedupShards:      *dedupShards,
+			DedupAffine:      *dedupAffine,
+			DedupWindow:      *dedupWindow,
+			TopDuplicates:    *topDups,
+			RedisAddr:        *redisAddr,
+			RedisPassword:    os.Getenv(redisPasswordEnv),
+			RedisDB:          *redisDB,
+			RedisKey:         *redisKey,
+			RedisShards:      splitList(*redisShards),
+			RedisShardBy:     *redisShard,
+			PostgresURL:      *pgURL,
+			PostgresPassword: os.Getenv(postgresPasswordEnv),
+			PostgresTable:    *pgTable,
+			MemcachedAddrs:   splitList(*mcAddrs),
+			MemcachedTTL:     *mcTTL,
+			MemcachedKey:     *mcKey,
+			PebbleDir:        *pebbleDir,
+			BitSetDir:        *bitSetDir,
+			BitSetSync:       *bitSetSync,
+			DynamoTable:      *dynamoTable,
+			DynamoRegion:     *dynamoRgn,
+			DynamoEndpoint:   *dynamoURL,
+			DynamoCache:      *dynamoCache,
+			Peers:            splitList(*peers),
+			PeerAddr:         *peerAddr,
+			PeerQueue:        *peerQueue,
+			OutputInterval:   *reportIntvl,
+			LogInterval:      *logIntvl,
+			LogBuffer:        *logBuffer,
+			LogFlush:         *logFlush,
+			LogMaxSize:       *logMaxSize,
+			LogCompress:      *logCompress,
+			LogRetain:        *logRetain,
+			ValueLen:         *valueLen,
+			MinValue:         *minValue,
+			MaxValue:         *maxValue,
+			LeadingZeros:     *zeros,
+
+			Recover:           *recoverLog,
+			RecoverBackground: *recoverBg,
+
+			LogSync:         *logSync,
+			LogSyncInterval: *syncIntvl,
+
+			Name:         *serverName,
+			NoGreeting:   *noGreeting,
+			ErrorReplies: *errReplies,
+			Quiet:        *quiet,
+			SkipInvalid:  *skipBad,
+			StrictLines:  *strict,
+			MaxBatch:     *maxBatch,
+			Terminate:    *terminate,
+			AuthToken:    os.Getenv(authTokenEnv),
+
+			IdleTimeout: *idleTimeout,
+			ReadTimeout: *readTimeout,
+
+			LogPartitions:  *logPartitions,
+			LogPartitionBy: *logPartitionBy,
+			LogQueue:       *logQueue,
+			LogQueuePolicy: *logQueuePolicy,
+			LogKeyFile:     *logKeyFile,
+
+			AuditLog:       *auditFile,
+			AuditMalformed: *auditMalformed,
+
+			DailyQuota: *dailyQuota,
+			UsageFile:  *usageFile,
+
+			RDNS:        *rdnsEnabled,
+			RDNSTimeout: *rdnsTimeout,
+			RDNSTTL:     *rdnsTTL,
+
+			GeoIP: splitList(*geoipFiles),
+
+			MQTTBroker:   *mqttBroker,
+			MQTTTopics:   splitList(*mqttTopics),
+			MQTTQoS:      *mqttQoS,
+			MQTTClientID: *mqttClientID,
+			MQTTUser:     *mqttUser,
+			MQTTPassword: os.Getenv(mqttPasswordEnv),
+
+			Capture: *captureFile,
+
+			TLSCert: *tlsCert,
+			TLSKey:  *tlsKey,
+			TLSAddr: net.JoinHostPort(*listenAddr, strconv.Itoa(*tlsPort)),
+
+			QUICAddr: quicAddr(),
+
+			Allow:     splitList(*allowNets),
+			Deny:      splitList(*denyNets),
+			LogDenied: *logDenied,
+			Tarpit:    *tarpitFor,
+			TarpitMax: *tarpitMax,
+
+			MaxConnsPerIP: *maxConnsPerIP,
+			RateLimit:     *rateLimit,
+			RateBurst:     *rateBurst,
+
+			Workers:     *workers,
+			WorkerQueue: *workerQueue,
+
+			ProxyProtocol: *proxyProtocol,
+			ProxyTrusted:  splitList(*proxyTrusted),
+
+			UDPAddr: udpAddr(),
+
+			GRPCAddr:      *grpcAddr,
+			GRPCAckWindow: *grpcAcks,
+
+			Unix:  *unixSocket,
+			NoTCP: !*tcp,
+
+			Pipe:     *pipeName,
+			PipeSDDL: *pipeSDDL,
+
+			SocketActivation: *socketActivation,
+
+			BusyPoll: *busyPoll,
+
+			Instrument:     *instrumentFlag,
+			InstrumentSlow: *instrumentSlow,
+
+			TraceFile: *traceFile,
+			TraceRate: *traceRate,
+
+			MaintenanceFile:  *maintFile,
+			MaintenanceDrain: *maintDrain,
+
+			Streams: streamSpecs,
+
+			Validators: splitList(*validatorNames),
+			Sinks:      splitList(*sinkNames),
+			Sidecar:    *sidecarCmd,
+
+			KafkaBrokers:      splitList(*kafkaBrokers),
+			KafkaTopic:        *kafkaTopic,
+			NATSAddr:          *natsAddr,
+			NATSSubject:       *natsSubject,
+			NATSUser:          *natsUser,
+			NATSPassword:      os.Getenv(natsPasswordEnv),
+			PubSubProject:     *pubsubProject,
+			PubSubTopic:       *pubsubTopic,
+			PubSubCredentials: *pubsubCreds,
+			PubSubEndpoint:    *pubsubURL,
+			AMQPURL:           *amqpURL,
+			AMQPPassword:      os.Getenv(amqpPasswordEnv),
+			AMQPExchange:      *amqpExchange,
+			AMQPRoutingKey:    *amqpKey,
+			SinkBatch:         *sinkBatch,
+			SinkLinger:        *sinkLinger,
+			SinkQueue:         *sinkQueue,
+
+			MetricsAddr: *metricsAddr,
+			HTTPIngest:  *httpIngest,
+			AdminAddr:   *adminAddr,
+
+			Logger: slog.Default(),
+		}
+
+		// Sampling none is the same as not tracing.
+		if otelEnv.on && otelEnv.ratio > 0 {
+			cfg.OTLPEndpoint = otelEnv.opts.Endpoint
+			cfg.OTLPHeaders = otelEnv.opts.Headers
+			cfg.OTLPService = otelEnv.opts.Service
+			cfg.OTLPSampleRatio = otelEnv.ratio
+		}
+		return cfg
+	}
+}
+
+// envPrefix starts the environment variable of every flag, followed by
+// the flag's name upper cased with dashes as underscores,
+// e.g. TCPSERVER_MAX_CONNS for -max-conns.
+const envPrefix = "TCPSERVER_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"\nEvery flag can also be set in the environment, e.g. -max-conns as %s.\n", envName("max-conns"))
+	}
+}
+
+// pinned are the flags given on the command line or in the environment,
+// the config file doesn't override them.
+var pinned = make(map[string]bool)
+
+// applyEnv sets the flags not given on the command line from their
+// environment variables, so the command line wins over the environment,
+// and the environment over the config file and the defaults.
+func applyEnv() (err error) {
+	flag.Visit(func(f *flag.Flag) { pinned[f.Name] = true })
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if pinned[f.Name] || err != nil {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if serr := f.Value.Set(v); serr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), serr)
+		}
+		pinned[f.Name] = true
+	})
+	return
+}
+
+// mqttPasswordEnv holds the MQTT password, kept out of flags so it
+// doesn't show up in the process list.
+const mqttPasswordEnv = "MQTT_PASSWORD"
+
+// natsPasswordEnv holds the password of -nats-user.
+const natsPasswordEnv = "NATS_PASSWORD"
+
+// amqpPasswordEnv holds the password of -amqp-url.
+const amqpPasswordEnv = "AMQP_PASSWORD"
+
+// authTokenEnv holds the shared secret clients authenticate with,
+// also kept out of flags.
+const authTokenEnv = "AUTH_TOKEN"
+
+// redisPasswordEnv holds the password of -redis-addr, also kept out of flags.
+const redisPasswordEnv = "REDIS_PASSWORD"
+
+// postgresPasswordEnv holds the password of -postgres-url, as for psql.
+const postgresPasswordEnv = "PGPASSWORD"
+
+type streamFlags []string
+
+func (f *streamFlags) String() string     { return strings.Join(*f, " ") }
+func (f *streamFlags) Set(s string) error { *f = append(*f, s); return nil }
+func (f *streamFlags) values() []string   { return append([]string{}, *f...) }
+
+// splitList splits a comma separated flag, dropping empty entries.
+func splitList(s string) (items []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
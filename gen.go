@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// corpus generates reproducible streams of input lines.
+// Given the same seed and settings it always yields the same lines,
+// which is what lets different people run comparable benchmarks.
+type corpus struct {
+	rnd       *rand.Rand
+	dupRatio  float64
+	badRatio  float64
+	next      func() int
+	generated []int
+}
+
+func newCorpus(seed int64, dist string, dupRatio, badRatio float64) (*corpus, error) {
+	c := &corpus{
+		rnd:      rand.New(rand.NewSource(seed)),
+		dupRatio: dupRatio,
+		badRatio: badRatio,
+	}
+
+	span := server.MaxValue - server.MinValue
+	switch dist {
+	case "uniform":
+		c.next = func() int { return server.MinValue + c.rnd.Intn(span+1) }
+	case "sequential":
+		n := server.MinValue
+		c.next = func() int {
+			v := n
+			if n++; n > server.MaxValue {
+				n = server.MinValue
+			}
+			return v
+		}
+	case "zipf":
+		// Small values are far more likely than large ones,
+		// which resembles id spaces that are mostly recent.
+		z := rand.NewZipf(c.rnd, 1.1, 1, uint64(span))
+		c.next = func() int { return server.MinValue + int(z.Uint64()) }
+	default:
+		return nil, fmt.Errorf("unknown distribution %q", dist)
+	}
+
+	return c, nil
+}
+
+func (c *corpus) line() string {
+	if c.rnd.Float64() < c.badRatio {
+		return c.malformed()
+	}
+
+	if len(c.generated) > 0 && c.rnd.Float64() < c.dupRatio {
+		return fmt.Sprintf("%0*d", server.ValidLen, c.generated[c.rnd.Intn(len(c.generated))])
+	}
+
+	v := c.next()
+	c.generated = append(c.generated, v)
+	return fmt.Sprintf("%0*d", server.ValidLen, v)
+}
+
+// malformed returns one of the kinds of bad input the server must reject.
+func (c *corpus) malformed() string {
+	switch c.rnd.Intn(4) {
+	case 0:
+		// Too short.
+		return fmt.Sprintf("%d", c.rnd.Intn(int(math.Pow10(server.ValidLen-1))))
+	case 1:
+		// Too long.
+		return fmt.Sprintf("%0*d", server.ValidLen+1+c.rnd.Intn(4), c.next())
+	case 2:
+		// Right length, not a number.
+		b := make([]byte, server.ValidLen)
+		for i := range b {
+			b[i] = byte('a' + c.rnd.Intn(26))
+		}
+		return string(b)
+	default:
+		// Right length, below the minimum.
+		return fmt.Sprintf("%0*d", server.ValidLen, c.rnd.Intn(server.MinValue))
+	}
+}
+
+// runGen implements the "gen" subcommand.
+func runGen(args []string) (err error) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	n := fs.Int("n", 1000000, "number of lines to generate")
+	dup := fs.Float64("dup", 0, "ratio of valid lines that repeat an earlier value (0-1)")
+	bad := fs.Float64("malformed", 0, "ratio of lines that are malformed (0-1)")
+	dist := fs.String("dist", "uniform", "value distribution: uniform, sequential or zipf")
+	seed := fs.Int64("seed", 1, "random seed, the same seed always produces the same corpus")
+	out := fs.String("o", "", "write the corpus to this file instead of stdout")
+	addr := fs.String("addr", "", "send the corpus directly to the server at this address")
+	conns := fs.Int("conns", 1, "connections to spread the corpus over when sending to a server")
+	fs.Parse(args)
+
+	if *dup < 0 || *dup > 1 || *bad < 0 || *bad > 1 {
+		return fmt.Errorf("ratios must be between 0 and 1")
+	}
+
+	c, err := newCorpus(*seed, *dist, *dup, *bad)
+	if err != nil {
+		return
+	}
+
+	if *addr != "" {
+		return sendCorpus(c, *n, *addr, *conns)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("could not create corpus file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return writeCorpus(c, *n, w)
+}
+
+func writeCorpus(c *corpus, n int, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i := 0; i < n; i++ {
+		if _, err := bw.WriteString(c.line() + "\n"); err != nil {
+			return fmt.Errorf("could not write corpus: %v", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("could not write corpus: %v", err)
+	}
+	return nil
+}
+
+// sendCorpus round-robins the corpus lines over conns connections.
+// Lines are generated up front so the order each connection sees
+// stays the same between runs.
+func sendCorpus(c *corpus, n int, addr string, conns int) error {
+	if conns < 1 {
+		conns = 1
+	}
+
+	writers := make([]*bufio.Writer, conns)
+	for i := range writers {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("could not connect to %s: %v", addr, err)
+		}
+		defer conn.Close()
+		writers[i] = bufio.NewWriter(conn)
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := writers[i%conns].WriteString(c.line() + "\n"); err != nil {
+			return fmt.Errorf("could not send corpus: %v", err)
+		}
+	}
+
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("could not send corpus: %v", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Sent %d lines over %d connections in %v\n", n, conns, time.Since(start))
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// watchInstrumentSignals toggles instrumentation on every
+// instrument signal (SIGUSR2 where available).
+func watchInstrumentSignals(srv *server.Server) {
+	if len(instrumentSignals) == 0 {
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, instrumentSignals...)
+	go func() {
+		for range sig {
+			on := !srv.Instrumented()
+			srv.SetInstrumented(on)
+			slog.Info("toggled instrumentation", "on", on)
+		}
+	}()
+}
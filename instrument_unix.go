@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// instrumentSignals toggle request instrumentation.
+var instrumentSignals = []os.Signal{syscall.SIGUSR2}
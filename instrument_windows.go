@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// instrumentSignals is empty, Windows has no spare signal to toggle with.
+// Use -instrument to turn it on at startup instead.
+var instrumentSignals []os.Signal
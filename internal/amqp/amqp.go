@@ -0,0 +1,436 @@
+// Package amqp is a minimal AMQP 0.9.1 publisher.
+//
+// It only does what the server's amqp sink needs: connect to a broker
+// such as RabbitMQ with a PLAIN login, open one channel in confirm
+// mode and publish batches of persistent messages to an exchange,
+// waiting until the broker has confirmed every one of them. There's no
+// consuming, no declaring, no heartbeats and no mandatory returns; a
+// publish the broker nacks or doesn't confirm in time is reported, the
+// connection is done with and the caller dials a new one.
+package amqp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Frame types and end.
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xce
+)
+
+// The methods used, as class and method id.
+const (
+	connectionStart   = 10<<16 | 10
+	connectionStartOk = 10<<16 | 11
+	connectionTune    = 10<<16 | 30
+	connectionTuneOk  = 10<<16 | 31
+	connectionOpen    = 10<<16 | 40
+	connectionOpenOk  = 10<<16 | 41
+	connectionClose   = 10<<16 | 50
+	channelOpen       = 20<<16 | 10
+	channelOpenOk     = 20<<16 | 11
+	channelClose      = 20<<16 | 40
+	basicPublish      = 60<<16 | 40
+	basicAck          = 60<<16 | 80
+	basicNack         = 60<<16 | 120
+	confirmSelect     = 85<<16 | 10
+	confirmSelectOk   = 85<<16 | 11
+)
+
+const (
+	classBasic = 60
+	// maxFrame is the largest frame we take, and offer the broker.
+	maxFrame = 1 << 17
+	// persistent is the delivery mode of messages kept on disk.
+	persistent = 2
+)
+
+// protocolHeader opens a connection, AMQP 0-9-1.
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// Options configure the connection.
+type Options struct {
+	// Password is used if the URL has none.
+	Password string
+	// Name is what the broker shows the connection as.
+	Name string
+	// Timeout bounds dialing, the handshake and the confirms of every
+	// publish, 10s if 0.
+	Timeout time.Duration
+}
+
+// Error is a connection or channel the broker closed, e.g. 404 for a
+// missing exchange.
+type Error struct {
+	Code int
+	Text string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("amqp: %d %s", e.Code, e.Text)
+}
+
+// ErrNacked is a publish the broker couldn't take on.
+var ErrNacked = errors.New("amqp: message nacked")
+
+// Message is a message to publish.
+type Message struct {
+	RoutingKey string
+	Body       []byte
+	// Headers are string headers of the message.
+	Headers map[string]string
+}
+
+// Publisher publishes to one exchange over a channel in confirm mode.
+// It's not safe for concurrent use.
+type Publisher struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	exchange string
+	timeout  time.Duration
+	frameMax int
+	// tag is the delivery tag of the last message published.
+	tag uint64
+}
+
+// Dial connects to the broker of an amqp:// or amqps:// URL, e.g.
+// amqp://numbers@rabbit:5672/vhost, to publish to exchange.
+func Dial(rawURL, exchange string, opts Options) (*Publisher, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "amqp" && u.Scheme != "amqps") {
+		return nil, fmt.Errorf("amqp: bad URL, want amqp://user@host:port/vhost")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "5672"
+		if u.Scheme == "amqps" {
+			port = "5671"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	user, password := u.User.Username(), opts.Password
+	if p, ok := u.User.Password(); ok {
+		password = p
+	}
+	if user == "" {
+		user, password = "guest", "guest"
+	}
+	// The default vhost is /, which is an empty path or %2f.
+	vhost := strings.TrimPrefix(u.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "amqps" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		tc.SetDeadline(time.Now().Add(opts.Timeout))
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("amqp: TLS handshake failed: %v", err)
+		}
+		conn = tc
+	}
+	p := &Publisher{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		exchange: exchange,
+		timeout:  opts.Timeout,
+		frameMax: maxFrame,
+	}
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	if err = p.open(user, password, vhost, opts.Name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return p, nil
+}
+
+// open logs in, opens channel 1 and puts it in confirm mode.
+func (p *Publisher) open(user, password, vhost, name string) error {
+	if _, err := p.w.Write(protocolHeader); err != nil {
+		return err
+	}
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := p.expect(0, connectionStart); err != nil {
+		return err
+	}
+
+	var b []byte
+	b = appendTable(b, map[string]string{"product": "go-simple-tcp-server", "connection_name": name})
+	b = appendShortStr(b, "PLAIN")
+	b = appendLongStr(b, "\x00"+user+"\x00"+password)
+	b = appendShortStr(b, "en_US")
+	if err := p.sendMethod(0, connectionStartOk, b); err != nil {
+		return err
+	}
+
+	tune, err := p.expect(0, connectionTune)
+	if err != nil {
+		return err
+	}
+	if len(tune) < 8 {
+		return fmt.Errorf("amqp: malformed tune")
+	}
+	channelMax := binary.BigEndian.Uint16(tune)
+	if fm := int(binary.BigEndian.Uint32(tune[2:])); fm > 0 && fm < p.frameMax {
+		p.frameMax = fm
+	}
+	b = binary.BigEndian.AppendUint16(nil, channelMax)
+	b = binary.BigEndian.AppendUint32(b, uint32(p.frameMax))
+	// No heartbeats, a batch is confirmed or the connection's given up.
+	b = binary.BigEndian.AppendUint16(b, 0)
+	if err = p.sendMethod(0, connectionTuneOk, b); err != nil {
+		return err
+	}
+
+	b = appendShortStr(nil, vhost)
+	b = appendShortStr(b, "")
+	b = append(b, 0)
+	if err = p.sendMethod(0, connectionOpen, b); err != nil {
+		return err
+	}
+	if _, err = p.expect(0, connectionOpenOk); err != nil {
+		return err
+	}
+
+	if err = p.sendMethod(1, channelOpen, appendShortStr(nil, "")); err != nil {
+		return err
+	}
+	if _, err = p.expect(1, channelOpenOk); err != nil {
+		return err
+	}
+	if err = p.sendMethod(1, confirmSelect, []byte{0}); err != nil {
+		return err
+	}
+	_, err = p.expect(1, confirmSelectOk)
+	return err
+}
+
+// Publish publishes msgs and waits until the broker has confirmed all
+// of them. If it fails some may have been published already.
+func (p *Publisher) Publish(msgs []Message) error {
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+	for _, m := range msgs {
+		b := binary.BigEndian.AppendUint16(nil, 0)
+		b = appendShortStr(b, p.exchange)
+		b = appendShortStr(b, m.RoutingKey)
+		b = append(b, 0) // neither mandatory nor immediate
+		if err := p.sendMethod(1, basicPublish, b); err != nil {
+			return err
+		}
+
+		// The content header: the body's size, then the headers and the
+		// delivery mode, flagged by bits 13 and 12.
+		h := binary.BigEndian.AppendUint16(nil, classBasic)
+		h = binary.BigEndian.AppendUint16(h, 0)
+		h = binary.BigEndian.AppendUint64(h, uint64(len(m.Body)))
+		h = binary.BigEndian.AppendUint16(h, 1<<13|1<<12)
+		h = appendTable(h, m.Headers)
+		h = append(h, persistent)
+		if err := p.sendFrame(frameHeader, 1, h); err != nil {
+			return err
+		}
+		for body := m.Body; len(body) > 0; {
+			n := min(len(body), p.frameMax-8)
+			if err := p.sendFrame(frameBody, 1, body[:n]); err != nil {
+				return err
+			}
+			body = body[n:]
+		}
+		p.tag++
+	}
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+
+	// An ack or nack confirms one tag, or with multiple every one up to
+	// its own.
+	first := p.tag - uint64(len(msgs)) + 1
+	confirmed := make([]bool, len(msgs))
+	left := len(msgs)
+	var nacked bool
+	for left > 0 {
+		m, args, err := p.readMethod(1)
+		if err != nil {
+			return err
+		}
+		if m != basicAck && m != basicNack {
+			continue
+		}
+		if len(args) < 9 {
+			return fmt.Errorf("amqp: malformed confirm")
+		}
+		tag, multiple := binary.BigEndian.Uint64(args), args[8]&1 != 0
+		if tag < first || tag > p.tag {
+			continue
+		}
+		from := tag
+		if multiple {
+			from = first
+		}
+		for t := from; t <= tag; t++ {
+			if !confirmed[t-first] {
+				confirmed[t-first] = true
+				left--
+			}
+		}
+		if m == basicNack {
+			nacked = true
+		}
+	}
+	p.conn.SetDeadline(time.Time{})
+	if nacked {
+		return ErrNacked
+	}
+	return nil
+}
+
+// Close closes the connection, it doesn't wait for the broker's
+// answer.
+func (p *Publisher) Close() error {
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+	b := binary.BigEndian.AppendUint16(nil, 200)
+	b = appendShortStr(b, "bye")
+	b = binary.BigEndian.AppendUint32(b, 0)
+	p.sendMethod(0, connectionClose, b)
+	p.w.Flush()
+	return p.conn.Close()
+}
+
+// expect reads the next method on channel, it must be want.
+func (p *Publisher) expect(channel uint16, want uint32) ([]byte, error) {
+	m, args, err := p.readMethod(channel)
+	if err != nil {
+		return nil, err
+	}
+	if m != want {
+		return nil, fmt.Errorf("amqp: got method %d.%d, want %d.%d", m>>16, m&0xffff, want>>16, want&0xffff)
+	}
+	return args, nil
+}
+
+// readMethod reads frames until a method, a closed channel or
+// connection is an *Error.
+func (p *Publisher) readMethod(channel uint16) (uint32, []byte, error) {
+	for {
+		typ, ch, payload, err := p.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != frameMethod {
+			continue
+		}
+		if len(payload) < 4 {
+			return 0, nil, fmt.Errorf("amqp: malformed method")
+		}
+		m, args := binary.BigEndian.Uint32(payload), payload[4:]
+		if m == connectionClose || m == channelClose {
+			return 0, nil, closeError(args)
+		}
+		if ch != channel {
+			continue
+		}
+		return m, args, nil
+	}
+}
+
+func (p *Publisher) readFrame() (typ byte, channel uint16, payload []byte, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		return
+	}
+	if string(hdr[:4]) == "AMQP" {
+		// The broker's answer to a protocol version it doesn't speak.
+		return 0, 0, nil, fmt.Errorf("amqp: the broker doesn't speak AMQP 0.9.1")
+	}
+	n := binary.BigEndian.Uint32(hdr[3:])
+	if n > maxFrame {
+		return 0, 0, nil, fmt.Errorf("amqp: frame of %d bytes too large", n)
+	}
+	payload = make([]byte, n+1)
+	if _, err = io.ReadFull(p.r, payload); err != nil {
+		return
+	}
+	if payload[n] != frameEnd {
+		return 0, 0, nil, fmt.Errorf("amqp: malformed frame")
+	}
+	if hdr[0] == frameHeartbeat {
+		return hdr[0], 0, nil, nil
+	}
+	return hdr[0], binary.BigEndian.Uint16(hdr[1:]), payload[:n], nil
+}
+
+func (p *Publisher) sendMethod(channel uint16, method uint32, args []byte) error {
+	b := binary.BigEndian.AppendUint32(nil, method)
+	if err := p.sendFrame(frameMethod, channel, append(b, args...)); err != nil {
+		return err
+	}
+	if method != basicPublish {
+		return p.w.Flush()
+	}
+	return nil
+}
+
+func (p *Publisher) sendFrame(typ byte, channel uint16, payload []byte) error {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, channel)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	if _, err := p.w.Write(b); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(payload); err != nil {
+		return err
+	}
+	return p.w.WriteByte(frameEnd)
+}
+
+// closeError reads the reply code and text of a close method.
+func closeError(args []byte) error {
+	if len(args) < 3 || len(args) < 3+int(args[2]) {
+		return &Error{Text: "closed"}
+	}
+	return &Error{Code: int(binary.BigEndian.Uint16(args)), Text: string(args[3 : 3+args[2]])}
+}
+
+func appendShortStr(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+func appendLongStr(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// appendTable appends a field table of long strings.
+func appendTable(b []byte, fields map[string]string) []byte {
+	var t []byte
+	for k, v := range fields {
+		t = appendShortStr(t, k)
+		t = appendLongStr(append(t, 'S'), v)
+	}
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(t))), t...)
+}
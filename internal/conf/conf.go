@@ -0,0 +1,261 @@
+// Package conf reads the server's config file, a flat subset of TOML.
+//
+// Only what a list of settings needs is implemented: comments, tables,
+// key = value pairs with string, integer, float and boolean values,
+// and arrays of those, which may span lines. Tables prefix the keys of
+// their section, so
+//
+//	[mqtt]
+//	broker = "localhost:1883"
+//
+// is the setting mqtt-broker. Underscores in keys are read as dashes.
+// Dates, inline tables and arrays of tables are not supported.
+// See https://toml.io/en/v1.0.0 for the format.
+package conf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Setting is one key of the file with its values as text,
+// an array has one value per element.
+type Setting struct {
+	Key    string
+	Values []string
+	// Line is where the setting starts, for error messages.
+	Line int
+}
+
+// bareKey matches the keys, and table names, that are supported.
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// errUnterminated reports an array whose closing bracket is on a later line.
+var errUnterminated = errors.New("unterminated array")
+
+// ParseFile reads the settings of the file name.
+func ParseFile(name string) ([]Setting, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %v", err)
+	}
+	defer f.Close()
+
+	settings, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return settings, nil
+}
+
+// Parse reads the settings from r in the order they appear.
+// A key set twice is an error, like in TOML.
+func Parse(r io.Reader) (settings []Setting, err error) {
+	var (
+		table string
+		seen  = make(map[string]int)
+		sc    = bufio.NewScanner(r)
+		n     int
+	)
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if table, err = parseTable(line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !bareKey.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		key = strings.Replace(key, "_", "-", -1)
+		if table != "" {
+			key = table + "-" + key
+		}
+		if first, ok := seen[key]; ok {
+			return nil, fmt.Errorf("line %d: %s already set on line %d", n, key, first)
+		}
+		seen[key] = n
+
+		start := n
+		vals, rest, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		for err == errUnterminated && sc.Scan() {
+			n++
+			if vals, rest, err = parseArray(rest+"\n"+sc.Text(), vals); err == nil {
+				err = endOfValue(rest)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", start, key, err)
+		}
+		settings = append(settings, Setting{Key: key, Values: vals, Line: start})
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	return settings, nil
+}
+
+// parseTable reads a [table] header, dotted names are joined with dashes.
+func parseTable(line string) (string, error) {
+	end := strings.IndexByte(line, ']')
+	if end < 0 || strings.HasPrefix(line, "[[") {
+		return "", fmt.Errorf("invalid table header %q", line)
+	}
+	if rest := strings.TrimSpace(line[end+1:]); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %q after table header", rest)
+	}
+
+	parts := strings.Split(line[1:end], ".")
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if !bareKey.MatchString(p) {
+			return "", fmt.Errorf("invalid table name %q", p)
+		}
+		parts[i] = strings.Replace(p, "_", "-", -1)
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// parseValue reads the value after the equals sign,
+// which is followed by nothing but maybe a comment.
+// An array that goes on on the next line returns errUnterminated with
+// its elements so far, and the text to parse the next line after with
+// parseArray, so no line is read twice.
+func parseValue(s string) (vals []string, rest string, err error) {
+	if strings.HasPrefix(s, "[") {
+		vals, rest, err = parseArray(s[1:], nil)
+	} else {
+		var v string
+		v, rest, err = parseScalar(s)
+		vals = []string{v}
+	}
+	if err != nil {
+		return vals, rest, err
+	}
+	return vals, "", endOfValue(rest)
+}
+
+// endOfValue checks nothing but maybe a comment follows a value.
+func endOfValue(rest string) error {
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return fmt.Errorf("unexpected %q after value", rest)
+	}
+	return nil
+}
+
+// parseArray reads the elements of an array up to its closing bracket
+// and appends them to vals, s starts after the opening one or where an
+// unterminated array left off.
+func parseArray(s string, vals []string) ([]string, string, error) {
+	for {
+		s = skipBlank(s)
+		if s == "" {
+			return vals, "", errUnterminated
+		}
+		if s[0] == ']' {
+			return vals, s[1:], nil
+		}
+		if s[0] == '[' {
+			return nil, "", errors.New("nested arrays are not supported")
+		}
+
+		v, after, err := parseScalar(s)
+		if err != nil {
+			return nil, "", err
+		}
+		elem := s[:len(s)-len(after)]
+
+		s = skipBlank(after)
+		switch {
+		case s == "":
+			// The comma may be on the next line, the element is
+			// read again with it.
+			return vals, elem, errUnterminated
+		case s[0] == ',':
+			s = s[1:]
+		case s[0] != ']':
+			return nil, "", fmt.Errorf("expected , or ] in array, got %q", s)
+		}
+		vals = append(vals, v)
+	}
+}
+
+// skipBlank skips white space, new lines and comments within arrays.
+func skipBlank(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return ""
+		}
+		s = s[i:]
+	}
+}
+
+// parseScalar reads a string, number or boolean from the start of s.
+func parseScalar(s string) (v, rest string, err error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("missing value")
+
+	case s[0] == '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", errors.New("unterminated string")
+		}
+		if v, err = strconv.Unquote(s[:end+1]); err != nil {
+			return "", "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+		return v, s[end+1:], nil
+
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	end := strings.IndexAny(s, " \t\r\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	v, rest = s[:end], s[end:]
+	if v == "true" || v == "false" {
+		return v, rest, nil
+	}
+	// Numbers may group digits with underscores, the flags don't.
+	v = strings.Replace(v, "_", "", -1)
+	if _, err = strconv.ParseFloat(v, 64); err != nil {
+		if _, err = strconv.ParseInt(v, 0, 64); err != nil {
+			return "", "", fmt.Errorf("invalid value %q, strings must be quoted", s[:end])
+		}
+	}
+	return v, rest, nil
+}
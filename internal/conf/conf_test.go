@@ -0,0 +1,142 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Setting
+	}{
+		{"empty", "", nil},
+		{"comments", "# a comment\n\n  # indented\n", nil},
+		{"scalars", `
+addr = "127.0.0.1"
+port = 3280 # the port
+log_dir = 'C:\logs'
+rate_limit = 0.5
+quiet = true
+min_value = 1_000_000
+mask = 0x1f
+`, []Setting{
+			{"addr", []string{"127.0.0.1"}, 2},
+			{"port", []string{"3280"}, 3},
+			{"log-dir", []string{`C:\logs`}, 4},
+			{"rate-limit", []string{"0.5"}, 5},
+			{"quiet", []string{"true"}, 6},
+			{"min-value", []string{"1000000"}, 7},
+			{"mask", []string{"0x1f"}, 8},
+		}},
+		{"escapes", `name = "tab\there \"quoted\" # not a comment"`, []Setting{
+			{"name", []string{"tab\there \"quoted\" # not a comment"}, 1},
+		}},
+		{"tables", "[mqtt]\nbroker = \"localhost:1883\"\n[tls . cert_opts] # nested\nfile = 'a.pem'\n", []Setting{
+			{"mqtt-broker", []string{"localhost:1883"}, 2},
+			{"tls-cert-opts-file", []string{"a.pem"}, 4},
+		}},
+		{"arrays", "stream = [\"a\", 'b',]\nempty = []\nports = [1, 2]", []Setting{
+			{"stream", []string{"a", "b"}, 1},
+			{"empty", nil, 2},
+			{"ports", []string{"1", "2"}, 3},
+		}},
+		{"multiline array", "stream = [\n  \"orders\", # the first\n\n  \"refunds\",\n] # done\nport = 1\n", []Setting{
+			{"stream", []string{"orders", "refunds"}, 1},
+			{"port", []string{"1"}, 6},
+		}},
+		{"commas on the next line", "stream = [\n  'orders' # the first\n  , 'refunds'\n\n]", []Setting{
+			{"stream", []string{"orders", "refunds"}, 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"no equals", "port 3280", "line 1: expected key = value"},
+		{"quoted key", `"port" = 1`, "line 1: invalid key"},
+		{"dotted key", "tls.cert = 'a'", "line 1: invalid key"},
+		{"empty key", "= 1", "line 1: invalid key"},
+		{"set twice", "port = 1\n\nport = 2", "line 3: port already set on line 1"},
+		{"set twice by table", "mqtt_qos = 1\n[mqtt]\nqos = 0", "line 3: mqtt-qos already set on line 1"},
+		{"missing value", "port =", "line 1: port: missing value"},
+		{"bare string", "addr = localhost", `invalid value "localhost", strings must be quoted`},
+		{"unterminated string", `addr = "localhost`, "unterminated string"},
+		{"unterminated literal", "addr = 'localhost", "unterminated string"},
+		{"bad escape", `addr = "\q"`, "invalid string"},
+		{"trailing", "port = 1 2", `unexpected "2" after value`},
+		{"unterminated array", "stream = [\"a\",\n\"b\"\nport = 1", "line 1: stream: "},
+		{"array without commas", `stream = ["a" "b"]`, "expected , or ] in array"},
+		{"lines without commas", "stream = [\n\"a\"\n\"b\"\n]", "expected , or ] in array"},
+		{"after array", "stream = [\n'a'\n] 1", `unexpected "1" after value`},
+		{"nested array", "ports = [[1]]", "nested arrays are not supported"},
+		{"array of tables", "[[stream]]", "line 1: invalid table header"},
+		{"unclosed table", "[mqtt", "line 1: invalid table header"},
+		{"bad table", "[mqtt.]", "invalid table name"},
+		{"after table", "[mqtt] qos = 1", "after table header"},
+		{"date", "start = 2024-01-01", "strings must be quoted"},
+		{"inline table", "tls = { cert = 'a' }", "strings must be quoted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.in))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// FuzzParse checks Parse doesn't panic, and what it takes holds
+// settings of valid keys in the order of their lines.
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+		"addr = \"127.0.0.1\"\nport = 3280\n",
+		"[mqtt]\nbroker = 'localhost:1883' # comment\n",
+		"stream = [\n  \"orders:prefix=ORD\",\n  'refunds', # x\n]\n",
+		"rate = 1_000.5\nquiet = false\nmask = 0x1f\n",
+		`name = "\u00e9\t\"x\""`,
+		"a = [",
+		"[[x]]",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		settings, err := Parse(strings.NewReader(in))
+		if err != nil {
+			return
+		}
+		line := 0
+		seen := make(map[string]bool)
+		for _, st := range settings {
+			if st.Line <= line {
+				t.Errorf("setting %s on line %d after line %d", st.Key, st.Line, line)
+			}
+			line = st.Line
+			if !bareKey.MatchString(st.Key) || strings.Contains(st.Key, "_") {
+				t.Errorf("invalid key %q", st.Key)
+			}
+			if seen[st.Key] {
+				t.Errorf("%s set twice", st.Key)
+			}
+			seen[st.Key] = true
+		}
+	})
+}
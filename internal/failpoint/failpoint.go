@@ -0,0 +1,202 @@
+// Package failpoint provides named fault injection points.
+//
+// Code that wants its error path exercised calls Eval with the name
+// of the point at the spot where the fault should happen.
+// Tests, or the chaos tooling, then Enable the point to make it return an
+// error, stall for a while, or both.
+//
+// Nothing is enabled by default, and Eval on a disabled point only costs
+// a single atomic load, so points can stay in hot paths.
+package failpoint
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EnvVar names the environment variable read by EnableFromEnv.
+const EnvVar = "GO_FAILPOINTS"
+
+// Action describes what an enabled point does when it's hit.
+type Action struct {
+	// Delay stalls the caller before returning.
+	Delay time.Duration
+	// Err is returned to the caller, after Delay. A nil Err only stalls.
+	Err error
+	// Count limits how many times the point fires, 0 means forever.
+	Count int
+	// Prob is the chance the point fires when it's hit, between 0 and 1,
+	// 0 means every time. Hits it skips don't count towards Count.
+	Prob float64
+}
+
+var (
+	mu     sync.Mutex
+	points = make(map[string]*Action)
+	// active is the number of enabled points,
+	// letting Eval skip the lock entirely in the common case.
+	active int32
+)
+
+// Enable activates the named point.
+// Enabling a point that is already active replaces its action.
+func Enable(name string, a Action) {
+	mu.Lock()
+	if _, ok := points[name]; !ok {
+		atomic.AddInt32(&active, 1)
+	}
+	points[name] = &a
+	mu.Unlock()
+}
+
+// Disable deactivates the named point.
+func Disable(name string) {
+	mu.Lock()
+	disable(name)
+	mu.Unlock()
+}
+
+func disable(name string) {
+	if _, ok := points[name]; ok {
+		delete(points, name)
+		atomic.AddInt32(&active, -1)
+	}
+}
+
+// Reset deactivates every point.
+func Reset() {
+	mu.Lock()
+	for name := range points {
+		disable(name)
+	}
+	mu.Unlock()
+}
+
+// Eval triggers the named point if it is enabled.
+// It returns the point's error, or nil if the point is disabled.
+func Eval(name string) error {
+	if atomic.LoadInt32(&active) == 0 {
+		return nil
+	}
+
+	mu.Lock()
+	a, ok := points[name]
+	if !ok {
+		mu.Unlock()
+		return nil
+	}
+	act := *a
+	if act.Prob > 0 && rand.Float64() >= act.Prob {
+		mu.Unlock()
+		return nil
+	}
+	if a.Count > 0 {
+		if a.Count--; a.Count == 0 {
+			disable(name)
+		}
+	}
+	mu.Unlock()
+
+	// Sleep outside the lock so a stalled point doesn't stall every other one.
+	if act.Delay > 0 {
+		time.Sleep(act.Delay)
+	}
+	return act.Err
+}
+
+// Active reports whether any point is enabled, for callers that only
+// set up their points' plumbing when it may fire.
+func Active() bool {
+	return atomic.LoadInt32(&active) > 0
+}
+
+// EnableFromEnv enables the points described by the GO_FAILPOINTS
+// environment variable, see EnableSpec for the format.
+func EnableFromEnv() error {
+	spec := os.Getenv(EnvVar)
+	if spec == "" {
+		return nil
+	}
+	return EnableSpec(spec)
+}
+
+// EnableSpec enables points from a textual description, which is handy
+// when driving a server binary from the outside.
+// Points are separated by ';' and look like
+//
+//	name=error
+//	name=error(disk full)
+//	name=delay(500ms)
+//	name=delay(2s)->error
+//	name=3*error
+//	name=10%delay(100ms)
+//
+// where a leading N* limits the point to firing N times, and a P%
+// after it makes the point fire on P percent of the hits only.
+func EnableSpec(spec string) error {
+	for _, term := range strings.Split(spec, ";") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(term, '=')
+		if eq < 1 {
+			return fmt.Errorf("invalid failpoint %q: missing name", term)
+		}
+
+		name := term[:eq]
+		a, err := parseAction(term[eq+1:])
+		if err != nil {
+			return fmt.Errorf("invalid failpoint %q: %v", term, err)
+		}
+		Enable(name, a)
+	}
+	return nil
+}
+
+func parseAction(s string) (a Action, err error) {
+	if star := strings.IndexByte(s, '*'); star >= 0 {
+		if _, err = fmt.Sscanf(s[:star], "%d", &a.Count); err != nil || a.Count < 1 {
+			return a, errors.New("count must be a positive number")
+		}
+		s = s[star+1:]
+	}
+	// Not a % in an error's message.
+	if pct := strings.IndexByte(s, '%'); pct >= 0 && !strings.Contains(s[:pct], "(") {
+		if a.Prob, err = strconv.ParseFloat(s[:pct], 64); err != nil || a.Prob <= 0 || a.Prob > 100 {
+			return a, errors.New("percentage must be above 0 and at most 100")
+		}
+		a.Prob /= 100
+		s = s[pct+1:]
+	}
+
+	for _, step := range strings.Split(s, "->") {
+		verb, arg := step, ""
+		if open := strings.IndexByte(step, '('); open >= 0 && strings.HasSuffix(step, ")") {
+			verb, arg = step[:open], step[open+1:len(step)-1]
+		}
+
+		switch verb {
+		case "error":
+			if arg == "" {
+				arg = "failpoint triggered"
+			}
+			a.Err = errors.New(arg)
+		case "delay":
+			if a.Delay, err = time.ParseDuration(arg); err != nil {
+				return a, fmt.Errorf("bad delay: %v", err)
+			}
+		default:
+			return a, fmt.Errorf("unknown action %q", verb)
+		}
+	}
+	return
+}
@@ -0,0 +1,350 @@
+// Package geoip reads MaxMind DB files, such as the GeoLite2 Country
+// and ASN databases, for the handful of fields the server reports on.
+//
+// Only what's needed for lookups is implemented: the metadata, the
+// binary search tree and the data section decoder. See
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata section at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSeparator is the gap between the search tree and the data section.
+const dataSeparator = 16
+
+// Reader looks up addresses in a MaxMind DB loaded into memory.
+type Reader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node IPv4 lookups start at in an IPv6 tree.
+	ipv4Start uint
+}
+
+// Open loads the database at name.
+func Open(name string) (*Reader, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read geoip database: %v", err)
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes reads a database already in memory.
+func FromBytes(buf []byte) (*Reader, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB: metadata marker not found")
+	}
+
+	meta := buf[i+len(metadataMarker):]
+	v, _, err := (&decoder{buf: meta}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode metadata: %v", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &Reader{buf: buf}
+	r.nodeCount = uint(asUint(m["node_count"]))
+	r.recordSize = uint(asUint(m["record_size"]))
+	r.ipVersion = uint(asUint(m["ip_version"]))
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSeparator > uint(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	r.data = buf[treeSize+dataSeparator : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node, bit uint) uint {
+	size := r.recordSize * 2 / 8
+	b := r.buf[node*size : node*size+size]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the record stored for ip, or nil if there is none.
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	bits := ip.To4()
+	if bits != nil && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if bits == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("invalid address %v", ip)
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-uint(i%8)))&1)
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errors.New("search tree ended on a node")
+	}
+
+	offset := node - r.nodeCount - dataSeparator
+	v, _, err := (&decoder{buf: r.data}).decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// Data section types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type decoder struct {
+	buf []byte
+}
+
+var errTruncated = errors.New("truncated data section")
+
+func (d *decoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, errTruncated
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+func beUint(b []byte) (v uint64) {
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return
+}
+
+// decode decodes the value at offset and returns it with the offset following it.
+func (d *decoder) decode(offset uint) (v interface{}, next uint, err error) {
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return
+	}
+	ctrl := b[0]
+	offset++
+
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		return d.decodePointer(ctrl, offset)
+	}
+
+	if typ == typeExtended {
+		if b, err = d.bytes(offset, 1); err != nil {
+			return
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if b, err = d.bytes(offset, extra); err != nil {
+			return
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + uint(beUint(b))
+		default:
+			size = 65821 + uint(beUint(b))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, val interface{}
+			if k, offset, err = d.decode(offset); err != nil {
+				return
+			}
+			if val, offset, err = d.decode(offset); err != nil {
+				return
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key] = val
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decode(offset); err != nil {
+				return
+			}
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+
+	if b, err = d.bytes(offset, size); err != nil {
+		return
+	}
+	next = offset + size
+
+	switch typ {
+	case typeString:
+		v = string(b)
+	case typeBytes, typeUint128:
+		v = append([]byte(nil), b...)
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		v = math.Float64frombits(binary.BigEndian.Uint64(b))
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case typeUint16, typeUint32, typeUint64:
+		v = beUint(b)
+	case typeInt32:
+		v = int32(uint32(beUint(b)))
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", typ)
+	}
+	return v, next, nil
+}
+
+// decodePointer follows a pointer and decodes the value it points to.
+// The returned offset is the one after the pointer itself.
+func (d *decoder) decodePointer(ctrl byte, offset uint) (v interface{}, next uint, err error) {
+	size := uint(ctrl>>3)&0x3 + 1
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return
+	}
+	next = offset + size
+
+	vvv := uint64(ctrl & 0x7)
+	var p uint64
+	switch size {
+	case 1:
+		p = vvv<<8 | beUint(b)
+	case 2:
+		p = (vvv<<16 | beUint(b)) + 2048
+	case 3:
+		p = (vvv<<24 | beUint(b)) + 526336
+	default:
+		p = beUint(b)
+	}
+
+	v, _, err = d.decode(uint(p))
+	return v, next, err
+}
+
+func asUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// Origin is where an address comes from, as far as the databases know.
+type Origin struct {
+	// Country is the ISO 3166 code of the country, "" if unknown.
+	Country string
+	// ASN is the autonomous system number, 0 if unknown.
+	ASN uint
+	// Org is the organization owning the autonomous system.
+	Org string
+}
+
+// Origin looks ip up and extracts the country and autonomous system
+// from the GeoLite2 Country, City or ASN record layouts.
+func (r *Reader) Origin(ip net.IP) (o Origin, err error) {
+	rec, err := r.Lookup(ip)
+	if err != nil || rec == nil {
+		return
+	}
+
+	for _, k := range []string{"country", "registered_country"} {
+		if c, ok := rec[k].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				o.Country = code
+				break
+			}
+		}
+	}
+	o.ASN = uint(asUint(rec["autonomous_system_number"]))
+	o.Org, _ = rec["autonomous_system_organization"].(string)
+	return
+}
@@ -0,0 +1,247 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// pointer is a value written as a pointer to an offset of the data section.
+type pointer uint
+
+// encode appends v in the data section format.
+func encode(b []byte, v interface{}) []byte {
+	ctrl := func(b []byte, typ byte, size int) []byte {
+		head := typ
+		if typ > 7 {
+			head = typeExtended
+		}
+		b = append(b, head<<5|byte(min(size, 29)))
+		if typ > 7 {
+			b = append(b, typ-7)
+		}
+		if size >= 29 {
+			b = append(b, byte(size-29))
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(b, typeString, len(v)), v...)
+	case uint16:
+		return binary.BigEndian.AppendUint16(ctrl(b, typeUint16, 2), v)
+	case uint32:
+		return binary.BigEndian.AppendUint32(ctrl(b, typeUint32, 4), v)
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		return ctrl(b, typeBool, n)
+	case pointer:
+		return append(b, typePointer<<5|byte(v>>8), byte(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = ctrl(b, typeMap, len(v))
+		for _, k := range keys {
+			b = encode(encode(b, k), v[k])
+		}
+		return b
+	}
+	panic("can't encode a value of this type")
+}
+
+// network is a prefix of the database and its record.
+type network struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// build lays a database of ipVersion with records of recordSize bits
+// out, the networks' records in the data section after shared.
+func build(ipVersion, recordSize int, shared []byte, nets []network) []byte {
+	const empty, leaf = -1, -2
+	type node [2]int
+	nodes := []node{{empty, empty}}
+	// refs are the data offsets of the leaves, by node and bit.
+	refs := make(map[[2]int]int)
+
+	data := append([]byte(nil), shared...)
+	for _, n := range nets {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if ip4 := ipnet.IP.To4(); ip4 != nil && ipVersion == 4 {
+			ip = ip4
+		} else if ip4 != nil {
+			// An IPv4 network in an IPv6 tree is under ::/96.
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+
+		at := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[at][bit] = leaf
+				refs[[2]int{at, bit}] = len(data)
+				break
+			}
+			if nodes[at][bit] < 0 {
+				nodes = append(nodes, node{empty, empty})
+				nodes[at][bit] = len(nodes) - 1
+			}
+			at = nodes[at][bit]
+		}
+		data = encode(data, n.record)
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for i, n := range nodes {
+		var rec [2]uint32
+		for bit, next := range n {
+			switch next {
+			case empty:
+				rec[bit] = uint32(count)
+			case leaf:
+				rec[bit] = uint32(count + dataSeparator + refs[[2]int{i, bit}])
+			default:
+				rec[bit] = uint32(next)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		case 28:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[0]>>24)<<4|byte(rec[1]>>24), byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, rec[0])
+			tree = binary.BigEndian.AppendUint32(tree, rec[1])
+		}
+	}
+
+	b := append(tree, make([]byte, dataSeparator)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return encode(b, map[string]interface{}{
+		"node_count":    uint32(count),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+	})
+}
+
+var testNets = []network{
+	{"203.0.113.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "NZ"},
+	}},
+	{"198.51.100.0/25", map[string]interface{}{
+		"autonomous_system_number": uint32(64500),
+		// The name at the start of the data section.
+		"autonomous_system_organization": pointer(0),
+	}},
+	{"198.51.100.128/25", map[string]interface{}{
+		"registered_country":             map[string]interface{}{"iso_code": "AU"},
+		"is_anycast":                     true,
+		"autonomous_system_organization": "Example",
+	}},
+}
+
+func TestOrigin(t *testing.T) {
+	// Longer than 28 bytes, its size takes a byte after the control byte.
+	org := "Example Networks of a name longer than 29"
+	tests := []struct {
+		ip   string
+		want Origin
+	}{
+		{"203.0.113.7", Origin{Country: "NZ"}},
+		{"198.51.100.1", Origin{ASN: 64500, Org: org}},
+		{"198.51.100.200", Origin{Country: "AU", Org: "Example"}},
+		{"192.0.2.1", Origin{}},
+	}
+	for _, version := range []int{4, 6} {
+		for _, size := range []int{24, 28, 32} {
+			nets := testNets
+			if version == 6 {
+				nets = append(nets, network{"2001:db8::/32", map[string]interface{}{
+					"country": map[string]interface{}{"iso_code": "DE"},
+				}})
+			}
+			r, err := FromBytes(build(version, size, encode(nil, org), nets))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bit records: %v", version, size, err)
+			}
+			cases := tests
+			if version == 6 {
+				cases = append(cases, struct {
+					ip   string
+					want Origin
+				}{"2001:db8::1", Origin{Country: "DE"}})
+			}
+			for _, tt := range cases {
+				got, err := r.Origin(net.ParseIP(tt.ip))
+				if err != nil || got != tt.want {
+					t.Errorf("IPv%d, %d bit records: Origin(%s) = %+v, %v, want %+v", version, size, tt.ip, got, err, tt.want)
+				}
+			}
+			if version == 4 {
+				if rec, err := r.Lookup(net.ParseIP("2001:db8::1")); rec != nil || err != nil {
+					t.Errorf("IPv4 database: Lookup of an IPv6 address = %v, %v, want nothing", rec, err)
+				}
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.mmdb")
+	os.WriteFile(name, build(4, 24, nil, testNets), 0644)
+	r, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := r.Origin(net.ParseIP("203.0.113.7")); o.Country != "NZ" {
+		t.Errorf("Origin = %+v, want NZ", o)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("opened a database that isn't there")
+	}
+}
+
+func TestFromBytesErrors(t *testing.T) {
+	good := build(4, 24, nil, testNets)
+	meta := func(m map[string]interface{}) []byte {
+		return encode(append([]byte(nil), metadataMarker...), m)
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"no marker", good[:bytes.LastIndex(good, metadataMarker)], "metadata marker not found"},
+		{"not a map", encode(append([]byte(nil), metadataMarker...), "x"), "metadata is not a map"},
+		{"record size", meta(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(16), "ip_version": uint16(4)}), "unsupported record size 16"},
+		{"tree too large", meta(map[string]interface{}{"node_count": uint32(1000), "record_size": uint16(24), "ip_version": uint16(4)}), "larger than the file"},
+		{"truncated metadata", append(append([]byte(nil), metadataMarker...), typeMap<<5|3), "truncated data section"},
+	}
+	for _, tt := range tests {
+		if _, err := FromBytes(tt.buf); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Package kafka is a minimal Kafka producer.
+//
+// It only does what the server's kafka sink needs: look up the leaders
+// of a topic's partitions and produce batches of records to them, acked
+// by all in-sync replicas. There's no consumer, compression, idempotence,
+// transactions, SASL or TLS; a failed produce, a moved leader included,
+// is reported and the caller dials a new Producer, which looks the
+// leaders up again.
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The requests used, and their versions: the oldest that brokers from
+// 1.0 up to 4.x all take.
+const (
+	apiProduce      = 0
+	apiMetadata     = 3
+	produceVersion  = 3
+	metadataVersion = 4
+)
+
+const (
+	recordBatchMagic = 2
+	// maxResponse bounds the size of responses we accept.
+	maxResponse = 1 << 24
+	// acksAll waits for all in-sync replicas.
+	acksAll = -1
+	errNone = 0
+	// none is the null length, producer id, epoch and sequence.
+	none = -1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configure the connections to the brokers.
+type Options struct {
+	// ClientID is what the brokers know the client as.
+	ClientID string
+	// Timeout bounds dialing and every round trip, and is the time
+	// the leaders have to replicate a batch, 10s if 0.
+	Timeout time.Duration
+}
+
+// Error is an error code a broker answered with, e.g. 6 for
+// NOT_LEADER_OR_FOLLOWER.
+type Error struct {
+	Topic     string
+	Partition int32
+	Code      int16
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kafka: %s/%d: error code %d", e.Topic, e.Partition, e.Code)
+}
+
+// Record is a message to produce, a nil Key is a null one.
+type Record struct {
+	Key   []byte
+	Value []byte
+}
+
+// Producer produces to the partitions of one topic, records with the
+// same key to the same partition. It's safe for concurrent use, but
+// produces one batch at a time.
+type Producer struct {
+	topic string
+	opts  Options
+
+	mu sync.Mutex
+	// leaders has the leader of every partition, by partition.
+	leaders []*broker
+	corr    int32
+}
+
+type broker struct {
+	addr string
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial looks up the partitions of topic on the first of the bootstrap
+// brokers that answers.
+func Dial(bootstrap []string, topic string, opts Options) (*Producer, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if len(bootstrap) == 0 {
+		return nil, errors.New("kafka: no brokers")
+	}
+	p := &Producer{topic: topic, opts: opts}
+
+	var err error
+	for _, addr := range bootstrap {
+		b := &broker{addr: addr}
+		err = p.metadata(b)
+		// A leader dials again on its first produce.
+		b.close()
+		if err == nil {
+			return p, nil
+		}
+	}
+	return nil, err
+}
+
+// metadata fills in the leaders, as b knows them.
+func (p *Producer) metadata(b *broker) error {
+	var req []byte
+	req = appendInt32(req, 1)
+	req = appendString(req, p.topic)
+	req = append(req, 0) // don't create the topic
+	resp, err := p.roundTrip(b, apiMetadata, metadataVersion, req)
+	if err != nil {
+		return err
+	}
+
+	d := decoder{b: resp}
+	d.int32() // throttle time
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster id
+	d.int32()  // controller
+
+	var leaders map[int32]int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, name := d.int16(), d.string()
+		d.bool() // internal
+		if name != p.topic {
+			d.err = fmt.Errorf("kafka: metadata of %q, not %q", name, p.topic)
+			break
+		}
+		if code != errNone {
+			return &Error{Topic: p.topic, Partition: -1, Code: code}
+		}
+		// A partition without a leader has one of -1, its error
+		// code isn't needed.
+		leaders = make(map[int32]int32)
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int16()
+			part, leader := d.int32(), d.int32()
+			d.int32s() // replicas
+			d.int32s() // in-sync replicas
+			leaders[part] = leader
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("kafka: topic %q has no partitions", p.topic)
+	}
+
+	conns := map[string]*broker{b.addr: b}
+	p.leaders = make([]*broker, len(leaders))
+	for part := range p.leaders {
+		addr, ok := brokers[leaders[int32(part)]]
+		if !ok {
+			return fmt.Errorf("kafka: %s/%d has no leader", p.topic, part)
+		}
+		if conns[addr] == nil {
+			conns[addr] = &broker{addr: addr}
+		}
+		p.leaders[part] = conns[addr]
+	}
+	return nil
+}
+
+// Produce sends the records to the leaders of their partitions, and
+// waits for all of them to be acked.
+func (p *Producer) Produce(records []Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parts := make(map[int32][]Record)
+	for _, r := range records {
+		part := p.partition(r.Key)
+		parts[part] = append(parts[part], r)
+	}
+	byLeader := make(map[*broker][]int32)
+	for part := range parts {
+		b := p.leaders[part]
+		byLeader[b] = append(byLeader[b], part)
+	}
+
+	now := time.Now().UnixMilli()
+	for b, ps := range byLeader {
+		var req []byte
+		req = appendInt16(req, none) // transactional id
+		req = appendInt16(req, acksAll)
+		req = appendInt32(req, int32(p.opts.Timeout/time.Millisecond))
+		req = appendInt32(req, 1)
+		req = appendString(req, p.topic)
+		req = appendInt32(req, int32(len(ps)))
+		for _, part := range ps {
+			batch := recordBatch(parts[part], now)
+			req = appendInt32(req, part)
+			req = appendInt32(req, int32(len(batch)))
+			req = append(req, batch...)
+		}
+
+		resp, err := p.roundTrip(b, apiProduce, produceVersion, req)
+		if err != nil {
+			return err
+		}
+		d := decoder{b: resp}
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			for m := d.int32(); m > 0 && d.err == nil; m-- {
+				part, code := d.int32(), d.int16()
+				d.int64() // base offset
+				d.int64() // log append time
+				if code != errNone {
+					return &Error{Topic: p.topic, Partition: part, Code: code}
+				}
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+	}
+	return nil
+}
+
+// partition picks the partition of a key, a null key goes to the first.
+func (p *Producer) partition(key []byte) int32 {
+	if key == nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int32(h.Sum32() % uint32(len(p.leaders)))
+}
+
+// Close hangs up on the brokers.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.leaders {
+		b.close()
+	}
+	return nil
+}
+
+// roundTrip sends a request to b and returns the response after its
+// header, connecting first if need be. A broken connection is closed,
+// the next request dials again.
+func (p *Producer) roundTrip(b *broker, api, version int16, body []byte) ([]byte, error) {
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, p.opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		b.conn, b.r = conn, bufio.NewReader(conn)
+	}
+
+	p.corr++
+	var req []byte
+	req = appendInt32(req, 0) // size, below
+	req = appendInt16(req, api)
+	req = appendInt16(req, version)
+	req = appendInt32(req, p.corr)
+	req = appendString(req, p.opts.ClientID)
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	// Time for the leaders to replicate, and for the answer to come back.
+	b.conn.SetDeadline(time.Now().Add(2 * p.opts.Timeout))
+	resp, err := b.exchange(req, p.corr)
+	if err != nil {
+		b.close()
+	}
+	return resp, err
+}
+
+func (b *broker) exchange(req []byte, corr int32) ([]byte, error) {
+	if _, err := b.conn.Write(req); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(b.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponse {
+		return nil, fmt.Errorf("kafka: response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(b.r, resp); err != nil {
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(resp)); got != corr {
+		return nil, fmt.Errorf("kafka: response to request %d, not %d", got, corr)
+	}
+	return resp[4:], nil
+}
+
+func (b *broker) close() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// recordBatch encodes records as a batch of the v2 message format,
+// all with timestamp now.
+func recordBatch(records []Record, now int64) []byte {
+	var recs []byte
+	for i, r := range records {
+		var rec []byte
+		rec = append(rec, 0)                     // attributes
+		rec = binary.AppendVarint(rec, 0)        // timestamp delta
+		rec = binary.AppendVarint(rec, int64(i)) // offset delta
+		rec = appendVarBytes(rec, r.Key)
+		rec = appendVarBytes(rec, r.Value)
+		rec = binary.AppendVarint(rec, 0) // headers
+		recs = binary.AppendVarint(recs, int64(len(rec)))
+		recs = append(recs, rec...)
+	}
+
+	// What the CRC covers, from the attributes on.
+	var tail []byte
+	tail = appendInt16(tail, 0)
+	tail = appendInt32(tail, int32(len(records)-1))
+	tail = appendInt64(tail, now)
+	tail = appendInt64(tail, now)
+	tail = appendInt64(tail, none) // producer id
+	tail = appendInt16(tail, none) // producer epoch
+	tail = appendInt32(tail, none) // base sequence
+	tail = appendInt32(tail, int32(len(records)))
+	tail = append(tail, recs...)
+
+	var b []byte
+	b = appendInt64(b, 0) // base offset
+	// The length counts from the leader epoch on.
+	b = appendInt32(b, int32(4+1+4+len(tail)))
+	b = appendInt32(b, none) // leader epoch
+	b = append(b, recordBatchMagic)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(tail, castagnoli))
+	return append(b, tail...)
+}
+
+func appendInt16(b []byte, v int16) []byte { return binary.BigEndian.AppendUint16(b, uint16(v)) }
+func appendInt32(b []byte, v int32) []byte { return binary.BigEndian.AppendUint32(b, uint32(v)) }
+func appendInt64(b []byte, v int64) []byte { return binary.BigEndian.AppendUint64(b, uint64(v)) }
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendVarBytes(b, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, none)
+	}
+	b = binary.AppendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
+
+// decoder reads a response, the first error sticks and makes the
+// rest read zeros.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.b) < n {
+		d.err = errors.New("kafka: short response")
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bool() bool   { return d.next(1)[0] != 0 }
+func (d *decoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *decoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *decoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.next(8))) }
+
+// string reads a nullable string, null is "".
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) int32s() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
@@ -0,0 +1,300 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCluster is two brokers, each leading a partition of the topic
+// numbers, that keep the records produced to them.
+type fakeCluster struct {
+	brokers [2]net.Listener
+
+	mu sync.Mutex
+	// records are "<broker> <partition> <key> <value>".
+	records []string
+	// code is what produce requests are answered with.
+	code int16
+	// topicCode is what metadata requests of the topic are answered with.
+	topicCode int16
+	acks      []int16
+}
+
+func newFakeCluster(t *testing.T) *fakeCluster {
+	t.Helper()
+	c := &fakeCluster{}
+	for i := range c.brokers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		c.brokers[i] = l
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go c.serve(int32(i+1), conn)
+			}
+		}()
+	}
+	return c
+}
+
+func (c *fakeCluster) serve(id int32, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		d := decoder{b: req}
+		api, _, corr := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+
+		resp := appendInt32(nil, corr)
+		switch api {
+		case apiMetadata:
+			resp = c.metadata(resp)
+		case apiProduce:
+			var err error
+			if resp, err = c.produce(id, &d, resp); err != nil {
+				return
+			}
+		default:
+			return
+		}
+		conn.Write(append(appendInt32(nil, int32(len(resp))), resp...))
+	}
+}
+
+func (c *fakeCluster) metadata(b []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b = appendInt32(b, 0) // throttle time
+	b = appendInt32(b, int32(len(c.brokers)))
+	for i, l := range c.brokers {
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		p, _ := strconv.Atoi(port)
+		b = appendInt32(b, int32(i+1))
+		b = appendString(b, host)
+		b = appendInt32(b, int32(p))
+		b = appendInt16(b, none) // rack
+	}
+	b = appendString(b, "cluster")
+	b = appendInt32(b, 1)
+	b = appendInt32(b, 1)
+	b = appendInt16(b, c.topicCode)
+	b = appendString(b, "numbers")
+	b = append(b, 0)
+	b = appendInt32(b, int32(len(c.brokers)))
+	for part := range c.brokers {
+		b = appendInt16(b, errNone)
+		b = appendInt32(b, int32(part))
+		b = appendInt32(b, int32(part+1)) // leader
+		b = appendInt32(b, 1)
+		b = appendInt32(b, int32(part+1))
+		b = appendInt32(b, 1)
+		b = appendInt32(b, int32(part+1))
+	}
+	return b
+}
+
+func (c *fakeCluster) produce(id int32, d *decoder, b []byte) ([]byte, error) {
+	d.string() // transactional id
+	acks := d.int16()
+	d.int32() // timeout
+	d.int32() // topics, one
+	topic := d.string()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acks = append(c.acks, acks)
+	b = appendInt32(b, 1)
+	b = appendString(b, topic)
+	n := d.int32()
+	b = appendInt32(b, n)
+	for ; n > 0 && d.err == nil; n-- {
+		part := d.int32()
+		batch := d.next(int(d.int32()))
+		records, err := readBatch(batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			c.records = append(c.records, fmt.Sprintf("%d %d %s %s", id, part, r.Key, r.Value))
+		}
+		b = appendInt32(b, part)
+		b = appendInt16(b, c.code)
+		b = appendInt64(b, 0)
+		b = appendInt64(b, none)
+	}
+	return appendInt32(b, 0), d.err // throttle time
+}
+
+// readBatch decodes a record batch, checking its length and CRC.
+func readBatch(b []byte) ([]Record, error) {
+	d := decoder{b: b}
+	d.int64() // base offset
+	if n := d.int32(); int(n) != len(d.b) {
+		return nil, fmt.Errorf("batch length %d, %d bytes follow", n, len(d.b))
+	}
+	d.int32() // leader epoch
+	if magic := d.next(1)[0]; magic != recordBatchMagic {
+		return nil, fmt.Errorf("magic %d", magic)
+	}
+	crc := uint32(d.int32())
+	if sum := crc32.Checksum(d.b, castagnoli); sum != crc {
+		return nil, fmt.Errorf("crc %x, want %x", crc, sum)
+	}
+	d.int16() // attributes
+	last := d.int32()
+	d.int64()
+	d.int64()
+	d.int64()
+	d.int16()
+	d.int32()
+	n := d.int32()
+	if last != n-1 {
+		return nil, fmt.Errorf("last offset delta %d of %d records", last, n)
+	}
+
+	varint := func() int64 {
+		v, k := binary.Varint(d.b)
+		if k <= 0 {
+			d.err = errors.New("bad varint")
+			return 0
+		}
+		d.b = d.b[k:]
+		return v
+	}
+	bytes := func() []byte {
+		if n := varint(); n >= 0 {
+			return d.next(int(n))
+		}
+		return nil
+	}
+	var records []Record
+	for i := int32(0); i < n && d.err == nil; i++ {
+		varint()  // length
+		d.next(1) // attributes
+		varint()  // timestamp delta
+		if delta := varint(); delta != int64(i) {
+			return nil, fmt.Errorf("offset delta %d of record %d", delta, i)
+		}
+		records = append(records, Record{Key: bytes(), Value: bytes()})
+		varint() // headers
+	}
+	return records, d.err
+}
+
+func (c *fakeCluster) addrs() []string {
+	return []string{c.brokers[0].Addr().String(), c.brokers[1].Addr().String()}
+}
+
+func TestProduce(t *testing.T) {
+	c := newFakeCluster(t)
+	p, err := Dial(c.addrs()[1:], "numbers", Options{ClientID: "numbers", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	records := []Record{
+		{Key: []byte("data"), Value: []byte("1234567890")},
+		{Key: []byte("orders"), Value: []byte("1234567891")},
+		{Key: []byte("data"), Value: []byte("1234567892")},
+		{Value: []byte("1234567893")},
+	}
+	if err := p.Produce(records); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, r := range records {
+		part := p.partition(r.Key)
+		want = append(want, fmt.Sprintf("%d %d %s %s", part+1, part, r.Key, r.Value))
+	}
+	c.mu.Lock()
+	got := append([]string(nil), c.records...)
+	acks := c.acks
+	c.mu.Unlock()
+	// The brokers are sent to in any order, but each in order.
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("produced %q, want %q", got, want)
+	}
+	for _, a := range acks {
+		if a != acksAll {
+			t.Errorf("produced with acks %d, want all", a)
+		}
+	}
+}
+
+func TestProduceError(t *testing.T) {
+	c := newFakeCluster(t)
+	p, err := Dial(c.addrs(), "numbers", Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// NOT_LEADER_OR_FOLLOWER, the leader moved.
+	c.mu.Lock()
+	c.code = 6
+	c.mu.Unlock()
+	err = p.Produce([]Record{{Value: []byte("1234567890")}})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != 6 || e.Partition != 0 || e.Topic != "numbers" {
+		t.Errorf("Produce = %v, want error code 6 of numbers/0", err)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	c := newFakeCluster(t)
+	// UNKNOWN_TOPIC_OR_PARTITION.
+	c.mu.Lock()
+	c.topicCode = 3
+	c.mu.Unlock()
+	_, err := Dial(c.addrs(), "numbers", Options{Timeout: time.Second})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != 3 {
+		t.Errorf("Dial = %v, want error code 3", err)
+	}
+
+	if _, err := Dial(c.addrs(), "orders", Options{Timeout: time.Second}); err == nil {
+		t.Error("Dial took the metadata of another topic")
+	}
+	if _, err := Dial(nil, "numbers", Options{}); err == nil {
+		t.Error("Dial without brokers")
+	}
+
+	// A broker that's down is skipped.
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l.Addr().String()
+	l.Close()
+	c.mu.Lock()
+	c.topicCode = errNone
+	c.mu.Unlock()
+	if _, err := Dial(append([]string{down}, c.addrs()...), "numbers", Options{Timeout: time.Second}); err != nil {
+		t.Errorf("Dial = %v, want the next bootstrap broker asked", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Package memcache is a minimal memcached client.
+//
+// It only does what the server's dedup cache needs: get, set and delete
+// keys over the text protocol, spread across a list of servers by the
+// hash of the key, with a small pool of connections to each. A
+// connection that fails a command is dropped and the next command
+// dials a new one.
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxValue bounds the size of the values we accept from a server.
+const maxValue = 1 << 20
+
+// maxRelative is the longest expiry memcached takes as a duration,
+// anything longer is read as a Unix time.
+const maxRelative = 30 * 24 * time.Hour
+
+// Options configure the connections to the servers.
+type Options struct {
+	// PoolSize is how many idle connections are kept per server, 8 if 0.
+	PoolSize int
+	// Timeout bounds dialing and every command's round trip, 1s if 0.
+	Timeout time.Duration
+}
+
+// Error is an error reply of a server, e.g. SERVER_ERROR out of memory.
+type Error string
+
+func (e Error) Error() string { return "memcache: " + string(e) }
+
+// ErrClosed is returned by commands on a closed Client.
+var ErrClosed = errors.New("memcache: client closed")
+
+// Client sends commands to memcached servers, it's safe for concurrent
+// use. Every key is kept on the server its hash picks, so clients
+// sharing the servers must list the same ones in the same order.
+type Client struct {
+	servers []*server
+	opts    Options
+}
+
+// server is the pool of connections to one memcached server.
+type server struct {
+	addr string
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Dial connects to the servers at addrs, checking each is reachable.
+func Dial(addrs []string, opts Options) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("memcache: no servers")
+	}
+	if opts.PoolSize == 0 {
+		opts.PoolSize = 8
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+
+	c := &Client{opts: opts}
+	for _, addr := range addrs {
+		sv := &server{addr: addr}
+		cn, err := c.dial(sv)
+		if err == nil {
+			err = cn.version(opts.Timeout)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("memcache: %s: %v", addr, err)
+		}
+		c.put(sv, cn)
+		c.servers = append(c.servers, sv)
+	}
+	return c, nil
+}
+
+func (c *Client) dial(sv *server) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", sv.addr, c.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
+}
+
+// pick returns the server of key.
+func (c *Client) pick(key string) *server {
+	return c.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.servers))]
+}
+
+// byServer groups keys by their server.
+func (c *Client) byServer(keys []string) map[*server][]string {
+	m := make(map[*server][]string)
+	for _, key := range keys {
+		sv := c.pick(key)
+		m[sv] = append(m[sv], key)
+	}
+	return m
+}
+
+// get takes an idle connection to sv, or dials one.
+func (c *Client) get(sv *server) (*conn, error) {
+	sv.mu.Lock()
+	if sv.closed {
+		sv.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(sv.idle); n > 0 {
+		cn := sv.idle[n-1]
+		sv.idle = sv.idle[:n-1]
+		sv.mu.Unlock()
+		return cn, nil
+	}
+	sv.mu.Unlock()
+	return c.dial(sv)
+}
+
+// put returns a connection to the pool of sv, closing it if the pool is
+// full.
+func (c *Client) put(sv *server, cn *conn) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.closed || len(sv.idle) >= c.opts.PoolSize {
+		cn.c.Close()
+		return
+	}
+	sv.idle = append(sv.idle, cn)
+}
+
+// do runs f on a connection to sv. The connection goes back to the pool
+// unless f failed other than with an Error reply.
+func (c *Client) do(sv *server, f func(cn *conn) error) error {
+	cn, err := c.get(sv)
+	if err != nil {
+		return err
+	}
+	cn.c.SetDeadline(time.Now().Add(c.opts.Timeout))
+	err = f(cn)
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection is out of sync or broken, don't reuse it.
+		cn.c.Close()
+		return fmt.Errorf("memcache: %s: %v", sv.addr, err)
+	}
+	c.put(sv, cn)
+	return err
+}
+
+// Get returns the values of the keys found, one round trip per server.
+func (c *Client) Get(keys ...string) (map[string][]byte, error) {
+	found := make(map[string][]byte)
+	for sv, keys := range c.byServer(keys) {
+		err := c.do(sv, func(cn *conn) error {
+			fmt.Fprintf(cn.w, "get %s\r\n", strings.Join(keys, " "))
+			if err := cn.w.Flush(); err != nil {
+				return err
+			}
+			return cn.values(found)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// Set stores value under every key for ttl, for good if 0. The sets of
+// a server go out in one write, one round trip per server.
+func (c *Client) Set(ttl time.Duration, value []byte, keys ...string) error {
+	exp := int64(ttl / time.Second)
+	if ttl > maxRelative {
+		exp = time.Now().Add(ttl).Unix()
+	}
+	for sv, keys := range c.byServer(keys) {
+		err := c.do(sv, func(cn *conn) error {
+			for _, key := range keys {
+				fmt.Fprintf(cn.w, "set %s 0 %d %d\r\n", key, exp, len(value))
+				cn.w.Write(value)
+				cn.w.WriteString("\r\n")
+			}
+			if err := cn.w.Flush(); err != nil {
+				return err
+			}
+			var rerr error
+			for range keys {
+				if err := cn.expect("STORED"); err != nil {
+					if _, ok := err.(Error); !ok {
+						return err
+					}
+					rerr = err
+				}
+			}
+			return rerr
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes key, it's not an error if it isn't there.
+func (c *Client) Delete(key string) error {
+	return c.do(c.pick(key), func(cn *conn) error {
+		fmt.Fprintf(cn.w, "delete %s\r\n", key)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		err := cn.expect("DELETED")
+		if err == Error("NOT_FOUND") {
+			return nil
+		}
+		return err
+	})
+}
+
+// Close closes the idle connections, commands in flight finish first.
+func (c *Client) Close() error {
+	for _, sv := range c.servers {
+		sv.mu.Lock()
+		sv.closed = true
+		for _, cn := range sv.idle {
+			cn.c.Close()
+		}
+		sv.idle = nil
+		sv.mu.Unlock()
+	}
+	return nil
+}
+
+// version checks the server answers.
+func (cn *conn) version(timeout time.Duration) error {
+	cn.c.SetDeadline(time.Now().Add(timeout))
+	cn.w.WriteString("version\r\n")
+	if err := cn.w.Flush(); err != nil {
+		return err
+	}
+	line, err := cn.line()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return Error(line)
+	}
+	return nil
+}
+
+// values reads the VALUE replies of a get up to END into found.
+func (cn *conn) values(found map[string][]byte) error {
+	for {
+		line, err := cn.line()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes>
+		f := strings.Fields(line)
+		if len(f) != 4 || f[0] != "VALUE" {
+			return fmt.Errorf("memcache: get replied %q", line)
+		}
+		n, err := strconv.Atoi(f[3])
+		if err != nil || n < 0 || n > maxValue {
+			return fmt.Errorf("memcache: malformed value length %q", line)
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(cn.r, b); err != nil {
+			return err
+		}
+		found[f[1]] = b[:n]
+	}
+}
+
+// expect reads a reply that must be want, any other one is an Error.
+func (cn *conn) expect(want string) error {
+	line, err := cn.line()
+	if err != nil {
+		return err
+	}
+	if line != want {
+		return Error(line)
+	}
+	return nil
+}
+
+// line reads a CRLF terminated line, without the CRLF.
+func (cn *conn) line() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("memcache: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,337 @@
+// Package mqtt is a minimal MQTT 3.1.1 subscriber.
+//
+// It only does what the server's ingestion bridge needs: connect,
+// subscribe at QoS 0 or 1, receive publishes and keep the session alive.
+// There's no publishing, no QoS 2 and no session persistence; a
+// broken connection is reported and the caller reconnects.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Control packet types.
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// maxPacket bounds the size of packets we accept from the broker.
+const maxPacket = 1 << 20
+
+// Options configure a connection to the broker.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive is the keep alive interval announced to the broker.
+	KeepAlive time.Duration
+	// Timeout bounds connecting and the CONNACK/SUBACK round trips.
+	Timeout time.Duration
+}
+
+// Message is a received publish.
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client is a connection to an MQTT broker.
+type Client struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	wmu       sync.Mutex
+	keepAlive time.Duration
+	nextID    uint16
+	// pending holds publishes that arrived before the SUBACK.
+	pending []Message
+	// lastFlags are the header flags of the last packet read.
+	lastFlags byte
+	done      chan bool
+	once      sync.Once
+}
+
+// Dial connects to the broker at addr and completes the MQTT handshake.
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		keepAlive: opts.KeepAlive,
+		done:      make(chan bool),
+	}
+
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = appendString(payload, opts.ClientID)
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendString(payload, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		payload = appendString(payload, opts.Password)
+	}
+
+	var vh []byte
+	vh = appendString(vh, "MQTT")
+	vh = append(vh, 4, flags)
+	vh = binary.BigEndian.AppendUint16(vh, uint16(opts.KeepAlive/time.Second))
+
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	if err = c.write(typeConnect<<4, append(vh, payload...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	typ, body, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read CONNACK: %v", err)
+	}
+	if typ != typeConnack || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("expected CONNACK, got packet type %d", typ)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by broker, return code %d", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// Subscribe subscribes to topics at the given QoS (0 or 1)
+// and waits for the broker to acknowledge.
+func (c *Client) Subscribe(topics []string, qos byte) error {
+	if qos > 1 {
+		return errors.New("only QoS 0 and 1 are supported")
+	}
+
+	c.nextID++
+	id := c.nextID
+
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, t := range topics {
+		body = appendString(body, t)
+		body = append(body, qos)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.write(typeSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return fmt.Errorf("could not read SUBACK: %v", err)
+		}
+
+		switch typ {
+		case typePublish:
+			msg, err := c.handlePublish(body)
+			if err != nil {
+				return err
+			}
+			c.pending = append(c.pending, msg)
+		case typeSuback:
+			if len(body) < 2 || binary.BigEndian.Uint16(body) != id {
+				return errors.New("SUBACK for unknown subscription")
+			}
+			for i, code := range body[2:] {
+				if code == 0x80 && i < len(topics) {
+					return fmt.Errorf("subscription to %q refused", topics[i])
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// Run delivers messages to handle until the connection breaks or is closed.
+// It also keeps the session alive, so it must be running for the
+// broker not to drop the client.
+func (c *Client) Run(handle func(Message)) error {
+	for _, msg := range c.pending {
+		handle(msg)
+	}
+	c.pending = nil
+
+	go c.pinger()
+
+	for {
+		// Missing a couple of PINGRESPs means the broker is gone.
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+
+		typ, body, err := c.read()
+		if err != nil {
+			select {
+			case <-c.done:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if typ == typePublish {
+			msg, err := c.handlePublish(body)
+			if err != nil {
+				return err
+			}
+			handle(msg)
+		}
+	}
+}
+
+func (c *Client) pinger() {
+	t := time.NewTicker(c.keepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if c.write(typePingreq<<4, nil) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handlePublish decodes a PUBLISH and acknowledges it if it's QoS 1.
+func (c *Client) handlePublish(body []byte) (msg Message, err error) {
+	flags := c.lastFlags
+	topic, rest, err := readString(body)
+	if err != nil {
+		return
+	}
+
+	qos := (flags >> 1) & 0x3
+	if qos > 0 {
+		if len(rest) < 2 {
+			return msg, errors.New("PUBLISH without packet id")
+		}
+		id := rest[:2]
+		rest = rest[2:]
+		if err = c.write(typePuback<<4, id); err != nil {
+			return
+		}
+	}
+
+	return Message{Topic: topic, Payload: rest}, nil
+}
+
+// Close disconnects from the broker.
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.write(typeDisconnect<<4, nil)
+	})
+	return c.conn.Close()
+}
+
+func (c *Client) write(header byte, body []byte) error {
+	pkt := []byte{header}
+	pkt = appendLength(pkt, len(body))
+	pkt = append(pkt, body...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+// read reads the next packet, returning its type and body.
+// The header flags of the last packet are kept in lastFlags.
+func (c *Client) read() (typ byte, body []byte, err error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	if n > maxPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes too large", n)
+	}
+
+	body = make([]byte, n)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		return
+	}
+
+	c.lastFlags = header & 0x0f
+	return header >> 4, body, nil
+}
+
+func appendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (s string, rest []byte, err error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
@@ -0,0 +1,258 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker hands the connection of every client to the test, which
+// plays the broker packet by packet.
+type fakeBroker struct {
+	l     net.Listener
+	conns chan net.Conn
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, conns: make(chan net.Conn, 1)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+		}
+	}()
+	return b
+}
+
+// brokerConn is the broker's side of a client connection.
+type brokerConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (b *fakeBroker) accept(t *testing.T) *brokerConn {
+	t.Helper()
+	select {
+	case conn := <-b.conns:
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return &brokerConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't connect")
+		return nil
+	}
+}
+
+// read reads the next packet of the client, with its header.
+func (c *brokerConn) read() (header byte, body []byte) {
+	c.t.Helper()
+	cl := &Client{r: c.r}
+	typ, body, err := cl.read()
+	if err != nil {
+		c.t.Fatalf("could not read the client's packet: %v", err)
+	}
+	return typ<<4 | cl.lastFlags, body
+}
+
+func (c *brokerConn) write(header byte, body []byte) {
+	pkt := appendLength([]byte{header}, len(body))
+	c.conn.Write(append(pkt, body...))
+}
+
+// publish sends a PUBLISH of payload to topic at QoS 1 as packet id.
+func (c *brokerConn) publish(topic, payload string, id uint16) {
+	body := appendString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, id)
+	c.write(typePublish<<4|0x02, append(body, payload...))
+}
+
+// dial connects a client to the broker, which takes it with code.
+func dial(t *testing.T, b *fakeBroker, opts Options, code byte) (*Client, *brokerConn, error) {
+	t.Helper()
+	type dialed struct {
+		c   *Client
+		err error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		c, err := Dial(b.l.Addr().String(), opts)
+		done <- dialed{c, err}
+	}()
+	bc := b.accept(t)
+	if header, body := bc.read(); header != typeConnect<<4 {
+		t.Fatalf("got packet %#x, want CONNECT", header)
+	} else if want := "\x00\x04MQTT\x04\xc2\x00\x3c\x00\x07numbers\x00\x04user\x00\x06secret"; string(body) != want {
+		t.Errorf("CONNECT %q, want %q", body, want)
+	}
+	bc.write(typeConnack<<4, []byte{0, code})
+	d := <-done
+	if d.err == nil {
+		t.Cleanup(func() { d.c.Close() })
+	}
+	return d.c, bc, d.err
+}
+
+var testOptions = Options{ClientID: "numbers", Username: "user", Password: "secret", KeepAlive: time.Minute}
+
+func TestSubscribe(t *testing.T) {
+	b := newFakeBroker(t)
+	c, bc, err := dial(t, b, testOptions, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribed := make(chan error, 1)
+	go func() { subscribed <- c.Subscribe([]string{"numbers/#", "orders"}, 1) }()
+	header, body := bc.read()
+	if header != typeSubscribe<<4|0x02 {
+		t.Fatalf("got packet %#x, want SUBSCRIBE", header)
+	}
+	if want := "\x00\x01\x00\x09numbers/#\x01\x00\x06orders\x01"; string(body) != want {
+		t.Errorf("SUBSCRIBE %q, want %q", body, want)
+	}
+	// A publish before the SUBACK is delivered once Run starts.
+	bc.publish("numbers/a", "1234567890", 7)
+	if header, body := bc.read(); header != typePuback<<4 || string(body) != "\x00\x07" {
+		t.Errorf("got packet %#x %q, want the PUBACK of 7", header, body)
+	}
+	bc.write(typeSuback<<4, []byte{0, 1, 1, 1})
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan Message, 10)
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run(func(m Message) { msgs <- m }) }()
+	// At QoS 0 there's nothing to ack.
+	bc.write(typePublish<<4, append(appendString(nil, "orders"), "1234567891"...))
+	bc.publish("numbers/b", "1234567892", 8)
+	if header, body := bc.read(); header != typePuback<<4 || string(body) != "\x00\x08" {
+		t.Errorf("got packet %#x %q, want the PUBACK of 8", header, body)
+	}
+	var got []string
+	for range 3 {
+		select {
+		case m := <-msgs:
+			got = append(got, m.Topic+" "+string(m.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatal("a message wasn't delivered")
+		}
+	}
+	if want := "numbers/a 1234567890|orders 1234567891|numbers/b 1234567892"; strings.Join(got, "|") != want {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+
+	// Closing says goodbye and ends Run without an error.
+	c.Close()
+	if header, _ := bc.read(); header != typeDisconnect<<4 {
+		t.Errorf("got packet %#x, want DISCONNECT", header)
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("Run = %v after Close, want nil", err)
+	}
+}
+
+func TestRunBrokerGone(t *testing.T) {
+	b := newFakeBroker(t)
+	c, bc, err := dial(t, b, testOptions, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run(func(Message) {}) }()
+	bc.conn.Close()
+	select {
+	case err := <-ran:
+		if err == nil {
+			t.Error("Run = nil with the broker gone, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return with the broker gone")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	b := newFakeBroker(t)
+	opts := testOptions
+	opts.KeepAlive = 200 * time.Millisecond
+	done := make(chan *Client, 1)
+	go func() {
+		c, err := Dial(b.l.Addr().String(), opts)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c
+	}()
+	bc := b.accept(t)
+	bc.read()
+	bc.write(typeConnack<<4, []byte{0, 0})
+	c := <-done
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run(func(Message) {}) }()
+	if header, _ := bc.read(); header != typePingreq<<4 {
+		t.Fatalf("got packet %#x, want PINGREQ", header)
+	}
+	// Without PINGRESPs the broker counts as gone.
+	select {
+	case err := <-ran:
+		if err == nil {
+			t.Error("Run = nil with no PINGRESP, want a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't time out without PINGRESPs")
+	}
+}
+
+func TestRefused(t *testing.T) {
+	b := newFakeBroker(t)
+	// Not authorized.
+	if _, _, err := dial(t, b, testOptions, 5); err == nil || !strings.Contains(err.Error(), "return code 5") {
+		t.Errorf("Dial = %v, want refused with return code 5", err)
+	}
+
+	c, bc, err := dial(t, b, testOptions, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe([]string{"x"}, 2); err == nil {
+		t.Error("Subscribe took QoS 2")
+	}
+	subscribed := make(chan error, 1)
+	go func() { subscribed <- c.Subscribe([]string{"numbers/#", "$SYS/#"}, 0) }()
+	bc.read()
+	bc.write(typeSuback<<4, []byte{0, 1, 0, 0x80})
+	if err := <-subscribed; err == nil || !strings.Contains(err.Error(), `"$SYS/#" refused`) {
+		t.Errorf("Subscribe = %v, want $SYS/# refused", err)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	for name, pkt := range map[string]string{
+		"length":    "\x30\xff\xff\xff\xff\x01",
+		"too large": "\x30\xff\xff\xff\x7f",
+		"truncated": "\x30\x05ab",
+	} {
+		c := &Client{r: bufio.NewReader(strings.NewReader(pkt))}
+		if _, _, err := c.read(); err == nil {
+			t.Errorf("%s: read = %v, want an error", name, err)
+		}
+	}
+}
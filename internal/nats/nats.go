@@ -0,0 +1,196 @@
+// Package nats is a minimal NATS publisher.
+//
+// It only does what the server's nats sink needs: connect, with a user
+// and password if the server wants them, publish and answer the
+// server's PINGs. There's no subscribing, JetStream or TLS; a broken
+// connection is reported and the caller reconnects.
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configure the connection to the server.
+type Options struct {
+	// Name is the client name the server shows in its monitoring.
+	Name     string
+	User     string
+	Password string
+	// Timeout bounds dialing, the handshake and every Flush, 5s if 0.
+	Timeout time.Duration
+}
+
+// Error is an -ERR of the server, e.g. 'Authorization Violation'.
+type Error string
+
+func (e Error) Error() string { return "nats: " + string(e) }
+
+// ErrClosed is returned by a Client that's been closed.
+var ErrClosed = errors.New("nats: client closed")
+
+// Client is a connection to a NATS server, it's safe for concurrent use.
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// err is what broke the connection, sticky.
+	err error
+}
+
+// connectInfo is the CONNECT the client introduces itself with.
+type connectInfo struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+}
+
+// Dial connects to the server at addr and waits for it to take the
+// CONNECT, so a wrong password is reported here.
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), timeout: opts.Timeout}
+
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	if line, err := c.line(); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("nats: expected INFO, got %q: %v", line, err)
+	}
+
+	info, _ := json.Marshal(connectInfo{Name: opts.Name, User: opts.User, Pass: opts.Password, Lang: "go", Version: "0"})
+	c.w.WriteString("CONNECT " + string(info) + "\r\nPING\r\n")
+	if err = c.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The PONG to our PING means the CONNECT went through.
+	for {
+		line, err := c.line()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, serverError(line)
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+// Publish queues a message on subject, it goes out with the next Flush,
+// or once the buffer is full.
+func (c *Client) Publish(subject string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.w.WriteString("PUB " + subject + " " + strconv.Itoa(len(payload)) + "\r\n")
+	c.w.Write(payload)
+	_, err := c.w.WriteString("\r\n")
+	return c.fail(err)
+}
+
+// Flush writes out the queued messages.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.fail(c.w.Flush())
+}
+
+// Close flushes the queued messages and hangs up.
+func (c *Client) Close() error {
+	err := c.Flush()
+	c.mu.Lock()
+	c.err = ErrClosed
+	c.mu.Unlock()
+	c.conn.Close()
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// fail makes err, if any, what the client fails with from now on.
+// c.mu must be held.
+func (c *Client) fail(err error) error {
+	if err != nil && c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	return err
+}
+
+// readLoop answers the server's PINGs and takes note of its errors,
+// until the connection breaks.
+func (c *Client) readLoop() {
+	for {
+		line, err := c.line()
+		if err != nil {
+			c.mu.Lock()
+			c.fail(err)
+			c.mu.Unlock()
+			return
+		}
+		switch {
+		case line == "PING":
+			c.mu.Lock()
+			if c.err == nil {
+				c.w.WriteString("PONG\r\n")
+				c.fail(c.w.Flush())
+			}
+			c.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			// The server hangs up after most errors, fail on all of
+			// them, so the caller reconnects.
+			c.mu.Lock()
+			c.fail(serverError(line))
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// line reads a CRLF terminated line, without the CRLF.
+func (c *Client) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func serverError(line string) Error {
+	return Error(strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+}
@@ -0,0 +1,170 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a NATS server that wants the password secret, it keeps
+// what's published and pings every client once it's connected.
+type fakeServer struct {
+	l net.Listener
+
+	mu        sync.Mutex
+	published []string
+	connected []connectInfo
+	ponged    chan struct{}
+	// conns are the open connections, to send them errors.
+	conns []net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeServer{l: l, ponged: make(chan struct{}, 10)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	io.WriteString(conn, `INFO {"server_id":"fake","auth_required":true,"max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, args, _ := strings.Cut(line, " ")
+		switch verb {
+		case "CONNECT":
+			var info connectInfo
+			json.Unmarshal([]byte(args), &info)
+			if info.Pass != "secret" {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+			f.mu.Lock()
+			f.connected = append(f.connected, info)
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+		case "PING":
+			io.WriteString(conn, "PONG\r\nPING\r\n")
+		case "PONG":
+			f.ponged <- struct{}{}
+		case "PUB":
+			fields := strings.Fields(args)
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.published = append(f.published, fields[0]+" "+string(payload[:n]))
+			f.mu.Unlock()
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	f := newFakeServer(t)
+	c, err := Dial(f.l.Addr().String(), Options{Name: "numbers", User: "numbers", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The server's PING is answered.
+	select {
+	case <-f.ponged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server's PING wasn't answered")
+	}
+
+	c.Publish("numbers.data", []byte("1234567890"))
+	c.Publish("numbers.orders", []byte("line\r\nbreak"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("numbers.data", nil); err != ErrClosed {
+		t.Errorf("Publish after Close = %v, want ErrClosed", err)
+	}
+
+	want := []string{"numbers.data 1234567890", "numbers.orders line\r\nbreak"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		got := append([]string(nil), f.published...)
+		info := f.connected[0]
+		f.mu.Unlock()
+		if len(got) == len(want) || time.Now().After(deadline) {
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("published %q, want %q", got, want)
+			}
+			if info.Name != "numbers" || info.User != "numbers" || info.Verbose {
+				t.Errorf("CONNECT %+v, want the name and user, not verbose", info)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialBadPassword(t *testing.T) {
+	f := newFakeServer(t)
+	_, err := Dial(f.l.Addr().String(), Options{User: "numbers", Password: "wrong"})
+	var e Error
+	if !errors.As(err, &e) || e != "Authorization Violation" {
+		t.Errorf("err = %v, want the server's Authorization Violation", err)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	f := newFakeServer(t)
+	c, err := Dial(f.l.Addr().String(), Options{Password: "secret", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-f.ponged
+
+	f.mu.Lock()
+	io.WriteString(f.conns[0], "-ERR 'Maximum Payload Violation'\r\n")
+	f.mu.Unlock()
+	// The error is sticky once the read loop saw it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = c.Publish("numbers.data", []byte("1234567890"))
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e, ok := err.(Error); !ok || e != "Maximum Payload Violation" {
+		t.Errorf("Publish = %v, want the server's error", err)
+	}
+	if err := c.Flush(); err == nil {
+		t.Error("Flush succeeded on a failed connection")
+	}
+}
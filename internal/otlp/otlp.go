@@ -0,0 +1,379 @@
+// Package otlp is a minimal OpenTelemetry trace exporter.
+//
+// It only does what the server's connection tracing needs: queue
+// finished spans and post them in batches to a collector as OTLP/HTTP
+// with JSON encoding. There's no gRPC or protobuf, no metrics or logs,
+// and no retries; a batch the collector doesn't take is dropped and
+// counted, so a slow or missing collector never holds up the caller.
+package otlp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds.
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// Options configure the exporter.
+type Options struct {
+	// Endpoint is the URL spans are posted to, e.g.
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	// Headers are sent with every request, e.g. for authentication.
+	Headers map[string]string
+	// Service is the service.name of the spans.
+	Service string
+	// Timeout bounds every request, 10s if 0.
+	Timeout time.Duration
+	// Batch is the most spans sent in one request, 512 if 0,
+	// Interval how long a partial batch waits, 5s if 0.
+	Batch    int
+	Interval time.Duration
+	// Queue is how many spans wait to be sent, 2048 if 0,
+	// more are dropped.
+	Queue int
+}
+
+// TraceID and SpanID identify spans, the zero SpanID is no parent.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// NewTraceID returns a random trace id.
+func NewTraceID() (id TraceID) {
+	rand.Read(id[:])
+	return
+}
+
+// NewSpanID returns a random span id.
+func NewSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return
+}
+
+// Span is a finished span.
+type Span struct {
+	Trace  TraceID
+	ID     SpanID
+	Parent SpanID
+	Name   string
+	Kind   int
+	Start  time.Time
+	End    time.Time
+	// Attrs are the span's attributes, string, bool, int, int64 or float64.
+	Attrs map[string]interface{}
+	// Err marks the span failed, with this message.
+	Err string
+}
+
+// Exporter sends spans in the background, it's safe for concurrent use.
+type Exporter struct {
+	opts    Options
+	client  *http.Client
+	queue   chan Span
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	dropped int64
+}
+
+// New starts an exporter sending to opts.Endpoint.
+func New(opts Options) (*Exporter, error) {
+	if _, err := url.ParseRequestURI(opts.Endpoint); err != nil {
+		return nil, fmt.Errorf("otlp: bad endpoint: %v", err)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Batch == 0 {
+		opts.Batch = 512
+	}
+	if opts.Interval == 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.Queue == 0 {
+		opts.Queue = 2048
+	}
+
+	e := &Exporter{
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		queue:   make(chan Span, opts.Queue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Export queues a span, it's dropped if the queue is full.
+func (e *Exporter) Export(s Span) {
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns how many spans were never delivered,
+// queued too many or refused by the collector.
+func (e *Exporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Close sends the spans still queued and stops the exporter.
+// Spans exported after Close are lost.
+func (e *Exporter) Close() error {
+	e.once.Do(func() { close(e.done) })
+	<-e.stopped
+	return nil
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+	tick := time.NewTicker(e.opts.Interval)
+	defer tick.Stop()
+
+	var batch []Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			atomic.AddInt64(&e.dropped, int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= e.opts.Batch {
+				send()
+			}
+		case <-tick.C:
+			send()
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					if batch = append(batch, s); len(batch) >= e.opts.Batch {
+						send()
+					}
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
+
+// The OTLP/HTTP JSON request, see opentelemetry-proto.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []jsonSpan `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	jsonSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []keyValue `json:"attributes,omitempty"`
+		Status       *status    `json:"status,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+// value is an attribute value in the JSON encoding,
+// 64 bit integers are strings there.
+func value(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func (e *Exporter) send(batch []Span) error {
+	spans := make([]jsonSpan, len(batch))
+	for i, s := range batch {
+		js := jsonSpan{
+			TraceID: hex.EncodeToString(s.Trace[:]),
+			SpanID:  hex.EncodeToString(s.ID[:]),
+			Name:    s.Name,
+			Kind:    s.Kind,
+			Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			js.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for k, v := range s.Attrs {
+			js.Attributes = append(js.Attributes, keyValue{Key: k, Value: value(v)})
+		}
+		if s.Err != "" {
+			js.Status = &status{Code: 2, Message: s.Err}
+		}
+		spans[i] = js
+	}
+
+	body, err := json.Marshal(exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{{Key: "service.name", Value: value(e.opts.Service)}}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "go-simple-tcp-server"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+// FromEnv reads the standard OTEL_* environment variables of the
+// trace exporter. ok is false if no endpoint is set, or the SDK is
+// disabled with OTEL_SDK_DISABLED. ratio is the sampling ratio of
+// OTEL_TRACES_SAMPLER, 1 unless it's traceidratio or always_off.
+func FromEnv() (opts Options, ratio float64, ok bool, err error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return
+	}
+
+	opts.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if opts.Endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return
+		}
+		opts.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	proto := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if proto == "" {
+		proto = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if proto != "" && proto != "http/json" {
+		return opts, 0, false, fmt.Errorf("otlp: protocol %s isn't supported, only http/json", proto)
+	}
+
+	headers := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")
+	if headers == "" {
+		headers = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	}
+	if opts.Headers, err = parseHeaders(headers); err != nil {
+		return opts, 0, false, err
+	}
+
+	timeout := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT")
+	if timeout == "" {
+		timeout = os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT")
+	}
+	if timeout != "" {
+		ms, err := strconv.Atoi(timeout)
+		if err != nil {
+			return opts, 0, false, fmt.Errorf("otlp: bad timeout %q", timeout)
+		}
+		opts.Timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	opts.Service = os.Getenv("OTEL_SERVICE_NAME")
+
+	ratio = 1
+	switch s := os.Getenv("OTEL_TRACES_SAMPLER"); s {
+	case "", "always_on", "parentbased_always_on":
+	case "always_off", "parentbased_always_off":
+		ratio = 0
+	case "traceidratio", "parentbased_traceidratio":
+		if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+			if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+				return opts, 0, false, fmt.Errorf("otlp: bad sampler ratio %q", arg)
+			}
+		}
+	default:
+		return opts, 0, false, fmt.Errorf("otlp: sampler %s isn't supported", s)
+	}
+	return opts, ratio, true, nil
+}
+
+// parseHeaders parses the key=value,key=value list of the headers
+// variables, the values are URL encoded.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("otlp: bad header %q", kv)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("otlp: bad header %q: %v", kv, err)
+		}
+		headers[strings.TrimSpace(kv[:i])] = v
+	}
+	return headers, nil
+}
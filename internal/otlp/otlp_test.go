@@ -0,0 +1,251 @@
+package otlp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCollector keeps the export requests posted to it and answers
+// them with status.
+type fakeCollector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []exportRequest
+	headers  []http.Header
+	paths    []string
+	status   int
+}
+
+func newFakeCollector(t *testing.T, status int) *fakeCollector {
+	t.Helper()
+	c := &fakeCollector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req exportRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("the collector got %q: %v", body, err)
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.headers = append(c.headers, r.Header)
+		c.paths = append(c.paths, r.Method+" "+r.URL.Path)
+		c.mu.Unlock()
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestExport(t *testing.T) {
+	c := newFakeCollector(t, http.StatusOK)
+	e, err := New(Options{
+		Endpoint: c.URL + "/v1/traces",
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		Service:  "numbers",
+		Batch:    2,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	conn := SpanID{0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0x10, 0x11}
+	start := time.Unix(1700000000, 5)
+	e.Export(Span{
+		Trace: trace, ID: conn, Name: "conn", Kind: KindServer,
+		Start: start, End: start.Add(time.Second),
+		Attrs: map[string]interface{}{"peer": "127.0.0.1", "tls": true, "values": 3, "bytes": int64(1) << 40, "rate": 0.5},
+	})
+	e.Export(Span{Trace: trace, ID: SpanID{1}, Parent: conn, Name: "write", Kind: KindInternal, Start: start, End: start, Err: "disk full"})
+	// A partial batch is sent on Close.
+	e.Export(Span{Trace: trace, ID: SpanID{2}, Name: "drain", Start: start, End: start})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Dropped(); n != 0 {
+		t.Errorf("Dropped = %d, want 0", n)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(c.requests))
+	}
+	for i, h := range c.headers {
+		if c.paths[i] != "POST /v1/traces" || h.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer secret" {
+			t.Errorf("request %d: %s %v, want a JSON POST to /v1/traces with the headers", i, c.paths[i], h)
+		}
+	}
+
+	rs := c.requests[0].ResourceSpans[0]
+	if want := []keyValue{{"service.name", map[string]interface{}{"stringValue": "numbers"}}}; !reflect.DeepEqual(rs.Resource.Attributes, want) {
+		t.Errorf("resource %+v, want %+v", rs.Resource.Attributes, want)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 || len(c.requests[1].ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("sent batches of %d and more spans, want 2 and 1", len(spans))
+	}
+	s := spans[0]
+	if s.TraceID != "0102030405060708090a0b0c0d0e0f10" || s.SpanID != "0a0b0c0d0e0f1011" || s.ParentSpanID != "" ||
+		s.Kind != KindServer || s.Start != "1700000000000000005" || s.End != "1700000001000000005" || s.Status != nil {
+		t.Errorf("span %+v", s)
+	}
+	attrs := make(map[string]map[string]interface{})
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	want := map[string]map[string]interface{}{
+		"peer":   {"stringValue": "127.0.0.1"},
+		"tls":    {"boolValue": true},
+		"values": {"intValue": "3"},
+		"bytes":  {"intValue": "1099511627776"},
+		"rate":   {"doubleValue": 0.5},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("attributes %v, want %v", attrs, want)
+	}
+	if s := spans[1]; s.ParentSpanID != "0a0b0c0d0e0f1011" || s.Status == nil || *s.Status != (status{2, "disk full"}) {
+		t.Errorf("child span %+v, want the parent and an error status", s)
+	}
+}
+
+func TestExportRefused(t *testing.T) {
+	c := newFakeCollector(t, http.StatusServiceUnavailable)
+	e, err := New(Options{Endpoint: c.URL, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		e.Export(Span{Name: "conn"})
+	}
+	e.Close()
+	if n := e.Dropped(); n != 3 {
+		t.Errorf("Dropped = %d, want the 3 spans the collector refused", n)
+	}
+}
+
+func TestNewBadEndpoint(t *testing.T) {
+	if _, err := New(Options{Endpoint: "collector/v1/traces"}); err == nil || !strings.Contains(err.Error(), "bad endpoint") {
+		t.Errorf("New = %v, want a bad endpoint", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		want  Options
+		ratio float64
+		ok    bool
+		err   string
+	}{
+		{name: "unset"},
+		{
+			name:  "base endpoint",
+			env:   map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/"},
+			want:  Options{Endpoint: "http://collector:4318/v1/traces", Headers: map[string]string{}},
+			ratio: 1, ok: true,
+		},
+		{
+			name: "traces settings win",
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318",
+				"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom",
+				"OTEL_EXPORTER_OTLP_HEADERS":         "a=1",
+				"OTEL_EXPORTER_OTLP_TRACES_HEADERS":  " authorization = Bearer%20secret , tenant=numbers,",
+				"OTEL_EXPORTER_OTLP_TIMEOUT":         "1000",
+				"OTEL_EXPORTER_OTLP_TRACES_TIMEOUT":  "250",
+				"OTEL_EXPORTER_OTLP_PROTOCOL":        "http/json",
+				"OTEL_SERVICE_NAME":                  "numbers",
+				"OTEL_TRACES_SAMPLER":                "parentbased_traceidratio",
+				"OTEL_TRACES_SAMPLER_ARG":            "0.25",
+			},
+			want: Options{
+				Endpoint: "http://traces:4318/custom",
+				Headers:  map[string]string{"authorization": "Bearer secret", "tenant": "numbers"},
+				Service:  "numbers",
+				Timeout:  250 * time.Millisecond,
+			},
+			ratio: 0.25, ok: true,
+		},
+		{
+			name: "always off",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_SAMPLER": "always_off"},
+			want: Options{Endpoint: "http://collector:4318/v1/traces", Headers: map[string]string{}},
+			ok:   true,
+		},
+		{
+			name: "disabled",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "TRUE"},
+		},
+		{
+			name: "grpc",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "grpc"},
+			err:  "protocol grpc isn't supported",
+		},
+		{
+			name: "bad header",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_HEADERS": "=x"},
+			err:  `bad header "=x"`,
+		},
+		{
+			name: "bad header escape",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_HEADERS": "a=%zz"},
+			err:  `bad header "a=%zz"`,
+		},
+		{
+			name: "bad timeout",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_TIMEOUT": "10s"},
+			err:  `bad timeout "10s"`,
+		},
+		{
+			name: "bad ratio",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_SAMPLER": "traceidratio", "OTEL_TRACES_SAMPLER_ARG": "2"},
+			err:  `bad sampler ratio "2"`,
+		},
+		{
+			name: "sampler",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_SAMPLER": "jaeger_remote"},
+			err:  "sampler jaeger_remote isn't supported",
+		},
+	}
+	vars := []string{
+		"OTEL_SDK_DISABLED", "OTEL_SERVICE_NAME", "OTEL_TRACES_SAMPLER", "OTEL_TRACES_SAMPLER_ARG",
+		"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+		"OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL",
+		"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS",
+		"OTEL_EXPORTER_OTLP_TIMEOUT", "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, tt.env[v])
+			}
+			opts, ratio, ok, err := FromEnv()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok || ratio != tt.ratio {
+				t.Errorf("ratio, ok = %v, %v, want %v, %v", ratio, ok, tt.ratio, tt.ok)
+			}
+			if ok && !reflect.DeepEqual(opts, tt.want) {
+				t.Errorf("FromEnv = %+v, want %+v", opts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,630 @@
+// Package postgres is a minimal PostgreSQL client.
+//
+// It only does what the server's postgres dedup store needs: connect
+// over the version 3 protocol, with TLS and cleartext, MD5 or
+// SCRAM-SHA-256 passwords, and run statements with text parameters,
+// each prepared once per connection, over a small pool of connections
+// so concurrent callers don't wait on each other's round trips. There's
+// no COPY, LISTEN, cancellation or binary format; a connection that
+// fails a statement other than with an error of the server is dropped
+// and the next statement dials a new one.
+package postgres
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMessage bounds the size of messages we accept from the server.
+const maxMessage = 1 << 20
+
+// protocolVersion is 3.0, sslRequestCode asks for TLS, see the
+// frontend/backend protocol's message formats.
+const (
+	protocolVersion = 3 << 16
+	sslRequestCode  = 80877103
+)
+
+// Options configure the connections to the server.
+type Options struct {
+	// Password is used if the URL has none.
+	Password string
+	// PoolSize is how many idle connections are kept, 8 if 0.
+	PoolSize int
+	// Timeout bounds dialing, the handshake and every statement's
+	// round trip, 5s if 0.
+	Timeout time.Duration
+}
+
+// Error is an ErrorResponse of the server, e.g. a unique violation.
+type Error struct {
+	Severity string
+	// Code is the SQLSTATE, e.g. 23505.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("postgres: %s %s: %s", e.Severity, e.Code, e.Message)
+}
+
+// ErrClosed is returned by statements on a closed Client.
+var ErrClosed = errors.New("postgres: client closed")
+
+// UncertainError is a failure after a statement was sent, e.g. a
+// timeout waiting for its result: the server may or may not have run
+// and committed it.
+type UncertainError struct {
+	Query string
+	Err   error
+}
+
+func (e *UncertainError) Error() string {
+	return fmt.Sprintf("postgres: no result of %q: %v", e.Query, e.Err)
+}
+
+func (e *UncertainError) Unwrap() error { return e.Err }
+
+// Result is what a statement returned: its rows, every column as
+// text, and its command tag, e.g. "INSERT 0 1".
+type Result struct {
+	Rows [][]string
+	Tag  string
+}
+
+// Affected is the number of rows the command tag says were affected.
+func (r Result) Affected() int {
+	f := strings.Fields(r.Tag)
+	if len(f) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(f[len(f)-1])
+	return n
+}
+
+// Client runs statements on a PostgreSQL server, it's safe for
+// concurrent use.
+type Client struct {
+	addr     string
+	user     string
+	password string
+	database string
+	tls      *tls.Config
+	opts     Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+	// prepared are the statements prepared on the connection by query,
+	// the name is their number.
+	prepared map[string]string
+}
+
+// Dial connects to the server of a postgres:// URL, e.g.
+// postgres://numbers@db:5432/numbers?sslmode=require, checking it's
+// reachable and the credentials are right. sslmode is disable, the
+// default, require, which doesn't check the certificate, or
+// verify-full.
+func Dial(rawURL string, opts Options) (*Client, error) {
+	if opts.PoolSize == 0 {
+		opts.PoolSize = 8
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return nil, fmt.Errorf("postgres: bad URL, want postgres://user@host:port/database")
+	}
+	c := &Client{
+		addr:     u.Host,
+		user:     u.User.Username(),
+		password: opts.Password,
+		database: strings.TrimPrefix(u.Path, "/"),
+		opts:     opts,
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	if p, ok := u.User.Password(); ok {
+		c.password = p
+	}
+	if c.user == "" {
+		return nil, fmt.Errorf("postgres: the URL has no user")
+	}
+	if c.database == "" {
+		c.database = c.user
+	}
+	switch mode := u.Query().Get("sslmode"); mode {
+	case "", "disable":
+	case "require":
+		// Like libpq, require encrypts without checking who's at the other end.
+		c.tls = &tls.Config{InsecureSkipVerify: true}
+	case "verify-full":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("postgres: unknown sslmode %q, must be disable, require or verify-full", mode)
+	}
+
+	cn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.put(cn)
+	return c, nil
+}
+
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, c.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(c.opts.Timeout))
+
+	if c.tls != nil {
+		if nc, err = startTLS(nc, c.tls); err != nil {
+			return nil, err
+		}
+	}
+	cn := &conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), prepared: make(map[string]string)}
+	if err = cn.startup(c.user, c.password, c.database); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// startTLS asks the server to switch nc to TLS.
+func startTLS(nc net.Conn, cfg *tls.Config) (net.Conn, error) {
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], sslRequestCode)
+	if _, err := nc.Write(req[:]); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(nc, answer[:]); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		nc.Close()
+		return nil, fmt.Errorf("postgres: the server doesn't do TLS")
+	}
+	tc := tls.Client(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("postgres: TLS handshake failed: %v", err)
+	}
+	return tc, nil
+}
+
+// startup sends the startup message and authenticates, until the
+// server is ready for statements.
+func (cn *conn) startup(user, password, database string) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, protocolVersion)
+	for _, kv := range []string{"user", user, "database", database, "application_name", "go-simple-tcp-server"} {
+		b = append(append(b, kv...), 0)
+	}
+	b = append(b, 0)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	if _, err := cn.w.Write(b); err != nil {
+		return err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, msg, err := cn.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(msg) < 4 {
+				return fmt.Errorf("postgres: malformed authentication request")
+			}
+			switch code, data := binary.BigEndian.Uint32(msg), msg[4:]; code {
+			case 0:
+			case 3:
+				err = cn.sendPassword(password)
+			case 5:
+				if len(data) < 4 {
+					return fmt.Errorf("postgres: malformed MD5 salt")
+				}
+				err = cn.sendPassword(md5Password(user, password, data[:4]))
+			case 10:
+				if !hasMechanism(data, "SCRAM-SHA-256") {
+					return fmt.Errorf("postgres: no supported SASL mechanism")
+				}
+				scram = newSCRAM(password)
+				err = cn.sendSASLInitial("SCRAM-SHA-256", scram.first())
+			case 11:
+				if scram == nil {
+					return fmt.Errorf("postgres: SASL continue without a start")
+				}
+				var final []byte
+				if final, err = scram.final(data); err == nil {
+					err = cn.send('p', final)
+				}
+			case 12:
+				if scram == nil {
+					return fmt.Errorf("postgres: SASL final without a start")
+				}
+				err = scram.verify(data)
+			default:
+				return fmt.Errorf("postgres: unsupported authentication %d", code)
+			}
+			if err != nil {
+				return fmt.Errorf("postgres: could not authenticate: %v", err)
+			}
+		case 'E':
+			return parseError(msg)
+		case 'Z':
+			return nil
+		}
+		// ParameterStatus, BackendKeyData and notices aren't needed.
+	}
+}
+
+func (cn *conn) sendPassword(password string) error {
+	return cn.send('p', append([]byte(password), 0))
+}
+
+func (cn *conn) sendSASLInitial(mechanism string, data []byte) error {
+	b := append([]byte(mechanism), 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return cn.send('p', append(b, data...))
+}
+
+// md5Password is the answer to an MD5 password request.
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// hasMechanism reports whether the SASL mechanisms of an
+// authentication request include name.
+func hasMechanism(data []byte, name string) bool {
+	for _, m := range strings.Split(string(data), "\x00") {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// get takes an idle connection, or dials one.
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// put returns a connection to the pool, closing it if the pool is full.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.PoolSize {
+		cn.c.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Exec runs a statement with text parameters, which the server casts
+// to the types their places take. Statements are prepared the first
+// time a connection runs them. An error of the
+// server is returned as an *Error, a failure once the statement may
+// have gone out as an *UncertainError.
+func (c *Client) Exec(query string, args ...string) (Result, error) {
+	cn, err := c.get()
+	if err != nil {
+		return Result{}, err
+	}
+
+	cn.c.SetDeadline(time.Now().Add(c.opts.Timeout))
+	res, err := cn.exec(query, args)
+	var perr *Error
+	if err != nil && !errors.As(err, &perr) {
+		// The connection is out of sync or broken, don't reuse it.
+		cn.c.Close()
+		return Result{}, &UncertainError{Query: query, Err: err}
+	}
+	c.put(cn)
+	return res, err
+}
+
+// Close closes the idle connections, statements in flight finish first.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.send('X', nil)
+		cn.w.Flush()
+		cn.c.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// exec runs a statement with the extended query protocol: Parse if it
+// isn't prepared yet, then Bind, Execute and Sync in one round trip.
+func (cn *conn) exec(query string, args []string) (res Result, err error) {
+	name, ok := cn.prepared[query]
+	if !ok {
+		name = strconv.Itoa(len(cn.prepared) + 1)
+		b := append([]byte(name), 0)
+		b = append(append(b, query...), 0)
+		b = binary.BigEndian.AppendUint16(b, 0)
+		if err = cn.send('P', b); err != nil {
+			return
+		}
+	}
+
+	b := []byte{0}
+	b = append(append(b, name...), 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(args)))
+	for _, a := range args {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(a)))
+		b = append(b, a...)
+	}
+	b = binary.BigEndian.AppendUint16(b, 0)
+	if err = cn.send('B', b); err != nil {
+		return
+	}
+	if err = cn.send('E', []byte{0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	if err = cn.send('S', nil); err != nil {
+		return
+	}
+	if err = cn.w.Flush(); err != nil {
+		return
+	}
+
+	// After an error the server skips to the Sync, it's still read up
+	// to ReadyForQuery so the connection can be reused.
+	var failed error
+	for {
+		typ, msg, rerr := cn.receive()
+		if rerr != nil {
+			return Result{}, rerr
+		}
+		switch typ {
+		case '1':
+			cn.prepared[query] = name
+		case 'D':
+			row, perr := parseRow(msg)
+			if perr != nil {
+				return Result{}, perr
+			}
+			res.Rows = append(res.Rows, row)
+		case 'C':
+			res.Tag = strings.TrimSuffix(string(msg), "\x00")
+		case 'E':
+			failed = parseError(msg)
+		case 'Z':
+			return res, failed
+		}
+	}
+}
+
+// send writes a message of type typ, Flush sends it.
+func (cn *conn) send(typ byte, body []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(body)+4))
+	if _, err := cn.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := cn.w.Write(body); err != nil {
+		return err
+	}
+	if typ == 'p' {
+		return cn.w.Flush()
+	}
+	return nil
+}
+
+// receive reads a message of the server.
+func (cn *conn) receive() (typ byte, msg []byte, err error) {
+	var hdr [5]byte
+	if _, err = io.ReadFull(cn.r, hdr[:]); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n < 4 || n-4 > maxMessage {
+		return 0, nil, fmt.Errorf("postgres: malformed message length %d", n)
+	}
+	msg = make([]byte, n-4)
+	if _, err = io.ReadFull(cn.r, msg); err != nil {
+		return
+	}
+	return hdr[0], msg, nil
+}
+
+// parseRow reads the text columns of a DataRow, NULL is "".
+func parseRow(msg []byte) ([]string, error) {
+	if len(msg) < 2 {
+		return nil, fmt.Errorf("postgres: malformed row")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	row := make([]string, n)
+	for i := range row {
+		if len(msg) < 4 {
+			return nil, fmt.Errorf("postgres: malformed row")
+		}
+		l := int32(binary.BigEndian.Uint32(msg))
+		msg = msg[4:]
+		if l < 0 {
+			continue
+		}
+		if int(l) > len(msg) {
+			return nil, fmt.Errorf("postgres: malformed row")
+		}
+		row[i], msg = string(msg[:l]), msg[l:]
+	}
+	return row, nil
+}
+
+// parseError reads the fields of an ErrorResponse.
+func parseError(msg []byte) error {
+	e := &Error{}
+	for len(msg) > 1 {
+		field := msg[0]
+		end := strings.IndexByte(string(msg[1:]), 0)
+		if end < 0 {
+			break
+		}
+		v := string(msg[1 : 1+end])
+		msg = msg[2+end:]
+		switch field {
+		case 'S':
+			e.Severity = v
+		case 'C':
+			e.Code = v
+		case 'M':
+			e.Message = v
+		}
+	}
+	return e
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange, RFC 5802
+// and 7677, without channel binding.
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string
+	serverProof []byte
+}
+
+func newSCRAM(password string) *scramClient {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(b)}
+}
+
+// first is the client-first-message. PostgreSQL takes the user from
+// the startup message, the one here is left empty.
+func (s *scramClient) first() []byte {
+	s.firstBare = "n=,r=" + s.nonce
+	return []byte("n,," + s.firstBare)
+}
+
+// final answers the server-first-message with the client's proof.
+func (s *scramClient) final(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		k, v, _ := strings.Cut(attr, "=")
+		switch k {
+		case "r":
+			nonce = v
+		case "s":
+			salt = v
+		case "i":
+			iterations, _ = strconv.Atoi(v)
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || iterations < 1 {
+		return nil, fmt.Errorf("bad SCRAM server-first-message")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("bad SCRAM salt")
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := s.firstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverProof = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message, so we know the server has
+// the password too.
+func (s *scramClient) verify(serverFinal []byte) error {
+	v, ok := strings.CutPrefix(string(serverFinal), "v=")
+	if !ok {
+		return fmt.Errorf("bad SCRAM server-final-message")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil || !hmac.Equal(sig, s.serverProof) {
+		return fmt.Errorf("the server's SCRAM signature doesn't match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 is SCRAM's Hi, PBKDF2 with HMAC-SHA-256 for one block.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,331 @@
+// Package pubsub is a minimal Google Cloud Pub/Sub publisher.
+//
+// It only does what the server's pubsub sink needs: publish batches of
+// messages, with ordering keys, to one topic over the REST API, with an
+// access token of a service account key file or of the metadata server
+// of the instance it runs on. There's no subscribing, gRPC, flow control
+// or retries; a publish that fails is reported and the caller sends the
+// batch again. With PUBSUB_EMULATOR_HOST set it publishes to the
+// emulator there, without a token, like Google's client libraries.
+package pubsub
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMessages is the most messages Pub/Sub takes in one publish.
+	maxMessages = 1000
+	// scope is what the access tokens are asked for.
+	scope = "https://www.googleapis.com/auth/pubsub"
+	// metadataToken is where an instance gets its service account's tokens.
+	metadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// tokenSlack is how long before it expires a token is replaced.
+	tokenSlack = time.Minute
+)
+
+// Options configure the publisher.
+type Options struct {
+	// Endpoint is the API's URL, https://pubsub.googleapis.com if
+	// empty. Ordered messages should go to a regional one, e.g.
+	// https://europe-west1-pubsub.googleapis.com.
+	Endpoint string
+	// Credentials is the path of a service account key file. If empty
+	// GOOGLE_APPLICATION_CREDENTIALS is used, or if that's unset the
+	// metadata server.
+	Credentials string
+	// Timeout bounds every request, 10s if 0.
+	Timeout time.Duration
+}
+
+// Message is a message to publish. Messages with the same
+// OrderingKey are delivered in the order they were published, to
+// subscriptions with message ordering on.
+type Message struct {
+	Data        []byte
+	OrderingKey string
+	Attributes  map[string]string
+}
+
+// Error is a publish the API refused.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pubsub: %d %s", e.Status, e.Message)
+}
+
+// Publisher publishes to one topic, it's safe for concurrent use.
+type Publisher struct {
+	topicURL string
+	client   *http.Client
+	// token is nil for the emulator.
+	token *tokenSource
+}
+
+// Dial returns a publisher to projects/project/topics/topic. It gets
+// an access token first, so credentials that don't work are reported
+// right away.
+func Dial(project, topic string, opts Options) (*Publisher, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://pubsub.googleapis.com"
+	}
+	p := &Publisher{client: &http.Client{Timeout: opts.Timeout}}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		opts.Endpoint = "http://" + host
+	} else {
+		if opts.Credentials == "" {
+			opts.Credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		ts, err := newTokenSource(opts.Credentials, p.client)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = ts.get(); err != nil {
+			return nil, err
+		}
+		p.token = ts
+	}
+	p.topicURL = strings.TrimSuffix(opts.Endpoint, "/") + "/v1/projects/" +
+		url.PathEscape(project) + "/topics/" + url.PathEscape(topic) + ":publish"
+	return p, nil
+}
+
+// The publish request and response, see the REST reference.
+type (
+	publishRequest struct {
+		Messages []pubsubMessage `json:"messages"`
+	}
+	pubsubMessage struct {
+		Data        string            `json:"data"`
+		OrderingKey string            `json:"orderingKey,omitempty"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+	}
+	publishResponse struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	errorResponse struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+// Publish publishes msgs in order, in requests of up to 1000. If it
+// fails some of them may have been published already.
+func (p *Publisher) Publish(msgs []Message) error {
+	for len(msgs) > 0 {
+		n := min(len(msgs), maxMessages)
+		if err := p.publish(msgs[:n]); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+func (p *Publisher) publish(msgs []Message) error {
+	req := publishRequest{Messages: make([]pubsubMessage, len(msgs))}
+	for i, m := range msgs {
+		req.Messages[i] = pubsubMessage{
+			Data:        base64.StdEncoding.EncodeToString(m.Data),
+			OrderingKey: m.OrderingKey,
+			Attributes:  m.Attributes,
+		}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", p.topicURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if p.token != nil {
+		token, err := p.token.get()
+		if err != nil {
+			return err
+		}
+		hreq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return &Error{Status: resp.StatusCode, Message: e.Error.Message}
+	}
+	var res publishResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("pubsub: bad response: %v", err)
+	}
+	if len(res.MessageIDs) != len(msgs) {
+		return fmt.Errorf("pubsub: %d of %d messages published", len(res.MessageIDs), len(msgs))
+	}
+	return nil
+}
+
+// Close releases the idle connections.
+func (p *Publisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// tokenSource gets access tokens and keeps one until shortly before
+// it expires.
+type tokenSource struct {
+	client *http.Client
+	// key is nil for the metadata server.
+	key *serviceAccount
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// serviceAccount is what's used of a service account key file.
+type serviceAccount struct {
+	Email    string `json:"client_email"`
+	KeyPEM   string `json:"private_key"`
+	TokenURI string `json:"token_uri"`
+	key      *rsa.PrivateKey
+}
+
+func newTokenSource(credentials string, client *http.Client) (*tokenSource, error) {
+	ts := &tokenSource{client: client}
+	if credentials == "" {
+		return ts, nil
+	}
+	b, err := os.ReadFile(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	sa := &serviceAccount{}
+	if err = json.Unmarshal(b, sa); err != nil || sa.Email == "" || sa.KeyPEM == "" {
+		return nil, fmt.Errorf("pubsub: %s isn't a service account key file", credentials)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(sa.KeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("pubsub: no private key in %s", credentials)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: bad private key in %s: %v", credentials, err)
+	}
+	var ok bool
+	if sa.key, ok = k.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("pubsub: the private key in %s isn't RSA", credentials)
+	}
+	ts.key = sa
+	return ts, nil
+}
+
+// tokenResponse is an OAuth 2 token, from the token URI or the
+// metadata server alike.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// get returns a token good for a minute at least.
+func (ts *tokenSource) get() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Until(ts.expires) > tokenSlack {
+		return ts.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.key == nil {
+		req, err = http.NewRequest("GET", metadataToken, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	} else {
+		var assertion string
+		if assertion, err = ts.key.assertion(time.Now()); err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err = http.NewRequest("POST", ts.key.TokenURI, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pubsub: could not get a token: %v", err)
+	}
+	defer resp.Body.Close()
+	var tok tokenResponse
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pubsub: could not get a token: %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return "", errors.New("pubsub: could not get a token: bad response")
+	}
+	ts.token = tok.AccessToken
+	ts.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion is the signed JWT a service account trades for a token.
+func (sa *serviceAccount) assertion(now time.Time) (string, error) {
+	header := `{"alg":"RS256","typ":"JWT"}`
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   sa.Email,
+		"scope": scope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("pubsub: could not sign the token request: %v", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
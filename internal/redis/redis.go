@@ -0,0 +1,265 @@
+// Package redis is a minimal Redis client.
+//
+// It only does what the server's shared dedup store needs: send a
+// command and read its reply, over a small pool of connections so
+// concurrent callers don't wait on each other's round trips. There's no
+// pipelining, pub/sub or cluster support; a connection that fails a
+// command is dropped and the next command dials a new one.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBulk bounds the size of bulk replies we accept from the server.
+const maxBulk = 1 << 20
+
+// Options configure the connections to the server.
+type Options struct {
+	Password string
+	// DB is the database selected on every connection.
+	DB int
+	// PoolSize is how many idle connections are kept, 8 if 0.
+	PoolSize int
+	// Timeout bounds dialing and every command's round trip, 5s if 0.
+	Timeout time.Duration
+}
+
+// Error is an error reply of the server, e.g. WRONGTYPE.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrClosed is returned by commands on a closed Client.
+var ErrClosed = errors.New("redis: client closed")
+
+// UncertainError is a failure after a command was sent, e.g. a timeout
+// waiting for its reply: the server may or may not have run it.
+type UncertainError struct {
+	Cmd string
+	Err error
+}
+
+func (e *UncertainError) Error() string {
+	return fmt.Sprintf("redis: no reply to %s: %v", e.Cmd, e.Err)
+}
+
+func (e *UncertainError) Unwrap() error { return e.Err }
+
+// Client sends commands to a Redis server, it's safe for concurrent use.
+type Client struct {
+	addr string
+	opts Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Dial connects to the server at addr, checking it's reachable and
+// the password and database are right.
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.PoolSize == 0 {
+		opts.PoolSize = 8
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	c := &Client{addr: addr, opts: opts}
+	cn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.put(cn)
+	return c, nil
+}
+
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, c.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if c.opts.Password != "" {
+		if _, err = cn.do(c.opts.Timeout, "AUTH", c.opts.Password); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis: could not authenticate: %v", err)
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err = cn.do(c.opts.Timeout, "SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis: could not select database %d: %v", c.opts.DB, err)
+		}
+	}
+	return cn, nil
+}
+
+// get takes an idle connection, or dials one.
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// put returns a connection to the pool, closing it if the pool is full.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.PoolSize {
+		cn.c.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Do sends a command and returns its reply: a string for simple and
+// bulk strings, an int64 for integers, nil for a nil bulk string and
+// []interface{} for arrays. An error reply is returned as an Error,
+// a failure once the command may have gone out as an UncertainError.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := cn.do(c.opts.Timeout, args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection is out of sync or broken, don't reuse it.
+		cn.c.Close()
+		return nil, &UncertainError{Cmd: args[0], Err: err}
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// Int sends a command with an integer reply, e.g. SADD.
+func (c *Client) Int(args ...string) (int64, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: %s replied %T, not an integer", args[0], reply)
+	}
+	return n, nil
+}
+
+// Close closes the idle connections, commands in flight finish first.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.c.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (cn *conn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	cn.c.SetDeadline(time.Now().Add(timeout))
+
+	// Commands go out as arrays of bulk strings.
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+func (cn *conn) read() (interface{}, error) {
+	line, err := cn.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxBulk {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = cn.read(); err != nil {
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+				a[i] = err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
+
+// line reads a CRLF terminated line, without the CRLF.
+func (cn *conn) line() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
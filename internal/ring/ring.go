@@ -0,0 +1,167 @@
+// Package ring provides a bounded multi-producer, single-consumer queue
+// of fixed-size records.
+//
+// Producers claim a slot with a single compare-and-swap and publish it
+// with an atomic store, so a push costs far less than a channel send
+// under contention. The consumer only sleeps when the ring is empty,
+// and producers only pay for waking it when it actually sleeps.
+//
+// The slot protocol is Dmitry Vyukov's bounded queue: every slot carries
+// a sequence number telling whose turn it is, producer or consumer.
+package ring
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+type slot struct {
+	seq uint64
+	val uint64
+}
+
+// Ring is a bounded MPSC queue of uint64 records.
+// Any number of goroutines may Push, only one may Pop or Get.
+type Ring struct {
+	slots []slot
+	mask  uint64
+	// head is the next position producers claim.
+	head uint64
+	// tail is the next position the consumer reads,
+	// only written by the consumer.
+	tail uint64
+
+	// waiting is 1 while the consumer is parked on wake.
+	waiting int32
+	wake    chan struct{}
+	closed  int32
+}
+
+// New returns a ring holding at least size records,
+// rounded up to a power of two.
+func New(size int) *Ring {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+
+	r := &Ring{
+		slots: make([]slot, n),
+		mask:  uint64(n - 1),
+		wake:  make(chan struct{}, 1),
+	}
+	for i := range r.slots {
+		r.slots[i].seq = uint64(i)
+	}
+	return r
+}
+
+// TryPush adds v to the ring, it returns false if the ring is full or closed.
+func (r *Ring) TryPush(v uint64) bool {
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return false
+	}
+
+	pos := atomic.LoadUint64(&r.head)
+	for {
+		s := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint64(&s.seq)
+
+		switch dif := int64(seq) - int64(pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				s.val = v
+				atomic.StoreUint64(&s.seq, pos+1)
+				r.notify()
+				return true
+			}
+			pos = atomic.LoadUint64(&r.head)
+		case dif < 0:
+			// The consumer hasn't freed this slot yet, we're a full lap ahead.
+			return false
+		default:
+			// Another producer claimed pos first.
+			pos = atomic.LoadUint64(&r.head)
+		}
+	}
+}
+
+// Push adds v to the ring, waiting for the consumer to make room.
+// It returns false only if the ring is closed.
+func (r *Ring) Push(v uint64) bool {
+	for spins := 0; !r.TryPush(v); spins++ {
+		if atomic.LoadInt32(&r.closed) == 1 {
+			return false
+		}
+		// Yield a few times before backing off properly,
+		// the consumer usually frees a slot almost immediately.
+		if spins < 16 {
+			runtime.Gosched()
+		} else {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+	return true
+}
+
+// Pop removes the oldest record without waiting,
+// ok is false if the ring is empty.
+func (r *Ring) Pop() (v uint64, ok bool) {
+	s := &r.slots[r.tail&r.mask]
+	if atomic.LoadUint64(&s.seq) != r.tail+1 {
+		return 0, false
+	}
+
+	v = s.val
+	// Hand the slot to the producer of the next lap.
+	atomic.StoreUint64(&s.seq, r.tail+r.mask+1)
+	atomic.StoreUint64(&r.tail, r.tail+1)
+	return v, true
+}
+
+// Get removes the oldest record, waiting for one if the ring is empty.
+// ok is false once the ring is closed and drained.
+func (r *Ring) Get() (v uint64, ok bool) {
+	for {
+		if v, ok = r.Pop(); ok {
+			return
+		}
+
+		// Announce we're about to sleep, then look again,
+		// a producer that pushed in between will see waiting and wake us.
+		atomic.StoreInt32(&r.waiting, 1)
+		if v, ok = r.Pop(); ok {
+			atomic.StoreInt32(&r.waiting, 0)
+			return
+		}
+		if atomic.LoadInt32(&r.closed) == 1 {
+			atomic.StoreInt32(&r.waiting, 0)
+			return 0, false
+		}
+		<-r.wake
+	}
+}
+
+// Len is the number of records waiting to be consumed.
+func (r *Ring) Len() int {
+	return int(atomic.LoadUint64(&r.head) - atomic.LoadUint64(&r.tail))
+}
+
+// Close stops the ring accepting records.
+// Records already pushed can still be consumed.
+// Close must not be called concurrently with Push.
+func (r *Ring) Close() {
+	atomic.StoreInt32(&r.closed, 1)
+	r.notify()
+}
+
+// notify wakes the consumer if it's parked.
+func (r *Ring) notify() {
+	if atomic.LoadInt32(&r.waiting) == 1 && atomic.CompareAndSwapInt32(&r.waiting, 1, 0) {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
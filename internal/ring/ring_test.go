@@ -0,0 +1,134 @@
+package ring
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFull(t *testing.T) {
+	r := New(3)
+	if n := len(r.slots); n != 4 {
+		t.Fatalf("%d slots, want 3 rounded up to 4", n)
+	}
+	for i := range uint64(4) {
+		if !r.TryPush(i) {
+			t.Fatalf("TryPush(%d) refused with room left", i)
+		}
+	}
+	if r.TryPush(4) {
+		t.Error("TryPush took a record with the ring full")
+	}
+	if n := r.Len(); n != 4 {
+		t.Errorf("Len() = %d, want 4", n)
+	}
+
+	// Push waits for the consumer to make room.
+	pushed := make(chan bool)
+	go func() { pushed <- r.Push(4) }()
+	select {
+	case <-pushed:
+		t.Fatal("Push returned with the ring full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v, ok := r.Pop(); !ok || v != 0 {
+		t.Fatalf("Pop() = %d, %v, want 0", v, ok)
+	}
+	if !<-pushed {
+		t.Fatal("Push refused once there was room")
+	}
+
+	// In order, around the wrap.
+	for want := uint64(1); want <= 4; want++ {
+		if v, ok := r.Pop(); !ok || v != want {
+			t.Errorf("Pop() = %d, %v, want %d", v, ok, want)
+		}
+	}
+	if _, ok := r.Pop(); ok {
+		t.Error("Pop took a record off an empty ring")
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := New(4)
+	r.Push(1)
+	r.Push(2)
+	r.Close()
+	if r.TryPush(3) || r.Push(3) {
+		t.Error("a closed ring took a record")
+	}
+	// What was pushed is still drained.
+	for _, want := range []uint64{1, 2} {
+		if v, ok := r.Get(); !ok || v != want {
+			t.Errorf("Get() = %d, %v, want %d", v, ok, want)
+		}
+	}
+	if _, ok := r.Get(); ok {
+		t.Error("Get took a record off a closed, drained ring")
+	}
+
+	// Close wakes a consumer waiting on an empty ring.
+	r = New(4)
+	got := make(chan bool)
+	go func() {
+		_, ok := r.Get()
+		got <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case ok := <-got:
+		if ok {
+			t.Error("Get took a record off an empty ring")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get didn't return once the ring was closed")
+	}
+}
+
+// TestProducers is meant for go test -race: many producers share a
+// small ring, so it fills and wraps, and every record has to come out
+// once, in the order its producer pushed it.
+func TestProducers(t *testing.T) {
+	const producers, each = 8, 20000
+	r := New(16)
+
+	var wg sync.WaitGroup
+	for p := range uint64(producers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range uint64(each) {
+				if !r.Push(p<<32 | i) {
+					t.Error("Push refused on an open ring")
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		r.Close()
+	}()
+
+	var next [producers]uint64
+	n := 0
+	for {
+		v, ok := r.Get()
+		if !ok {
+			break
+		}
+		p, i := v>>32, v&(1<<32-1)
+		if p >= producers || i != next[p] {
+			t.Fatalf("got record %d of producer %d, want %d", i, p, next[p])
+		}
+		next[p]++
+		n++
+	}
+	if n != producers*each {
+		t.Errorf("got %d records, want %d", n, producers*each)
+	}
+	if l := r.Len(); l != 0 {
+		t.Errorf("Len() = %d after draining, want 0", l)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	loggerFormat = flag.String("logger-format", "text", "format of the messages on stderr: text or json, one object per line")
+	loggerLevel  = flag.String("logger-level", "info", "least severe messages written: debug, info, warn or error, debug adds a line per closed connection")
+)
+
+// newLogger builds the logger of the process from the logger flags,
+// writing to stderr.
+func newLogger() (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*loggerLevel)); err != nil {
+		return nil, fmt.Errorf("bad -logger-level: %v", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch *loggerFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown -logger-format %q, want text or json", *loggerFormat)
+}
+
+// fatal logs an error the process can't carry on after, and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
@@ -1,154 +1,150 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"log"
-	"net"
+	"context"
+	"flag"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
-)
 
-const (
-	port      = 3280
-	connLimit = 6
-	validLen  = 10
-	minValue  = 1000000
-	outIntvl  = 5 * time.Second
-	logIntvl  = 10 * time.Second
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+	"github.com/chandanws/go-simple-tcp-server/server"
 )
 
-func init() {
-	os.Mkdir("./logs", 0777)
+// shutdownGrace is how long shutting down lets open connections
+// finish before hanging up on them and flushing the logs regardless.
+var shutdownGrace = flag.Duration("shutdown-grace", 10*time.Second, "how long shutting down waits for open connections to finish before hanging up on them")
+
+// subcommands are the tools bundled alongside the server.
+// Running the binary without one of these starts the server.
+var subcommands = map[string]func(args []string) error{
+	"audit-verify":   runAuditVerify,
+	"bench":          runBench,
+	"conformance":    runConformance,
+	"gen":            runGen,
+	"merge":          runMerge,
+	"replay":         runReplay,
+	"selftest-bench": runSelftestBench,
+	"stress":         runStress,
+	"verify":         runVerify,
 }
 
 func main() {
-	// Start up the tcp server.
-	srv, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Fatalf("Error listening: %v", err)
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fatal(os.Args[1]+" failed", err)
+			}
+			return
+		}
 	}
 
-	fmt.Printf(
-		"Started %s server.\nListening on %s\n",
-		srv.Addr().Network(), srv.Addr().String())
-	defer srv.Close()
+	flag.Parse()
 
-	counter := NewCounter(connLimit)
-
-	// Listen for termination signals.
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
-
-	// Set up intervals
-	go counter.RunOutputInterval(outIntvl)
-	go counter.RunLogInterval(logIntvl)
-
-	// Receive new connections on an unbuffered channel.
-	conns := acceptConns(srv, counter)
+	if err := applyEnv(); err != nil {
+		fatal("could not read environment", err)
+	}
 
-	for {
-		select {
-		case conn := <-conns:
-			go handleConnection(conn, counter)
-		case <-sig:
-			// Add a leading new line since the signal escape sequence prints on stdout.
-			fmt.Printf("\nShutting down server.\n")
-			counter.Close()
-			os.Exit(0)
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			fatal("could not read config", err)
 		}
 	}
-}
 
-// acceptConns uses the semaphore channel on the counter to rate limit.
-// New connections get sent on the returned channel.
-func acceptConns(srv net.Listener, counter *Counter) <-chan net.Conn {
-	conns := make(chan net.Conn)
-
-	go func() {
-		for {
-			conn, err := srv.Accept()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error accepting connection: %v\n", err)
-				continue
-			}
+	logger, err := newLogger()
+	if err != nil {
+		fatal("could not set up logging", err)
+	}
+	slog.SetDefault(logger)
+
+	// Shut down on an interrupt, Ctrl+C or Ctrl+Break on Windows, and on
+	// SIGTERM, which Windows sends when the console closes, the user logs
+	// off or the system shuts down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, stopService, err := runService(ctx)
+	if err != nil {
+		fatal("could not run as a service", err)
+	}
+	defer stopService()
 
-			select {
-			case counter.Sem <- 1:
-				conns <- conn
-			default:
-				fmt.Fprintf(conn, "Server busy.")
-				conn.Close()
-			}
-		}
-	}()
+	if err := applyTuning(); err != nil {
+		fatal("could not tune runtime", err)
+	}
 
-	return conns
-}
+	profiles, err := startProfiling()
+	if err != nil {
+		fatal("could not start profiles", err)
+	}
 
-// Handles incoming requests.
-// Input is parsed and written to log if unique.
-// Handles closing of the connection.
-func handleConnection(conn net.Conn, counter *Counter) {
-	// Defer all close logic.
-	// Using a closure makes it easy to group logic as well as execute serially
-	// and avoid the deferred LIFO exec order.
-	defer func() {
-		// Since handleConnection is run in a go routine,
-		// it manages the closing of our net.Conn.
-		conn.Close()
-		// Once our connection is closed,
-		// we can drain a value from our semaphore
-		// to free up a space in the connection limit.
-		<-counter.Sem
-	}()
-
-	scanner := bufio.NewScanner(conn)
-	var s string
-	for scanner.Scan() {
-		s = scanner.Text()
-
-		// Malformed Request: invalid length
-		// Digit chars are safe for counting via len()
-		if len(s) != validLen {
-			continue
+	if err := failpoint.EnableFromEnv(); err != nil {
+		fatal("could not enable failpoints", err)
+	}
+	if *chaos != "" {
+		if err := failpoint.EnableSpec(*chaos); err != nil {
+			fatal("could not enable chaos mode", err)
 		}
+		slog.Warn("chaos mode on, faults are injected", "failpoints", *chaos)
+	}
 
-		num, err := strconv.Atoi(s)
-		// Malformed Request: not a number
-		if err != nil {
-			continue
-		}
+	if err := readOTelEnv(); err != nil {
+		fatal("could not set up OpenTelemetry tracing", err)
+	}
 
-		// Malformed Request: less than minimum
-		if num < minValue {
-			continue
-		}
+	// The server's connections are served under force, which a second
+	// signal cancels to cut the grace period short.
+	force, forceNow := context.WithCancel(context.Background())
+	defer forceNow()
+	cfg := serverConfig()
+	cfg.BaseContext = force
+	srv, err := server.New(cfg)
+	if err != nil {
+		fatal("could not start server", err)
+	}
+	if err := serveDebug(srv); err != nil {
+		fatal("could not start debug server", err)
+	}
 
-		/* From here on out, we have a valid input. */
-		// Safely increment total counter.
-		counter.Inc()
+	watchInstrumentSignals(srv)
+	go watchDiagSignal(srv)
+	go watchReopenSignal(srv)
 
-		// Check if input has been recorded previously.
-		if counter.HasValue(num) {
-			continue
-		}
+	// Start up the tcp server.
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
 
-		// Record the new unique value.
-		// In this case, logging is part of our reqs.
-		// We should fail is we didn't get this right.
-		if err = counter.RecordUniq(num); err != nil {
-			log.Fatalf("could not log unique value: %v\n", err)
+	restart := watchRestartSignal()
+wait:
+	for {
+		select {
+		case err := <-served:
+			fatal("could not serve", err)
+		case <-ctx.Done():
+			// A second signal hangs up on the draining connections right
+			// away, the logs are still flushed.
+			stop()
+			again, stopAgain := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stopAgain()
+			context.AfterFunc(again, forceNow)
+			slog.Info("shutting down server")
+			break wait
+		case <-srv.Terminated():
+			slog.Info("terminated by client, shutting down server")
+			break wait
+		case <-restart:
+			if restartServer(srv) {
+				profiles.Stop()
+				return
+			}
 		}
 	}
 
-	// If a failure to read input occurs,
-	// it's probably my bad.
-	// Fail and figure it out if so!
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading: %v", err)
+	grace, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+	if err := srv.Shutdown(grace); err != nil {
+		slog.Error("could not shut down cleanly", "err", err)
 	}
+	profiles.Stop()
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// runMerge implements the "merge" subcommand.
+// It stitches partitioned log segments back into one stream of values,
+// segment by segment, optionally sorted.
+// With -key it's also the export tool for encrypted logs.
+func runMerge(args []string) (err error) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	dir := fs.String("logs", "logs", "log directory to merge")
+	out := fs.String("o", "", "write the merged log to this file instead of stdout")
+	sorted := fs.Bool("sort", false, "sort all values numerically instead of keeping segment order")
+	keyFile := fs.String("key", "", "key file to decrypt encrypted segments with")
+	base := fs.String("stream", "data", "stream whose log to merge, data is the main one")
+	fs.Parse(args)
+
+	var keys *server.Keyring
+	if *keyFile != "" {
+		if keys, err = server.LoadKeyring(*keyFile); err != nil {
+			return
+		}
+	}
+
+	parts, err := server.LogSegments(*dir, *base)
+	if err != nil {
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("could not create merged log: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	var all []int
+	for _, p := range parts {
+		f, err := server.OpenLogReader(p.Path, keys)
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if *sorted {
+				v, err := strconv.Atoi(scanner.Text())
+				if err != nil {
+					f.Close()
+					return fmt.Errorf("corrupt line %q in %s", scanner.Text(), p.Path)
+				}
+				all = append(all, v)
+				continue
+			}
+			bw.WriteString(scanner.Text() + "\n")
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("could not read log file: %v", err)
+		}
+	}
+
+	if *sorted {
+		sort.Ints(all)
+		for _, v := range all {
+			fmt.Fprintf(bw, "%d\n", v)
+		}
+	}
+
+	if err = bw.Flush(); err != nil {
+		return fmt.Errorf("could not write merged log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "github.com/chandanws/go-simple-tcp-server/internal/otlp"
+
+// otelEnv is the OpenTelemetry trace export configured with the
+// standard OTEL_* environment variables, read once on startup.
+var otelEnv struct {
+	opts  otlp.Options
+	ratio float64
+	on    bool
+}
+
+func readOTelEnv() (err error) {
+	otelEnv.opts, otelEnv.ratio, otelEnv.on, err = otlp.FromEnv()
+	return
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+var (
+	cpuProfile   = flag.String("cpuprofile", "", "write a CPU profile to this file")
+	memProfile   = flag.String("memprofile", "", "write a heap profile to this file")
+	blockProfile = flag.String("blockprofile", "", "write a goroutine blocking profile to this file")
+	mutexProfile = flag.String("mutexprofile", "", "write a mutex contention profile to this file")
+)
+
+// profiler captures the profiles requested on the command line
+// from startup until Stop, which runs on shutdown or on the profile
+// signal (SIGUSR1 where available), whichever comes first.
+//
+// This is meant for hosts where exposing an HTTP pprof port isn't an option.
+type profiler struct {
+	cpu  *os.File
+	once sync.Once
+}
+
+// startProfiling starts the profiles requested by the profiling flags.
+func startProfiling() (p *profiler, err error) {
+	p = &profiler{}
+
+	if *blockProfile != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if *mutexProfile != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+
+	if *cpuProfile != "" {
+		if p.cpu, err = os.Create(*cpuProfile); err != nil {
+			return nil, fmt.Errorf("could not create CPU profile: %v", err)
+		}
+		if err = pprof.StartCPUProfile(p.cpu); err != nil {
+			p.cpu.Close()
+			return nil, fmt.Errorf("could not start CPU profile: %v", err)
+		}
+	}
+
+	if len(profileSignals) > 0 {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, profileSignals...)
+		go func() {
+			<-sig
+			signal.Stop(sig)
+			slog.Info("writing profiles")
+			p.Stop()
+		}()
+	}
+
+	return p, nil
+}
+
+// Stop finishes every profile and writes it to disk.
+// Only the first call does anything.
+func (p *profiler) Stop() {
+	p.once.Do(func() {
+		if p.cpu != nil {
+			pprof.StopCPUProfile()
+			p.cpu.Close()
+		}
+
+		// Get up to date statistics for the heap profile.
+		if *memProfile != "" {
+			runtime.GC()
+		}
+
+		for name, file := range map[string]string{
+			"heap":  *memProfile,
+			"block": *blockProfile,
+			"mutex": *mutexProfile,
+		} {
+			if file == "" {
+				continue
+			}
+			if err := writeProfile(name, file); err != nil {
+				slog.Error("could not write profile", "profile", name, "err", err)
+			}
+		}
+	})
+}
+
+func writeProfile(name, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if err = pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
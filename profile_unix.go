@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// profileSignals stop profiling and write the profiles without stopping the server.
+var profileSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// profileSignals is empty, Windows has no spare signal to use,
+// so profiles are only written on shutdown.
+var profileSignals []os.Signal
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// watchReopenSignal reopens the server's logs on every SIGHUP,
+// so they can be rotated by an external logrotate.
+// With -config it rereads the config file first.
+// Must be run on go routine.
+func watchReopenSignal(srv *server.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if *configFile != "" {
+			if err := reloadConfig(srv); err != nil {
+				slog.Error("could not reload config", "err", err)
+			} else {
+				slog.Info("reloaded config")
+			}
+		}
+
+		if err := srv.Reopen(); err != nil {
+			slog.Error("could not reopen logs", "err", err)
+			continue
+		}
+		slog.Info("reopened logs")
+	}
+}
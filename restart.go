@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// executable is the binary the server was started from, a restart runs
+// whatever is at that path by then.
+var executable, _ = os.Executable()
+
+// watchRestartSignal returns a channel receiving the restart signal
+// (SIGTTIN where available), nil where there's none.
+func watchRestartSignal() <-chan os.Signal {
+	if len(restartSignals) == 0 {
+		return nil
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, restartSignals...)
+	return sig
+}
+
+// restartCmd is the new process of a restart: the binary at the same
+// path with the same arguments and output.
+func restartCmd() *exec.Cmd {
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	slog.Info("restarting", "binary", executable)
+	return cmd
+}
+
+// restartServer hands srv's listeners over to a new process and drains
+// it, it reports whether srv is shut down.
+func restartServer(srv *server.Server) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+	err := srv.Restart(ctx, restartCmd())
+	if err != nil && !srv.Closed() {
+		slog.Error("could not restart, still serving", "err", err)
+		return false
+	}
+	if err != nil {
+		slog.Error("could not restart cleanly", "err", err)
+	}
+	return true
+}
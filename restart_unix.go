@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals hand the listeners over to a new process, SIGUSR2 is
+// taken by instrumentation.
+var restartSignals = []os.Signal{syscall.SIGTTIN}
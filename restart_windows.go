@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// restartSignals is empty, Windows can't pass sockets to a new process
+// this way.
+var restartSignals []os.Signal
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// runSelftestBench implements the "selftest-bench" subcommand.
+// It runs the server and a synthetic workload in one process, so
+// throughput, allocation and latency can be compared between builds
+// without any external tooling. The defaults are the fixed scenario,
+// only change them to explore, not to compare against a baseline.
+//
+// Every client pipelines -batch values followed by a PING and waits for
+// the PONG, latency is that round trip, so it covers processing the batch.
+func runSelftestBench(args []string) (err error) {
+	fs := flag.NewFlagSet("selftest-bench", flag.ExitOnError)
+	clients := fs.Int("conns", 4, "concurrent client connections")
+	n := fs.Int("n", 500000, "total values sent")
+	batch := fs.Int("batch", 100, "values sent between latency probes")
+	dup := fs.Float64("dup", 0.1, "ratio of values that repeat an earlier one")
+	seed := fs.Int64("seed", 1, "random seed of the workload")
+	fs.Parse(args)
+
+	if *clients < 1 || *batch < 1 {
+		return fmt.Errorf("-conns and -batch must be at least 1")
+	}
+
+	dir, err := os.MkdirTemp("", "selftest-bench")
+	if err != nil {
+		return fmt.Errorf("could not create log directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := server.New(server.Config{
+		MaxConns: *clients,
+		LogDir:   dir,
+		Output:   io.Discard,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("could not listen: %v", err)
+	}
+	go srv.Serve(l)
+
+	// Generate the workload up front, it isn't part of what's measured.
+	c, err := newCorpus(*seed, "uniform", *dup, 0)
+	if err != nil {
+		return
+	}
+	work := make([][]string, *clients)
+	for i := 0; i < *n; i++ {
+		work[i%*clients] = append(work[i%*clients], c.line())
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    error
+	)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for _, lines := range work {
+		wg.Add(1)
+		go func(lines []string) {
+			defer wg.Done()
+			lat, err := benchClient(l.Addr().String(), lines, *batch)
+
+			mu.Lock()
+			latencies = append(latencies, lat...)
+			if err != nil && failed == nil {
+				failed = err
+			}
+			mu.Unlock()
+		}(lines)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	if err = srv.Shutdown(context.Background()); err != nil {
+		return
+	}
+	if failed != nil {
+		return failed
+	}
+
+	uniq, total, _ := srv.Counts()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Printf(
+		"Values      : %d in %v, %.0f values/sec\n"+
+			"Unique      : %d\n"+
+			"Allocs      : %.2f per value, %.1f bytes per value\n"+
+			"Latency     : p50=%v p99=%v max=%v over %d probes\n",
+		total, elapsed, float64(total)/elapsed.Seconds(),
+		uniq,
+		float64(after.Mallocs-before.Mallocs)/float64(total),
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(total),
+		pct(0.5), pct(0.99), pct(1), len(latencies))
+
+	return nil
+}
+
+// benchClient sends lines to the server at addr,
+// probing with a PING after every batch, and returns the round trips.
+func benchClient(addr string, lines []string, batch int) (lat []time.Duration, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	probe := func() error {
+		t := time.Now()
+		if _, err := w.WriteString("PING\n"); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			return err
+		}
+		lat = append(lat, time.Since(t))
+		return nil
+	}
+
+	if _, err = r.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("could not read greeting: %v", err)
+	}
+
+	for i, line := range lines {
+		if _, err = w.WriteString(line + "\n"); err != nil {
+			return lat, fmt.Errorf("could not send: %v", err)
+		}
+		if (i+1)%batch == 0 {
+			if err = probe(); err != nil {
+				return lat, fmt.Errorf("could not probe: %v", err)
+			}
+		}
+	}
+
+	// A final probe makes sure the server processed everything sent.
+	if err = probe(); err != nil {
+		return lat, fmt.Errorf("could not probe: %v", err)
+	}
+	return lat, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ipACL decides which peers may connect at all, by CIDR ranges:
+// a denied range always loses, and with any allowed ranges only those
+// get in. Pipe and Unix socket peers have no IP and are always let in.
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// denied counts the connections turned away, for the interval output.
+	denied int64
+}
+
+// parseACL parses CIDR ranges, or single IPs, it returns nil without any.
+func parseACL(allow, deny []string) (a *ipACL, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a = &ipACL{}
+	if a.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseNets(specs []string) (nets []*net.IPNet, err error) {
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR range %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", spec)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// permits reports whether the peer at addr may connect,
+// counting it if it may not.
+func (a *ipACL) permits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(hostOf(addr.String()))
+	if ip == nil {
+		return true
+	}
+
+	ok := len(a.allow) == 0 || contains(a.allow, ip)
+	if ok && contains(a.deny, ip) {
+		ok = false
+	}
+	if !ok {
+		atomic.AddInt64(&a.denied, 1)
+	}
+	return ok
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// report is the interval output line of the turned away connections.
+func (a *ipACL) report() string {
+	return fmt.Sprintf("Denied      : %d connections\n", atomic.LoadInt64(&a.denied))
+}
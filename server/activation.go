@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor systemd passes,
+// see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// listenFds returns the listening sockets systemd passed to the
+// process with socket activation and their FileDescriptorNames, in
+// order, nil if it wasn't socket activated. It takes the sockets of a
+// Restart the same way. The variables are unset, so processes started
+// by the server don't take the sockets for theirs.
+func listenFds() (ls []net.Listener, names []string, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv(handoverEnv)
+	defer os.Unsetenv(handoverSegsEnv)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	activated := err == nil && pid == os.Getpid()
+	// The old process may be gone already, it doesn't wait.
+	_, err = strconv.Atoi(os.Getenv(handoverEnv))
+	handedOver := err == nil
+	if !activated && !handedOver {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for len(names) < n {
+		names = append(names, "")
+	}
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		// FileListener dups the fd, close on exec.
+		f := os.NewFile(uintptr(fd), names[i])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("fd %d (%s) isn't a listening socket: %v", fd, names[i], err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, names[:n], nil
+}
+
+// openActivated takes the sockets systemd passed, if it did. Those
+// named after a stream serve it instead of its port, the others serve
+// the main stream instead of Addr.
+func (s *Server) openActivated() error {
+	ls, names, err := listenFds()
+	if err != nil || ls == nil {
+		return err
+	}
+
+	s.activated = make(map[string][]net.Listener)
+	for i, l := range ls {
+		stream := ""
+		for _, st := range s.streams {
+			if st.name == names[i] {
+				stream = st.name
+				break
+			}
+		}
+		s.activated[stream] = append(s.activated[stream], l)
+	}
+	return nil
+}
+
+// inherited wraps a socket systemd passed like the server's own
+// listeners, busy polling TCP ones and reading PROXY headers.
+func (s *Server) inherited(l net.Listener) (net.Listener, error) {
+	if _, ok := l.(*net.TCPListener); ok && s.cfg.BusyPoll > 0 {
+		var err error
+		if l, err = busyPollListener(l, s.cfg.BusyPoll); err != nil {
+			return nil, fmt.Errorf("could not enable busy polling: %v", err)
+		}
+	}
+	return s.proxied(l), nil
+}
+
+// acceptActivated accepts connections for counter on the rest of the
+// sockets systemd passed for its stream.
+func (s *Server) acceptActivated(ls []net.Listener, counter *Counter) error {
+	for _, l := range ls {
+		l, err := s.inherited(l)
+		if err != nil {
+			return err
+		}
+		s.handOver(counter.name, l)
+		if err = s.acceptOn(l, counter, "socket activation"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
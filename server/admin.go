@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin protocol, served on Config.AdminAddr, is one command per
+// line, each answered with a single line:
+//
+//	STATS                     the main stream's stats as key=value pairs
+//	STATS JSON                every stream's stats as a JSON object
+//	TOPDUPS [<n>]             the main stream's most resubmitted duplicates
+//	SET <setting> <value>     change max-conns, report-interval or log-interval
+//	FLUSH                     write out every stream's log
+//	REOPEN                    reopen every stream's log, for logrotate
+//	DISCONNECT <addr>         hang up on the connection from ip:port, or every one from an IP
+//	SHUTDOWN                  stop the server, like the terminate command
+//
+// Replies are OK, ERR <reason>, or STATS' or TOPDUPS' line.
+const (
+	adminOK = "OK\n"
+)
+
+// adminCommand handles one admin command, args is the rest of the line.
+type adminCommand func(s *Server, conn net.Conn, args string) string
+
+var adminCommands = map[string]adminCommand{
+	"STATS":      adminStats,
+	"TOPDUPS":    adminTopDups,
+	"SET":        adminSet,
+	"FLUSH":      adminFlush,
+	"REOPEN":     adminReopen,
+	"DISCONNECT": adminDisconnect,
+	"SHUTDOWN":   adminShutdown,
+}
+
+// adminSettings are what SET changes, applied like Reload.
+var adminSettings = map[string]func(cfg *Config, v string) error{
+	"max-conns": func(cfg *Config, v string) (err error) {
+		cfg.MaxConns, err = strconv.Atoi(v)
+		return
+	},
+	"report-interval": func(cfg *Config, v string) (err error) {
+		cfg.OutputInterval, err = parseInterval(v)
+		return
+	},
+	"log-interval": func(cfg *Config, v string) (err error) {
+		cfg.LogInterval, err = parseInterval(v)
+		return
+	},
+}
+
+// parseInterval parses a positive duration.
+func parseInterval(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// serveAdmin listens for admin connections on spec,
+// host:port for TCP or unix:<path> for a Unix socket, until Shutdown.
+func (s *Server) serveAdmin(spec string) error {
+	var l net.Listener
+	var err error
+	if path := strings.TrimPrefix(spec, "unix:"); path != spec {
+		l, err = listenUnix(path)
+	} else {
+		l, err = net.Listen("tcp", spec)
+	}
+	if err != nil {
+		return err
+	}
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	go s.acceptAdmin(l)
+	s.log.Info("listening", "addr", l.Addr().String(), "for", "admin")
+	return nil
+}
+
+// acceptAdmin serves every admin connection on its own goroutine,
+// they don't count against the connection limits.
+// Must be run on go routine.
+func (s *Server) acceptAdmin(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing() {
+				return
+			}
+			s.log.Error("could not accept admin connection", "err", err)
+			continue
+		}
+		go s.handleAdmin(conn)
+	}
+}
+
+// handleAdmin answers the commands of an admin connection until it
+// hangs up, or the server shuts down.
+func (s *Server) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+	hungUp := make(chan bool)
+	defer close(hungUp)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-hungUp:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	if s.cfg.AuthToken != "" && !s.authenticate(conn, r) {
+		return
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		verb, args := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, args = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		reply := "ERR unknown command " + verb + "\n"
+		if cmd, ok := adminCommands[strings.ToUpper(verb)]; ok {
+			reply = cmd(s, conn, args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// adminStats answers STATS with the main stream's stats, and
+// STATS JSON with every stream's, as the stats endpoint serves them.
+func adminStats(s *Server, conn net.Conn, args string) string {
+	if strings.EqualFold(args, "json") {
+		b, err := json.Marshal(s.streamStats())
+		if err != nil {
+			return "ERR " + err.Error() + "\n"
+		}
+		return string(b) + "\n"
+	}
+	c := s.counter
+	st := c.Snapshot()
+	_, max := c.sem.inUse()
+	return fmt.Sprintf(
+		"uptime=%d unique=%d total=%d duplicates=%d interval=%d conns=%d max_conns=%d errors=%d maintenance=%t\n",
+		int(st.Uptime.Seconds()), st.Unique, st.Total, st.Duplicates, st.IntvlTotal, st.Conns, max, s.Errors(), s.inMaintenance())
+}
+
+// adminTopDups answers TOPDUPS with the main stream's n most
+// resubmitted duplicates as value=count pairs, as many as the interval
+// output reports without n.
+func adminTopDups(s *Server, conn net.Conn, args string) string {
+	if s.counter.dups == nil {
+		return "ERR duplicates aren't tracked\n"
+	}
+	n := 0
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 {
+			return "ERR usage: TOPDUPS [<n>]\n"
+		}
+	}
+	return formatDups(s.counter.dups.top(n)) + "\n"
+}
+
+func adminSet(s *Server, conn net.Conn, args string) string {
+	f := strings.Fields(args)
+	if len(f) != 2 {
+		return "ERR usage: SET <setting> <value>\n"
+	}
+	set, ok := adminSettings[f[0]]
+	if !ok {
+		return "ERR unknown setting " + f[0] + "\n"
+	}
+
+	cfg := s.config()
+	if err := set(&cfg, f[1]); err != nil {
+		return fmt.Sprintf("ERR bad %s: %v\n", f[0], err)
+	}
+	if _, err := s.Reload(cfg); err != nil {
+		return fmt.Sprintf("ERR %v\n", err)
+	}
+	s.log.Info("changed setting over admin", "setting", f[0], "value", f[1], "remote", conn.RemoteAddr().String())
+	return adminOK
+}
+
+func adminFlush(s *Server, conn net.Conn, args string) string {
+	for _, c := range s.counters() {
+		if err := c.Flush(); err != nil {
+			return fmt.Sprintf("ERR %v\n", err)
+		}
+	}
+	return adminOK
+}
+
+// adminReopen reopens every stream's log by name, like Reopen does on
+// SIGHUP for the logs alone.
+func adminReopen(s *Server, conn net.Conn, args string) string {
+	for _, c := range s.counters() {
+		if err := c.Reopen(); err != nil {
+			return fmt.Sprintf("ERR %v\n", err)
+		}
+	}
+	s.log.Info("reopened logs over admin", "remote", conn.RemoteAddr().String())
+	return adminOK
+}
+
+// adminDisconnect cancels the contexts of the connections from args,
+// which hangs up on them.
+func adminDisconnect(s *Server, conn net.Conn, args string) string {
+	if args == "" {
+		return "ERR usage: DISCONNECT <ip:port or ip>\n"
+	}
+	var n int
+	for _, c := range s.counters() {
+		c.mu.RLock()
+		for cs := range c.conns {
+			if cs.remote == args || hostOf(cs.remote) == args {
+				cs.cancel()
+				n++
+			}
+		}
+		c.mu.RUnlock()
+	}
+	if n == 0 {
+		return "ERR no connection from " + args + "\n"
+	}
+	s.audit.Record(auditDisconnected, args, fmt.Sprintf("%d connections hung up on over admin", n))
+	s.log.Info("hung up over admin", "remote", args, "conns", n, "admin", conn.RemoteAddr().String())
+	return adminOK
+}
+
+func adminShutdown(s *Server, conn net.Conn, args string) string {
+	s.audit.Record(auditTerminate, conn.RemoteAddr().String(), "shutdown requested over admin")
+	s.terminateOnce.Do(func() { close(s.terminated) })
+	return adminOK
+}
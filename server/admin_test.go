@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminReopen(t *testing.T) {
+	cfg := testConfig(t)
+	srv, addr := serveTest(t, cfg)
+	send(t, addr, "1234567890")
+
+	// logrotate moves the segment away, REOPEN starts a new one in place.
+	seg := filepath.Join(cfg.LogDir, "data.0.log")
+	if err := srv.counter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(seg, seg+".1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	if reply := adminCommands["REOPEN"](srv, conn, ""); reply != adminOK {
+		t.Fatalf("REOPEN = %q, want %q", reply, adminOK)
+	}
+
+	send(t, addr, "2345678901")
+	if err := srv.counter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{seg + ".1": "1234567890\n", seg: "2345678901\n"} {
+		logged, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(logged) != want {
+			t.Errorf("%s is %q, want %q", filepath.Base(path), logged, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// errAffineClosed is what an affineSet returns once it's closed.
+var errAffineClosed = errors.New("the dedup shards are closed")
+
+// affineSet is the map dedup of Config.DedupAffine: shards by value
+// like shardedSet's, but each shard's map is only ever touched by a
+// worker of its own, locked to an OS thread and, on linux, that thread
+// to a CPU. Lookups are handed to the worker of their shard and waited
+// for, so a shard's map stays in the cache of one core instead of
+// moving between those of the connections using it. That's only a win
+// with as many busy cores as shards, on big hosts.
+type affineSet struct {
+	shards []affineShard
+	done   chan struct{}
+	wg     sync.WaitGroup
+	close  sync.Once
+}
+
+type affineShard struct {
+	// reqs is unbuffered, a request sent is being served.
+	reqs chan *affineReq
+	// n is the values in the shard's map.
+	n atomic.Int64
+	// Keep every shard on a cache line of its own, like mapShard.
+	_ [48]byte
+}
+
+// The kinds of affineReq.
+const (
+	affineAdd = iota
+	affineHas
+	affineRemove
+	affineBatch
+)
+
+// affineReq is a lookup for a shard's worker, which answers on done.
+type affineReq struct {
+	kind int
+	num  int
+	ok   bool
+	// nums of affineBatch are added, uniq says which were new.
+	nums []int
+	uniq []bool
+	done chan *affineReq
+}
+
+var affineReqs = sync.Pool{New: func() any {
+	return &affineReq{done: make(chan *affineReq, 1)}
+}}
+
+// newAffineSet starts a worker for each of n shards, shard i on the
+// i-th CPU the process may run on, counting round. It fails if a
+// worker's thread can't be pinned.
+func newAffineSet(n int) (*affineSet, error) {
+	cpus, err := allowedCPUs()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the CPUs to pin the dedup shards to: %v", err)
+	}
+	s := &affineSet{shards: make([]affineShard, n), done: make(chan struct{})}
+	pinned := make(chan error, n)
+	for i := range s.shards {
+		s.shards[i].reqs = make(chan *affineReq)
+		cpu := -1
+		if len(cpus) > 0 {
+			cpu = cpus[i%len(cpus)]
+		}
+		s.wg.Add(1)
+		go s.work(&s.shards[i], cpu, pinned)
+	}
+	for range s.shards {
+		if perr := <-pinned; perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("could not pin a dedup shard: %v", err)
+	}
+	return s, nil
+}
+
+// work serves the lookups of sh until the set is closed, on a thread
+// of its own pinned to cpu, unless it's -1. The map is made here, so
+// it's allocated on the CPU's NUMA node.
+// Must be run on go routine.
+func (s *affineSet) work(sh *affineShard, cpu int, pinned chan<- error) {
+	defer s.wg.Done()
+	// The thread is left locked when the worker ends, so it's thrown
+	// away rather than reused pinned.
+	runtime.LockOSThread()
+	if cpu >= 0 {
+		if err := pinThread(cpu); err != nil {
+			pinned <- err
+			return
+		}
+	}
+	pinned <- nil
+
+	m := make(map[int]bool)
+	for {
+		var r *affineReq
+		select {
+		case r = <-sh.reqs:
+		case <-s.done:
+			return
+		}
+		switch r.kind {
+		case affineAdd:
+			r.ok = !m[r.num]
+			if r.ok {
+				m[r.num] = true
+				sh.n.Add(1)
+			}
+		case affineHas:
+			r.ok = m[r.num]
+		case affineRemove:
+			if m[r.num] {
+				delete(m, r.num)
+				sh.n.Add(-1)
+			}
+		case affineBatch:
+			for i, num := range r.nums {
+				r.uniq[i] = !m[num]
+				if r.uniq[i] {
+					m[num] = true
+					sh.n.Add(1)
+				}
+			}
+		}
+		r.done <- r
+	}
+}
+
+// shard returns the shard of num, values are spread by their remainder.
+func (s *affineSet) shard(num int) int {
+	return int(uint(num) % uint(len(s.shards)))
+}
+
+// send hands r to the worker of shard i, it fails once the set is closed.
+func (s *affineSet) send(i int, r *affineReq) error {
+	select {
+	case s.shards[i].reqs <- r:
+		return nil
+	case <-s.done:
+		return errAffineClosed
+	}
+}
+
+// do runs a lookup of num on its shard's worker.
+func (s *affineSet) do(kind, num int) (bool, error) {
+	r := affineReqs.Get().(*affineReq)
+	defer affineReqs.Put(r)
+	r.kind, r.num = kind, num
+	if err := s.send(s.shard(num), r); err != nil {
+		return false, err
+	}
+	<-r.done
+	return r.ok, nil
+}
+
+func (s *affineSet) Add(num int) (bool, error) { return s.do(affineAdd, num) }
+func (s *affineSet) Has(num int) (bool, error) { return s.do(affineHas, num) }
+
+func (s *affineSet) Remove(num int) error {
+	_, err := s.do(affineRemove, num)
+	return err
+}
+
+// AddBatch hands every shard nums land in its values at once, the
+// workers add them at the same time.
+func (s *affineSet) AddBatch(nums []int) ([]bool, error) {
+	reqs := make([]*affineReq, len(s.shards))
+	idx := make([][]int, len(s.shards))
+	for i, num := range nums {
+		sh := s.shard(num)
+		if reqs[sh] == nil {
+			reqs[sh] = &affineReq{kind: affineBatch, done: make(chan *affineReq, 1)}
+		}
+		reqs[sh].nums = append(reqs[sh].nums, num)
+		idx[sh] = append(idx[sh], i)
+	}
+	var sent []*affineReq
+	var err error
+	for sh, r := range reqs {
+		if r == nil {
+			continue
+		}
+		r.uniq = make([]bool, len(r.nums))
+		if err = s.send(sh, r); err != nil {
+			break
+		}
+		sent = append(sent, r)
+	}
+	for _, r := range sent {
+		<-r.done
+	}
+	if err != nil {
+		// The set is closed, what the workers served went with it.
+		return nil, err
+	}
+
+	uniq := make([]bool, len(nums))
+	for sh, r := range reqs {
+		if r == nil {
+			continue
+		}
+		for k, i := range idx[sh] {
+			uniq[i] = r.uniq[k]
+		}
+	}
+	return uniq, nil
+}
+
+// Len adds up the counts of the shards, values added meanwhile may or
+// may not be counted.
+func (s *affineSet) Len() (int, error) {
+	n := int64(0)
+	for i := range s.shards {
+		n += s.shards[i].n.Load()
+	}
+	return int(n), nil
+}
+
+// Close stops the workers, their maps go with them.
+func (s *affineSet) Close() error {
+	s.close.Do(func() { close(s.done) })
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// cpuSet is the kernel's cpu_set_t, of up to 1024 CPUs.
+type cpuSet [16]uint64
+
+// allowedCPUs returns the CPUs the calling thread may run on, those
+// the process was started with unless it was pinned.
+func allowedCPUs() ([]int, error) {
+	var set cpuSet
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if errno != 0 {
+		return nil, errno
+	}
+	var cpus []int
+	for i := 0; i < len(set)*64; i++ {
+		if set[i/64]&(1<<uint(i%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus, nil
+}
+
+// pinThread binds the calling thread to cpu, the goroutine must be
+// locked to it.
+func pinThread(cpu int) error {
+	var set cpuSet
+	set[cpu/64] |= 1 << uint(cpu%64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
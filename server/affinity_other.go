@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+// allowedCPUs returns no CPUs, threads can only be pinned on linux, the
+// workers of the dedup shards are locked to threads of their own only.
+func allowedCPUs() ([]int, error) { return nil, nil }
+
+func pinThread(cpu int) error { return nil }
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archive compresses segment seg of the log named after format,
+// once it's rotated, and deletes the segments past the retention.
+// It runs on its own goroutine, the rotation doesn't wait for it,
+// but Counter.StopLogIntvl does.
+func (o *segmentOptions) archive(format string, seg int) {
+	if !o.compress && o.retain == 0 {
+		return
+	}
+
+	o.archiving.Add(1)
+	go func() {
+		defer o.archiving.Done()
+		// One at a time, so a segment being compressed isn't pruned under us.
+		o.archiveMu.Lock()
+		defer o.archiveMu.Unlock()
+
+		if o.compress {
+			for _, name := range o.names(format, seg) {
+				if err := compressFile(name); err != nil {
+					o.log.Error("could not compress log segment", "segment", name, "err", err)
+				}
+			}
+		}
+		if o.retain > 0 {
+			if err := prune(format, seg-o.retain); err != nil {
+				o.log.Error("could not delete old log segments", "err", err)
+			}
+		}
+	}()
+}
+
+// names are the files segment seg of the log named after format is written to.
+func (o *segmentOptions) names(format string, seg int) []string {
+	if o.partitions <= 1 {
+		return []string{fmt.Sprintf(format, seg)}
+	}
+	names := make([]string, o.partitions)
+	for i := range names {
+		names[i] = partitionName(format, seg, i)
+	}
+	return names
+}
+
+// compressFile gzips name to name.gz and removes name.
+// The gzip file only shows up once it's complete.
+func compressFile(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	tmp := name + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not compress %s: %v", name, err)
+	}
+	return os.Remove(name)
+}
+
+// prune deletes the segments up to and including last of the log named
+// after format, compressed or not, with all of their partitions.
+func prune(format string, last int) error {
+	if last < 0 {
+		return nil
+	}
+
+	dir, pattern := filepath.Split(format)
+	segs, err := LogSegments(filepath.Clean(dir), strings.TrimSuffix(pattern, ".%d.log"))
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		if seg.Seg > last {
+			break
+		}
+		if err = os.Remove(seg.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
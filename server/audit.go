@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event names.
+const (
+	auditBusy         = "busy"
+	auditFlood        = "malformed_flood"
+	auditOversized    = "oversized_line"
+	auditBadStream    = "bad_stream"
+	auditTerminate    = "terminate"
+	auditBadProxy     = "bad_proxy_header"
+	auditRateLimited  = "rate_limited"
+	auditDenied       = "denied"
+	auditAuthFailed   = "auth_failed"
+	auditTimeout      = "timeout"
+	auditDisconnected = "disconnected"
+)
+
+// auditGenesis is the previous hash of the very first record in a log.
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// AuditRecord is one line of the audit log.
+//
+// Records are chained: Hash is the SHA-256 of the previous record's hash
+// followed by this record's JSON encoding with an empty Hash.
+// Editing, removing or reordering a record breaks the chain from
+// that point on, which VerifyAudit detects.
+type AuditRecord struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Remote string    `json:"remote,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+func (r AuditRecord) digest() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(r.Prev), b...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an append-only, hash chained log of rejected and anomalous activity.
+// Records go straight to the file, unbuffered, since they're rare
+// and matter most right before things go wrong.
+type AuditLog struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+	seq  uint64
+	prev string
+	// hosts names the remote addresses, nil without reverse DNS.
+	hosts *reverseDNS
+	// log is where failing writes are reported.
+	log *slog.Logger
+}
+
+// OpenAuditLog opens the audit log at name for appending,
+// continuing the chain of any records already in it.
+func OpenAuditLog(name string) (*AuditLog, error) {
+	a := &AuditLog{name: name, prev: auditGenesis, log: slog.Default()}
+
+	last, err := lastAuditRecord(name)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		a.seq, a.prev = last.Seq, last.Hash
+	}
+
+	a.f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %v", err)
+	}
+	return a, nil
+}
+
+// lastAuditRecord returns the last record of an existing audit log, if any.
+func lastAuditRecord(name string) (*AuditRecord, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var last *AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("corrupt audit log record after seq %d: %v", seqOf(last), err)
+		}
+		last = &r
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read audit log: %v", err)
+	}
+	return last, nil
+}
+
+func seqOf(r *AuditRecord) uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.Seq
+}
+
+// Record appends an event to the log.
+// A nil AuditLog drops the event, so callers don't need to check
+// whether auditing is enabled.
+func (a *AuditLog) Record(event, remote, detail string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r := AuditRecord{
+		Seq:    a.seq + 1,
+		Time:   time.Now().UTC(),
+		Event:  event,
+		Remote: remote,
+		Host:   a.hosts.name(remote),
+		Detail: detail,
+		Prev:   a.prev,
+	}
+
+	var err error
+	if r.Hash, err = r.digest(); err != nil {
+		a.log.Error("could not encode audit record", "err", err)
+		return
+	}
+
+	b, _ := json.Marshal(r)
+	if _, err = a.f.Write(append(b, '\n')); err != nil {
+		a.log.Error("could not write audit record", "err", err)
+		return
+	}
+
+	a.seq, a.prev = r.Seq, r.Hash
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// Reopen closes the audit log file and opens it again by name,
+// so an external logrotate can move it away. The chain carries on
+// into the new file, verify rotated files together, oldest first.
+func (a *AuditLog) Reopen() (err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err = a.f.Close(); err != nil {
+		return fmt.Errorf("could not close audit log: %v", err)
+	}
+
+	a.f, err = os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not reopen audit log: %v", err)
+	}
+	return
+}
+
+// move closes the audit log file and carries on appending to name.
+// The chain continues into it, like after Reopen.
+func (a *AuditLog) move(name string) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %v", err)
+	}
+	if err = a.f.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not close audit log: %v", err)
+	}
+	a.f, a.name = f, name
+	return
+}
+
+// VerifyAudit walks audit logs and checks every link of the chain.
+// Logs split by rotation are passed oldest first,
+// the chain continues from one file into the next.
+// It returns the number of valid records.
+func VerifyAudit(names ...string) (n int, err error) {
+	prev := auditGenesis
+	for _, name := range names {
+		if prev, err = verifyAuditFile(name, prev, &n); err != nil {
+			return
+		}
+	}
+	return n, nil
+}
+
+// verifyAuditFile checks the chain in a single file, starting from prev.
+// It returns the hash the next file has to continue from.
+func verifyAuditFile(name, prev string, n *int) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return prev, fmt.Errorf("could not open audit log: %v", err)
+	}
+	defer f.Close()
+
+	line := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+		var r AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return prev, fmt.Errorf("%s line %d: corrupt record: %v", name, line, err)
+		}
+
+		if r.Prev != prev {
+			return prev, fmt.Errorf("%s line %d (seq %d): chain broken, previous hash does not match", name, line, r.Seq)
+		}
+
+		sum, err := r.digest()
+		if err != nil {
+			return prev, err
+		}
+		if sum != r.Hash {
+			return prev, fmt.Errorf("%s line %d (seq %d): record was modified", name, line, r.Seq)
+		}
+
+		prev = r.Hash
+		*n++
+	}
+
+	if err = scanner.Err(); err != nil {
+		return prev, fmt.Errorf("could not read audit log: %v", err)
+	}
+	return prev, nil
+}
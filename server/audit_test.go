@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAudit records n events to a new audit log and returns its name.
+func writeAudit(t *testing.T, n int) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		a.Record(auditDenied, "192.0.2.1:5000", "attempt "+string(rune('a'+i)))
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func auditLines(t *testing.T, name string) []string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAuditChain(t *testing.T) {
+	name := writeAudit(t, 3)
+	if n, err := VerifyAudit(name); err != nil || n != 3 {
+		t.Fatalf("VerifyAudit = %d, %v, want 3 records intact", n, err)
+	}
+
+	// Opened again the chain carries on.
+	a, err := OpenAuditLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(auditTimeout, "192.0.2.1:5000", "")
+	// And into the file a logrotate leaves after moving it away.
+	rotated := name + ".1"
+	if err := os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	a.Record(auditTimeout, "192.0.2.1:5000", "")
+	a.Close()
+
+	lines := auditLines(t, name)
+	var r AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil || r.Seq != 5 {
+		t.Errorf("first record after the rotation is seq %d, %v, want 5", r.Seq, err)
+	}
+	if n, err := VerifyAudit(rotated, name); err != nil || n != 5 {
+		t.Errorf("VerifyAudit = %d, %v, want 5 records intact", n, err)
+	}
+	// Out of order the files don't chain.
+	if _, err := VerifyAudit(name, rotated); err == nil || !strings.Contains(err.Error(), "chain broken") {
+		t.Errorf("err = %v verifying the files newest first, want the chain broken", err)
+	}
+
+	var none *AuditLog
+	none.Record(auditDenied, "", "")
+	if err := none.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditTamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		// n is the records verified before the chain fails.
+		n   int
+		err string
+	}{
+		{"edited", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "attempt b", "attempt z", 1)
+			return lines
+		}, 1, "line 2 (seq 2): record was modified"},
+		{"edited and rehashed", func(lines []string) []string {
+			var r AuditRecord
+			json.Unmarshal([]byte(lines[1]), &r)
+			r.Detail = "attempt z"
+			r.Hash, _ = r.digest()
+			b, _ := json.Marshal(r)
+			lines[1] = string(b)
+			return lines
+		}, 2, "line 3 (seq 3): chain broken"},
+		{"removed", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, 1, "line 2 (seq 3): chain broken"},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, "line 2 (seq 3): chain broken"},
+		{"first removed", func(lines []string) []string {
+			return lines[1:]
+		}, 0, "line 1 (seq 2): chain broken"},
+		{"corrupt", func(lines []string) []string {
+			lines[2] = lines[2][:10]
+			return lines
+		}, 2, "line 3: corrupt record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := writeAudit(t, 4)
+			lines := tt.tamper(auditLines(t, name))
+			if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			n, err := VerifyAudit(name)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			if n != tt.n {
+				t.Errorf("%d records verified, want %d", n, tt.n)
+			}
+		})
+	}
+
+	if _, err := VerifyAudit(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("verified an audit log that isn't there")
+	}
+}
+
+func TestOpenAuditLogCorrupt(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	os.WriteFile(name, []byte("{\"seq\":1\n"), 0600)
+	if _, err := OpenAuditLog(name); err == nil || !strings.Contains(err.Error(), "corrupt audit log") {
+		t.Errorf("err = %v, want the log refused as corrupt", err)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// authCmd must be the first line with Config.AuthToken set,
+	// followed by a space and the token, see handleAuth.
+	authCmd = "AUTH"
+	// authTimeout is how long a client has to authenticate.
+	authTimeout = 10 * time.Second
+)
+
+// errUnauthorized hangs up on a client that didn't authenticate.
+var errUnauthorized = errors.New("not authenticated")
+
+// tokenOK reports whether token is Config.AuthToken.
+func (s *Server) tokenOK(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AuthToken)) == 1
+}
+
+// readFirstLine reads the line a connection has to authenticate with
+// off r, nil if it didn't send one in time. ReadSlice is bounded by r's
+// buffer, a huge first line can't eat memory.
+func readFirstLine(conn net.Conn, r *bufio.Reader) []byte {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	line, err := r.ReadSlice('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil
+	}
+	return bytes.TrimRight(line, "\r\n")
+}
+
+// authenticate reads the AUTH line of an admin or peer connection off r
+// and checks its token. Those that don't send the right one in time get
+// unauthorizedReply, the caller hangs up.
+func (s *Server) authenticate(conn net.Conn, r *bufio.Reader) bool {
+	given := string(readFirstLine(conn, r))
+	if token, ok := strings.CutPrefix(given, authCmd+" "); ok && s.tokenOK(token) {
+		return true
+	}
+	s.audit.Record(auditAuthFailed, conn.RemoteAddr().String(), "missing or wrong token")
+	io.WriteString(conn, unauthorizedReply)
+	return false
+}
+
+// authenticateClient dispatches the first line of a client, read off r
+// before the handshake so binary and compressed sessions start
+// authenticated too. Until the client is, dispatch lets nothing but AUTH
+// through. Nothing is sent on success, so a client can pipeline its
+// values right behind the AUTH line.
+func (s *Server) authenticateClient(cl *client, r *bufio.Reader) error {
+	return dispatch(cl, readFirstLine(cl.conn, r))
+}
+
+// handleAuth authenticates the client if args is Config.AuthToken, and
+// hangs up on it otherwise. Without a token AUTH is a value like any
+// other line.
+func handleAuth(cl *client, args string) error {
+	if cl.srv.cfg.AuthToken == "" {
+		return handleValue(cl, []byte(authCmd+" "+args))
+	}
+	if !cl.srv.tokenOK(args) {
+		return cl.unauthorized()
+	}
+	cl.authed = true
+	return nil
+}
+
+// unauthorized records a client that didn't authenticate, and sends it
+// unauthorizedReply before hanging up.
+func (cl *client) unauthorized() error {
+	cl.srv.audit.Record(auditAuthFailed, cl.conn.RemoteAddr().String(), "missing or wrong token")
+	cl.reply(unauthorizedReply)
+	cl.flush()
+	return errUnauthorized
+}
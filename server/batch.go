@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+)
+
+// batchLimit returns the longest line the server takes: maxLine, or
+// with Config.MaxBatch a whole batch of the longest values, behind the
+// longest stream prefix.
+func (s *Server) batchLimit() (int, error) {
+	if s.cfg.MaxBatch == 0 {
+		return maxLine, nil
+	}
+	n := s.cfg.MaxBatch * (s.profile.length + 1)
+	for _, st := range s.streams {
+		if m := len(st.prefix) + 1 + s.cfg.MaxBatch*(st.counter.profile.length+1); m > n {
+			n = m
+		}
+	}
+	if n > bufio.MaxScanTokenSize {
+		return 0, fmt.Errorf("a batch of %d values takes lines of up to %d bytes, over the limit of %d",
+			s.cfg.MaxBatch, n, bufio.MaxScanTokenSize)
+	}
+	if n < maxLine {
+		n = maxLine
+	}
+	return n, nil
+}
+
+// recordLine records the value of a line, or each value of a batch
+// line with Config.MaxBatch.
+func recordLine(cl *client, counter *Counter, line []byte) error {
+	if cl.srv.cfg.MaxBatch > 0 && bytes.IndexByte(line, ',') >= 0 {
+		return recordBatch(cl, counter, line)
+	}
+	return recordValue(cl, counter, line)
+}
+
+// recordBatch records the comma separated values of a batch line, and
+// answers with how many were new, duplicates and malformed. The values
+// are checked like lines of their own, then those valid are recorded
+// in one Counter.RecordBatch. A batch over Config.MaxBatch counts as
+// one malformed line, none of its values are recorded, and so are none
+// of a batch with a malformed value under Config.Quiet, which hangs up.
+func recordBatch(cl *client, counter *Counter, line []byte) error {
+	if bytes.Count(line, []byte{','}) >= cl.srv.cfg.MaxBatch {
+		cl.span.decide("malformed")
+		if !cl.srv.cfg.Quiet {
+			if err := cl.reply(batchTooLargeReply); err != nil {
+				return err
+			}
+		}
+		return cl.malformed("")
+	}
+
+	values, uniques, malformed := cl.stats.values, cl.stats.uniques, cl.stats.malformed
+	cl.inBatch = true
+	defer func() { cl.inBatch = false }()
+	nums := make([]int, 0, bytes.Count(line, []byte{','})+1)
+	for len(line) > 0 {
+		v := line
+		if i := bytes.IndexByte(line, ','); i >= 0 {
+			v, line = line[:i], line[i+1:]
+		} else {
+			line = nil
+		}
+		num, err := counter.validate(v)
+		cl.span.mark("parse")
+		if err != nil {
+			cl.span.decide("malformed")
+			if err := cl.malformed(invalidReply(err)); err != nil {
+				return err
+			}
+			continue
+		}
+		ok, err := acceptNum(cl, counter, num)
+		if err != nil {
+			return err
+		}
+		if ok {
+			nums = append(nums, num)
+		}
+	}
+	if len(nums) > 0 {
+		uniq, err := counter.recordBatch(nums, cl.span)
+		for i, u := range uniq {
+			sawNum(cl, counter, nums[i], u)
+		}
+		if err != nil {
+			return recordFailed(cl, counter, nums[len(uniq)], err)
+		}
+	}
+	cl.span.decide("batch")
+
+	uniques = cl.stats.uniques - uniques
+	return cl.reply(fmt.Sprintf("OK new=%d dup=%d malformed=%d\n",
+		uniques, cl.stats.values-values-uniques, cl.stats.malformed-malformed))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The benchmarks of the hot path: parsing lines, HasValue and RecordUniq
+// under contention, and whole connections over a loopback listener, long
+// lived ones and one per value. make bench runs them with profiles.
+
+func BenchmarkParseValid(b *testing.B) {
+	benchParse(b, fmt.Sprintf("%0*d", ValidLen, MinValue+12345))
+}
+
+func BenchmarkParseMalformed(b *testing.B) {
+	benchParse(b, "12345abcde")
+}
+
+func benchParse(b *testing.B, line string) {
+	p := []byte(line + "\n")
+	for i := 0; i < b.N; i++ {
+		ParseLine(p)
+	}
+}
+
+// benchCounter returns a Counter logging to a temporary directory,
+// it's closed when the benchmark ends.
+func benchCounter(b *testing.B) *Counter {
+	c, err := NewCounter(DefaultMaxConns, filepath.Join(b.TempDir(), "data.%d.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.FlushClose() })
+	return c
+}
+
+// benchKeys is the keyspace of the contention benchmarks, small enough
+// for values to collide between goroutines.
+const benchKeys = 1 << 16
+
+func BenchmarkHasValueParallel(b *testing.B) {
+	c := benchCounter(b)
+	for i := 0; i < benchKeys; i += 2 {
+		c.RecordUniq(MinValue + i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			c.HasValue(MinValue + rnd.Intn(benchKeys))
+		}
+	})
+}
+
+func BenchmarkRecordUniqParallel(b *testing.B) {
+	benchRecordUniq(b, nil)
+}
+
+func BenchmarkRecordUniqShardedParallel(b *testing.B) {
+	benchRecordUniq(b, func(n int) (Store, error) { return newShardedSet(n), nil })
+}
+
+// BenchmarkRecordUniqAffineParallel is the sharded one with a pinned
+// worker per shard, see Config.DedupAffine. On a small host the hand-off
+// to the workers costs more than it saves, it takes many cores to win.
+func BenchmarkRecordUniqAffineParallel(b *testing.B) {
+	benchRecordUniq(b, func(n int) (Store, error) { return newAffineSet(n) })
+}
+
+// benchRecordUniq records new values into the single map, or into the
+// Store newSet makes of a shard per CPU like the server's default.
+func benchRecordUniq(b *testing.B, newSet func(n int) (Store, error)) {
+	c := benchCounter(b)
+	if newSet != nil {
+		set, err := newSet(runtime.GOMAXPROCS(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { set.Close() })
+		c.Uniq, c.set, c.locked = nil, set, false
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := c.RecordUniq(MinValue + int(atomic.AddInt64(&next, 1))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRecordParallel(b *testing.B) {
+	c := benchCounter(b)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := c.Record(MinValue + rnd.Intn(benchKeys)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkConnection(b *testing.B) {
+	benchConns(b, 1)
+}
+
+func BenchmarkConnections6(b *testing.B) {
+	benchConns(b, DefaultMaxConns)
+}
+
+// benchConns sends b.N values to a server on a loopback listener,
+// spread over conns connections, each ending with a PING so the time
+// covers handling them all.
+func benchConns(b *testing.B, conns int) {
+	addr := benchServer(b, Config{})
+
+	// The lines are made up front, they aren't what's measured.
+	work := make([]string, conns)
+	for i := range work {
+		var sb strings.Builder
+		for n := i; n < b.N; n += conns {
+			fmt.Fprintf(&sb, "%0*d\n", ValidLen, MinValue+n)
+		}
+		sb.WriteString("PING\n")
+		work[i] = sb.String()
+	}
+
+	b.SetBytes(int64(ValidLen + 1))
+	b.ResetTimer()
+	done := make(chan error, conns)
+	for _, lines := range work {
+		go func(lines string) {
+			done <- benchSend(addr, lines)
+		}(lines)
+	}
+	for range work {
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkConnectionChurn opens a connection per value, which sends it
+// and a PING, so the time is mostly setting up and tearing down connections.
+func BenchmarkConnectionChurn(b *testing.B) {
+	// Closed connections may still hold their slot when the next comes.
+	addr := benchServer(b, Config{MaxConns: 1024})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := benchSend(addr, fmt.Sprintf("%0*d\nPING\n", ValidLen, MinValue+i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+// benchServer serves cfg, logging to a temporary directory, on a
+// loopback listener until the benchmark ends, and returns its address.
+func benchServer(b *testing.B, cfg Config) string {
+	cfg.LogDir = b.TempDir()
+	cfg.Output = io.Discard
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv, err := New(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { srv.Shutdown(context.Background()) })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go srv.Serve(l)
+	return l.Addr().String()
+}
+
+// benchSend sends lines to addr and waits for the PONG they end with.
+func benchSend(addr, lines string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go io.WriteString(conn, lines)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no PONG: %v", err)
+		}
+		if line == pongReply {
+			return nil
+		}
+	}
+}
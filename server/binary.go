@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// binaryMagic is the first byte of a binary session, it can't start a
+// line. After it the client sends every value as a 4 byte big endian
+// unsigned integer, no lines, no commands and no replies, so values
+// take less than half the bytes and aren't parsed at all. A value is
+// valid if it's in the range of the stream's profile, leading zeros
+// are implied, see valueProfile.inRange. Values over 4294967295 can't
+// be sent.
+const binaryMagic = 0xB1
+
+// binaryValueLen is the size of a binary value.
+const binaryValueLen = 4
+
+// serveBinary records the values of a binary session read from in,
+// through buf, until the client hangs up. It returns the error that
+// ended reading, nil if the client hung up or was hung up on.
+// An incomplete value the client hung up in the middle of is malformed.
+func (s *Server) serveBinary(cl *client, in io.Reader, buf []byte, ip string) error {
+	p := cl.counter.profile
+	n := 0
+	for {
+		m, err := in.Read(buf[n:])
+		n += m
+		full := n - n%binaryValueLen
+		for i := 0; i < full; i += binaryValueLen {
+			if !s.limits.allow(ip) {
+				s.audit.Record(auditRateLimited, cl.conn.RemoteAddr().String(), "per IP line rate exceeded")
+				cl.reply(rateLimitedReply)
+				cl.flush()
+				return nil
+			}
+
+			start := s.metrics.start()
+			num := int(binary.BigEndian.Uint32(buf[i:]))
+			if !p.inRange(num) {
+				if cl.malformed("") != nil {
+					return nil
+				}
+			} else if recordNum(cl, cl.counter, num) != nil {
+				return nil
+			}
+			s.metrics.handled(start)
+		}
+		n = copy(buf, buf[full:n])
+
+		if err == io.EOF {
+			if n > 0 {
+				cl.malformed("")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// binaryValues is a binary session sending nums.
+func binaryValues(nums ...uint32) string {
+	b := []byte{binaryMagic}
+	for _, n := range nums {
+		b = binary.BigEndian.AppendUint32(b, n)
+	}
+	return string(b)
+}
+
+func TestBinarySession(t *testing.T) {
+	cfg := testConfig(t)
+	orders := freeAddr(t)
+	cfg.Streams = []string{"orders:port=" + orders[strings.LastIndexByte(orders, ':')+1:] + ",len=9,min=100000000"}
+	srv, addr := serveTest(t, cfg)
+	// Once the main listener answers, the stream's is up.
+	send(t, addr)
+
+	// More values than a read takes, some split across reads.
+	var nums []uint32
+	var want strings.Builder
+	for i := range uint32(3000) {
+		nums = append(nums, MinValue+i, MinValue+i)
+		fmt.Fprintln(&want, MinValue+i)
+	}
+	if got := converse(t, addr, binaryValues(nums...)); got != "" {
+		t.Errorf("a binary session got %q, want no replies", got)
+	}
+	// An incomplete value at the end is dropped.
+	converse(t, addr, binaryValues(4294967295)+"\x00\x00\x01")
+	fmt.Fprintln(&want, uint32(4294967295))
+	// The first invalid value hangs up, the values after it are lost.
+	converse(t, addr, binaryValues(1234567890, 12345, 1234567891))
+	fmt.Fprintln(&want, 1234567890)
+
+	// A stream's values are in the range of its profile.
+	converse(t, orders, binaryValues(100000000, 999999999, 1000000000, 100000001))
+
+	srv.Shutdown(context.Background())
+	for name, want := range map[string]string{
+		"data.0.log":   want.String(),
+		"orders.0.log": "100000000\n999999999\n",
+	} {
+		if logged, err := os.ReadFile(filepath.Join(cfg.LogDir, name)); err != nil || string(logged) != want {
+			t.Errorf("%s is %.100q, %v, want %.100q", name, logged, err, want)
+		}
+	}
+	if stats := srv.Stats()[""]; stats.Unique != 3002 || stats.Total != 6002 {
+		t.Errorf("Stats() = %d unique, %d total, want 3002, 6002", stats.Unique, stats.Total)
+	}
+}
+
+func TestBinarySkipInvalid(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SkipInvalid = true
+	srv, addr := serveTest(t, cfg)
+
+	converse(t, addr, binaryValues(12345, 1234567890, 999999, 1234567891)+"\x01")
+	if uniq, total, _ := srv.Counts(); uniq != 2 || total != 2 {
+		t.Errorf("Counts() = %d unique, %d total, want the 2 valid values", uniq, total)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// bitSetHeader is the size of a bitset file's header, a page, so the
+// words after it are aligned however the file is mapped.
+const bitSetHeader = 4096
+
+// bitSetMagic starts a bitset file, bitSetVersion is the layout of the
+// header that follows it:
+//
+//	[0:8]    magic
+//	[8:12]   version
+//	[12:16]  flags, bitSetClean if it was closed cleanly
+//	[16:24]  the smallest value, the first bit
+//	[24:32]  the number of bits
+//	[32:40]  the values set, only if clean
+//	[40:48]  when it was last synced, Unix nanoseconds
+//	[64:]    a note on how consistent the file is, NUL terminated
+//
+// Everything is little endian.
+const (
+	bitSetMagic   = "GSTSBITS"
+	bitSetVersion = 1
+	bitSetClean   = 1
+)
+
+// mappedBitSet is the bitset dedup kept in a file of the stream's under
+// Config.BitSetDir, mapped into memory: it's as fast as the bitSet and
+// kept across restarts. The file is written back as Config.BitSetSync
+// says and on Close. A file that wasn't closed cleanly, the process or
+// the host crashed, is recounted when it's opened: after a process
+// crash every value is still set, the kernel writes the pages back, but
+// after a power failure the values set since the last sync may be lost
+// and be logged again when they're resent, unless the log is recovered.
+type mappedBitSet struct {
+	*bitSet
+	m    *fileMap
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// bitSetNote is the note in the header of a file synced every interval.
+func bitSetNote(interval time.Duration) string {
+	policy := "the values set since the last sync may be lost to a power failure, syncs are left to the OS"
+	if interval > 0 {
+		policy = fmt.Sprintf("the values set up to %v before a power failure may be lost, it's synced every %v", interval, interval)
+	}
+	return "unclean: recount on open, a process crash loses nothing, " + policy
+}
+
+// openMappedBitSet opens the bitset file of stream for the values of p,
+// creating it if need be.
+func openMappedBitSet(cfg Config, stream string, p valueProfile) (Store, error) {
+	if err := os.MkdirAll(cfg.BitSetDir, 0777); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cfg.BitSetDir, streamBase(stream)+".bits")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	b, m, err := mapBitSet(f, p)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("bitset file %s: %v", path, err)
+	}
+	mb := &mappedBitSet{bitSet: b, m: m, done: make(chan struct{})}
+	// Until it's closed the count in the header is stale.
+	hdr := m.data[:bitSetHeader]
+	binary.LittleEndian.PutUint32(hdr[12:], 0)
+	clear(hdr[64:])
+	copy(hdr[64:bitSetHeader-1], bitSetNote(cfg.BitSetSync))
+	if err = mb.sync(); err != nil {
+		m.close()
+		return nil, fmt.Errorf("bitset file %s: %v", path, err)
+	}
+	if cfg.BitSetSync > 0 {
+		mb.wg.Add(1)
+		go mb.syncEvery(cfg.BitSetSync)
+	}
+	return mb, nil
+}
+
+// mapBitSet maps f as the bitset of the values of p, laying it out if
+// it's empty, and counts the values set if it wasn't closed cleanly.
+func mapBitSet(f *os.File, p valueProfile) (*bitSet, *fileMap, error) {
+	if err := lockFile(f); err != nil {
+		return nil, nil, fmt.Errorf("in use by another process: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	nbits := int64(p.max() - p.lowest() + 1)
+	size := bitSetHeader + (nbits+63)/64*8
+	fresh := fi.Size() == 0
+	if fresh {
+		if err = f.Truncate(size); err != nil {
+			return nil, nil, err
+		}
+	} else if fi.Size() != size {
+		return nil, nil, fmt.Errorf("%d bytes, not the %d of a bitset of the values from %d to %d", fi.Size(), size, p.lowest(), p.max())
+	}
+	m := &fileMap{f: f}
+	if err = m.mmap(int(size)); err != nil {
+		return nil, nil, err
+	}
+	hdr := m.data[:bitSetHeader]
+	if fresh {
+		copy(hdr, bitSetMagic)
+		binary.LittleEndian.PutUint32(hdr[8:], bitSetVersion)
+		binary.LittleEndian.PutUint32(hdr[12:], bitSetClean)
+		binary.LittleEndian.PutUint64(hdr[16:], uint64(p.lowest()))
+		binary.LittleEndian.PutUint64(hdr[24:], uint64(nbits))
+	}
+	switch {
+	case !bytes.Equal(hdr[:8], []byte(bitSetMagic)):
+		err = fmt.Errorf("not a bitset file")
+	case binary.LittleEndian.Uint32(hdr[8:]) != bitSetVersion:
+		err = fmt.Errorf("bitset file version %d, want %d", binary.LittleEndian.Uint32(hdr[8:]), bitSetVersion)
+	case int64(binary.LittleEndian.Uint64(hdr[16:])) != int64(p.lowest()) || int64(binary.LittleEndian.Uint64(hdr[24:])) != nbits:
+		err = fmt.Errorf("a bitset of the values from %d, %d bits, not from %d to %d",
+			binary.LittleEndian.Uint64(hdr[16:]), binary.LittleEndian.Uint64(hdr[24:]), p.lowest(), p.max())
+	}
+	if err != nil {
+		m.close()
+		return nil, nil, err
+	}
+
+	words := m.data[bitSetHeader:]
+	b := &bitSet{min: p.lowest(), words: unsafe.Slice((*uint64)(unsafe.Pointer(&words[0])), len(words)/8)}
+	if binary.LittleEndian.Uint32(hdr[12:])&bitSetClean != 0 {
+		b.n = int64(binary.LittleEndian.Uint64(hdr[32:]))
+	} else {
+		for _, w := range b.words {
+			b.n += int64(bits.OnesCount64(w))
+		}
+	}
+	return b, m, nil
+}
+
+// sync writes the file back and records when in the header.
+func (mb *mappedBitSet) sync() error {
+	binary.LittleEndian.PutUint64(mb.m.data[40:], uint64(time.Now().UnixNano()))
+	return mb.m.msync()
+}
+
+// syncEvery syncs the file every interval until it's closed.
+// Must be run on go routine.
+func (mb *mappedBitSet) syncEvery(interval time.Duration) {
+	defer mb.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			mb.sync()
+		case <-mb.done:
+			return
+		}
+	}
+}
+
+// Close syncs the file, then marks it clean with the count of values.
+func (mb *mappedBitSet) Close() error {
+	close(mb.done)
+	mb.wg.Wait()
+	err := mb.sync()
+	if err == nil {
+		hdr := mb.m.data[:bitSetHeader]
+		binary.LittleEndian.PutUint64(hdr[32:], uint64(atomic.LoadInt64(&mb.n)))
+		binary.LittleEndian.PutUint32(hdr[12:], bitSetClean)
+		clear(hdr[64:])
+		copy(hdr[64:], "clean: closed with the count of values set")
+		err = mb.m.msync()
+	}
+	if cerr := mb.m.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBitSetProfile is a range of a thousand values, a small file.
+var testBitSetProfile = valueProfile{length: 4, min: 9000}
+
+func openTestBitSet(t *testing.T, cfg Config) *mappedBitSet {
+	t.Helper()
+	store, err := openMappedBitSet(cfg, "", testBitSetProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*mappedBitSet)
+}
+
+func TestMappedBitSet(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Dedup, cfg.BitSetDir = "bitset", t.TempDir()
+	store := openTestBitSet(t, cfg)
+	for _, num := range []int{9000, 9001, 9999, 9001} {
+		store.Add(num)
+	}
+	if n, _ := store.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3", n)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.BitSetDir, "data.bits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b[64:]), "clean") {
+		t.Errorf("note after Close = %q, want clean", strings.TrimRight(string(b[64:200]), "\x00"))
+	}
+
+	// The values and their count are there after a restart.
+	store = openTestBitSet(t, cfg)
+	if n, _ := store.Len(); n != 3 {
+		t.Errorf("Len after reopening = %d, want 3", n)
+	}
+	if uniq, err := store.Add(9999); err != nil || uniq {
+		t.Errorf("Add after reopening = %v, %v, want a duplicate", uniq, err)
+	}
+	store.Add(9500)
+	store.Remove(9000)
+
+	// A file that wasn't closed is counted again.
+	close(store.done)
+	store.m.close()
+	store = openTestBitSet(t, cfg)
+	defer store.Close()
+	if n, _ := store.Len(); n != 3 {
+		t.Errorf("Len after a crash = %d, want 3", n)
+	}
+	if has, _ := store.Has(9000); has {
+		t.Error("has a value removed before the crash")
+	}
+}
+
+func TestMappedBitSetSync(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Dedup, cfg.BitSetDir, cfg.BitSetSync = "bitset", t.TempDir(), time.Millisecond
+	store := openTestBitSet(t, cfg)
+	store.Add(9000)
+	time.Sleep(5 * time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMappedBitSetRejected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BitSetDir = t.TempDir()
+	store := openTestBitSet(t, cfg)
+	if runtime.GOOS != "windows" {
+		if _, err := openMappedBitSet(cfg, "", testBitSetProfile); err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("second open = %v, want it in use", err)
+		}
+	}
+	store.Close()
+
+	// Another range of values doesn't fit the file.
+	if _, err := openMappedBitSet(cfg, "", valueProfile{length: 4, min: 8000}); err == nil {
+		t.Error("opened the file for another range")
+	}
+	path := filepath.Join(cfg.BitSetDir, "other.bits")
+	b := make([]byte, bitSetHeader+16*8)
+	copy(b, "NOTBITS!")
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openMappedBitSet(cfg, "other", testBitSetProfile); err == nil || !strings.Contains(err.Error(), "not a bitset") {
+		t.Errorf("open of another file = %v, want not a bitset file", err)
+	}
+}
+
+func TestMappedBitSetConfig(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BitSetDir = t.TempDir()
+	if _, err := New(cfg); err == nil {
+		t.Error("New took a bitset directory without the bitset dedup")
+	}
+	cfg.Dedup = "bitset"
+	srv, _ := serveTest(t, cfg)
+	if err := srv.Restart(t.Context(), nil); err == nil {
+		t.Error("Restart handed over the bitset files")
+	}
+}
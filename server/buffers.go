@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// replyBufSize buffers a batch of replies, see client.reply.
+// Bigger batches go out in more than one write.
+const replyBufSize = 4096
+
+// The buffers of a connection come from pools, with thousands of short
+// lived connections a second they'd be most of the garbage otherwise.
+var (
+	helloReaders  = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, helloBufSize) }}
+	streamReaders = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, streamBufSize) }}
+	replyWriters  = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, replyBufSize) }}
+	// The scanner buffers by size, pointers so Put doesn't allocate.
+	legacyBufs = sync.Pool{New: func() interface{} { b := make([]byte, legacyBufSize); return &b }}
+	lineBufs   = sync.Pool{New: func() interface{} { b := make([]byte, lineBufSize); return &b }}
+)
+
+// connBuffers are the pooled buffers of one connection.
+// They're taken as the connection needs them and all go back to their
+// pools with release, once nothing reads or writes through them.
+type connBuffers struct {
+	hello  *bufio.Reader
+	stream *bufio.Reader
+	out    *bufio.Writer
+	scan   *[]byte
+	// scanPool is where scan goes back to.
+	scanPool *sync.Pool
+}
+
+// reader returns the buffered reader of the handshake, reading from r.
+func (b *connBuffers) reader(r io.Reader) *bufio.Reader {
+	b.hello = helloReaders.Get().(*bufio.Reader)
+	b.hello.Reset(r)
+	return b.hello
+}
+
+// streamReader returns the reader of a deflate stream's compressed side.
+func (b *connBuffers) streamReader(r io.Reader) *bufio.Reader {
+	b.stream = streamReaders.Get().(*bufio.Reader)
+	b.stream.Reset(r)
+	return b.stream
+}
+
+// writer returns the buffer replies are batched in, writing to w.
+func (b *connBuffers) writer(w io.Writer) *bufio.Writer {
+	b.out = replyWriters.Get().(*bufio.Writer)
+	b.out.Reset(w)
+	return b.out
+}
+
+// scanBuf returns the initial line scanner buffer, of size or bigger.
+// The scanner replaces it when a line needs more, that one isn't reused.
+func (b *connBuffers) scanBuf(size int) []byte {
+	switch {
+	case size <= legacyBufSize:
+		b.scanPool = &legacyBufs
+	case size <= lineBufSize:
+		b.scanPool = &lineBufs
+	default:
+		return make([]byte, size)
+	}
+	b.scan = b.scanPool.Get().(*[]byte)
+	return *b.scan
+}
+
+// release puts the buffers back, dropping what they held,
+// so a closed connection isn't kept alive by its pool.
+func (b *connBuffers) release() {
+	if b.hello != nil {
+		b.hello.Reset(nil)
+		helloReaders.Put(b.hello)
+	}
+	if b.stream != nil {
+		b.stream.Reset(nil)
+		streamReaders.Put(b.stream)
+	}
+	if b.out != nil {
+		b.out.Reset(nil)
+		replyWriters.Put(b.out)
+	}
+	if b.scan != nil {
+		b.scanPool.Put(b.scan)
+	}
+	*b = connBuffers{}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func busyPollListener(l net.Listener, budget time.Duration) (net.Listener, error) {
+	return nil, errors.New("busy polling is only supported on linux")
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// captureMagic is written at the start of every capture file
+// so the replayer can refuse to play back something else.
+const captureMagic = "TCPCAP1\n"
+
+// Recorder writes timestamped inbound frames for every wrapped connection
+// to a single capture file.
+//
+// Each frame is stored as a fixed 16 byte header followed by the payload:
+//   - offset since the capture started in nanoseconds (uint64)
+//   - connection id (uint32)
+//   - payload length (uint32)
+//
+// All integers are big endian.
+type Recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	w     *bufio.Writer
+	f     io.Closer
+	// nextID is the id handed to the next wrapped connection.
+	nextID uint32
+}
+
+// NewRecorder creates (or truncates) the capture file at name.
+func NewRecorder(name string) (*Recorder, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("could not open capture file: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err = w.WriteString(captureMagic); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not write capture header: %v", err)
+	}
+
+	return &Recorder{start: time.Now(), w: w, f: f}, nil
+}
+
+// Wrap returns a net.Conn that records everything read from conn.
+// A nil Recorder returns conn untouched, so callers don't need to check
+// whether capturing is enabled.
+func (r *Recorder) Wrap(conn net.Conn) net.Conn {
+	if r == nil {
+		return conn
+	}
+
+	r.mu.Lock()
+	id := r.nextID
+	r.nextID++
+	r.mu.Unlock()
+
+	return &capturedConn{Conn: conn, rec: r, id: id}
+}
+
+func (r *Recorder) record(id uint32, p []byte) {
+	var hdr [16]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(time.Since(r.start)))
+	binary.BigEndian.PutUint32(hdr[8:12], id)
+	binary.BigEndian.PutUint32(hdr[12:16], uint32(len(p)))
+
+	r.mu.Lock()
+	// A capture is a debugging aid,
+	// so a failed write must never take the connection down with it.
+	// The error resurfaces on Close through the buffered writer.
+	r.w.Write(hdr[:])
+	r.w.Write(p)
+	r.mu.Unlock()
+}
+
+// Close flushes the capture to disk and closes the file.
+func (r *Recorder) Close() (err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err = r.w.Flush(); err != nil {
+		return fmt.Errorf("could not flush capture to disk: %v", err)
+	}
+
+	if err = r.f.Close(); err != nil {
+		return fmt.Errorf("could not close capture file: %v", err)
+	}
+
+	return
+}
+
+// capturedConn records every successful read before handing it back.
+type capturedConn struct {
+	net.Conn
+	rec *Recorder
+	id  uint32
+}
+
+func (c *capturedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.rec.record(c.id, p[:n])
+	}
+	return
+}
+
+// Frame is a single captured read.
+type Frame struct {
+	// Offset is when the read happened, since the capture started.
+	Offset time.Duration
+	// Conn identifies the connection, each gets its own id.
+	Conn uint32
+	Data []byte
+}
+
+// CaptureReader reads back the frames of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+	f *os.File
+}
+
+// OpenCapture opens a capture file written by a Recorder.
+func OpenCapture(name string) (*CaptureReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open capture file: %v", err)
+	}
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(captureMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a capture file", name)
+	}
+	return &CaptureReader{r: r, f: f}, nil
+}
+
+// Next reads the next frame from the capture.
+// It returns io.EOF once the capture is exhausted.
+func (c *CaptureReader) Next() (fr Frame, err error) {
+	var hdr [16]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated frame header")
+		}
+		return
+	}
+
+	fr.Offset = time.Duration(binary.BigEndian.Uint64(hdr[0:8]))
+	fr.Conn = binary.BigEndian.Uint32(hdr[8:12])
+	fr.Data = make([]byte, binary.BigEndian.Uint32(hdr[12:16]))
+
+	if _, err = io.ReadFull(c.r, fr.Data); err != nil {
+		err = fmt.Errorf("truncated frame payload: %v", err)
+	}
+	return
+}
+
+// Close closes the capture file.
+func (c *CaptureReader) Close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"io"
+	"net"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+)
+
+// chaosConn is a client connection with the fpRead and fpDrop
+// failpoints on its reads. Connections are only wrapped while a
+// failpoint is enabled, see runConn.
+type chaosConn struct {
+	net.Conn
+}
+
+func (c chaosConn) Read(p []byte) (int, error) {
+	if err := failpoint.Eval(fpRead); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	if n > 1 && failpoint.Eval(fpDrop) != nil {
+		// The first half makes it in, as if the client died sending
+		// the rest.
+		c.Conn.Close()
+		return n / 2, io.EOF
+	}
+	return n, err
+}
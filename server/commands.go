@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+)
+
+const (
+	// pingCmd is sent by clients to keep idle connections alive,
+	// the server answers with pongReply.
+	pingCmd   = "PING"
+	pongReply = "PONG\n"
+	// statusCmd asks for a one line stats summary, see Counter.status.
+	statusCmd = "STATUS"
+	// terminateCmd asks the server to shut down, if Config.Terminate
+	// allows it. The server answers with byeReply and hangs up.
+	terminateCmd = "terminate"
+	byeReply     = "BYE\n"
+)
+
+// maxPending is how many replies are held back before they're written
+// even though more buffered input is waiting.
+const maxPending = 64
+
+// client is the state of a connection that command handlers work with.
+type client struct {
+	srv     *Server
+	conn    net.Conn
+	counter *Counter
+	stats   *connStats
+	sess    session
+	// out batches the replies not written yet, pending counts them,
+	// see flushReader for when they go out.
+	out     *bufio.Writer
+	pending int
+	// span traces the current request, nil unless it was sampled.
+	span *span
+	// ctx is passed to the Handler, it carries the client itself.
+	ctx context.Context
+	// log is the server's Logger with the client's remote address.
+	log *slog.Logger
+	// otel is the OpenTelemetry trace of the connection, nil unless it was sampled.
+	otel *connTrace
+	// inBatch is whether the values handled are a batch's, which is
+	// answered as a whole.
+	inBatch bool
+	// authed is whether the client sent Config.AuthToken, or doesn't
+	// have to.
+	authed bool
+}
+
+// reply queues a response to the client.
+// Chatty clients pipelining commands get all replies for the input
+// already read in a single write, instead of one write per reply.
+func (cl *client) reply(s string) error {
+	if _, err := cl.out.WriteString(s); err != nil {
+		return err
+	}
+	return cl.queued()
+}
+
+// queued counts a reply written to out, and flushes them at maxPending.
+func (cl *client) queued() error {
+	if cl.pending++; cl.pending >= maxPending {
+		return cl.flush()
+	}
+	return nil
+}
+
+// flush writes out the pending replies.
+func (cl *client) flush() error {
+	if cl.pending == 0 {
+		return nil
+	}
+	cl.pending = 0
+	return cl.out.Flush()
+}
+
+// flushReader flushes the client's pending replies before every read.
+// The scanner only reads once it's run out of buffered lines,
+// which is exactly when the client may be waiting on our answers.
+type flushReader struct {
+	cl *client
+	r  io.Reader
+}
+
+func (f flushReader) Read(p []byte) (int, error) {
+	if err := f.cl.flush(); err != nil {
+		return 0, err
+	}
+	n, err := f.r.Read(p)
+	f.cl.stats.bytes += int64(n)
+	return n, err
+}
+
+// malformed counts an invalid line from the client,
+// and audits the connection once it crosses the flood threshold.
+// With Config.Quiet it returns errQuiet to hang up on the client.
+// The value of a batch or a JSON request is answered its own way,
+// otherwise it answers with reply with ErrorReplies, unless it's "",
+// and returns errInvalid to hang up, unless Config.SkipInvalid.
+func (cl *client) malformed(reply string) error {
+	cl.stats.malformed++
+	cl.srv.metrics.sawMalformed()
+	if cl.stats.malformed == cl.srv.cfg.AuditMalformed {
+		cl.srv.audit.Record(auditFlood, cl.conn.RemoteAddr().String(),
+			fmt.Sprintf("%d malformed lines", cl.stats.malformed))
+	}
+	switch {
+	case cl.srv.cfg.Quiet:
+		return errQuiet
+	case cl.inBatch || cl.sess.caps["json"]:
+		return nil
+	}
+	if cl.srv.cfg.ErrorReplies && reply != "" {
+		if err := cl.reply(reply); err != nil {
+			return err
+		}
+	}
+	if cl.srv.cfg.SkipInvalid {
+		return nil
+	}
+	// The replies before the hang up still go out.
+	if err := cl.flush(); err != nil {
+		return err
+	}
+	return errInvalid
+}
+
+// commandFunc handles one in-band command.
+// args is the rest of the line after the verb.
+// Returning an error closes the connection.
+type commandFunc func(cl *client, args string) error
+
+// CommandFunc handles an in-band command of an embedder's, see
+// Server.RegisterCommand. args is the rest of the line after the verb,
+// ctx and w are a Handler's.
+type CommandFunc func(ctx context.Context, args string, w io.Writer) error
+
+// commands maps the built-in verbs to their handlers, every Server
+// starts with them, see Server.commands.
+// Lines that don't start with a registered verb are values.
+var commands = make(map[string]commandFunc)
+
+// registerCommand adds a handler for an in-band command.
+// Like http.Handle, registering a verb twice is a programming error and panics.
+func registerCommand(verb string, fn commandFunc) {
+	if _, ok := commands[verb]; ok {
+		panic(fmt.Sprintf("command %s registered twice", verb))
+	}
+	commands[verb] = fn
+}
+
+// RegisterCommand adds an in-band command to the server's protocol:
+// lines that are verb, or verb followed by a space and args, go to fn
+// instead of being values. Unlike a Handler, it leaves the rest of the
+// protocol to the server. It must be called before Serve, and like
+// registerCommand, registering a verb that's taken, by a command or as
+// a stream's prefix, panics.
+func (s *Server) RegisterCommand(verb string, fn CommandFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		panic(fmt.Sprintf("command %s registered after Serve", verb))
+	}
+	if _, ok := s.commands[verb]; ok {
+		panic(fmt.Sprintf("command %s registered twice", verb))
+	}
+	if _, ok := s.prefixes[verb]; ok {
+		panic(fmt.Sprintf("command %s is a stream's prefix", verb))
+	}
+	s.commands[verb] = func(cl *client, args string) error {
+		return fn(cl.ctx, args, cl)
+	}
+}
+
+func init() {
+	registerCommand(pingCmd, handlePing)
+	registerCommand(statusCmd, handleStatus)
+	registerCommand(terminateCmd, handleTerminate)
+	registerCommand(subscribeCmd, handleSubscribe)
+	registerCommand(authCmd, handleAuth)
+}
+
+// dispatch routes a line to the handler of its verb, or of its stream
+// prefix, or to handleValue if it's neither. Every line of a json
+// session is a request, for handleJSON. A client that has yet to
+// authenticate only gets through with AUTH.
+// Values stay bytes all the way, so the hot path doesn't allocate,
+// only commands get their args as a string.
+func dispatch(cl *client, line []byte) error {
+	verb, args := line, []byte(nil)
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		verb, args = line[:i], line[i+1:]
+	}
+	if !cl.authed && string(verb) != authCmd {
+		return cl.unauthorized()
+	}
+
+	if cl.sess.caps["json"] {
+		return handleJSON(cl, line)
+	}
+
+	// string(verb) in a map index doesn't allocate.
+	if fn, ok := cl.srv.commands[string(verb)]; ok {
+		return fn(cl, string(args))
+	}
+	if st, ok := cl.srv.prefixes[string(verb)]; ok {
+		return st.handle(cl, args)
+	}
+	return handleValue(cl, line)
+}
+
+func handlePing(cl *client, args string) error {
+	cl.stats.sawPing()
+	if cl.sess.caps["quiet"] {
+		return nil
+	}
+	return cl.reply(pongReply)
+}
+
+func handleStatus(cl *client, args string) error {
+	return cl.reply(cl.counter.status(cl.stats))
+}
+
+// errTerminated hangs up on the client that sent terminate.
+var errTerminated = errors.New("terminated by client")
+
+func handleTerminate(cl *client, args string) error {
+	if !cl.srv.cfg.Terminate {
+		return handleValue(cl, []byte(terminateCmd))
+	}
+
+	cl.srv.audit.Record(auditTerminate, cl.conn.RemoteAddr().String(), "shutdown requested")
+	cl.srv.terminateOnce.Do(func() { close(cl.srv.terminated) })
+	if err := cl.reply(byeReply); err != nil {
+		return err
+	}
+	if err := cl.flush(); err != nil {
+		return err
+	}
+	return errTerminated
+}
+
+// valueProfile is what makes a line a valid value: exactly length
+// digits, at least min and at most upper, the largest of length digits
+// if 0, and what leading zeros do, see Config.LeadingZeros. Streams can
+// each have their own.
+type valueProfile struct {
+	length int
+	min    int
+	upper  int
+	zeros  string
+}
+
+// defaultProfile is the validation of the main stream,
+// unless Config says otherwise.
+var defaultProfile = valueProfile{length: ValidLen, min: MinValue}
+
+// check reports what's wrong with a profile set up by hand.
+func (p valueProfile) check() error {
+	if p.length < 1 || p.length > 18 {
+		return fmt.Errorf("len must be between 1 and 18")
+	}
+	digits := int(math.Pow10(p.length)) - 1
+	if p.min > digits {
+		return fmt.Errorf("min doesn't fit in %d digits", p.length)
+	}
+	if p.upper < 0 || p.upper > digits {
+		return fmt.Errorf("max doesn't fit in %d digits", p.length)
+	}
+	if p.min > p.max() {
+		return fmt.Errorf("min is over max")
+	}
+	switch p.zeros {
+	case "", zerosAccept, zerosReject:
+	default:
+		return fmt.Errorf("unknown leading zeros %q, want accept or reject", p.zeros)
+	}
+	return nil
+}
+
+// max is the largest valid value.
+func (p valueProfile) max() int {
+	if p.upper > 0 {
+		return p.upper
+	}
+	return int(math.Pow10(p.length)) - 1
+}
+
+// lowest is the smallest valid value, min unless zero padded values
+// are valid whatever their number.
+func (p valueProfile) lowest() int {
+	if p.zeros == zerosAccept {
+		return 0
+	}
+	return p.min
+}
+
+// inRange reports whether num is valid as a number, with the leading
+// zeros it takes implied, e.g. sent in binary.
+func (p valueProfile) inRange(num int) bool {
+	return num >= p.lowest() && num <= p.max()
+}
+
+// handleValue parses a value line and records it if it's valid.
+func handleValue(cl *client, line []byte) error {
+	return recordLine(cl, cl.counter, line)
+}
+
+// recordValue validates line against the counter's profile,
+// and records it if it's valid.
+func recordValue(cl *client, counter *Counter, line []byte) error {
+	num, err := counter.validate(line)
+	cl.span.mark("parse")
+	if err != nil {
+		cl.span.decide("malformed")
+		return cl.malformed(invalidReply(err))
+	}
+	return recordNum(cl, counter, num)
+}
+
+// recordNum records num, a value of the counter's profile, if the
+// validators take it.
+func recordNum(cl *client, counter *Counter, num int) error {
+	if ok, err := acceptNum(cl, counter, num); !ok {
+		return err
+	}
+
+	/* From here on out, we have a valid input. */
+	// Count the value and record it if it's new, in one step,
+	// so two connections sending the same new value can't both log it.
+	// In this case, logging is part of our reqs,
+	// a connection we can't log the values of is closed.
+	uniq, err := counter.record(num, cl.span)
+	if err != nil {
+		return recordFailed(cl, counter, num, err)
+	}
+	sawNum(cl, counter, num, uniq)
+	return nil
+}
+
+// acceptNum runs the validators on num, a value of the counter's
+// profile. If one rejects it, it reports false and what malformed
+// returned.
+func acceptNum(cl *client, counter *Counter, num int) (bool, error) {
+	if len(cl.srv.validators) > 0 {
+		err := cl.srv.validate(counter, num)
+		cl.span.mark("validate")
+		if err != nil {
+			cl.span.decide("rejected")
+			return false, cl.malformed(rejectedReply)
+		}
+	}
+	return true, nil
+}
+
+// recordFailed reports the error recording num, and returns it to
+// hang up on the client.
+func recordFailed(cl *client, counter *Counter, num int, err error) error {
+	switch err {
+	case errHandedOver:
+		cl.span.decide("handed-over")
+		return err
+	case errRecovering:
+		cl.span.decide("recovering")
+		// A json session answers the request itself.
+		if !cl.sess.caps["json"] {
+			cl.reply(recoveringReply)
+			cl.flush()
+		}
+		return err
+	case errQuotaExceeded:
+		cl.span.decide("over-quota")
+		if !cl.sess.caps["json"] {
+			cl.reply(quotaExceededReply)
+			cl.flush()
+		}
+		return err
+	}
+	cl.span.decide("error")
+	cl.srv.opError(&OpError{Op: "log", Remote: cl.conn.RemoteAddr().String(), Stream: counter.name, Value: num, Err: err})
+	return err
+}
+
+// sawNum counts num, just recorded, for the client and the metrics,
+// and emits it if it was new.
+func sawNum(cl *client, counter *Counter, num int, uniq bool) {
+	if uniq {
+		cl.span.decide("new")
+		cl.srv.emitUnique(counter, num)
+	} else {
+		cl.span.decide("duplicate")
+	}
+	cl.stats.sawValue(uniq)
+	cl.srv.metrics.sawValue(uniq)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	srv, err := New(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterCommand("ECHO", func(ctx context.Context, args string, w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s\n", args)
+		return err
+	})
+	addr := serveOn(t, srv)
+
+	replies := send(t, addr, "ECHO hello", "1234567890", "ECHO")
+	if want := []string{"hello", ""}; !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+	if _, total, _ := srv.Counts(); total != 1 {
+		t.Errorf("%d values counted, want 1", total)
+	}
+}
+
+func TestRegisterCommandTaken(t *testing.T) {
+	srv, err := New(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering PING again didn't panic")
+		}
+	}()
+	srv.RegisterCommand(pingCmd, func(context.Context, string, io.Writer) error { return nil })
+}
+
+func TestDefaultHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Handler = HandlerFunc(func(ctx context.Context, line []byte, w io.Writer) error {
+		if string(line) == "WHO" {
+			_, err := io.WriteString(w, "numbers\n")
+			return err
+		}
+		return DefaultHandler.HandleLine(ctx, line, w)
+	})
+	srv, addr := serveTest(t, cfg)
+	if replies := send(t, addr, "WHO", "1234567890"); !reflect.DeepEqual(replies, []string{"numbers"}) {
+		t.Errorf("replies = %q, want numbers", replies)
+	}
+	if _, total, _ := srv.Counts(); total != 1 {
+		t.Errorf("%d values counted, want the one passed on", total)
+	}
+
+	if err := DefaultHandler.HandleLine(context.Background(), []byte("1234567890"), io.Discard); err != ErrNotServerConn {
+		t.Errorf("HandleLine off a connection = %v, want ErrNotServerConn", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AuthToken = "s3cret"
+	srv, addr := serveTest(t, cfg)
+
+	replies := send(t, addr, "AUTH s3cret", "HELLO v2", "1234567890", "AUTH s3cret")
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], helloCmd) {
+		t.Errorf("replies = %q, want the handshake's", replies)
+	}
+	if _, total, _ := srv.Counts(); total != 1 {
+		t.Errorf("%d values counted, want 1", total)
+	}
+
+	for _, line := range []string{"AUTH nope", "AUTH", "1234567890", pingCmd, "HELLO v2"} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "%s\n%s\n", line, pingCmd)
+		if got, _ := io.ReadAll(c); string(got) != unauthorizedReply {
+			t.Errorf("%q first got %q, want %q", line, got, unauthorizedReply)
+		}
+		c.Close()
+	}
+
+	// A wrong token later on hangs up too.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "AUTH s3cret\nAUTH nope\n%s\n", pingCmd)
+	if got, _ := io.ReadAll(c); string(got) != unauthorizedReply {
+		t.Errorf("a wrong AUTH after the right one got %q, want %q", got, unauthorizedReply)
+	}
+
+	fresh, err := New(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Shutdown(context.Background())
+	defer func() {
+		if recover() == nil {
+			t.Error("registering AUTH didn't panic")
+		}
+	}()
+	fresh.RegisterCommand(authCmd, func(context.Context, string, io.Writer) error { return nil })
+}
+
+func TestInvalidLineHangsUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies bool
+		want    string
+	}{
+		{"counted", false, ""},
+		{"error replies", true, "ERR 001 malformed\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.ErrorReplies = tt.replies
+			srv, addr := serveTest(t, cfg)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprint(conn, "1234567890\n12345\n2345678901\n")
+
+			// The server hangs up after the reply, if there is one.
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q before the hang up, want %q", got, tt.want)
+			}
+			if uniq, total, _ := srv.Counts(); uniq != 1 || total != 1 {
+				t.Errorf("Counts() = %d unique, %d total, want the 1 value before the invalid line", uniq, total)
+			}
+		})
+	}
+}
+
+func TestBatchLine(t *testing.T) {
+	// The map under the Counter's lock, and a Store of its own.
+	for _, shards := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.MaxBatch = 5
+			cfg.DedupShards = shards
+			cfg.SkipInvalid = true
+			srv, addr := serveTest(t, cfg)
+
+			replies := send(t, addr,
+				"1234567890,1234567891,1234567890,12x,1234567892",
+				"1234567891,1234567893",
+				"1234567894,1234567895,1234567896,1234567897,1234567898,1234567899")
+			want := []string{"OK new=3 dup=1 malformed=1", "OK new=1 dup=1 malformed=0", strings.TrimSuffix(batchTooLargeReply, "\n")}
+			if !reflect.DeepEqual(replies, want) {
+				t.Errorf("replies = %q, want %q", replies, want)
+			}
+			if uniq, total, _ := srv.Counts(); uniq != 4 || total != 6 {
+				t.Errorf("Counts() = %d unique, %d total, want 4 of 6", uniq, total)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// connStats holds the counters and liveness of a single connection.
+// The timestamps are unix nanoseconds, written by the connection's handler
+// and read by the reporting goroutines, so they're only accessed atomically.
+type connStats struct {
+	opened time.Time
+	// values and uniques are the valid and new values the connection sent.
+	// Only the connection's own handler touches them.
+	values  int
+	uniques int
+	// malformed is the number of invalid lines the connection sent.
+	malformed int
+	// bytes is how much input the connection's lines were read from,
+	// after decompression. Only the connection's own handler touches it.
+	bytes int64
+	// origin aggregates the connection with others from the same
+	// country and network, nil unless geoip is enabled.
+	origin *originStats
+	// lastValue is when the connection last sent a valid value.
+	lastValue int64
+	// lastPing is when the connection last sent a PING.
+	lastPing int64
+	// readBuf is how many bytes of read buffers the connection's mode
+	// was given, set once the handshake is done.
+	readBuf int64
+	// remote is the connection's remote address, cancel cancels its
+	// context, which hangs up on it.
+	remote string
+	cancel context.CancelFunc
+}
+
+func newConnStats() *connStats {
+	now := time.Now()
+	return &connStats{
+		opened:   now,
+		lastPing: now.UnixNano(),
+	}
+}
+
+func (cs *connStats) sawValue(uniq bool) {
+	cs.values++
+	if uniq {
+		cs.uniques++
+	}
+	cs.origin.addValue()
+	atomic.StoreInt64(&cs.lastValue, time.Now().UnixNano())
+}
+
+func (cs *connStats) sawPing() {
+	atomic.StoreInt64(&cs.lastPing, time.Now().UnixNano())
+}
+
+func (cs *connStats) setReadBuf(n int) {
+	atomic.StoreInt64(&cs.readBuf, int64(n))
+}
+
+// liveness classifies the connection by what it sent since t:
+// busy ones sent values, idle ones only pinged, silent ones sent nothing
+// and are probably dead.
+func (cs *connStats) liveness(since time.Time) string {
+	t := since.UnixNano()
+	switch {
+	case atomic.LoadInt64(&cs.lastValue) >= t:
+		return "busy"
+	case atomic.LoadInt64(&cs.lastPing) >= t:
+		return "idle"
+	}
+	return "silent"
+}
@@ -0,0 +1,1000 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+)
+
+// Counter is a container for tracking and managing the runtime counters.
+//
+// Concurrency guarantees:
+//   - Every method is safe to call from any number of goroutines.
+//   - Record is atomic: checking a value against the unique set, adding it
+//     and buffering it for the log happen under one lock, so a value is
+//     reported new and logged exactly once no matter how many connections
+//     send it at the same time. With a Store other than the single map
+//     adding it is atomic in the Store, and the lock is only held to log it.
+//   - RecordBatch gives every value of a batch the guarantee of Record.
+//   - The counts are atomic, counting a value never takes the lock.
+//   - Log rotation is atomic with respect to Record: a value is either in
+//     the segment being rotated out or in the new one, never lost in between.
+//   - Snapshot is consistent as far as a value is never counted unique or
+//     duplicate without being counted in the total: values are counted
+//     in the total first, and read from it last. A value counted as an
+//     interval ends may have its total in one interval and being unique
+//     or duplicate in the next.
+//   - Inc, HasValue and RecordUniq are each atomic on their own, but
+//     calling them in sequence is not; use Record for the check-then-act
+//     sequence on incoming values.
+//   - With a Store other than the default map HasValue doesn't lock at
+//     all, and RecordUniq only to log a new value.
+//   - While the log is recovered in the background, see
+//     Config.RecoverBackground, Record and RecordBatch only take the
+//     values the recovery already added as duplicates, and refuse any
+//     other, RecordUniq refuses every value.
+//   - Record and RecordBatch refuse the values over the stream's daily
+//     quota, see Config.DailyQuota, a batch has the values that still
+//     fit recorded first.
+//
+// The exported counts are atomic, Uniq is only safe to read while no
+// other goroutine uses the Counter, it's kept for inspection after Close.
+type Counter struct {
+	mu sync.RWMutex
+	// Uniq is a map of the unique numbers received during uptime,
+	// nil with another Store, see set.
+	Uniq map[int]bool
+	// set is Uniq, or the Store that replaces it.
+	set Store
+	// locked is whether set is only safe under mu, true for Uniq.
+	locked bool
+	// Cnt valid numbers received during uptime.
+	Cnt atomic.Uint64
+	// IntvlCnt is the total valid numbers received during output interval.
+	IntvlCnt atomic.Uint64
+	// Dup valid numbers received during uptime that were seen before.
+	Dup atomic.Uint64
+	// IntvlUniq and IntvlDup are the new unique and the duplicate
+	// numbers received during output interval.
+	IntvlUniq atomic.Uint64
+	IntvlDup  atomic.Uint64
+	Log       *struct {
+		// Cnt is the log rotation counter.
+		Cnt int
+		// seg writes the current log entry
+		seg segmentWriter
+		// fmt is the name pattern of the log segments.
+		fmt string
+	}
+	intvl *struct {
+		output  chan bool
+		logging chan bool
+		// logged is closed once the final log flush is done.
+		logged chan bool
+		// stop makes sure the interval channels are only closed once.
+		stop sync.Once
+		// outputEvery and logEvery are the intervals in nanoseconds,
+		// see setIntervals, changes wake the loops through the resets.
+		outputEvery  int64
+		logEvery     int64
+		outputReset  chan bool
+		loggingReset chan bool
+		// rotate asks for a rotation of a full segment, see full.
+		rotate chan bool
+	}
+	// sem does the connection limiting.
+	sem *semaphore
+	// serve is the ConnHandler of the stream's connections, see Server.chain.
+	serve ConnHandler
+	// conns are the currently open connections.
+	conns map[*connStats]bool
+	// subs are the connections that subscribed to the reports.
+	subs map[*connStats]*subscriber
+	// lastOutput is when the counters were last output.
+	lastOutput time.Time
+	// started is when the Counter was created, the server's uptime.
+	started time.Time
+	// name is the stream the Counter counts, empty for the main one.
+	name string
+	// profile validates the values of the stream, unless validator
+	// does, see Config.ValueValidator.
+	profile   valueProfile
+	validator ValueValidator
+	// seg is how log segments are written.
+	seg *segmentOptions
+	// out receives the interval output.
+	out io.Writer
+	// extra returns server wide lines for the interval output, may be nil.
+	extra func() string
+	// failed reports errors writing out the log, nil logs them to seg.log.
+	failed func(err error)
+	// failing is 1 from a failed write out of the log to the next
+	// flush that succeeds.
+	failing int32
+	// handedOver is set once Restart handed the log over to a new
+	// process, values are refused from then on.
+	handedOver atomic.Bool
+	// dups counts the resubmissions of duplicates, nil unless
+	// Config.TopDuplicates is set.
+	dups *dupTracker
+	// peers gets the values logged, to send them to the other servers
+	// of a cluster, nil without Config.Peers.
+	peers *replicator
+	// firstSeg is the oldest segment whose values are in the set, the
+	// peers are caught up from there.
+	firstSeg int
+	// recovery is the replay of the log in the background, nil without
+	// Config.RecoverBackground or segments to replay.
+	recovery *recovery
+	// quota counts the values taken in each day and refuses those over
+	// the stream's daily quota, nil without Config.DailyQuota or
+	// Config.UsageFile.
+	quota *quota
+}
+
+// NewCounter constructs a Counter writing plain log segments named
+// after format, e.g. "logs/data.%d.log". It fails if the first segment
+// can't be opened.
+func NewCounter(connLimit int, format string) (*Counter, error) {
+	return newStreamCounter("", connLimit, format, 0, defaultProfile, &segmentOptions{flush: DefaultLogFlush, log: slog.Default()}, os.Stdout)
+}
+
+// newStreamCounter constructs the Counter of a named stream,
+// validating values with p and writing segments as opts says,
+// starting at segment seg.
+func newStreamCounter(name string, connLimit int, format string, seg int, p valueProfile, opts *segmentOptions, out io.Writer) (*Counter, error) {
+	first, err := opts.open(format, seg, os.O_TRUNC, p)
+	if err != nil {
+		return nil, &OpError{Op: "open", Stream: name, Err: err}
+	}
+	uniq := make(map[int]bool)
+	return &Counter{
+		name:       name,
+		profile:    p,
+		seg:        opts,
+		out:        out,
+		Uniq:       uniq,
+		set:        mapSet(uniq),
+		locked:     true,
+		sem:        newSemaphore(connLimit),
+		conns:      make(map[*connStats]bool),
+		subs:       make(map[*connStats]*subscriber),
+		lastOutput: time.Now(),
+		started:    time.Now(),
+		Log: &struct {
+			Cnt int
+			seg segmentWriter
+			fmt string
+		}{
+			Cnt: seg,
+			seg: first,
+			fmt: format,
+		},
+		intvl: &struct {
+			output  chan bool
+			logging chan bool
+			logged  chan bool
+			stop    sync.Once
+
+			outputEvery  int64
+			logEvery     int64
+			outputReset  chan bool
+			loggingReset chan bool
+			rotate       chan bool
+		}{
+			output:       make(chan bool),
+			logging:      make(chan bool),
+			logged:       make(chan bool),
+			outputReset:  make(chan bool, 1),
+			loggingReset: make(chan bool, 1),
+			rotate:       make(chan bool, 1),
+		},
+	}, nil
+}
+
+// openLogFile opens a log segment, mode is os.O_TRUNC for a fresh
+// segment or os.O_APPEND to carry on writing one, see Reopen.
+func openLogFile(name string, mode int) (*os.File, error) {
+	f, err := os.OpenFile(
+		name,
+		// We only need to write to the log,
+		// but we need to create if file does not exist,
+		// or else truncate it if we're re-opening it on a new run.
+		os.O_WRONLY|os.O_CREATE|mode,
+		0666)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file: %v", err)
+	}
+
+	return f, nil
+}
+
+// openSegment opens the current segment with mode, c.mu must be held.
+// If it can't be, values fail to log until a rotation opens one, and
+// the error is returned as an OpError.
+func (c *Counter) openSegment(mode int) error {
+	seg, err := c.seg.open(c.Log.fmt, c.Log.Cnt, mode, c.profile)
+	if err != nil {
+		c.Log.seg = brokenSegment{err}
+		return &OpError{Op: "open", Stream: c.name, Err: err}
+	}
+	c.Log.seg = seg
+	return nil
+}
+
+// FlushClose writes the log contents to disk and closes the file.
+func (c *Counter) FlushClose() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flushClose()
+}
+
+// flushClose is FlushClose for callers already holding the lock.
+func (c *Counter) flushClose() (err error) {
+	if err = flushFault(); err != nil {
+		return
+	}
+
+	return c.Log.seg.Close()
+}
+
+// flushFault is the fpFlush failpoint, it leaves the segment open.
+func flushFault() error {
+	if err := failpoint.Eval(fpFlush); err != nil {
+		return fmt.Errorf("could not flush log to disk: %v", err)
+	}
+	return nil
+}
+
+// Flush writes the values buffered for the log to disk,
+// without waiting for the size or time they're batched by.
+func (c *Counter) Flush() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = flushFault(); err != nil {
+		return
+	}
+
+	return c.Log.seg.Flush()
+}
+
+// Sync is Flush that also has the log fsynced, see Config.LogSync.
+func (c *Counter) Sync() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = flushFault(); err != nil {
+		return
+	}
+
+	return c.Log.seg.Sync()
+}
+
+// flushLog is Flush for the intervals, they report the errors.
+func (c *Counter) flushLog() {
+	if err := c.Flush(); err != nil {
+		c.logFailed(err)
+		return
+	}
+	atomic.StoreInt32(&c.failing, 0)
+}
+
+// syncLog is Sync for the intervals.
+func (c *Counter) syncLog() {
+	if err := c.Sync(); err != nil {
+		c.logFailed(err)
+	}
+}
+
+// logFailed reports an error writing out the log.
+func (c *Counter) logFailed(err error) {
+	atomic.StoreInt32(&c.failing, 1)
+	if c.failed != nil {
+		c.failed(err)
+		return
+	}
+	c.seg.log.Error("could not flush log to disk", "stream", c.name, "err", err)
+}
+
+// FlushRotate writes the log contents to disk, closes, and rotates the log file.
+// A segment that fails to flush is closed and rotated all the same,
+// the values that follow it go to the next one. If the next one can't
+// be opened, values fail to log until a later FlushRotate opens it.
+func (c *Counter) FlushRotate() (err error) {
+	// Hold the lock across the whole rotation,
+	// otherwise a value recorded between closing the old segment
+	// and opening the new one would be written to a closed file.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = flushFault(); err != nil {
+		return
+	}
+	// A segment that never opened is opened again under its number.
+	if _, broken := c.Log.seg.(brokenSegment); !broken {
+		err = c.Log.seg.Close()
+		c.seg.archive(c.Log.fmt, c.Log.Cnt)
+		c.Log.Cnt++
+	}
+
+	if oerr := c.openSegment(os.O_TRUNC); oerr != nil {
+		err = oerr
+	}
+	return
+}
+
+// relocate flushes and closes the current log segment and rotates
+// into a new one named after format, e.g. in another directory.
+// The rotation counter carries on, so segments stay in order across both.
+func (c *Counter) relocate(format string) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.flushClose(); err != nil {
+		return
+	}
+	if _, broken := c.Log.seg.(brokenSegment); !broken {
+		c.seg.archive(c.Log.fmt, c.Log.Cnt)
+		c.Log.Cnt++
+	}
+	c.Log.fmt = format
+	return c.openSegment(os.O_TRUNC)
+}
+
+// Reopen flushes and closes the current log segment,
+// then opens it again under the same name without rotating.
+// After an external logrotate moved the file away, this starts a new
+// file in its place, otherwise it carries on appending to the same one.
+// Nothing queued for the writers is lost, they're drained by the close.
+func (c *Counter) Reopen() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.flushClose(); err != nil {
+		return
+	}
+
+	return c.openSegment(os.O_APPEND)
+}
+
+// Record counts a valid value and records it if it hasn't been seen before.
+// It reports whether num was new.
+// Unlike calling Inc, HasValue and RecordUniq in turn, this is atomic.
+func (c *Counter) Record(num int) (uniq bool, err error) {
+	return c.record(num, nil)
+}
+
+// record is Record marking the dedup lookup and the log write on sp.
+func (c *Counter) record(num int, sp *span) (uniq bool, err error) {
+	if err = failpoint.Eval(fpRecord); err != nil {
+		return
+	}
+	if c.handedOver.Load() {
+		return false, errHandedOver
+	}
+	if c.recovering() {
+		return c.recordRecovering(num)
+	}
+	if c.quota.take(1) == 0 {
+		return false, errQuotaExceeded
+	}
+
+	c.count(1)
+	if !c.locked {
+		uniq, err = c.set.Add(num)
+		sp.mark("dedup")
+		if err != nil {
+			return
+		}
+		if !uniq {
+			c.countDup(num)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		err = c.logUniq(num)
+		sp.mark("log")
+		return true, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	uniq, err = c.set.Add(num)
+	sp.mark("dedup")
+	if err != nil {
+		return
+	}
+	if !uniq {
+		c.countDup(num)
+		return
+	}
+	err = c.logUniq(num)
+	sp.mark("log")
+	return true, err
+}
+
+// RecordBatch is Record for the values of a batch, in order, with one
+// lookup in the Store and one lock acquisition for the lot of them,
+// see BatchStore. uniq[i] reports whether nums[i] was new. With an
+// error uniq only has the values recorded before the one that failed,
+// nums[len(uniq)].
+func (c *Counter) RecordBatch(nums []int) (uniq []bool, err error) {
+	return c.recordBatch(nums, nil)
+}
+
+// recordBatch is RecordBatch marking the dedup lookup and the log
+// writes on sp.
+func (c *Counter) recordBatch(nums []int, sp *span) (uniq []bool, err error) {
+	if err = failpoint.Eval(fpRecord); err != nil {
+		return
+	}
+	if c.handedOver.Load() {
+		return nil, errHandedOver
+	}
+	if c.recovering() {
+		for i, num := range nums {
+			if _, err = c.recordRecovering(num); err != nil {
+				return make([]bool, i), err
+			}
+		}
+		return make([]bool, len(nums)), nil
+	}
+	if n := c.quota.take(len(nums)); n < len(nums) {
+		// The values that fit are recorded, the first one that doesn't
+		// fails.
+		if n > 0 {
+			if uniq, err = c.recordTaken(nums[:n], sp); err != nil {
+				return
+			}
+		}
+		return uniq, errQuotaExceeded
+	}
+	return c.recordTaken(nums, sp)
+}
+
+// recordTaken is recordBatch for values the quota let in.
+func (c *Counter) recordTaken(nums []int, sp *span) (uniq []bool, err error) {
+	c.count(len(nums))
+	if !c.locked {
+		added, err := addBatch(c.set, nums)
+		sp.mark("dedup")
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, num := range nums {
+			if !added[i] {
+				c.countDup(num)
+				continue
+			}
+			if err = c.logUniq(num); err != nil {
+				// The new values after num aren't logged either.
+				removeNew(c.set, nums[i+1:], added[i+1:], err)
+				sp.mark("log")
+				return added[:i], err
+			}
+		}
+		sp.mark("log")
+		return added, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	uniq = make([]bool, 0, len(nums))
+	for _, num := range nums {
+		added, err := c.set.Add(num)
+		if err != nil {
+			return uniq, err
+		}
+		if !added {
+			c.countDup(num)
+		} else if err = c.logUniq(num); err != nil {
+			return uniq, err
+		}
+		uniq = append(uniq, added)
+	}
+	sp.mark("log")
+	return uniq, nil
+}
+
+// recovering reports whether the log is still being recovered in the
+// background.
+func (c *Counter) recovering() bool {
+	return c.recovery != nil && !c.recovery.done.Load()
+}
+
+// recordRecovering is record while the log is recovered: a value the
+// recovery already added is a duplicate, any other may still turn up in
+// the log, it's refused with errRecovering and isn't counted.
+func (c *Counter) recordRecovering(num int) (uniq bool, err error) {
+	if !c.HasValue(num) {
+		return false, errRecovering
+	}
+	c.count(1)
+	c.countDup(num)
+	return false, nil
+}
+
+// replay adds num, logged by an earlier run, to the set like a peer's
+// value, recovering the log.
+func (c *Counter) replay(num int) error {
+	if err := c.replicate(num); err != nil {
+		return err
+	}
+	return failpoint.Eval(fpRecover)
+}
+
+// count counts n valid values in the totals, before anything else
+// counts them, see Snapshot.
+func (c *Counter) count(n int) {
+	c.Cnt.Add(uint64(n))
+	c.IntvlCnt.Add(uint64(n))
+}
+
+// countDup counts a duplicate value.
+func (c *Counter) countDup(num int) {
+	c.Dup.Add(1)
+	c.IntvlDup.Add(1)
+	c.dups.saw(num)
+}
+
+// RecordUniq adds a unique int to the map and the log buffer in a thread safe way.
+// Values already in the map are not written to the log again.
+func (c *Counter) RecordUniq(num int) (err error) {
+	if err = failpoint.Eval(fpRecord); err != nil {
+		return
+	}
+	if c.handedOver.Load() {
+		return errHandedOver
+	}
+	if c.recovering() {
+		return errRecovering
+	}
+
+	// Other Stores only need the lock to log a new value.
+	if !c.locked {
+		if uniq, err := c.set.Add(num); !uniq || err != nil {
+			return err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.logUniq(num)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uniq, err := c.set.Add(num); !uniq || err != nil {
+		return err
+	}
+	return c.logUniq(num)
+}
+
+// logUniq writes num, just added to the set, to the log and counts it,
+// c.mu must be held.
+func (c *Counter) logUniq(num int) (err error) {
+	// A value that isn't logged isn't unique yet, it's logged when it's sent again.
+	if err = failpoint.Eval(fpLogWrite); err == nil {
+		err = c.Log.seg.WriteValue(num)
+	}
+	if err != nil {
+		if rerr := c.set.Remove(num); rerr != nil {
+			c.seg.log.Error("could not remove unlogged value from the store", "stream", c.name, "value", num, "err", rerr)
+		}
+		return
+	}
+	c.IntvlUniq.Add(1)
+	c.quota.sawUnique()
+	if c.peers != nil {
+		c.peers.send(c.name, num)
+	}
+	if c.full() {
+		select {
+		case c.intvl.rotate <- true:
+		default:
+		}
+	}
+	return
+}
+
+// full reports whether the current segment is due for rotation by size.
+// The rotation itself is left to RunLogInterval.
+func (c *Counter) full() bool {
+	return c.seg.maxSize > 0 && c.Log.seg.Size() >= c.seg.maxSize
+}
+
+// rotateFull is FlushRotate for a full segment, the log interval starts
+// over after it. It's a no-op if the segment was rotated in the meantime.
+func (c *Counter) rotateFull() (rotated bool, err error) {
+	c.mu.RLock()
+	full := c.full()
+	c.mu.RUnlock()
+	if !full {
+		return false, nil
+	}
+	return true, c.FlushRotate()
+}
+
+// uniqLen is the number of unique values, c.mu must be held if c.locked.
+func (c *Counter) uniqLen() int {
+	n, err := c.set.Len()
+	if err != nil {
+		c.seg.log.Error("could not count unique values", "stream", c.name, "err", err)
+	}
+	return n
+}
+
+// Stats are the counts of a Counter, see Snapshot.
+type Stats struct {
+	// Unique is the size of the unique set, Total all valid values and
+	// Duplicates those seen before, over the uptime.
+	Unique     int
+	Total      int
+	Duplicates int
+	// The same for the current output interval, IntvlUnique are the new
+	// unique values.
+	IntvlUnique     int
+	IntvlTotal      int
+	IntvlDuplicates int
+	// Conns are the stream's open connections.
+	Conns int
+	// Uptime is how long the stream has been counting.
+	Uptime time.Duration
+	// Recovered is the percentage of the log recovered in the background,
+	// 100 once it's done or if there is none, see Config.RecoverBackground.
+	Recovered int
+}
+
+// MarshalJSON encodes the stats with the keys of the admin STATS,
+// the uptime in whole seconds.
+func (st Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Unique          int `json:"unique"`
+		Total           int `json:"total"`
+		Duplicates      int `json:"duplicates"`
+		IntvlUnique     int `json:"interval_unique"`
+		IntvlTotal      int `json:"interval"`
+		IntvlDuplicates int `json:"interval_duplicates"`
+		Conns           int `json:"conns"`
+		Uptime          int `json:"uptime"`
+		Recovered       int `json:"recovered"`
+	}{st.Unique, st.Total, st.Duplicates, st.IntvlUnique, st.IntvlTotal, st.IntvlDuplicates, st.Conns,
+		int(st.Uptime.Seconds()), st.Recovered})
+}
+
+// Snapshot reads all counts without holding up the connections
+// recording values, see Counter for how consistent they are.
+// The reports, STATUS, the admin STATS and the stats endpoint are
+// all made from it.
+func (c *Counter) Snapshot() Stats {
+	return c.snapshot(false)
+}
+
+// snapshot is Snapshot, with reset the interval counts start over
+// from what's read.
+func (c *Counter) snapshot(reset bool) (st Stats) {
+	read := func(n *atomic.Uint64) int {
+		if reset {
+			return int(n.Swap(0))
+		}
+		return int(n.Load())
+	}
+	st.IntvlUnique = read(&c.IntvlUniq)
+	st.IntvlDuplicates = read(&c.IntvlDup)
+	st.IntvlTotal = read(&c.IntvlCnt)
+
+	// Other Stores may go over the network, count without the lock.
+	if !c.locked {
+		st.Unique = c.uniqLen()
+	}
+	c.mu.RLock()
+	if c.locked {
+		st.Unique = c.uniqLen()
+	}
+	st.Conns = len(c.conns)
+	c.mu.RUnlock()
+	st.Duplicates = int(c.Dup.Load())
+	st.Total = int(c.Cnt.Load())
+	st.Uptime = time.Since(c.started)
+	st.Recovered = c.recovery.percent()
+	return
+}
+
+// Counts returns a snapshot of the counters.
+func (c *Counter) Counts() (uniq, total, intvl int) {
+	return c.counts()
+}
+
+func (c *Counter) counts() (uniq, total, intvl int) {
+	st := c.Snapshot()
+	return st.Unique, st.Total, st.IntvlTotal
+}
+
+// status is the one line reply to the STATUS command,
+// made of space separated key=value pairs so clients can parse it easily.
+func (c *Counter) status(cs *connStats) string {
+	st := c.Snapshot()
+	return fmt.Sprintf(
+		"uptime=%d unique=%d total=%d interval=%d conn_age=%d conn_total=%d conn_unique=%d\n",
+		int(st.Uptime.Seconds()),
+		st.Unique,
+		st.Total,
+		st.IntvlTotal,
+		int(time.Since(cs.opened).Seconds()),
+		cs.values,
+		cs.uniques)
+}
+
+func (c *Counter) outputCounters() {
+	// What's reported is on disk.
+	c.flushLog()
+
+	// Only the connections need the lock, the counts are atomic
+	// and the output is written after unlocking.
+	st := c.snapshot(true)
+	c.mu.Lock()
+	live := make(map[string]int)
+	var bufs int64
+	for cs := range c.conns {
+		live[cs.liveness(c.lastOutput)]++
+		bufs += atomic.LoadInt64(&cs.readBuf)
+	}
+	c.lastOutput = time.Now()
+	c.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b,
+		"----------------%s\n"+
+			"Received %d new unique numbers, %d duplicates. Unique total: %d\n"+
+			"Count total : %d\n"+
+			"Conns       : %d busy, %d idle, %d silent\n"+
+			"Read bufs   : %d KiB\n",
+		strings.TrimRight(" "+c.name, " "),
+		st.IntvlUnique,
+		st.IntvlDuplicates,
+		st.Unique,
+		st.Total,
+		live["busy"], live["idle"], live["silent"],
+		bufs>>10)
+	if c.recovering() {
+		fmt.Fprintf(&b, "Recovered   : %d%%\n", st.Recovered)
+	}
+	if top := c.dups.top(0); len(top) > 0 {
+		fmt.Fprintf(&b, "Top dups    : %s\n", formatDups(top))
+	}
+	if c.extra != nil {
+		b.WriteString(c.extra())
+	}
+	io.WriteString(c.out, b.String())
+	c.publish(b.String(), st)
+}
+
+// outputFinal prints the counts of the whole uptime, on shutdown.
+func (c *Counter) outputFinal() {
+	st := c.Snapshot()
+	fmt.Fprintf(c.out,
+		"================ final%s\n"+
+			"Count unique: %d\n"+
+			"Count total : %d\n"+
+			"Uptime      : %v\n",
+		strings.TrimRight(" "+c.name, " "),
+		st.Unique,
+		st.Total,
+		st.Uptime.Round(time.Second))
+}
+
+// RunOutputInterval outputs the counters on an interval,
+// until ctx is done or StopOutputIntvl is called.
+// Must be run on go routine.
+func (c *Counter) RunOutputInterval(ctx context.Context, intvl time.Duration) {
+	atomic.CompareAndSwapInt64(&c.intvl.outputEvery, 0, int64(intvl))
+	for {
+		select {
+		case <-time.After(time.Duration(atomic.LoadInt64(&c.intvl.outputEvery))):
+			c.outputCounters()
+		case <-c.intvl.outputReset:
+		case <-c.intvl.output:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StopOutputIntvl exits the output interval by closing it's underlying nil channel.
+func (c *Counter) StopOutputIntvl() {
+	close(c.intvl.output)
+}
+
+// RunLogInterval rotates the log on an interval, until ctx is done or
+// StopLogIntvl is called, then it flushes and closes the log, which
+// stops the segment's writers.
+// Must be run on go routine.
+// The log is flushed and synced in between as often as the segment
+// options say, and rotated early once a segment is full.
+func (c *Counter) RunLogInterval(ctx context.Context, intvl time.Duration) {
+	atomic.CompareAndSwapInt64(&c.intvl.logEvery, 0, int64(intvl))
+	every := func() time.Duration { return time.Duration(atomic.LoadInt64(&c.intvl.logEvery)) }
+	rotate := time.NewTimer(every())
+	defer rotate.Stop()
+	restart := func() {
+		if !rotate.Stop() {
+			select {
+			case <-rotate.C:
+			default:
+			}
+		}
+		rotate.Reset(every())
+	}
+
+	var flush, fsync <-chan time.Time
+	if c.seg.flush > 0 {
+		t := time.NewTicker(c.seg.flush)
+		defer t.Stop()
+		flush = t.C
+	}
+	if c.seg.sync == "interval" {
+		t := time.NewTicker(c.seg.syncEvery)
+		defer t.Stop()
+		fsync = t.C
+	}
+
+	for {
+		select {
+		case <-rotate.C:
+			if err := c.FlushRotate(); err != nil {
+				c.logFailed(err)
+			}
+			rotate.Reset(every())
+		case <-c.intvl.rotate:
+			rotated, err := c.rotateFull()
+			if err != nil {
+				c.logFailed(err)
+			}
+			if rotated {
+				restart()
+			}
+		case <-flush:
+			c.flushLog()
+		case <-fsync:
+			c.syncLog()
+		case <-c.intvl.loggingReset:
+			restart()
+		case <-c.intvl.logging:
+			c.closeLog()
+			return
+		case <-ctx.Done():
+			c.closeLog()
+			return
+		}
+	}
+}
+
+// closeLog is RunLogInterval's final flush, it waits for the archiving
+// of the rotated segments too.
+func (c *Counter) closeLog() {
+	if err := c.FlushClose(); err != nil {
+		c.logFailed(err)
+	}
+	c.seg.archiving.Wait()
+	close(c.intvl.logged)
+}
+
+// StopLogIntvl exits the output interval by closing it's underlying nil channel.
+// It waits for the final flush, the process usually exits right after,
+// and partitioned segments are still being written out by their goroutines.
+func (c *Counter) StopLogIntvl() {
+	close(c.intvl.logging)
+	<-c.intvl.logged
+}
+
+// setIntervals changes how often the counters are output and the log
+// rotated. Running intervals start over with the new ones right away.
+func (c *Counter) setIntervals(output, logging time.Duration) {
+	atomic.StoreInt64(&c.intvl.outputEvery, int64(output))
+	atomic.StoreInt64(&c.intvl.logEvery, int64(logging))
+	for _, reset := range []chan bool{c.intvl.outputReset, c.intvl.loggingReset} {
+		select {
+		case reset <- true:
+		default:
+		}
+	}
+}
+
+// logQueues returns how many values wait in each log partition's queue,
+// nothing if the log isn't partitioned.
+func (c *Counter) logQueues() []int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, ok := c.Log.seg.(*partitionedSegment); ok {
+		return s.depths()
+	}
+	return nil
+}
+
+// track adds a connection to the liveness report.
+func (c *Counter) track(cs *connStats) {
+	c.mu.Lock()
+	c.conns[cs] = true
+	c.mu.Unlock()
+}
+
+// untrack removes a closed connection from the liveness report,
+// and its subscription.
+func (c *Counter) untrack(cs *connStats) {
+	c.mu.Lock()
+	delete(c.conns, cs)
+	if sub := c.subs[cs]; sub != nil {
+		close(sub.ch)
+		delete(c.subs, cs)
+	}
+	c.mu.Unlock()
+}
+
+// Inc increments the counters in a thread safe way.
+func (c *Counter) Inc() {
+	c.count(1)
+}
+
+// HasValue checks if an int has been recorded in a thread safe way.
+func (c *Counter) HasValue(num int) (b bool) {
+	var err error
+	if c.locked {
+		c.mu.RLock()
+		b, err = c.set.Has(num)
+		c.mu.RUnlock()
+	} else {
+		b, err = c.set.Has(num)
+	}
+	if err != nil {
+		c.seg.log.Error("could not check the store", "stream", c.name, "value", num, "err", err)
+	}
+	return
+}
+
+// handOver closes the log for Restart and refuses every value from
+// then on, even one the new process doesn't have in its unique set, so
+// only one process ever writes a segment and adds to a shared Store.
+// The intervals are stopped if running says they run. It returns the
+// segment the new process carries on logging in.
+func (c *Counter) handOver(running bool) (next int, err error) {
+	c.handedOver.Store(true)
+	c.mu.Lock()
+	err = c.flushClose()
+	if err != nil {
+		c.Log.seg.Close()
+	}
+	c.Log.seg = brokenSegment{errHandedOver}
+	next = c.Log.Cnt + 1
+	c.mu.Unlock()
+
+	if running {
+		c.Close()
+	}
+	return next, err
+}
+
+// Close closes all internals and flushes logs to disk.
+// It is safe to call more than once, but only once the intervals run,
+// a Counter without them is closed with FlushClose.
+func (c *Counter) Close() (err error) {
+	c.intvl.stop.Do(func() {
+		c.StopOutputIntvl()
+		c.StopLogIntvl()
+	})
+	return
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// deadlineConn closes stalled connections, ones that hold a slot of the
+// connection limit without sending anything: before every read it sets
+// a deadline of idle from now and, in the middle of a line, of line from
+// where the line started. The second catches clients trickling a line
+// a byte at a time, which never trip the first.
+//
+// Lines are told apart on the raw bytes, so once a connection switches
+// to a compressed stream only idle applies, see plain.
+type deadlineConn struct {
+	net.Conn
+	idle, line time.Duration
+	// fixed is a deadline set with SetReadDeadline, e.g. for
+	// authenticating, the earlier one of it and ours applies.
+	fixed time.Time
+	// plain is whether the bytes read are lines, not a compressed stream.
+	plain bool
+	// midLine is whether the last byte read wasn't a newline,
+	// with lineStart when that line's first byte arrived.
+	midLine   bool
+	lineStart time.Time
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	now := time.Now()
+	var deadline time.Time
+	if c.idle > 0 {
+		deadline = now.Add(c.idle)
+	}
+	if c.line > 0 && c.plain && c.midLine {
+		deadline = earliest(deadline, c.lineStart.Add(c.line))
+	}
+	deadline = earliest(deadline, c.fixed)
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.plain {
+		c.track(p[:n], time.Now())
+	}
+	return n, err
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.fixed = t
+	return nil
+}
+
+// earliest of a and b, where zero is none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// track follows where lines start and end in the bytes just read.
+func (c *deadlineConn) track(b []byte, now time.Time) {
+	last := bytes.LastIndexByte(b, '\n')
+	switch {
+	case last == len(b)-1:
+		c.midLine = false
+	case last >= 0 || !c.midLine:
+		// A new line started in b.
+		c.midLine, c.lineStart = true, now
+	}
+}
+
+// isTimeout reports whether err is a read deadline passing.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentErrors is how many warnings and errors the diagnostic dump keeps.
+const recentErrors = 100
+
+// recentLines are the last max lines added.
+type recentLines struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (r *recentLines) add(l string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines = append(r.lines, l)
+	if n := len(r.lines) - r.max; n > 0 {
+		r.lines = append(r.lines[:0], r.lines[n:]...)
+	}
+}
+
+func (r *recentLines) recent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// recentHandler passes records through to a Handler, and keeps the
+// warnings and errors as text lines in recent, whatever the Handler's format.
+type recentHandler struct {
+	slog.Handler
+	recent *recentLines
+	// attrs are those added with WithAttrs, as text.
+	attrs string
+}
+
+func newRecentHandler(h slog.Handler, max int) *recentHandler {
+	return &recentHandler{Handler: h, recent: &recentLines{max: max}}
+}
+
+func (h *recentHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s %s%s", r.Time.UTC().Format(time.RFC3339), r.Level, r.Message, h.attrs)
+		r.Attrs(func(a slog.Attr) bool {
+			fmt.Fprintf(&b, " %s", a)
+			return true
+		})
+		h.recent.add(b.String())
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *recentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	text := h.attrs
+	for _, a := range attrs {
+		text += " " + a.String()
+	}
+	return &recentHandler{Handler: h.Handler.WithAttrs(attrs), recent: h.recent, attrs: text}
+}
+
+func (h *recentHandler) WithGroup(name string) slog.Handler {
+	return &recentHandler{Handler: h.Handler.WithGroup(name), recent: h.recent, attrs: h.attrs}
+}
+
+// WriteDiagnostics writes everything useful after an incident to a
+// timestamped file in the log directory: stats, queue depths, the
+// configuration, recent errors and every goroutine's stack.
+// It returns the name of the file.
+func (s *Server) WriteDiagnostics() (name string, err error) {
+	cfg := s.config()
+	name = filepath.Join(cfg.LogDir, fmt.Sprintf("diag.%s.txt", time.Now().UTC().Format("20060102T150405.000")))
+	f, err := os.Create(name)
+	if err != nil {
+		return "", fmt.Errorf("could not create diagnostics file: %v", err)
+	}
+	defer f.Close()
+
+	counter := s.counter
+	st := counter.Snapshot()
+	fmt.Fprintf(f, "== Stats\n")
+	fmt.Fprintf(f, "time=%s uptime=%v goroutines=%d\n",
+		time.Now().UTC().Format(time.RFC3339), st.Uptime.Round(time.Second), runtime.NumGoroutine())
+	fmt.Fprintf(f, "unique=%d total=%d duplicates=%d interval=%d conns=%d\n",
+		st.Unique, st.Total, st.Duplicates, st.IntvlTotal, st.Conns)
+
+	fmt.Fprintf(f, "\n== Queues\n")
+	used, max := counter.sem.inUse()
+	fmt.Fprintf(f, "conn_slots=%d/%d\n", used, max)
+	fmt.Fprintf(f, "conn_waiting=%d\n", counter.sem.waiting())
+	for i, d := range counter.logQueues() {
+		fmt.Fprintf(f, "log_partition_%d=%d\n", i, d)
+	}
+
+	fmt.Fprintf(f, "\n== Config\n")
+	writeConfig(f, cfg)
+
+	fmt.Fprintf(f, "\n== Recent errors\n")
+	for _, l := range s.recent.recent() {
+		fmt.Fprintln(f, l)
+	}
+
+	fmt.Fprintf(f, "\n== Goroutines\n")
+	if err = pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		return "", fmt.Errorf("could not write goroutine stacks: %v", err)
+	}
+
+	return name, f.Close()
+}
+
+// writeConfig lists the fields of cfg one per line, redacting the ones
+// tagged diag:"secret" and leaving out the ones tagged diag:"-".
+func writeConfig(w io.Writer, cfg Config) {
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		val := v.Field(i).Interface()
+		switch field.Tag.Get("diag") {
+		case "-":
+			continue
+		case "secret":
+			if !v.Field(i).IsZero() {
+				val = "<redacted>"
+			}
+		}
+		fmt.Fprintf(w, "%s=%v\n", field.Name, val)
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// dynamoTimeout bounds every call to DynamoDB, its retries included.
+	dynamoTimeout = 10 * time.Second
+	// dynamoAttempts is how often a throttled call is tried, backing off
+	// up to dynamoMaxBackoff in between.
+	dynamoAttempts   = 8
+	dynamoMaxBackoff = 2 * time.Second
+	// dynamoBatchGet is the most keys a BatchGetItem takes.
+	dynamoBatchGet = 100
+	// dynamoPuts is how many puts of a batch run at once.
+	dynamoPuts = 16
+)
+
+// dynamoStore keeps the values in a DynamoDB table, shared by every
+// server pointed at it, and kept across restarts. The table is
+// Config.DynamoTable, its partition key the stream, a string named
+// stream, its sort key the value, a number named value. A value is added
+// with a put on the condition it isn't there, so only one server ever
+// adds it. The values known to be in the table are kept locally too, up
+// to Config.DynamoCache of them, so resent duplicates cost no call.
+type dynamoStore struct {
+	c      *dynamodb.Client
+	table  string
+	stream string
+	known  *knownSet
+	// n is the stream's items counted when the store was opened, and
+	// those added and removed here since, like postgresStore's.
+	n atomic.Int64
+
+	hits   atomic.Int64
+	reads  atomic.Int64
+	writes atomic.Int64
+}
+
+func openDynamoStore(cfg Config, stream string) (Store, error) {
+	if stream == "" {
+		stream = "data"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	opts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = dynamoAttempts
+				o.MaxBackoff = dynamoMaxBackoff
+				// Throttled calls back off and try again however
+				// many fail, rather than failing their values.
+				o.RateLimiter = ratelimit.None
+			})
+		}),
+	}
+	if cfg.DynamoRegion != "" {
+		opts = append(opts, config.WithRegion(cfg.DynamoRegion))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure dynamodb: %v", err)
+	}
+	c := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if cfg.DynamoEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoEndpoint)
+		}
+	})
+	d := &dynamoStore{c: c, table: cfg.DynamoTable, stream: stream, known: newKnownSet(cfg.DynamoCache)}
+
+	// Counting reads every item of the stream, once.
+	pages := dynamodb.NewQueryPaginator(c, &dynamodb.QueryInput{
+		TableName:                 &d.table,
+		KeyConditionExpression:    aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]string{"#s": "stream"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":s": &types.AttributeValueMemberS{Value: stream}},
+		Select:                    types.SelectCount,
+	})
+	var n int64
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not count the values in the dynamodb table %s: %v", d.table, err)
+		}
+		n += int64(page.Count)
+	}
+	d.n.Store(n)
+	return d, nil
+}
+
+func (d *dynamoStore) key(num int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"stream": &types.AttributeValueMemberS{Value: d.stream},
+		"value":  &types.AttributeValueMemberN{Value: strconv.Itoa(num)},
+	}
+}
+
+// put adds num on the condition it isn't there, it reports false if it
+// was. Like the redis store it leaves num be if DynamoDB may have added
+// it without answering.
+func (d *dynamoStore) put(ctx context.Context, num int) (bool, error) {
+	item := d.key(num)
+	item["added"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	d.writes.Add(1)
+	_, err := d.c.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                &d.table,
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#v)"),
+		ExpressionAttributeNames: map[string]string{"#v": "value"},
+	})
+	var exists *types.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		d.known.add(num)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	d.known.add(num)
+	d.n.Add(1)
+	return true, nil
+}
+
+func (d *dynamoStore) Add(num int) (bool, error) {
+	if d.known.has(num) {
+		d.hits.Add(1)
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	return d.put(ctx, num)
+}
+
+func (d *dynamoStore) Has(num int) (bool, error) {
+	if d.known.has(num) {
+		d.hits.Add(1)
+		return true, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	d.reads.Add(1)
+	out, err := d.c.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                &d.table,
+		Key:                      d.key(num),
+		ConsistentRead:           aws.Bool(true),
+		ProjectionExpression:     aws.String("#v"),
+		ExpressionAttributeNames: map[string]string{"#v": "value"},
+	})
+	if err != nil {
+		return false, err
+	}
+	if out.Item != nil {
+		d.known.add(num)
+	}
+	return out.Item != nil, nil
+}
+
+// AddBatch looks nums up in reads of up to 100 at once first, a read
+// costs a fifth of a write, then puts the values that weren't there a
+// few at a time. A value another server added meanwhile still fails
+// its put's condition.
+func (d *dynamoStore) AddBatch(nums []int) ([]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	var todo []int
+	seen := make(map[int]bool)
+	for _, num := range nums {
+		if seen[num] {
+			continue
+		}
+		seen[num] = true
+		if d.known.has(num) {
+			d.hits.Add(1)
+			continue
+		}
+		todo = append(todo, num)
+	}
+	there, err := d.batchHas(ctx, todo)
+	if err != nil {
+		return nil, err
+	}
+	var absent []int
+	for _, num := range todo {
+		if !there[num] {
+			absent = append(absent, num)
+		}
+	}
+
+	added := make([]bool, len(absent))
+	errs := make([]error, len(absent))
+	sem := make(chan struct{}, dynamoPuts)
+	var wg sync.WaitGroup
+	for i, num := range absent {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			added[i], errs[i] = d.put(ctx, num)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	if err = errors.Join(errs...); err != nil {
+		return nil, removeNew(d, absent, added, err)
+	}
+
+	isNew := make(map[int]bool, len(absent))
+	for i, num := range absent {
+		isNew[num] = added[i]
+	}
+	uniq := make([]bool, len(nums))
+	for i, num := range nums {
+		// Only the first of a value twice in nums is new.
+		uniq[i] = isNew[num]
+		delete(isNew, num)
+	}
+	return uniq, nil
+}
+
+// batchHas returns which of nums are in the table, with consistent
+// reads of up to dynamoBatchGet keys. The keys DynamoDB leaves
+// unprocessed, when it's throttling, are read again after a backoff.
+func (d *dynamoStore) batchHas(ctx context.Context, nums []int) (map[int]bool, error) {
+	there := make(map[int]bool)
+	for len(nums) > 0 {
+		chunk := nums[:min(len(nums), dynamoBatchGet)]
+		nums = nums[len(chunk):]
+		keys := make([]map[string]types.AttributeValue, len(chunk))
+		for i, num := range chunk {
+			keys[i] = d.key(num)
+		}
+		req := map[string]types.KeysAndAttributes{d.table: {
+			Keys:                     keys,
+			ConsistentRead:           aws.Bool(true),
+			ProjectionExpression:     aws.String("#v"),
+			ExpressionAttributeNames: map[string]string{"#v": "value"},
+		}}
+		for backoff := 50 * time.Millisecond; len(req) > 0; backoff = min(2*backoff, dynamoMaxBackoff) {
+			d.reads.Add(1)
+			out, err := d.c.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: req})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Responses[d.table] {
+				v, ok := item["value"].(*types.AttributeValueMemberN)
+				if !ok {
+					return nil, fmt.Errorf("dynamodb: item without a value in %s", d.table)
+				}
+				num, err := strconv.Atoi(v.Value)
+				if err != nil {
+					return nil, fmt.Errorf("dynamodb: value %q in %s: %v", v.Value, d.table, err)
+				}
+				there[num] = true
+				d.known.add(num)
+			}
+			req = out.UnprocessedKeys
+			if len(req) > 0 {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+		}
+	}
+	return there, nil
+}
+
+func (d *dynamoStore) Remove(num int) error {
+	d.known.remove(num)
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	d.writes.Add(1)
+	out, err := d.c.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    &d.table,
+		Key:          d.key(num),
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return err
+	}
+	if out.Attributes != nil {
+		d.n.Add(-1)
+	}
+	return nil
+}
+
+// Len is the count kept by the store, see dynamoStore.n.
+func (d *dynamoStore) Len() (int, error) { return int(d.n.Load()), nil }
+
+func (d *dynamoStore) Close() error { return nil }
+
+func (d *dynamoStore) metrics() []storeMetric {
+	return []storeMetric{
+		{"simple_tcp_server_dynamodb_cache_hits_total", "Values the dynamodb dedup knew were in the table without a call.", "counter", float64(d.hits.Load())},
+		{"simple_tcp_server_dynamodb_reads_total", "Read calls of the dynamodb dedup.", "counter", float64(d.reads.Load())},
+		{"simple_tcp_server_dynamodb_writes_total", "Write calls of the dynamodb dedup.", "counter", float64(d.writes.Load())},
+	}
+}
+
+// knownSet is a bounded set of values known to be in a shared store,
+// the oldest is forgotten first to make room for a new one.
+type knownSet struct {
+	mu   sync.Mutex
+	m    map[int]bool
+	ring []int
+	next int
+}
+
+// newKnownSet returns a set of up to size values, none if it's negative.
+func newKnownSet(size int) *knownSet {
+	size = max(size, 0)
+	return &knownSet{m: make(map[int]bool, size), ring: make([]int, 0, size)}
+}
+
+func (k *knownSet) has(num int) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.m[num]
+}
+
+func (k *knownSet) add(num int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.m[num] || cap(k.ring) == 0 {
+		return
+	}
+	if len(k.ring) < cap(k.ring) {
+		k.ring = append(k.ring, num)
+	} else {
+		delete(k.m, k.ring[k.next])
+		k.ring[k.next] = num
+		k.next = (k.next + 1) % len(k.ring)
+	}
+	k.m[num] = true
+}
+
+// remove forgets num, its place in the ring is freed when it comes up.
+func (k *knownSet) remove(num int) {
+	k.mu.Lock()
+	delete(k.m, num)
+	k.mu.Unlock()
+}
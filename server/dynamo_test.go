@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDynamo is a DynamoDB endpoint of one table that knows the calls
+// of the dynamodb store. It throttles the first put, and leaves the
+// last key of the first batch get unprocessed, like a busy table.
+type fakeDynamo struct {
+	mu        sync.Mutex
+	items     map[string]bool
+	calls     map[string]int
+	throttled bool
+	deferred  bool
+}
+
+// dynamoItem is an item's attributes, as DynamoDB's JSON has them.
+type dynamoItem map[string]map[string]string
+
+func (it dynamoItem) id() string { return it["stream"]["S"] + ":" + it["value"]["N"] }
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, op, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+	var req struct {
+		Key                       dynamoItem
+		Item                      dynamoItem
+		RequestItems              map[string]struct{ Keys []dynamoItem }
+		ExpressionAttributeValues dynamoItem
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	fail := func(typ string) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#%s","message":"%s"}`, typ, typ)
+	}
+	var resp interface{} = struct{}{}
+	switch op {
+	case "Query":
+		n := 0
+		for id := range f.items {
+			if strings.HasPrefix(id, req.ExpressionAttributeValues[":s"]["S"]+":") {
+				n++
+			}
+		}
+		resp = map[string]int{"Count": n, "ScannedCount": n}
+	case "PutItem":
+		if !f.throttled {
+			f.throttled = true
+			fail("ProvisionedThroughputExceededException")
+			return
+		}
+		if f.items[req.Item.id()] {
+			fail("ConditionalCheckFailedException")
+			return
+		}
+		f.items[req.Item.id()] = true
+	case "GetItem":
+		if f.items[req.Key.id()] {
+			resp = map[string]dynamoItem{"Item": req.Key}
+		}
+	case "BatchGetItem":
+		found := make(map[string][]dynamoItem)
+		unprocessed := make(map[string]map[string][]dynamoItem)
+		for table, ka := range req.RequestItems {
+			keys := ka.Keys
+			if !f.deferred && len(keys) > 1 {
+				f.deferred = true
+				unprocessed[table] = map[string][]dynamoItem{"Keys": keys[len(keys)-1:]}
+				keys = keys[:len(keys)-1]
+			}
+			for _, key := range keys {
+				if f.items[key.id()] {
+					found[table] = append(found[table], dynamoItem{"value": key["value"]})
+				}
+			}
+		}
+		resp = map[string]interface{}{"Responses": found, "UnprocessedKeys": unprocessed}
+	case "DeleteItem":
+		if f.items[req.Key.id()] {
+			delete(f.items, req.Key.id())
+			resp = map[string]dynamoItem{"Attributes": req.Key}
+		}
+	default:
+		fail("UnknownOperationException")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveDynamo serves f, with the AWS configuration pointed at nothing
+// but made up credentials.
+func serveDynamo(t *testing.T, f *fakeDynamo) Config {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	f.items, f.calls = make(map[string]bool), make(map[string]int)
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := testConfig(t)
+	cfg.Dedup, cfg.DynamoTable, cfg.DynamoEndpoint = "dynamodb", "numbers", srv.URL
+	return cfg.withDefaults()
+}
+
+func TestDynamoStore(t *testing.T) {
+	f := &fakeDynamo{}
+	cfg := serveDynamo(t, f)
+	store, err := openDynamoStore(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// The first put is throttled, and tried again.
+	for i, want := range []bool{true, false} {
+		if uniq, err := store.Add(MinValue); err != nil || uniq != want {
+			t.Errorf("Add #%d = %v, %v, want %v", i+1, uniq, err, want)
+		}
+	}
+	f.mu.Lock()
+	if f.calls["PutItem"] != 2 {
+		t.Errorf("%d puts, want the throttled one and its retry, then none for the known duplicate", f.calls["PutItem"])
+	}
+	f.mu.Unlock()
+	if has, err := store.Has(MinValue); err != nil || !has {
+		t.Errorf("Has = %v, %v, want true", has, err)
+	}
+	if err := store.Remove(MinValue); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := store.Has(MinValue); err != nil || has {
+		t.Errorf("Has after Remove = %v, %v, want false", has, err)
+	}
+
+	// Another server's value fails its put's condition.
+	f.mu.Lock()
+	f.items[fmt.Sprintf("data:%d", MinValue+3)] = true
+	f.mu.Unlock()
+	if uniq, err := store.Add(MinValue + 3); err != nil || uniq {
+		t.Errorf("Add of another server's value = %v, %v, want a duplicate", uniq, err)
+	}
+
+	store.Add(MinValue + 1)
+	uniq, err := store.(BatchStore).AddBatch([]int{MinValue, MinValue + 1, MinValue, MinValue + 2, MinValue + 4})
+	if want := []bool{true, false, false, true, true}; err != nil || !reflect.DeepEqual(uniq, want) {
+		t.Errorf("AddBatch = %v, %v, want %v", uniq, err, want)
+	}
+	f.mu.Lock()
+	if f.calls["BatchGetItem"] != 2 {
+		t.Errorf("%d batch gets, want the one that left a key unprocessed and its retry", f.calls["BatchGetItem"])
+	}
+	f.mu.Unlock()
+	if n, err := store.Len(); err != nil || n != 4 {
+		t.Errorf("Len = %d, %v, want 4", n, err)
+	}
+
+	// A store opened later counts what's there.
+	other, err := openDynamoStore(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := other.Len(); err != nil || n != 5 {
+		t.Errorf("Len of a store opened later = %d, %v, want 5", n, err)
+	}
+}
+
+func TestKnownSet(t *testing.T) {
+	k := newKnownSet(2)
+	k.add(1)
+	k.add(2)
+	k.add(3)
+	if k.has(1) || !k.has(2) || !k.has(3) {
+		t.Errorf("has 1, 2, 3 = %v, %v, %v, want the oldest forgotten", k.has(1), k.has(2), k.has(3))
+	}
+	k.remove(2)
+	if k.has(2) {
+		t.Error("has a removed value")
+	}
+	off := newKnownSet(-1)
+	off.add(1)
+	if off.has(1) {
+		t.Error("a set of none has a value")
+	}
+}
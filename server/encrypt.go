@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// encMagic starts every encrypted log segment,
+// and every part appended to one after a reopen.
+const encMagic = "TCPENC1\n"
+
+// encChunk is how much plaintext goes into one sealed frame.
+const encChunk = 64 << 10
+
+// Keyring is the set of keys from a key file.
+// Each line holds a key id and a hex encoded 256 bit AES key:
+//
+//	# id  key
+//	2024-01  6b1f...
+//	2024-07  93ac...
+//
+// New segments are encrypted with the last key, older ones are kept
+// so segments written before a rotation can still be read.
+// The file is meant to be put in place by whatever manages secrets,
+// e.g. unwrapped from a KMS envelope at deploy time.
+type Keyring struct {
+	ids  []string
+	keys map[string]cipher.AEAD
+}
+
+// LoadKeyring reads the key file at name.
+func LoadKeyring(name string) (*Keyring, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open key file: %v", err)
+	}
+	defer f.Close()
+
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("key file line %d: want <id> <hex key>", line)
+		}
+
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("key file line %d: key must be 64 hex digits", line)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %v", line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %v", line, err)
+		}
+
+		if _, ok := k.keys[fields[0]]; !ok {
+			k.ids = append(k.ids, fields[0])
+		}
+		k.keys[fields[0]] = aead
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", err)
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("key file holds no keys")
+	}
+	return k, nil
+}
+
+// active returns the key new segments are sealed with.
+func (k *Keyring) active() (id string, aead cipher.AEAD) {
+	id = k.ids[len(k.ids)-1]
+	return id, k.keys[id]
+}
+
+// logKeys holds the *Keyring log segments are encrypted with,
+// unset if the log is written in plain text.
+type logKeys struct {
+	v atomic.Value
+}
+
+// current returns the keyring to encrypt with, nil for plain text.
+func (l *logKeys) current() *Keyring {
+	k, _ := l.v.Load().(*Keyring)
+	return k
+}
+
+// loadLogKeys (re)reads Config.LogKeyFile, segments opened afterwards
+// use its newest key.
+func (s *Server) loadLogKeys() error {
+	if s.cfg.LogKeyFile == "" {
+		return nil
+	}
+
+	k, err := LoadKeyring(s.cfg.LogKeyFile)
+	if err != nil {
+		return err
+	}
+	s.keys.v.Store(k)
+	return nil
+}
+
+// sealer encrypts everything written to it in AES-GCM frames.
+//
+// A part starts with encMagic, the key id length (one byte) and the key id.
+// Each frame then is the sealed length (uint32, big endian), a random
+// nonce and the sealed chunk. The key id and the frame's index within
+// the part are authenticated along with it, so frames can't be
+// reordered or moved between parts without failing to open.
+type sealer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	id   string
+	seq  uint64
+}
+
+func newSealer(w io.Writer, k *Keyring) (*sealer, error) {
+	id, aead := k.active()
+
+	hdr := append([]byte(encMagic), byte(len(id)))
+	if _, err := w.Write(append(hdr, id...)); err != nil {
+		return nil, fmt.Errorf("could not write encryption header: %v", err)
+	}
+	return &sealer{w: w, aead: aead, id: id}, nil
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += encChunk {
+		end := off + encChunk
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.seal(p[off:end]); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *sealer) seal(chunk []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %v", err)
+	}
+
+	sealed := s.aead.Seal(nil, nonce, chunk, frameAAD(s.id, s.seq))
+	s.seq++
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	frame := append(append(length[:], nonce...), sealed...)
+	_, err := s.w.Write(frame)
+	return err
+}
+
+func frameAAD(id string, seq uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	return append([]byte(id), b[:]...)
+}
+
+// OpenLogReader opens a log segment for reading,
+// decompressing it if it's gzipped, see Config.LogCompress,
+// and decrypting it with keys if it's encrypted.
+// Plain segments are returned as they are.
+func OpenLogReader(name string, keys *Keyring) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file: %v", err)
+	}
+
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(2); string(head) == "\x1f\x8b" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not decompress %s: %v", name, err)
+		}
+		r = bufio.NewReader(zr)
+	}
+	if head, _ := r.Peek(len(encMagic)); string(head) != encMagic {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, f}, nil
+	}
+
+	if keys == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is encrypted, a key file is needed to read it", name)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&opener{r: r, keys: keys, name: name}, f}, nil
+}
+
+// opener decrypts the frames written by sealer.
+type opener struct {
+	r    *bufio.Reader
+	keys *Keyring
+	name string
+
+	aead cipher.AEAD
+	id   string
+	seq  uint64
+	buf  bytes.Buffer
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for o.buf.Len() == 0 {
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	return o.buf.Read(p)
+}
+
+// next opens the following frame into buf,
+// switching keys whenever a new part starts.
+func (o *opener) next() error {
+	head, err := o.r.Peek(len(encMagic))
+	if err == io.EOF && len(head) == 0 {
+		return io.EOF
+	}
+	if string(head) == encMagic {
+		return o.part()
+	}
+	if o.aead == nil {
+		return fmt.Errorf("%s: missing encryption header", o.name)
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(o.r, length[:]); err != nil {
+		return fmt.Errorf("%s: truncated frame: %v", o.name, err)
+	}
+	frame := make([]byte, o.aead.NonceSize()+int(binary.BigEndian.Uint32(length[:])))
+	if _, err := io.ReadFull(o.r, frame); err != nil {
+		return fmt.Errorf("%s: truncated frame: %v", o.name, err)
+	}
+
+	nonce, sealed := frame[:o.aead.NonceSize()], frame[o.aead.NonceSize():]
+	plain, err := o.aead.Open(nil, nonce, sealed, frameAAD(o.id, o.seq))
+	if err != nil {
+		return fmt.Errorf("%s: frame %d of key %s does not authenticate", o.name, o.seq, o.id)
+	}
+	o.seq++
+	o.buf.Write(plain)
+	return nil
+}
+
+// part reads the header starting a part and selects its key.
+func (o *opener) part() error {
+	o.r.Discard(len(encMagic))
+	n, err := o.r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%s: truncated encryption header", o.name)
+	}
+	id := make([]byte, n)
+	if _, err := io.ReadFull(o.r, id); err != nil {
+		return fmt.Errorf("%s: truncated encryption header", o.name)
+	}
+
+	aead, ok := o.keys.keys[string(id)]
+	if !ok {
+		return fmt.Errorf("%s: encrypted with key %s, which isn't in the key file", o.name, id)
+	}
+	o.aead, o.id, o.seq = aead, string(id), 0
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+// writeKeyring writes a key file of lines and loads it.
+func writeKeyring(t *testing.T, lines ...string) *Keyring {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "log.keys")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// sealParts seals each of parts with the newest key of the keyring
+// next to it and writes them one after the other to a segment.
+func sealParts(t *testing.T, parts ...any) string {
+	t.Helper()
+	var b bytes.Buffer
+	for i := 0; i < len(parts); i += 2 {
+		s, err := newSealer(&b, parts[i].(*Keyring))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(parts[i+1].([]byte)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(t.TempDir(), "server.log")
+	if err := os.WriteFile(name, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// readLog reads the segment name back with keys.
+func readLog(name string, keys *Keyring) ([]byte, error) {
+	r, err := OpenLogReader(name, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	old := writeKeyring(t, "# the first key", "k1 "+testKey1)
+	rotated := writeKeyring(t, "k1 "+testKey1, "", "k2 "+testKey2)
+	if id, _ := rotated.active(); id != "k2" {
+		t.Fatalf("active key %s, want the last one, k2", id)
+	}
+
+	// More than a chunk, so it takes frames.
+	first := bytes.Repeat([]byte("1234567890\n"), encChunk/11+100)
+	second := []byte("1234567891\n")
+	name := sealParts(t, old, first, rotated, second)
+	if b, _ := os.ReadFile(name); bytes.Contains(b, []byte("1234567890")) {
+		t.Error("the segment holds values in plain text")
+	}
+
+	got, err := readLog(name, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), first...), second...); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes back, want the %d written", len(got), len(want))
+	}
+
+	// Plain segments are read as they are.
+	plain := filepath.Join(t.TempDir(), "plain.log")
+	os.WriteFile(plain, second, 0600)
+	if got, err := readLog(plain, nil); err != nil || !bytes.Equal(got, second) {
+		t.Errorf("read %q, %v from a plain segment, want %q", got, err, second)
+	}
+}
+
+func TestEncryptWrongKey(t *testing.T) {
+	k1 := writeKeyring(t, "k1 "+testKey1)
+	name := sealParts(t, k1, []byte("1234567890\n"))
+
+	if _, err := readLog(name, nil); err == nil || !strings.Contains(err.Error(), "key file is needed") {
+		t.Errorf("err = %v without keys, want a key file asked for", err)
+	}
+	if _, err := readLog(name, writeKeyring(t, "k2 "+testKey2)); err == nil || !strings.Contains(err.Error(), "isn't in the key file") {
+		t.Errorf("err = %v without the key, want it missing", err)
+	}
+	// Another key of the same id.
+	if _, err := readLog(name, writeKeyring(t, "k1 "+testKey2)); err == nil || !strings.Contains(err.Error(), "does not authenticate") {
+		t.Errorf("err = %v with the wrong key, want it not to authenticate", err)
+	}
+}
+
+func TestEncryptTamper(t *testing.T) {
+	k := writeKeyring(t, "k1 "+testKey1)
+	hdr := len(encMagic) + 1 + len("k1")
+	frame := func(b []byte, off int) []byte {
+		return b[off : off+4+12+int(binary.BigEndian.Uint32(b[off:]))]
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(b []byte) []byte
+		err    string
+	}{
+		{"flipped byte", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}, "does not authenticate"},
+		{"reordered frames", func(b []byte) []byte {
+			f1 := frame(b, hdr)
+			f2 := frame(b, hdr+len(f1))
+			out := append([]byte(nil), b[:hdr]...)
+			out = append(append(out, f2...), f1...)
+			return append(out, b[hdr+len(f1)+len(f2):]...)
+		}, "frame 0 of key k1 does not authenticate"},
+		{"truncated", func(b []byte) []byte {
+			return b[:len(b)-5]
+		}, "truncated frame"},
+		{"frames without a header", func(b []byte) []byte {
+			return append([]byte(encMagic+"\x02k1"), b[hdr+len(frame(b, hdr)):]...)
+		}, "frame 0 of key k1 does not authenticate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := sealParts(t, k, bytes.Repeat([]byte("1234567890\n"), encChunk/11*2+10))
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(name, tt.tamper(b), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readLog(name, k); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		err  string
+	}{
+		{"empty", "# no keys\n", "holds no keys"},
+		{"no key", "k1\n", "want <id> <hex key>"},
+		{"short key", "k1 0001\n", "64 hex digits"},
+		{"not hex", "k1 " + strings.Repeat("z", 64) + "\n", "64 hex digits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "log.keys")
+			os.WriteFile(name, []byte(tt.file), 0600)
+			if _, err := LoadKeyring(name); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if _, err := LoadKeyring(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loaded a key file that isn't there")
+	}
+}
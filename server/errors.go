@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// The error replies of the line protocol, "ERR", a code clients can
+// branch on and its name. Codes are never reused for something else.
+const (
+	// malformedReply answers a value that isn't ValueLen digits,
+	// with Config.ErrorReplies.
+	malformedReply = "ERR 001 malformed\n"
+	// outOfRangeReply answers a value out of the stream's range,
+	// with Config.ErrorReplies.
+	outOfRangeReply = "ERR 002 out-of-range\n"
+	// rateLimitedReply is sent before hanging up on a client over its limits.
+	rateLimitedReply = "ERR 003 rate-limited\n"
+	// lineTooLongReply is sent before hanging up on a line over the limit.
+	lineTooLongReply = "ERR 004 line-too-long\n"
+	// unauthorizedReply is sent before hanging up on a client that
+	// didn't authenticate.
+	unauthorizedReply = "ERR 005 unauthorized\n"
+	// batchTooLargeReply turns away a batch of more than Config.MaxBatch values.
+	batchTooLargeReply = "ERR 006 batch-too-large\n"
+	// rejectedReply answers a value a validator extension rejected,
+	// with Config.ErrorReplies.
+	rejectedReply = "ERR 007 rejected\n"
+	// recoveringReply is sent before hanging up on a value that may still
+	// turn up in the log being recovered, see Config.RecoverBackground.
+	recoveringReply = "ERR 008 recovering\n"
+	// quotaExceededReply is sent before hanging up on a value to a stream
+	// that took in its daily quota, see Config.DailyQuota.
+	quotaExceededReply = "ERR 009 quota-exceeded\n"
+)
+
+// errQuiet hangs up on a client that sent invalid input with Config.Quiet.
+var errQuiet = errors.New("invalid input")
+
+// errInvalid hangs up on a client at its first invalid line, unless
+// Config.SkipInvalid.
+var errInvalid = errors.New("invalid line")
+
+// errHandedOver refuses the values a Counter gets after Restart handed
+// its log over, the client is hung up on to send them to the new
+// process. It isn't an OpError.
+var errHandedOver = errors.New("log handed over to a new process")
+
+// errRecovering refuses the values a Counter can't answer yet while it
+// recovers its log in the background, see Config.RecoverBackground.
+// The client is hung up on to send them again later. It isn't an OpError.
+var errRecovering = errors.New("log still being recovered")
+
+// errQuotaExceeded refuses the values a Counter gets over its stream's
+// daily quota, see Config.DailyQuota. They're counted as rejected in the
+// usage, not in the totals. It isn't an OpError.
+var errQuotaExceeded = errors.New("daily quota exceeded")
+
+// invalidReply is the error reply to a value validation failed with err.
+func invalidReply(err error) string {
+	switch err {
+	case ErrTooSmall, ErrTooLarge:
+		return outOfRangeReply
+	}
+	return malformedReply
+}
+
+// OpError is an error that cost a connection or a value: reading from a
+// connection failed, and the connection was closed, a unique value
+// couldn't be written to its stream's log, the values buffered for
+// it couldn't be written out, or a log segment couldn't be opened.
+// See Config.ErrorHandler.
+type OpError struct {
+	// Op is what failed, "read", "log", "flush" or "open". With flush the
+	// values buffered since the last flush may be missing from the log,
+	// with open values fail to log until a rotation opens a segment.
+	Op string
+	// Remote is the address of the peer, "" for values from the MQTT broker
+	// and for flush and open.
+	Remote string
+	// Stream is the name of the stream, "" for the main one.
+	Stream string
+	// Value is the value that wasn't logged, for Op log. It isn't part
+	// of the unique set either, so a handler can retry logging it with
+	// the stream Counter's RecordUniq, unless a shared Store couldn't
+	// tell whether it added it, see Store's Add.
+	Value int
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	switch e.Op {
+	case "log":
+		return fmt.Sprintf("could not log unique value %d from %s: %v", e.Value, e.Remote, e.Err)
+	case "flush", "open":
+		what := "write out"
+		if e.Op == "open" {
+			what = "open"
+		}
+		if e.Stream != "" {
+			return fmt.Sprintf("could not %s the log of stream %s: %v", what, e.Stream, e.Err)
+		}
+		return fmt.Sprintf("could not %s the log: %v", what, e.Err)
+	}
+	return fmt.Sprintf("could not %s from %s: %v", e.Op, e.Remote, e.Err)
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// opError counts e and hands it to the ErrorHandler,
+// or reports it if there is none.
+func (s *Server) opError(e *OpError) {
+	atomic.AddInt64(&s.errors, 1)
+	if s.cfg.ErrorHandler != nil {
+		s.cfg.ErrorHandler(e)
+		return
+	}
+	msg, args := "could not "+e.Op, []interface{}{"op", e.Op}
+	switch e.Op {
+	case "log":
+		msg, args = "could not log unique value", append(args, "value", e.Value)
+	case "flush":
+		msg = "could not write out the log"
+	case "open":
+		msg = "could not open the log"
+	}
+	if e.Remote != "" {
+		args = append(args, "remote", e.Remote)
+	}
+	if e.Stream != "" {
+		args = append(args, "stream", e.Stream)
+	}
+	s.log.Error(msg, append(args, "err", e.Err)...)
+}
+
+// Errors returns how many OpErrors there were since the server started.
+func (s *Server) Errors() int64 {
+	return atomic.LoadInt64(&s.errors)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/geoip"
+)
+
+// geoTop is how many origins the interval output lists.
+const geoTop = 10
+
+// originStats are the counters of one origin.
+// They're shared by all its connections, so only accessed atomically.
+type originStats struct {
+	conns  int64
+	values int64
+}
+
+// addValue counts a valid value from the origin.
+// A nil originStats does nothing, for when geoip is disabled.
+func (o *originStats) addValue() {
+	if o != nil {
+		atomic.AddInt64(&o.values, 1)
+	}
+}
+
+// geoResolver aggregates connections and values by origin.
+type geoResolver struct {
+	readers []*geoip.Reader
+	mu      sync.Mutex
+	origins map[string]*originStats
+}
+
+func openGeo(files []string) (*geoResolver, error) {
+	g := &geoResolver{origins: make(map[string]*originStats)}
+	for _, name := range files {
+		r, err := geoip.Open(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		g.readers = append(g.readers, r)
+	}
+	return g, nil
+}
+
+// origin looks up an address in every database, merging what they know.
+func (g *geoResolver) origin(ip net.IP) (o geoip.Origin) {
+	for _, r := range g.readers {
+		got, err := r.Origin(ip)
+		if err != nil {
+			continue
+		}
+		if got.Country != "" {
+			o.Country = got.Country
+		}
+		if got.ASN != 0 {
+			o.ASN, o.Org = got.ASN, got.Org
+		}
+	}
+	return
+}
+
+// resolve counts a new connection from addr and returns the stats of its origin,
+// e.g. "DE AS3320". A nil geoResolver returns nil.
+func (g *geoResolver) resolve(addr net.Addr) *originStats {
+	if g == nil {
+		return nil
+	}
+
+	key := "unknown"
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		o := g.origin(tcp.IP)
+		key = o.Country
+		if key == "" {
+			key = "??"
+		}
+		if o.ASN != 0 {
+			key += fmt.Sprintf(" AS%d", o.ASN)
+		}
+	}
+
+	g.mu.Lock()
+	o, ok := g.origins[key]
+	if !ok {
+		o = &originStats{}
+		g.origins[key] = o
+	}
+	g.mu.Unlock()
+
+	atomic.AddInt64(&o.conns, 1)
+	return o
+}
+
+// report lists the origins sending the most values.
+func (g *geoResolver) report() string {
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.origins))
+	values := make(map[string]int64, len(g.origins))
+	conns := make(map[string]int64, len(g.origins))
+	for k, o := range g.origins {
+		keys = append(keys, k)
+		values[k] = atomic.LoadInt64(&o.values)
+		conns[k] = atomic.LoadInt64(&o.conns)
+	}
+	g.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if values[keys[i]] != values[keys[j]] {
+			return values[keys[i]] > values[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > geoTop {
+		keys = keys[:geoTop]
+	}
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "Origin      : %s conns=%d values=%d\n", k, conns[k], values[k])
+	}
+	return b.String()
+}
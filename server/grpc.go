@@ -0,0 +1,613 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// grpcService is the path prefix of the methods of the Numbers service,
+// see numbers.proto.
+const grpcService = "/numbers.v1.Numbers/"
+
+// maxGRPCMessage is the largest request message taken, a Number is a
+// few dozen bytes.
+const maxGRPCMessage = 64 << 10
+
+// The gRPC status codes the service answers with.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is a call's failure, with the status code it answers with.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// errGRPCClosing fails the calls that come in once Shutdown started.
+var errGRPCClosing = &grpcError{grpcUnavailable, "server shutting down"}
+
+// errGRPCRecovering fails the values that may still turn up in the log
+// being recovered, see Config.RecoverBackground.
+var errGRPCRecovering = &grpcError{grpcUnavailable, "recovering the log"}
+
+// errGRPCQuota fails the values over the stream's daily quota, see
+// Config.DailyQuota.
+var errGRPCQuota = &grpcError{grpcResourceExhausted, "daily quota exceeded"}
+
+// grpcNumber is the Number message, a value to record.
+type grpcNumber struct {
+	value  string
+	stream string
+	number uint64
+}
+
+// grpcReceiver serves the Numbers service over HTTP/2 without TLS, for
+// clients that would rather generate a stub from numbers.proto than
+// speak the line protocol. Values go through the same validation and
+// dedup as values sent over TCP, and the connections are turned away
+// by the allow and deny lists and Config.AuthToken like TCP ones.
+// Messages are encoded by hand, there's no gRPC library.
+type grpcReceiver struct {
+	srv *Server
+	hs  *http.Server
+
+	// calls and failed are totals for the interval output.
+	calls  int64
+	failed int64
+}
+
+// serveGRPC serves the Numbers service on addr, until Shutdown.
+func (s *Server) serveGRPC(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	g := &grpcReceiver{srv: s}
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcService+"SubmitNumber", g.method(g.submitNumber))
+	mux.HandleFunc(grpcService+"SubmitStream", g.method(g.submitStream))
+	mux.HandleFunc(grpcService+"SubmitAcked", g.streamMethod(g.submitAcked))
+	mux.HandleFunc(grpcService+"GetStats", g.method(g.getStats))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		g.finish(w, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path))
+	})
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	g.hs = &http.Server{
+		Handler:   mux,
+		Protocols: &protocols,
+		ErrorLog:  slog.NewLogLogger(s.log.Handler(), slog.LevelWarn),
+	}
+	s.grpc = g
+	go g.hs.Serve(grpcListener{l, s})
+	s.log.Info("listening", "addr", l.Addr().String(), "for", "gRPC")
+	return nil
+}
+
+// grpcListener turns away the connections the allow and deny lists
+// keep out, like acceptConns.
+type grpcListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l grpcListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.srv.acl.permits(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		if l.srv.cfg.LogDenied {
+			l.srv.audit.Record(auditDenied, conn.RemoteAddr().String(), "not allowed by the allow and deny lists")
+		}
+		conn.Close()
+	}
+}
+
+// method is the handler of a method of the service: call reads the
+// requests off body and returns the reply message.
+func (g *grpcReceiver) method(call func(body io.Reader, remote string) ([]byte, error)) http.HandlerFunc {
+	return g.streamMethod(func(w http.ResponseWriter, body io.Reader, remote string) error {
+		reply, err := call(body, remote)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/grpc")
+			_, err = w.Write(grpcFrame(reply))
+		}
+		return err
+	})
+}
+
+// streamMethod is the handler of a method that writes its reply
+// messages to w itself, as many as it likes.
+func (g *grpcReceiver) streamMethod(call func(w http.ResponseWriter, body io.Reader, remote string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+			!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+			return
+		}
+		atomic.AddInt64(&g.calls, 1)
+
+		s := g.srv
+		// Like connections, calls are tracked so Shutdown waits for them.
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			g.finish(w, errGRPCClosing)
+			return
+		}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		defer s.handlers.Done()
+
+		if err := g.admit(r); err != nil {
+			atomic.AddInt64(&g.failed, 1)
+			g.finish(w, err)
+			return
+		}
+		err := call(w, r.Body, r.RemoteAddr)
+		if err != nil {
+			atomic.AddInt64(&g.failed, 1)
+		}
+		g.finish(w, err)
+	}
+}
+
+// admit fails a call during maintenance, or without the token.
+func (g *grpcReceiver) admit(r *http.Request) error {
+	s := g.srv
+	if s.inMaintenance() {
+		return &grpcError{grpcUnavailable, "in maintenance"}
+	}
+	if s.cfg.AuthToken == "" {
+		return nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AuthToken)) == 1 {
+		return nil
+	}
+	s.audit.Record(auditAuthFailed, r.RemoteAddr, "missing or wrong token")
+	return &grpcError{grpcUnauthenticated, "missing or wrong token"}
+}
+
+// finish sends the status of a call in the trailers, OK if err is nil.
+func (g *grpcReceiver) finish(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		var ge *grpcError
+		if !errors.As(err, &ge) {
+			// The client went away, or sent something that's not gRPC.
+			ge = &grpcError{grpcInternal, err.Error()}
+		}
+		code, msg = ge.code, ge.msg
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcMessage(msg))
+	}
+}
+
+// submitNumber records a value, the reply tells whether it was new.
+func (g *grpcReceiver) submitNumber(body io.Reader, remote string) ([]byte, error) {
+	msg, err := readGRPCMessage(body)
+	if err == io.EOF {
+		return nil, &grpcError{grpcInvalidArgument, "no request"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req, err := decodeGRPCNumber(msg)
+	if err != nil {
+		return nil, err
+	}
+	uniq, err := g.record(req, remote)
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoBool(nil, 1, uniq), nil
+}
+
+// submitStream records every value of the stream of requests, those
+// record fails as invalid are counted as malformed. The reply has the
+// counts once the client is done sending.
+func (g *grpcReceiver) submitStream(body io.Reader, remote string) ([]byte, error) {
+	var uniq, dups, malformed uint64
+	for {
+		msg, err := readGRPCMessage(body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		req, err := decodeGRPCNumber(msg)
+		if err != nil {
+			return nil, err
+		}
+		isNew, err := g.record(req, remote)
+		var ge *grpcError
+		switch {
+		case errors.As(err, &ge) && (ge.code == grpcInvalidArgument || ge.code == grpcNotFound):
+			malformed++
+		case err != nil:
+			return nil, err
+		case isNew:
+			uniq++
+		default:
+			dups++
+		}
+	}
+
+	var reply []byte
+	reply = appendProtoUint(reply, 1, uniq)
+	reply = appendProtoUint(reply, 2, dups)
+	return appendProtoUint(reply, 3, malformed), nil
+}
+
+// The statuses of an Ack.
+const (
+	ackOK  = 1
+	ackDup = 2
+	ackErr = 3
+)
+
+// grpcSubmission is the Submission message, a value with the client's
+// sequence number, which its Ack echoes.
+type grpcSubmission struct {
+	seq uint64
+	num grpcNumber
+}
+
+// submitAcked records every value of the stream of requests and answers
+// each with an Ack of its sequence number once it's recorded: OK if it
+// was new, DUP for a duplicate, ERR with the status code a SubmitNumber
+// would have failed with. Up to Config.GRPCAckWindow values are read
+// ahead of their acks, from then on HTTP/2 flow control holds the
+// client back. On shutdown the call fails with UNAVAILABLE, the values
+// without an ack weren't recorded and go to the next server.
+func (g *grpcReceiver) submitAcked(w http.ResponseWriter, body io.Reader, remote string) error {
+	s := g.srv
+	subs := make(chan grpcSubmission, s.cfg.GRPCAckWindow)
+	failed := make(chan error, 1)
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		defer close(subs)
+		for {
+			msg, err := readGRPCMessage(body)
+			if err == nil {
+				var sub grpcSubmission
+				if sub, err = decodeGRPCSubmission(msg); err == nil {
+					select {
+					case subs <- sub:
+						continue
+					case <-stop:
+						return
+					}
+				}
+			}
+			if err != io.EOF {
+				failed <- err
+			}
+			return
+		}
+	}()
+
+	// The window goes out in the headers, for clients to size theirs.
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Ack-Window", strconv.Itoa(s.cfg.GRPCAckWindow))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case sub, ok := <-subs:
+			if !ok {
+				select {
+				case err := <-failed:
+					return err
+				default:
+					return nil
+				}
+			}
+			ack := appendProtoUint(nil, 1, sub.seq)
+			uniq, err := g.record(sub.num, remote)
+			var ge *grpcError
+			switch {
+			case err == errGRPCClosing:
+				return err
+			case errors.As(err, &ge):
+				ack = appendProtoUint(ack, 2, ackErr)
+				ack = appendProtoUint(ack, 3, uint64(ge.code))
+				ack = appendProtoBytes(ack, 4, []byte(ge.msg))
+			case err != nil:
+				return err
+			case uniq:
+				ack = appendProtoUint(ack, 2, ackOK)
+			default:
+				ack = appendProtoUint(ack, 2, ackDup)
+			}
+			if _, err = w.Write(grpcFrame(ack)); err != nil {
+				return err
+			}
+			// Acks of values read together go out together.
+			if len(subs) == 0 && flusher != nil {
+				flusher.Flush()
+			}
+		case <-s.done:
+			return errGRPCClosing
+		}
+	}
+}
+
+// getStats replies with the counts of a stream.
+func (g *grpcReceiver) getStats(body io.Reader, remote string) ([]byte, error) {
+	msg, err := readGRPCMessage(body)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var stream string
+	err = walkProto(msg, func(field int, v uint64, b []byte) {
+		if field == 1 {
+			stream = string(b)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	counter, err := g.counter(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	st := counter.Snapshot()
+	var reply []byte
+	for i, v := range []int{st.Unique, st.Total, st.Duplicates, st.IntvlUnique, st.IntvlTotal, st.IntvlDuplicates, st.Conns} {
+		reply = appendProtoUint(reply, i+1, uint64(v))
+	}
+	return appendProtoUint(reply, 8, uint64(st.Uptime/time.Second)), nil
+}
+
+// counter returns the Counter of the named stream, the main one if
+// name is empty.
+func (g *grpcReceiver) counter(name string) (*Counter, error) {
+	if name == "" {
+		return g.srv.counter, nil
+	}
+	if c := g.srv.streamCounter(name); c != nil {
+		return c, nil
+	}
+	return nil, grpcErrorf(grpcNotFound, "unknown stream %q", name)
+}
+
+// record records a value, it reports whether it was new.
+func (g *grpcReceiver) record(req grpcNumber, remote string) (bool, error) {
+	s := g.srv
+	s.metrics.sawLine()
+	counter, err := g.counter(req.stream)
+	if err != nil {
+		s.metrics.sawMalformed()
+		return false, err
+	}
+
+	var num int
+	var ok bool
+	if req.value != "" {
+		num, ok = counter.parse(req.value)
+	} else {
+		num, ok = int(req.number), req.number <= uint64(counter.profile.max()) && counter.profile.inRange(int(req.number))
+	}
+	if !ok {
+		s.metrics.sawMalformed()
+		return false, &grpcError{grpcInvalidArgument, "invalid value"}
+	}
+	if err := s.validate(counter, num); err != nil {
+		s.metrics.sawMalformed()
+		return false, grpcErrorf(grpcInvalidArgument, "rejected: %v", err)
+	}
+
+	// Same policy as TCP values, logging is part of our reqs.
+	uniq, err := counter.Record(num)
+	if err == errHandedOver {
+		return false, errGRPCClosing
+	}
+	if err == errRecovering {
+		return false, errGRPCRecovering
+	}
+	if err == errQuotaExceeded {
+		return false, errGRPCQuota
+	}
+	if err != nil {
+		s.opError(&OpError{Op: "log", Remote: remote, Stream: counter.name, Value: num, Err: err})
+		return false, &grpcError{grpcInternal, "could not log the value"}
+	}
+	s.metrics.sawValue(uniq)
+	if uniq {
+		s.emitUnique(counter, num)
+	}
+	return uniq, nil
+}
+
+// report is the service's line of the interval output.
+func (g *grpcReceiver) report() string {
+	return fmt.Sprintf("gRPC        : %d calls, %d failed\n",
+		atomic.LoadInt64(&g.calls), atomic.LoadInt64(&g.failed))
+}
+
+// readGRPCMessage reads a length prefixed message, io.EOF once the
+// client is done sending.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages aren't supported"}
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes over the limit of %d", n, maxGRPCMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// grpcFrame is msg with its uncompressed length prefix.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcMessage percent encodes a status message, as gRPC wants it.
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeGRPCSubmission(msg []byte) (sub grpcSubmission, err error) {
+	var number []byte
+	err = walkProto(msg, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			sub.seq = v
+		case 2:
+			number = b
+		}
+	})
+	if err == nil {
+		sub.num, err = decodeGRPCNumber(number)
+	}
+	return
+}
+
+func decodeGRPCNumber(msg []byte) (req grpcNumber, err error) {
+	err = walkProto(msg, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			req.value = string(b)
+		case 2:
+			req.stream = string(b)
+		case 3:
+			req.number = v
+		}
+	})
+	return
+}
+
+// walkProto calls fn with every field of a protobuf message, v for
+// varints and b for length delimited ones, fixed size ones are skipped.
+func walkProto(msg []byte, fn func(field int, v uint64, b []byte)) error {
+	bad := &grpcError{grpcInvalidArgument, "malformed message"}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return bad
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return bad
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return bad
+			}
+			msg = msg[size:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return bad
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		default:
+			return bad
+		}
+	}
+	return nil
+}
+
+// appendProtoUint appends a varint field, nothing for 0 like proto3.
+func appendProtoUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendProtoBytes appends a length delimited field, nothing if empty.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if v {
+		return appendProtoUint(b, field, 1)
+	}
+	return b
+}
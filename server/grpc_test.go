@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// grpcClient is an HTTP/2 client without TLS, for the gRPC service.
+func grpcClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+}
+
+func TestSubmitAcked(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	cfg := testConfig(t)
+	cfg.GRPCAddr = addr
+	serveTest(t, cfg)
+	// The service listens once Serve has got going.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	body, requests := io.Pipe()
+	req, err := http.NewRequest("POST", "http://"+addr+grpcService+"SubmitAcked", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	go func() {
+		for seq, value := range []string{"1234567890", "1234567890", "12345"} {
+			num := appendProtoBytes(nil, 1, []byte(value))
+			sub := appendProtoUint(nil, 1, uint64(seq+1))
+			requests.Write(grpcFrame(appendProtoBytes(sub, 2, num)))
+		}
+		requests.Close()
+	}()
+	resp, err := grpcClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if w := resp.Header.Get("Ack-Window"); w != "1024" {
+		t.Errorf("ack window %q, want 1024", w)
+	}
+
+	var acks []string
+	for {
+		msg, err := readGRPCMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seq, status, code uint64
+		walkProto(msg, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				seq = v
+			case 2:
+				status = v
+			case 3:
+				code = v
+			}
+		})
+		acks = append(acks, fmt.Sprintf("%d:%d:%d", seq, status, code))
+	}
+	if st := resp.Trailer.Get("Grpc-Status"); st != "0" {
+		t.Errorf("status %s %s, want 0", st, resp.Trailer.Get("Grpc-Message"))
+	}
+	want := []string{
+		fmt.Sprintf("1:%d:0", ackOK),
+		fmt.Sprintf("2:%d:0", ackDup),
+		fmt.Sprintf("3:%d:%d", ackErr, grpcInvalidArgument),
+	}
+	if fmt.Sprint(acks) != fmt.Sprint(want) {
+		t.Errorf("acks %v, want %v", acks, want)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Handler handles the lines of every connection, see Config.Handler.
+// The server does the rest: accepting, the connection limits, the
+// handshake, and splitting input into lines, so a custom Handler can
+// reuse all of it for wire commands of its own.
+//
+// HandleLine is called with each line, without its line ending, in the
+// order they arrive. line is only valid until it returns. Replies are
+// written to w, they're batched and go out before the server waits for
+// more input. w's buffer is reused by other connections once this one
+// closed, so it must not be kept. Returning an error closes the connection.
+//
+// ctx is cancelled if Shutdown hangs up on the connection.
+type Handler interface {
+	HandleLine(ctx context.Context, line []byte, w io.Writer) error
+}
+
+// HandlerFunc adapts a function to a Handler, like http.HandlerFunc.
+type HandlerFunc func(ctx context.Context, line []byte, w io.Writer) error
+
+func (f HandlerFunc) HandleLine(ctx context.Context, line []byte, w io.Writer) error {
+	return f(ctx, line, w)
+}
+
+// DefaultHandler is the server's own protocol: the commands, stream
+// prefixes and values. It only works with the ctx of the server's own
+// connections, a custom Handler can pass it the lines it doesn't handle
+// to extend the protocol rather than replace it.
+var DefaultHandler Handler = numbersHandler{}
+
+// ErrNotServerConn is returned by DefaultHandler given a ctx that isn't
+// one of the server's own connections, e.g. a test's.
+var ErrNotServerConn = errors.New("DefaultHandler needs the ctx of a server connection")
+
+// numbersHandler is DefaultHandler, see dispatch.
+type numbersHandler struct{}
+
+func (numbersHandler) HandleLine(ctx context.Context, line []byte, w io.Writer) error {
+	cl, ok := ctx.Value(clientKey{}).(*client)
+	if !ok {
+		return ErrNotServerConn
+	}
+	return dispatch(cl, line)
+}
+
+// clientKey is the context key of a connection's *client.
+type clientKey struct{}
+
+// handle passes one line to the Handler.
+func (cl *client) handle(line []byte) error {
+	return cl.srv.cfg.Handler.HandleLine(cl.ctx, line, cl)
+}
+
+// Write queues p as a reply, for Handlers.
+func (cl *client) Write(p []byte) (int, error) {
+	n, err := cl.out.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, cl.queued()
+}
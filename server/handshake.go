@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// helloCmd opens the optional protocol handshake.
+// A client sends "HELLO v2 <capability>..." as its very first line and
+// the server answers with the version and the subset of capabilities
+// it agreed to. Clients that don't start with HELLO get plain v1.
+const helloCmd = "HELLO"
+
+// protoVersion is the highest protocol version the server speaks.
+const protoVersion = 2
+
+// greeting is the banner sent to every connection as soon as it's accepted.
+// Like STATUS it's space separated key=value pairs after a fixed verb:
+//
+//	WELCOME name=go-simple-tcp-server proto=2 max_conns=6 value_len=10 min_value=1000000
+//
+// Connections to a stream's port get the stream's validation,
+// and a trailing stream=<name>. With an AuthToken it ends in auth=required.
+func (s *Server) greeting(counter *Counter) string {
+	_, max := counter.sem.inUse()
+	g := fmt.Sprintf(
+		"WELCOME name=%s proto=%d max_conns=%d value_len=%d min_value=%d",
+		s.cfg.Name, protoVersion, max, counter.profile.length, counter.profile.min)
+	if counter.name != "" {
+		g += " stream=" + counter.name
+	}
+	if s.cfg.AuthToken != "" {
+		g += " auth=required"
+	}
+	return g + "\n"
+}
+
+// capabilities are the features a v2 client can ask for.
+var capabilities = map[string]bool{
+	// deflate: everything the client sends after the handshake is a raw
+	// DEFLATE stream of the usual newline terminated lines.
+	"deflate": true,
+	// quiet: the server doesn't answer PING, only explicit queries.
+	"quiet": true,
+	// json: every line is a JSON request, answered with a JSON reply
+	// that echoes its id, see handleJSON.
+	"json": true,
+	// trace: every request of the connection is traced,
+	// if the server writes traces at all (Config.TraceFile).
+	"trace": true,
+}
+
+// session is what a connection negotiated during the handshake.
+type session struct {
+	version int
+	caps    map[string]bool
+	// binary is whether the client sends binary values, see binaryMagic.
+	binary bool
+}
+
+// v1 is the session of legacy clients that skip the handshake.
+var v1 = session{version: 1, caps: map[string]bool{}}
+
+// maxLine is the longest line the server takes, not counting its line
+// ending, unless batches are longer, see Server.lineLimit. Any value
+// fits, behind a stream prefix too, and so does every command. Longer
+// lines are a protocol error: the client gets lineTooLongReply and is
+// hung up on, instead of growing the read buffer for as long as it
+// doesn't send a newline.
+const maxLine = 128
+
+// errLineTooLong is a line over the limit.
+var errLineTooLong = errors.New("line exceeds the maximum length")
+
+// scanLines returns bufio.ScanLines up to limit bytes a line. Lines
+// lose their trailing whitespace too, telnet's and Windows' CR among it,
+// unless strict, then only the newline goes, see Config.StrictLines.
+func scanLines(limit int, strict bool) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = bufio.ScanLines(data, atEOF)
+		if len(token) > limit || (advance == 0 && len(data) > limit) {
+			return 0, nil, errLineTooLong
+		}
+		if token != nil {
+			if strict {
+				token = bytes.TrimSuffix(data[:advance], []byte{'\n'})
+			} else {
+				token = bytes.TrimRight(token, lineSpace)
+			}
+		}
+		return
+	}
+}
+
+// lineSpace is the trailing whitespace taken off lines.
+const lineSpace = " \t\r"
+
+// Read buffer sizes by mode. With thousands of connections open the
+// buffers are most of the server's memory, so legacy clients that send
+// the odd value get a tiny one and only streams get a large one.
+// The line scanner still grows its buffer for a longer line.
+const (
+	// helloBufSize buffers the first line, which is read in one piece
+	// out of it: a HELLO with every capability, or any other line.
+	helloBufSize = maxLine + len("\r\n")
+	// legacyBufSize fits a handful of legacy value lines.
+	legacyBufSize = 64
+	// lineBufSize is for v2 clients, which pipeline commands and values.
+	lineBufSize = 4096
+	// streamBufSize buffers the compressed side of a deflate stream.
+	streamBufSize = 64 << 10
+)
+
+// bufSizes returns the initial size of the line scanner's buffer
+// for the session, and the total read buffering of its connection.
+func (s session) bufSizes() (scan, total int) {
+	scan = lineBufSize
+	if s.version < 2 && !s.binary {
+		scan = legacyBufSize
+	}
+
+	total = helloBufSize + scan
+	if s.caps["deflate"] {
+		total += streamBufSize
+	}
+	return
+}
+
+// negotiate parses a HELLO line and returns the resulting session along
+// with the line to send back to the client.
+// Unknown capabilities are dropped, unknown versions fall back to v1.
+func negotiate(line string) (sess session, reply string) {
+	fields := strings.Fields(line)
+
+	sess = session{version: 1, caps: map[string]bool{}}
+	if len(fields) > 1 && fields[1] == fmt.Sprintf("v%d", protoVersion) {
+		sess.version = protoVersion
+		for _, c := range fields[2:] {
+			if capabilities[c] {
+				sess.caps[c] = true
+			}
+		}
+	}
+
+	agreed := make([]string, 0, len(sess.caps))
+	for c := range sess.caps {
+		agreed = append(agreed, c)
+	}
+	sort.Strings(agreed)
+
+	reply = strings.TrimSpace(fmt.Sprintf("%s v%d %s", helloCmd, sess.version, strings.Join(agreed, " "))) + "\n"
+	return
+}
+
+// handshake reads the connection's first line from the buffers' reader
+// and negotiates a session if it's a HELLO. It returns the reader the
+// rest of the input should be read from. For legacy clients the first
+// line is put back in front of it, so it gets handled like any other line.
+// A client starting with binaryMagic gets a binary session instead.
+func handshake(bufs *connBuffers, w io.Writer) (sess session, in io.Reader, err error) {
+	r := bufs.hello
+	if b, _ := r.Peek(1); len(b) == 1 && b[0] == binaryMagic {
+		r.Discard(1)
+		return session{version: 1, caps: map[string]bool{}, binary: true}, r, nil
+	}
+	// r only buffers helloBufSize, ReadSlice can't read past that.
+	// Every HELLO fits, a longer line is left to the line scanner,
+	// it may be a batch.
+	slice, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return v1, io.MultiReader(strings.NewReader(string(slice)), r), nil
+	}
+	if err != nil && err != io.EOF {
+		return
+	}
+	first := string(slice)
+
+	line := strings.TrimRight(first, "\r\n")
+	if line != helloCmd && !strings.HasPrefix(line, helloCmd+" ") {
+		return v1, io.MultiReader(strings.NewReader(first), r), nil
+	}
+
+	sess, reply := negotiate(line)
+	if _, err = io.WriteString(w, reply); err != nil {
+		return
+	}
+
+	in = r
+	if sess.caps["deflate"] {
+		// Reads bigger than r's buffer bypass it,
+		// so the stream buffer isn't copied through the small one.
+		in = flate.NewReader(bufs.streamReader(r))
+	}
+	return sess, in, nil
+}
+
+// badStream reports whether a read error is the client's fault,
+// a truncated or corrupt compressed stream, rather than the server's.
+func badStream(err error) bool {
+	_, corrupt := err.(flate.CorruptInputError)
+	return corrupt || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// converse sends input to the server at addr, stops sending and returns
+// everything the server sent until it hung up.
+func converse(t *testing.T, addr, input string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, input)
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(conn)
+	// Hanging up on input it didn't read, the server resets the connection.
+	if err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("reading the replies to %q: %v", input, err)
+	}
+	return string(got)
+}
+
+// deflated is s compressed as a raw DEFLATE stream.
+func deflated(s string) string {
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestSpeed)
+	io.WriteString(w, s)
+	w.Close()
+	return b.String()
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		line    string
+		version int
+		caps    string
+		reply   string
+	}{
+		{"HELLO v2 quiet deflate", 2, "deflate quiet", "HELLO v2 deflate quiet\n"},
+		{"HELLO v2", 2, "", "HELLO v2\n"},
+		// Unknown capabilities are dropped.
+		{"HELLO v2 json zstd  trace", 2, "json trace", "HELLO v2 json trace\n"},
+		// Unknown versions, or none, are v1 without capabilities.
+		{"HELLO v3 quiet", 1, "", "HELLO v1\n"},
+		{"HELLO 2 quiet", 1, "", "HELLO v1\n"},
+		{"HELLO", 1, "", "HELLO v1\n"},
+	}
+	for _, tt := range tests {
+		sess, reply := negotiate(tt.line)
+		caps := make([]string, 0, len(sess.caps))
+		for c := range sess.caps {
+			caps = append(caps, c)
+		}
+		sort.Strings(caps)
+		if sess.version != tt.version || strings.Join(caps, " ") != tt.caps || reply != tt.reply {
+			t.Errorf("negotiate(%q) = v%d %q, %q, want v%d %q, %q",
+				tt.line, sess.version, caps, reply, tt.version, tt.caps, tt.reply)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	srv, addr := serveTest(t, testConfig(t))
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"v2", "HELLO v2\n1234567890\nPING\n", "HELLO v2\nPONG\n"},
+		{"crlf", "HELLO v2 quiet\r\nPING\r\n", "HELLO v2 quiet\n"},
+		// quiet leaves PING unanswered, STATUS isn't.
+		{"quiet", "HELLO v2 quiet\n1234567891\nPING\nSTATUS\n", "HELLO v2 quiet\nuptime="},
+		{"unknown version", "HELLO v9 quiet\nPING\n", "HELLO v1\nPONG\n"},
+		{"no version", "HELLO\nPING\n", "HELLO v1\nPONG\n"},
+		// The replies to the last lines go out when the stream ends.
+		{"deflate", "HELLO v2 deflate\n" + deflated("1234567892\nPING\n"), "HELLO v2 deflate\nPONG\n"},
+		// A corrupt compressed stream is hung up on.
+		{"corrupt stream", "HELLO v2 deflate\n\xff\xff\xff\xff1234567893\nPING\n", "HELLO v2 deflate\n"},
+		// A HELLO after the first line is a value, an invalid one.
+		{"not first", "PING\nHELLO v2\nPING\n", "PONG\n"},
+		{"prefix", "HELLOv2\nPING\n", ""},
+	}
+	for _, tt := range tests {
+		// A want ending in = is the start of a STATUS reply.
+		if got := converse(t, addr, tt.input); got != tt.want && !(strings.HasSuffix(tt.want, "=") && strings.HasPrefix(got, tt.want)) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if uniq, _, _ := srv.Counts(); uniq != 3 {
+		t.Errorf("Counts() = %d unique, want the 3 values before a PING", uniq)
+	}
+}
+
+func TestLineTooLong(t *testing.T) {
+	cfg := testConfig(t)
+	_, addr := serveTest(t, cfg)
+
+	// At most maxLine, trailing spaces count, the line ending doesn't.
+	longest := "1234567890" + strings.Repeat(" ", maxLine-len("1234567890"))
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"longest", longest + "\r\nPING\n", pongReply},
+		{"first line", longest + " \nPING\n", lineTooLongReply},
+		// Longer than the handshake's buffer.
+		{"longer than a HELLO", strings.Repeat("1", 4*helloBufSize) + "\n", lineTooLongReply},
+		{"after a value", "1234567890\nPING\n" + longest + "1\nPING\n", pongReply + lineTooLongReply},
+		{"no newline", "PING\n" + strings.Repeat("1", maxLine+1), pongReply + lineTooLongReply},
+		{"v2", "HELLO v2\n" + longest + " \n", "HELLO v2\n" + lineTooLongReply},
+	}
+	for _, tt := range tests {
+		if got := converse(t, addr, tt.input); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Quiet hangs up without a word.
+	cfg = testConfig(t)
+	cfg.Quiet = true
+	_, addr = serveTest(t, cfg)
+	if got := converse(t, addr, "PING\n"+longest+"1\n"); got != pongReply {
+		t.Errorf("quiet: got %q, want %q", got, pongReply)
+	}
+}
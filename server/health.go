@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// The probes served next to the metrics on Config.MetricsAddr.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// notReady returns why the server shouldn't be sent new connections,
+// empty if it's ready: listening, done recovering the log, which is
+// before it listens unless Config.RecoverBackground, and writing out
+// every stream's log.
+func (s *Server) notReady() string {
+	s.mu.Lock()
+	started, closed := s.started, s.closed
+	s.mu.Unlock()
+	switch {
+	case closed:
+		return "shutting down"
+	case !started:
+		return "starting"
+	case s.inMaintenance():
+		return "in maintenance"
+	}
+	for _, c := range s.counters() {
+		if c.recovering() {
+			if err := c.recovery.failed(); err != nil {
+				return fmt.Sprintf("could not recover the log of %s: %v", streamBase(c.name), err)
+			}
+			return fmt.Sprintf("recovering the log of %s, %d%%", streamBase(c.name), c.recovery.percent())
+		}
+		if atomic.LoadInt32(&c.failing) == 1 {
+			return "could not write out the log of " + streamBase(c.name)
+		}
+	}
+	return ""
+}
+
+// healthz answers as long as the process is alive.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyz answers 503 with the reason while the server isn't ready.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if why := s.notReady(); why != "" {
+		http.Error(w, why, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
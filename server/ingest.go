@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// numbersPath is where values are taken over HTTP on Config.MetricsAddr,
+// with Config.HTTPIngest.
+const numbersPath = "/numbers"
+
+// maxIngestBody is the largest body taken at numbersPath, about 90k
+// values of the default length.
+const maxIngestBody = 1 << 20
+
+// ingestResult is the outcome of one value of a request, with the
+// status and codes of a json session's replies, see handleJSON.
+type ingestResult struct {
+	Value  string `json:"value"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+}
+
+// ingestReply is the body of the answer to a request.
+type ingestReply struct {
+	Results    []ingestResult `json:"results"`
+	Unique     int            `json:"unique"`
+	Duplicates int            `json:"duplicates"`
+	Malformed  int            `json:"malformed"`
+}
+
+// serveNumbers records the values of a POST body, one per line, into
+// the main stream or the one the stream parameter names. They go
+// through the same validation and dedup as values sent over TCP, and
+// every one gets a result: ok for a new value, duplicate, or error
+// with a code. A value that can't be logged ends the request with a
+// 500, one over the IP's line rate with a 429, the values after it are
+// left out.
+func (s *Server) serveNumbers(w http.ResponseWriter, r *http.Request) {
+	if why := s.notReady(); why == "starting" || why == "in maintenance" {
+		http.Error(w, why, http.StatusServiceUnavailable)
+		return
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if !s.acl.permits(addr) {
+		if s.cfg.LogDenied {
+			s.audit.Record(auditDenied, r.RemoteAddr, "not allowed by the allow and deny lists")
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if s.cfg.AuthToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AuthToken)) != 1 {
+			s.audit.Record(auditAuthFailed, r.RemoteAddr, "missing or wrong token")
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// The per IP limits are the connections': a request holds one of
+	// the IP's connections while it's handled, and its values count
+	// toward the IP's line rate.
+	var ip string
+	if addr != nil {
+		ip = limitedIP(addr)
+	}
+	if !s.limits.acquire(ip) {
+		s.audit.Record(auditRateLimited, r.RemoteAddr, "per IP connection limit reached")
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+	defer s.limits.release(ip)
+
+	counter := s.counter
+	if name := r.URL.Query().Get("stream"); name != "" {
+		if counter = s.streamCounter(name); counter == nil {
+			http.Error(w, "unknown stream", http.StatusNotFound)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "could not read body", http.StatusBadRequest)
+		}
+		return
+	}
+
+	// Like connections, requests are tracked so Shutdown waits for them.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.handlers.Add(1)
+	s.mu.Unlock()
+	defer s.handlers.Done()
+
+	reply := ingestReply{Results: []ingestResult{}}
+	code := http.StatusOK
+	for _, line := range strings.Split(string(body), "\n") {
+		if !s.cfg.StrictLines {
+			line = strings.TrimRight(line, lineSpace)
+		}
+		if line == "" {
+			continue
+		}
+		if !s.limits.allow(ip) {
+			s.audit.Record(auditRateLimited, r.RemoteAddr, "per IP line rate exceeded")
+			code = http.StatusTooManyRequests
+			break
+		}
+		res, err := s.ingest(counter, line, r.RemoteAddr)
+		reply.Results = append(reply.Results, res)
+		switch {
+		case res.Status == "ok":
+			reply.Unique++
+		case res.Status == "duplicate":
+			reply.Duplicates++
+		case err == nil:
+			reply.Malformed++
+		}
+		if err == errHandedOver || err == errRecovering {
+			code = http.StatusServiceUnavailable
+			break
+		}
+		if err == errQuotaExceeded {
+			code = http.StatusTooManyRequests
+			break
+		}
+		if err != nil {
+			code = http.StatusInternalServerError
+			break
+		}
+	}
+	if len(reply.Results) == 0 && code == http.StatusOK {
+		http.Error(w, "no values", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// ingest records a value line of a request, err is set if it couldn't
+// be logged.
+func (s *Server) ingest(counter *Counter, line, remote string) (ingestResult, error) {
+	res := ingestResult{Value: line, Status: "error"}
+	s.metrics.sawLine()
+	num, ok := counter.parse(line)
+	if !ok {
+		s.metrics.sawMalformed()
+		res.Code = jsonInvalid
+		return res, nil
+	}
+	if s.validate(counter, num) != nil {
+		s.metrics.sawMalformed()
+		res.Code = jsonRejected
+		return res, nil
+	}
+
+	// Same policy as TCP values, logging is part of our reqs.
+	uniq, err := counter.Record(num)
+	if err == errHandedOver {
+		res.Code = jsonInternal
+		return res, err
+	}
+	if err == errRecovering {
+		res.Code = jsonRecovering
+		return res, err
+	}
+	if err == errQuotaExceeded {
+		res.Code = jsonQuotaExceeded
+		return res, err
+	}
+	if err != nil {
+		s.opError(&OpError{Op: "log", Remote: remote, Stream: counter.name, Value: num, Err: err})
+		res.Code = jsonInternal
+		return res, err
+	}
+	s.metrics.sawValue(uniq)
+	if uniq {
+		s.emitUnique(counter, num)
+		res.Status = "ok"
+	} else {
+		res.Status = "duplicate"
+	}
+	return res, nil
+}
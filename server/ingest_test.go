@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIngestRateLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricsAddr = "127.0.0.1:0"
+	cfg.HTTPIngest = true
+	cfg.RateLimit = 0.001
+	cfg.RateBurst = 2
+	srv, _ := serveTest(t, cfg)
+	url := "http://" + srv.http.Addr().String() + numbersPath
+
+	resp, err := http.Post(url, "text/plain", strings.NewReader("1234567890\n2345678901\n3456789012\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	var reply ingestReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 2 || reply.Unique != 2 {
+		t.Errorf("got %d results, %d unique, want the 2 of the burst", len(reply.Results), reply.Unique)
+	}
+	if srv.counter.HasValue(3456789012) {
+		t.Error("value over the rate was recorded")
+	}
+}
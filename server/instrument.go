@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Request instrumentation is switched with an atomic flag.
+// Handlers check it once per request, so leaving instrumentation
+// compiled in costs a single atomic load when it's off,
+// and it can be flipped on during an incident without a restart.
+func (s *Server) instrumentOn() bool {
+	return atomic.LoadInt32(&s.instrumented) == 1
+}
+
+func (s *Server) setInstrumented(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.instrumented, v)
+}
+
+// SetInstrumented turns request instrumentation on or off:
+// per request latencies go into a histogram in the interval output,
+// and requests slower than Config.InstrumentSlow are logged.
+func (s *Server) SetInstrumented(on bool) {
+	s.setInstrumented(on)
+}
+
+// Instrumented reports whether request instrumentation is on.
+func (s *Server) Instrumented() bool {
+	return s.instrumentOn()
+}
+
+// latencyBuckets are the upper bounds of the request latency histogram,
+// anything slower lands in a last overflow bucket.
+var latencyBuckets = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+}
+
+// requestStats is a request latency histogram,
+// only filled in while instrumentation is on.
+type requestStats struct {
+	n       int64
+	nanos   int64
+	buckets [5]int64
+}
+
+func (rs *requestStats) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d >= latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&rs.buckets[i], 1)
+	atomic.AddInt64(&rs.n, 1)
+	atomic.AddInt64(&rs.nanos, int64(d))
+}
+
+// report returns the histogram since the last report, and resets it.
+func (rs *requestStats) report() string {
+	n := atomic.SwapInt64(&rs.n, 0)
+	nanos := atomic.SwapInt64(&rs.nanos, 0)
+	var b [5]int64
+	for i := range rs.buckets {
+		b[i] = atomic.SwapInt64(&rs.buckets[i], 0)
+	}
+
+	var avg time.Duration
+	if n > 0 {
+		avg = time.Duration(nanos / n)
+	}
+	return fmt.Sprintf(
+		"Requests    : %d avg=%v <1us=%d <10us=%d <100us=%d <1ms=%d slower=%d\n",
+		n, avg, b[0], b[1], b[2], b[3], b[4])
+}
+
+// instrumentedDispatch is handing a line to the Handler with timing,
+// slow request logging and the latency histogram.
+func instrumentedDispatch(cl *client, line []byte) error {
+	start := time.Now()
+	err := cl.handle(line)
+	d := time.Since(start)
+
+	cl.srv.reqStats.observe(d)
+	if d >= cl.srv.cfg.InstrumentSlow {
+		cl.log.Warn("slow request", "line", string(line), "took", d)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// maxJSONLine is the longest line of a json session, requests need
+// more room than bare values for their ids.
+const maxJSONLine = 1024
+
+// jsonRequest is a line of a json session, see the json capability:
+//
+//	{"id":"a1","value":1234567890}
+//
+// id is anything the client wants echoed back, value a number or a
+// string of digits, which keeps its leading zeros. stream is the name
+// of a named stream, the connection's own if empty.
+type jsonRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Value  json.RawMessage `json:"value"`
+	Stream string          `json:"stream"`
+}
+
+// The codes of a json session's error replies.
+const (
+	// jsonBadRequest is a line that isn't a request.
+	jsonBadRequest = "bad_request"
+	// jsonUnknownStream names a stream that doesn't exist.
+	jsonUnknownStream = "unknown_stream"
+	// jsonInvalid is a value that isn't valid for the stream.
+	jsonInvalid = "invalid"
+	// jsonRejected is a valid value a validator extension rejected.
+	jsonRejected = "rejected"
+	// jsonInternal is a value that couldn't be logged, the connection
+	// is closed after it.
+	jsonInternal = "internal"
+	// jsonRecovering is a value that may still turn up in the log being
+	// recovered, the connection is closed after it.
+	jsonRecovering = "recovering"
+	// jsonQuotaExceeded is a value over the stream's daily quota, the
+	// connection is closed after it.
+	jsonQuotaExceeded = "quota_exceeded"
+)
+
+// handleJSON records the value of a json session's request line and
+// answers with its id and status: ok for a new value, duplicate, or
+// error with one of the codes above.
+func handleJSON(cl *client, line []byte) error {
+	var req jsonRequest
+	if err := json.Unmarshal(line, &req); err != nil || len(req.Value) == 0 {
+		if err := cl.malformed(""); err != nil {
+			return err
+		}
+		return cl.reply(jsonReply(req.ID, "error", jsonBadRequest))
+	}
+
+	counter := cl.counter
+	if req.Stream != "" {
+		if counter = cl.srv.streamCounter(req.Stream); counter == nil {
+			if err := cl.malformed(""); err != nil {
+				return err
+			}
+			return cl.reply(jsonReply(req.ID, "error", jsonUnknownStream))
+		}
+	}
+
+	num, ok := jsonValue(req.Value, counter)
+	if !ok {
+		if err := cl.malformed(""); err != nil {
+			return err
+		}
+		return cl.reply(jsonReply(req.ID, "error", jsonInvalid))
+	}
+
+	uniques, malformed := cl.stats.uniques, cl.stats.malformed
+	if err := recordNum(cl, counter, num); err == errQuiet {
+		return err
+	} else if err == errRecovering {
+		cl.reply(jsonReply(req.ID, "error", jsonRecovering))
+		cl.flush()
+		return err
+	} else if err == errQuotaExceeded {
+		cl.reply(jsonReply(req.ID, "error", jsonQuotaExceeded))
+		cl.flush()
+		return err
+	} else if err != nil {
+		cl.reply(jsonReply(req.ID, "error", jsonInternal))
+		cl.flush()
+		return err
+	}
+	switch {
+	case cl.stats.malformed > malformed:
+		return cl.reply(jsonReply(req.ID, "error", jsonRejected))
+	case cl.stats.uniques > uniques:
+		return cl.reply(jsonReply(req.ID, "ok", ""))
+	}
+	return cl.reply(jsonReply(req.ID, "duplicate", ""))
+}
+
+// jsonValue returns the number of a request's value, if it's valid for
+// the counter's stream: a string of digits is validated like a line,
+// a number is valid in the range of its profile.
+func jsonValue(raw json.RawMessage, counter *Counter) (int, bool) {
+	if raw[0] == '"' {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return 0, false
+		}
+		return counter.parse(s)
+	}
+	num, err := strconv.Atoi(string(raw))
+	if err != nil || !counter.profile.inRange(num) {
+		return 0, false
+	}
+	return num, true
+}
+
+// jsonReply is the reply line to a request with id, code only with
+// status error. A request without an id gets a null one.
+func jsonReply(id json.RawMessage, status, code string) string {
+	var b bytes.Buffer
+	b.WriteString(`{"id":`)
+	if len(id) == 0 {
+		b.WriteString("null")
+	} else {
+		json.Compact(&b, id)
+	}
+	b.WriteString(`,"status":"` + status + `"`)
+	if code != "" {
+		b.WriteString(`,"code":"` + code + `"`)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// streamCounter returns the Counter of the named stream, nil if
+// there's none.
+func (s *Server) streamCounter(name string) *Counter {
+	for _, st := range s.streams {
+		if st.name == name {
+			return st.counter
+		}
+	}
+	return nil
+}
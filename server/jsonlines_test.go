@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONSession(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Streams = []string{"orders:prefix=ORD,len=9,min=100000000"}
+	srv, addr := serveTest(t, cfg)
+
+	// Requests longer than maxLine fit, up to maxJSONLine.
+	long := `"` + strings.Repeat("a", 2*maxLine) + `"`
+	requests := []struct {
+		line  string
+		reply string
+	}{
+		{`{"id":"a1","value":1234567890}`, `{"id":"a1","status":"ok"}`},
+		{`{"id":2,"value":"1234567890"}`, `{"id":2,"status":"duplicate"}`},
+		// A string keeps its leading zeros, a number has them implied.
+		{`{"value":"0001234567"}`, `{"id":null,"status":"ok"}`},
+		{`{"id":3,"value":1234567}`, `{"id":3,"status":"duplicate"}`},
+		{`{"id": [1, {"x": 2}], "value": 123456789, "stream": "orders"}`, `{"id":[1,{"x":2}],"status":"ok"}`},
+		{`{"id":` + long + `,"value":1234567891}`, `{"id":` + long + `,"status":"ok"}`},
+		{`{"id":4,"value":12345}`, `{"id":4,"status":"error","code":"invalid"}`},
+		{`{"id":"short","value":"1234567"}`, `{"id":"short","status":"error","code":"invalid"}`},
+		{`{"id":5,"value":"12345678a0"}`, `{"id":5,"status":"error","code":"invalid"}`},
+		{`{"id":6,"value":1.5e9}`, `{"id":6,"status":"error","code":"invalid"}`},
+		{`{"id":7,"value":1234567890,"stream":"orders"}`, `{"id":7,"status":"error","code":"invalid"}`},
+		{`{"id":8,"value":1234567890,"stream":"refunds"}`, `{"id":8,"status":"error","code":"unknown_stream"}`},
+		{`{"id":9}`, `{"id":9,"status":"error","code":"bad_request"}`},
+		{`{"id":10,"value":`, `{"id":null,"status":"error","code":"bad_request"}`},
+		// Commands are requests too, bad ones.
+		{"PING", `{"id":null,"status":"error","code":"bad_request"}`},
+		{"1234567892", `{"id":null,"status":"error","code":"bad_request"}`},
+	}
+	var input, want strings.Builder
+	input.WriteString("HELLO v2 json\n")
+	want.WriteString("HELLO v2 json\n")
+	for _, r := range requests {
+		input.WriteString(r.line + "\n")
+		want.WriteString(r.reply + "\n")
+	}
+	// Invalid requests don't hang up, every one is answered.
+	got := converse(t, addr, input.String())
+	if got != want.String() {
+		gotLines, wantLines := strings.Split(got, "\n"), strings.Split(want.String(), "\n")
+		for i := range wantLines {
+			if i >= len(gotLines) || gotLines[i] != wantLines[i] {
+				t.Fatalf("reply %d is %q, want %q", i, strings.Join(gotLines[i:], "\n"), wantLines[i])
+			}
+		}
+	}
+
+	// Longer than maxJSONLine isn't a request.
+	if got := converse(t, addr, "HELLO v2 json\n"+strings.Repeat(" ", maxJSONLine+1)+"\n"); got != "HELLO v2 json\n"+lineTooLongReply {
+		t.Errorf("an overlong request got %q, want %q", got, lineTooLongReply)
+	}
+
+	srv.Shutdown(context.Background())
+	for name, want := range map[string]string{
+		"data.0.log":   "1234567890\n1234567\n1234567891\n",
+		"orders.0.log": "123456789\n",
+	} {
+		if logged, err := os.ReadFile(filepath.Join(cfg.LogDir, name)); err != nil || string(logged) != want {
+			t.Errorf("%s is %q, %v, want %q", name, logged, err, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// maintPoll is how often the maintenance file is checked.
+const maintPoll = time.Second
+
+// In maintenance mode new connections are turned away, and once the
+// open ones are done the log is flushed, so the storage underneath
+// can be worked on.
+func (s *Server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// watchMaintenance enters and leaves maintenance mode as the
+// maintenance file appears and disappears, until Shutdown.
+// Must be run on go routine.
+func (s *Server) watchMaintenance(name string) {
+	tick := time.NewTicker(maintPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-s.done:
+			return
+		}
+
+		_, err := os.Stat(name)
+		want := err == nil
+		if want == s.inMaintenance() {
+			continue
+		}
+
+		if want {
+			s.enterMaintenance()
+		} else {
+			atomic.StoreInt32(&s.maintenance, 0)
+			s.log.Info("leaving maintenance, accepting connections")
+		}
+	}
+}
+
+// enterMaintenance stops taking new connections, waits for the open
+// ones to hang up, and rotates the log so everything is on disk.
+func (s *Server) enterMaintenance() {
+	atomic.StoreInt32(&s.maintenance, 1)
+	s.log.Info("entering maintenance, no longer accepting connections")
+
+	counter := s.counter
+	deadline := time.Now().Add(s.cfg.MaintenanceDrain)
+	inUse := func() int { n, _ := counter.sem.inUse(); return n }
+	for inUse() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := inUse(); n > 0 {
+		s.log.Warn("connections still open entering maintenance", "open", n, "after", s.cfg.MaintenanceDrain)
+	}
+
+	if err := counter.FlushRotate(); err != nil {
+		s.log.Error("could not flush log entering maintenance", "err", err)
+		return
+	}
+	s.log.Info("maintenance log flushed to disk")
+}
+
+// rejectMaintenance turns away a connection during maintenance,
+// distinct from busy so clients know to retry later rather than elsewhere.
+func rejectMaintenance(conn net.Conn) {
+	fmt.Fprintf(conn, "Server in maintenance.")
+	conn.Close()
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/memcache"
+)
+
+// cachedStore is a Store in front of which memcached keeps the values
+// known to be in it, see Config.MemcachedAddrs: a duplicate found in
+// the cache costs no round trip to the Store. Only values in the set
+// are cached, for the TTL, a miss is looked up in the Store and cached
+// if it's there or added. The cache failing counts as a miss.
+type cachedStore struct {
+	Store
+	c   *memcache.Client
+	ttl time.Duration
+	// key is the prefix of the keys, followed by the value.
+	key string
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errs   atomic.Int64
+}
+
+// cachedValue is what's stored under a value's key, only that it's
+// there counts.
+var cachedValue = []byte{'1'}
+
+// newCachedStore caches the values of s, the set of stream, in memcached.
+func newCachedStore(cfg Config, stream string, s Store) (Store, error) {
+	if stream == "" {
+		stream = "data"
+	}
+	c, err := memcache.Dial(cfg.MemcachedAddrs, memcache.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to memcached: %v", err)
+	}
+	return &cachedStore{Store: s, c: c, ttl: cfg.MemcachedTTL, key: cfg.MemcachedKey + ":" + stream + ":"}, nil
+}
+
+func (cs *cachedStore) keyOf(num int) string { return cs.key + strconv.Itoa(num) }
+
+// cached reports whether num is in the cache.
+func (cs *cachedStore) cached(num int) bool {
+	found, err := cs.c.Get(cs.keyOf(num))
+	if err != nil {
+		cs.errs.Add(1)
+	}
+	if len(found) == 1 {
+		cs.hits.Add(1)
+		return true
+	}
+	cs.misses.Add(1)
+	return false
+}
+
+// cache caches nums as being in the set.
+func (cs *cachedStore) cache(nums ...int) {
+	keys := make([]string, len(nums))
+	for i, num := range nums {
+		keys[i] = cs.keyOf(num)
+	}
+	if err := cs.c.Set(cs.ttl, cachedValue, keys...); err != nil {
+		cs.errs.Add(1)
+	}
+}
+
+func (cs *cachedStore) Has(num int) (bool, error) {
+	if cs.cached(num) {
+		return true, nil
+	}
+	ok, err := cs.Store.Has(num)
+	if ok {
+		cs.cache(num)
+	}
+	return ok, err
+}
+
+func (cs *cachedStore) Add(num int) (bool, error) {
+	if cs.cached(num) {
+		return false, nil
+	}
+	added, err := cs.Store.Add(num)
+	if err == nil {
+		cs.cache(num)
+	}
+	return added, err
+}
+
+// AddBatch looks nums up in the cache in one go, and adds the misses
+// to the Store in one batch.
+func (cs *cachedStore) AddBatch(nums []int) ([]bool, error) {
+	keys := make([]string, len(nums))
+	for i, num := range nums {
+		keys[i] = cs.keyOf(num)
+	}
+	found, err := cs.c.Get(keys...)
+	if err != nil {
+		cs.errs.Add(1)
+	}
+	var miss []int
+	var at []int
+	for i, key := range keys {
+		if _, ok := found[key]; !ok {
+			miss, at = append(miss, nums[i]), append(at, i)
+		}
+	}
+	cs.hits.Add(int64(len(nums) - len(miss)))
+	cs.misses.Add(int64(len(miss)))
+
+	uniq := make([]bool, len(nums))
+	if len(miss) == 0 {
+		return uniq, nil
+	}
+	u, err := addBatch(cs.Store, miss)
+	if err != nil {
+		return nil, err
+	}
+	for k, i := range at {
+		uniq[i] = u[k]
+	}
+	cs.cache(miss...)
+	return uniq, nil
+}
+
+// Remove takes num out of the cache before the Store, so it's never
+// cached while it isn't in the set.
+func (cs *cachedStore) Remove(num int) error {
+	if err := cs.c.Delete(cs.keyOf(num)); err != nil {
+		return fmt.Errorf("could not uncache the value: %v", err)
+	}
+	return cs.Store.Remove(num)
+}
+
+func (cs *cachedStore) Close() error {
+	cs.c.Close()
+	return cs.Store.Close()
+}
+
+func (cs *cachedStore) metrics() []storeMetric {
+	return []storeMetric{
+		{"simple_tcp_server_dedup_cache_hits_total", "Values found in the memcached dedup cache.", "counter", float64(cs.hits.Load())},
+		{"simple_tcp_server_dedup_cache_misses_total", "Values looked up in the store behind the memcached dedup cache.", "counter", float64(cs.misses.Load())},
+		{"simple_tcp_server_dedup_cache_errors_total", "Failed memcached commands, taken for misses.", "counter", float64(cs.errs.Load())},
+	}
+}
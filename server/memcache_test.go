@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMemcached is a memcached server that knows get, set, delete and
+// version, and ignores expiry. With down it hangs up on every command.
+type fakeMemcached struct {
+	mu   sync.Mutex
+	keys map[string]bool
+	down bool
+}
+
+func (f *fakeMemcached) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeMemcached) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		if f.down {
+			f.mu.Unlock()
+			return
+		}
+		switch args[0] {
+		case "version":
+			fmt.Fprint(conn, "VERSION 1.6.0\r\n")
+		case "get":
+			for _, key := range args[1:] {
+				if f.keys[key] {
+					fmt.Fprintf(conn, "VALUE %s 0 1\r\n1\r\n", key)
+				}
+			}
+			fmt.Fprint(conn, "END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(args[4])
+			r.Discard(n + 2)
+			f.keys[args[1]] = true
+			fmt.Fprint(conn, "STORED\r\n")
+		case "delete":
+			if f.keys[args[1]] {
+				delete(f.keys, args[1])
+				fmt.Fprint(conn, "DELETED\r\n")
+			} else {
+				fmt.Fprint(conn, "NOT_FOUND\r\n")
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// countingStore counts the calls that get to the Store behind it.
+type countingStore struct {
+	Store
+	mu    sync.Mutex
+	calls int
+}
+
+func (cs *countingStore) count() {
+	cs.mu.Lock()
+	cs.calls++
+	cs.mu.Unlock()
+}
+
+func (cs *countingStore) Add(num int) (bool, error) { cs.count(); return cs.Store.Add(num) }
+func (cs *countingStore) Has(num int) (bool, error) { cs.count(); return cs.Store.Has(num) }
+
+func (cs *countingStore) AddBatch(nums []int) ([]bool, error) {
+	cs.count()
+	return addBatch(cs.Store, nums)
+}
+
+func (cs *countingStore) reset() (calls int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	calls, cs.calls = cs.calls, 0
+	return
+}
+
+// serveMemcached serves f, it returns the address.
+func serveMemcached(t *testing.T, f *fakeMemcached) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.keys = make(map[string]bool)
+	go f.serve(l)
+	return l.Addr().String()
+}
+
+func TestCachedStore(t *testing.T) {
+	f := &fakeMemcached{}
+	addr := serveMemcached(t, f)
+	cfg := testConfig(t)
+	cfg.MemcachedAddrs = []string{addr}
+	cfg = cfg.withDefaults()
+	backing := &countingStore{Store: newShardedSet(1)}
+	store, err := newCachedStore(cfg, "", backing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i, want := range []bool{true, false} {
+		if uniq, err := store.Add(MinValue); err != nil || uniq != want {
+			t.Errorf("Add #%d = %v, %v, want %v", i+1, uniq, err, want)
+		}
+	}
+	if calls := backing.reset(); calls != 1 {
+		t.Errorf("the store was asked %d times, want once, then the cache", calls)
+	}
+	key := fmt.Sprintf("go-simple-tcp-server:data:%d", MinValue)
+	f.mu.Lock()
+	cached := f.keys[key]
+	f.mu.Unlock()
+	if !cached {
+		t.Errorf("%s not cached", key)
+	}
+
+	// A value another server added is found in the store, and cached.
+	backing.Store.Add(MinValue + 1)
+	for i := 0; i < 2; i++ {
+		if has, err := store.Has(MinValue + 1); err != nil || !has {
+			t.Errorf("Has #%d = %v, %v, want true", i+1, has, err)
+		}
+	}
+	if calls := backing.reset(); calls != 1 {
+		t.Errorf("the store was asked %d times, want once, then the cache", calls)
+	}
+
+	// A removed value is uncached first.
+	if err := store.Remove(MinValue); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := store.Has(MinValue); err != nil || has {
+		t.Errorf("Has after Remove = %v, %v, want false", has, err)
+	}
+
+	backing.reset()
+	uniq, err := store.(BatchStore).AddBatch([]int{MinValue, MinValue + 1, MinValue, MinValue + 2})
+	if want := []bool{true, false, false, true}; err != nil || !reflect.DeepEqual(uniq, want) {
+		t.Errorf("AddBatch = %v, %v, want %v", uniq, err, want)
+	}
+	if calls := backing.reset(); calls != 1 {
+		t.Errorf("the store was asked %d times for a batch, want once", calls)
+	}
+	if n, err := store.Len(); err != nil || n != 3 {
+		t.Errorf("Len = %d, %v, want 3", n, err)
+	}
+
+	// The batch's misses are cached, it takes no trip to the store again.
+	uniq, err = store.(BatchStore).AddBatch([]int{MinValue, MinValue + 2})
+	if want := []bool{false, false}; err != nil || !reflect.DeepEqual(uniq, want) {
+		t.Errorf("AddBatch again = %v, %v, want %v", uniq, err, want)
+	}
+	if calls := backing.reset(); calls != 0 {
+		t.Errorf("the store was asked %d times for a cached batch", calls)
+	}
+
+	m := store.(metricsStore).metrics()
+	if m[0].value != 5 || m[1].value != 6 || m[2].value != 0 {
+		t.Errorf("hits, misses, errors = %v, %v, %v, want 5, 6, 0", m[0].value, m[1].value, m[2].value)
+	}
+}
+
+func TestCachedStoreDown(t *testing.T) {
+	f := &fakeMemcached{}
+	addr := serveMemcached(t, f)
+	cfg := testConfig(t)
+	cfg.MemcachedAddrs = []string{addr}
+	cfg = cfg.withDefaults()
+	store, err := newCachedStore(cfg, "", newShardedSet(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// The cache hangs up on every command, the values go to the store.
+	f.mu.Lock()
+	f.down = true
+	f.mu.Unlock()
+	for i, want := range []bool{true, false} {
+		if uniq, err := store.Add(MinValue); err != nil || uniq != want {
+			t.Errorf("Add #%d = %v, %v, want %v", i+1, uniq, err, want)
+		}
+	}
+	if m := store.(metricsStore).metrics(); m[0].value != 0 || m[2].value == 0 {
+		t.Errorf("hits, errors = %v, %v, want none and some", m[0].value, m[2].value)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPath is where the metrics are served on Config.MetricsAddr,
+// statsPath where the streams' stats are, as JSON.
+const (
+	metricsPath = "/metrics"
+	statsPath   = "/stats"
+)
+
+// metricBuckets are the upper bounds of the line latency histogram.
+var metricBuckets = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// metrics are the server wide counters served in the Prometheus text
+// format, see Config.MetricsAddr. A nil *metrics counts nothing, so the
+// call sites don't check whether metrics are on.
+type metrics struct {
+	// lines are all lines received, values are sorted as unique,
+	// duplicate or malformed ones, busy are the connections turned away.
+	lines     int64
+	unique    int64
+	duplicate int64
+	malformed int64
+	busy      int64
+
+	// The line latency histogram, buckets holds the non cumulative
+	// counts, with a last one for anything slower than metricBuckets.
+	n       int64
+	nanos   int64
+	buckets [8]int64
+}
+
+func (m *metrics) sawLine() {
+	if m != nil {
+		atomic.AddInt64(&m.lines, 1)
+	}
+}
+
+func (m *metrics) sawValue(uniq bool) {
+	if m == nil {
+		return
+	}
+	if uniq {
+		atomic.AddInt64(&m.unique, 1)
+	} else {
+		atomic.AddInt64(&m.duplicate, 1)
+	}
+}
+
+func (m *metrics) sawMalformed() {
+	if m != nil {
+		atomic.AddInt64(&m.malformed, 1)
+	}
+}
+
+func (m *metrics) sawBusy() {
+	if m != nil {
+		atomic.AddInt64(&m.busy, 1)
+	}
+}
+
+// start is when handling a line started, the zero time without metrics
+// so they don't cost a clock read then.
+func (m *metrics) start() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// handled counts a line received at start and observes how long it took.
+func (m *metrics) handled(start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	i := 0
+	for i < len(metricBuckets) && d > metricBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&m.buckets[i], 1)
+	atomic.AddInt64(&m.n, 1)
+	atomic.AddInt64(&m.nanos, int64(d))
+	atomic.AddInt64(&m.lines, 1)
+}
+
+// write writes the metrics to w, active is the number of open connections.
+func (m *metrics) write(w io.Writer, active int) {
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("simple_tcp_server_lines_received_total", "Lines received, values and commands.", atomic.LoadInt64(&m.lines))
+	counter("simple_tcp_server_values_unique_total", "Valid values seen for the first time.", atomic.LoadInt64(&m.unique))
+	counter("simple_tcp_server_values_duplicate_total", "Valid values seen before.", atomic.LoadInt64(&m.duplicate))
+	counter("simple_tcp_server_values_malformed_total", "Invalid or rejected values.", atomic.LoadInt64(&m.malformed))
+
+	const rejected = "simple_tcp_server_connections_rejected_total"
+	fmt.Fprintf(w, "# HELP %s Connections turned away.\n# TYPE %s counter\n", rejected, rejected)
+	fmt.Fprintf(w, "%s{reason=\"busy\"} %d\n", rejected, atomic.LoadInt64(&m.busy))
+
+	const conns = "simple_tcp_server_connections_active"
+	fmt.Fprintf(w, "# HELP %s Connections being served.\n# TYPE %s gauge\n%s %d\n", conns, conns, conns, active)
+
+	const latency = "simple_tcp_server_line_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s How long handling a line took.\n# TYPE %s histogram\n", latency, latency)
+	var cum int64
+	for i, le := range metricBuckets {
+		cum += atomic.LoadInt64(&m.buckets[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", latency, le.Seconds(), cum)
+	}
+	cum += atomic.LoadInt64(&m.buckets[len(metricBuckets)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", latency, cum)
+	fmt.Fprintf(w, "%s_sum %g\n", latency, time.Duration(atomic.LoadInt64(&m.nanos)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", latency, atomic.LoadInt64(&m.n))
+}
+
+// activeConns is the number of connections being served, over every stream.
+func (s *Server) activeConns() (n int) {
+	for _, c := range s.counters() {
+		c.mu.RLock()
+		n += len(c.conns)
+		c.mu.RUnlock()
+	}
+	return
+}
+
+// storeMetric is a counter or gauge of a Store's own, reported by
+// stream, see metricsStore.
+type storeMetric struct {
+	name, help, kind string
+	value            float64
+}
+
+// A metricsStore is a Store with metrics of its own, e.g. the hits of
+// the memcached cache.
+type metricsStore interface {
+	metrics() []storeMetric
+}
+
+// writeStoreMetrics writes the metrics of every stream's Store that
+// has any, labelled with the stream's log name.
+func (s *Server) writeStoreMetrics(w io.Writer) {
+	var names []string
+	byName := make(map[string][]string)
+	help := make(map[string]storeMetric)
+	for _, c := range s.counters() {
+		ms, ok := c.set.(metricsStore)
+		if !ok {
+			continue
+		}
+		for _, m := range ms.metrics() {
+			if _, ok := help[m.name]; !ok {
+				names = append(names, m.name)
+				help[m.name] = m
+			}
+			byName[m.name] = append(byName[m.name], fmt.Sprintf("%s{stream=%q} %g\n", m.name, streamBase(c.name), m.value))
+		}
+	}
+	for _, name := range names {
+		m := help[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+		for _, line := range byName[name] {
+			io.WriteString(w, line)
+		}
+	}
+}
+
+// serveStats serves every stream's stats as a JSON object by stream,
+// 503 until the streams are up.
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if s.notReady() == "starting" {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.streamStats())
+}
+
+// serveMetrics serves the metrics and the health probes on addr.
+// It's up before the log is recovered, so the probes answer meanwhile,
+// and until the connections are drained, see release.
+func (s *Server) serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.http = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		active := 0
+		if s.notReady() != "starting" {
+			active = s.activeConns()
+		}
+		s.metrics.write(w, active)
+		if s.notReady() != "starting" {
+			s.writeStoreMetrics(w)
+		}
+	})
+	mux.HandleFunc(statsPath, s.serveStats)
+	if s.cfg.HTTPIngest {
+		mux.HandleFunc("POST "+numbersPath, s.serveNumbers)
+	}
+	mux.HandleFunc(healthzPath, s.healthz)
+	mux.HandleFunc(readyzPath, s.readyz)
+	go http.Serve(l, mux)
+	s.log.Info("serving metrics", "url", "http://"+l.Addr().String()+metricsPath)
+	return nil
+}
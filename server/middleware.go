@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+)
+
+// ConnHandler serves an accepted connection until it returns,
+// the connection is closed then.
+type ConnHandler func(ctx context.Context, conn net.Conn)
+
+// Middleware wraps the serving of every connection, for concerns like
+// auth, logging or metrics that don't belong in the line protocol, see
+// Config.Middleware. Its ConnHandler can hand next a wrapped conn, or
+// turn the connection away by not calling next at all.
+type Middleware func(next ConnHandler) ConnHandler
+
+// chain returns the ConnHandler of the connections counted by counter:
+// the per IP and server wide connection limits, then the deadlines,
+// then Config.Middleware in order, around handleConnection. Limits go
+// first, so a connection over them costs nothing more.
+func (s *Server) chain(counter *Counter) ConnHandler {
+	h := func(ctx context.Context, conn net.Conn) {
+		s.handleConnection(ctx, conn, counter)
+	}
+	for i := len(s.cfg.Middleware) - 1; i >= 0; i-- {
+		h = s.cfg.Middleware[i](h)
+	}
+	h = s.deadlines(h)
+	h = s.limitConns(counter)(h)
+	return s.limitIPConns(h)
+}
+
+// limitConns is the connection limit of counter's stream, connections
+// over it are turned away as busy, after Config.BusyWait for a slot.
+func (s *Server) limitConns(counter *Counter) Middleware {
+	return func(next ConnHandler) ConnHandler {
+		return func(ctx context.Context, conn net.Conn) {
+			if failpoint.Eval(fpBusy) != nil || !counter.sem.acquire(ctx, s.cfg.BusyWait, s.cfg.BusyQueue) {
+				s.rejectBusy(conn)
+				return
+			}
+			// Once our connection is closed,
+			// we can free up a space in the connection limit.
+			defer counter.sem.release()
+			next(ctx, conn)
+		}
+	}
+}
+
+// limitIPConns is the per IP connection limit.
+func (s *Server) limitIPConns(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, conn net.Conn) {
+		ip := limitedIP(conn.RemoteAddr())
+		if !s.limits.acquire(ip) {
+			s.rejectRateLimited(conn, "per IP connection limit reached")
+			return
+		}
+		defer s.limits.release(ip)
+		next(ctx, conn)
+	}
+}
+
+// deadlines closes stalled connections, see deadlineConn.
+func (s *Server) deadlines(next ConnHandler) ConnHandler {
+	if s.cfg.IdleTimeout == 0 && s.cfg.ReadTimeout == 0 {
+		return next
+	}
+	return func(ctx context.Context, conn net.Conn) {
+		dc := &deadlineConn{Conn: conn, idle: s.cfg.IdleTimeout, line: s.cfg.ReadTimeout, plain: true}
+		next(context.WithValue(ctx, deadlinesKey{}, dc), dc)
+	}
+}
+
+// deadlinesKey is the context key of a connection's *deadlineConn.
+type deadlinesKey struct{}
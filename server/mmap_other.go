@@ -0,0 +1,41 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileMap is a file mapped into memory, shared, so what's written to
+// data is written to the file.
+type fileMap struct {
+	f    *os.File
+	data []byte
+}
+
+func (m *fileMap) mmap(size int) (err error) {
+	m.data, err = unix.Mmap(int(m.f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	return err
+}
+
+// msync writes the pages written to back to the file, and waits for it.
+func (m *fileMap) msync() error {
+	return unix.Msync(m.data, unix.MS_SYNC)
+}
+
+// close unmaps the file and closes it, which drops its lock.
+func (m *fileMap) close() error {
+	err := unix.Munmap(m.data)
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// lockFile takes an exclusive lock of f, or fails if another process
+// holds it.
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
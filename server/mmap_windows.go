@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io"
+	"os"
+)
+
+// fileMap is a file read into memory, there's no mapping on windows:
+// msync writes all of data back to the file instead.
+type fileMap struct {
+	f    *os.File
+	data []byte
+}
+
+func (m *fileMap) mmap(size int) error {
+	m.data = make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(m.f, 0, int64(size)), m.data)
+	return err
+}
+
+// msync writes data to the file, and waits for it to be on disk.
+func (m *fileMap) msync() error {
+	if _, err := m.f.WriteAt(m.data, 0); err != nil {
+		return err
+	}
+	return m.f.Sync()
+}
+
+func (m *fileMap) close() error { return m.f.Close() }
+
+// lockFile does nothing on windows, two servers opening the same file
+// aren't caught.
+func lockFile(f *os.File) error { return nil }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/mqtt"
+)
+
+// mqttMaxBackoff caps the wait between reconnect attempts.
+const mqttMaxBackoff = time.Minute
+
+// mqttBridge subscribes to a broker and feeds every message payload
+// through the same validation and dedup as values sent over TCP.
+// Malformed payloads are dropped, just like malformed lines.
+type mqttBridge struct {
+	addr    string
+	topics  []string
+	qos     byte
+	opts    mqtt.Options
+	srv     *Server
+	counter *Counter
+	stop    chan bool
+}
+
+func newMQTTBridge(s *Server) (*mqttBridge, error) {
+	cfg := s.cfg
+	if len(cfg.MQTTTopics) == 0 {
+		return nil, errors.New("topics are required with a broker")
+	}
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 1 {
+		return nil, errors.New("QoS must be 0 or 1")
+	}
+
+	return &mqttBridge{
+		addr:   cfg.MQTTBroker,
+		topics: cfg.MQTTTopics,
+		qos:    byte(cfg.MQTTQoS),
+		opts: mqtt.Options{
+			ClientID: cfg.MQTTClientID,
+			Username: cfg.MQTTUser,
+			Password: cfg.MQTTPassword,
+		},
+		srv:     s,
+		counter: s.counter,
+		stop:    make(chan bool),
+	}, nil
+}
+
+// Run keeps the bridge connected, reconnecting with exponential backoff,
+// until Stop is called. Must be run on go routine.
+func (b *mqttBridge) Run() {
+	backoff := time.Second
+	for {
+		subscribed, err := b.session()
+		if subscribed {
+			// Only back off further while the broker keeps failing us.
+			backoff = time.Second
+		}
+
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+
+		b.srv.log.Warn("MQTT bridge disconnected, retrying", "in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-b.stop:
+			return
+		}
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// session runs a single broker connection until it breaks.
+// It reports whether it got as far as subscribing.
+func (b *mqttBridge) session() (subscribed bool, err error) {
+	c, err := mqtt.Dial(b.addr, b.opts)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	if err = c.Subscribe(b.topics, b.qos); err != nil {
+		return
+	}
+	b.srv.log.Info("MQTT bridge subscribed", "topics", strings.Join(b.topics, ","), "broker", b.addr)
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-b.stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	return true, c.Run(b.handle)
+}
+
+func (b *mqttBridge) handle(msg mqtt.Message) {
+	b.srv.metrics.sawLine()
+	num, ok := b.counter.parse(strings.TrimSpace(string(msg.Payload)))
+	if !ok || b.srv.validate(b.counter, num) != nil {
+		b.srv.metrics.sawMalformed()
+		return
+	}
+
+	// Same policy as TCP values, logging is part of our reqs.
+	uniq, err := b.counter.Record(num)
+	if err == errHandedOver || err == errRecovering || err == errQuotaExceeded {
+		return
+	}
+	if err != nil {
+		b.srv.opError(&OpError{Op: "log", Stream: b.counter.name, Value: num, Err: err})
+		return
+	}
+	b.srv.metrics.sawValue(uniq)
+	if uniq {
+		b.srv.emitUnique(b.counter, num)
+	}
+}
+
+// Stop disconnects the bridge for good.
+func (b *mqttBridge) Stop() {
+	close(b.stop)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/otlp"
+)
+
+// otelLines is how many lines of a traced connection get spans,
+// so a long lived producer doesn't flood the collector.
+const otelLines = 100
+
+// otelTracer exports OpenTelemetry traces of sampled connections,
+// see Config.OTLPEndpoint. A nil *otelTracer traces nothing.
+type otelTracer struct {
+	exp   *otlp.Exporter
+	ratio float64
+}
+
+func openOTel(cfg Config) (*otelTracer, error) {
+	if cfg.OTLPSampleRatio < 0 || cfg.OTLPSampleRatio > 1 {
+		return nil, fmt.Errorf("the sample ratio must be between 0 and 1")
+	}
+	service := cfg.OTLPService
+	if service == "" {
+		service = cfg.Name
+	}
+	exp, err := otlp.New(otlp.Options{Endpoint: cfg.OTLPEndpoint, Headers: cfg.OTLPHeaders, Service: service})
+	if err != nil {
+		return nil, err
+	}
+	ratio := cfg.OTLPSampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	return &otelTracer{exp: exp, ratio: ratio}, nil
+}
+
+// Close sends the spans still queued.
+func (t *otelTracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.exp.Close()
+}
+
+// acceptedKey is the context key of when a traced connection was accepted.
+type acceptedKey struct{}
+
+// connTrace is the trace of a sampled connection: a connection span
+// from accept to close, with an accept span for the limits, middleware
+// and handshake before its first line, and a span for each of the
+// first otelLines lines, with their stages. nil if it isn't sampled.
+type connTrace struct {
+	exp   *otlp.Exporter
+	root  otlp.Span
+	lines int
+}
+
+// startConn starts the trace of a connection, if it's sampled.
+func (t *otelTracer) startConn(ctx context.Context, remote net.Addr, counter *Counter) *connTrace {
+	if t == nil || (t.ratio < 1 && rand.Float64() >= t.ratio) {
+		return nil
+	}
+	accepted, _ := ctx.Value(acceptedKey{}).(time.Time)
+	if accepted.IsZero() {
+		accepted = time.Now()
+	}
+	return &connTrace{exp: t.exp, root: otlp.Span{
+		Trace: otlp.NewTraceID(),
+		ID:    otlp.NewSpanID(),
+		Name:  "connection",
+		Kind:  otlp.KindServer,
+		Start: accepted,
+		Attrs: map[string]interface{}{
+			"client.address": remote.String(),
+			"stream":         streamBase(counter.name),
+		},
+	}}
+}
+
+// child exports a span under parent and returns its id.
+func (ct *connTrace) child(parent otlp.SpanID, name string, start, end time.Time, attrs map[string]interface{}) otlp.SpanID {
+	s := otlp.Span{
+		Trace:  ct.root.Trace,
+		ID:     otlp.NewSpanID(),
+		Parent: parent,
+		Name:   name,
+		Kind:   otlp.KindInternal,
+		Start:  start,
+		End:    end,
+		Attrs:  attrs,
+	}
+	ct.exp.Export(s)
+	return s.ID
+}
+
+// accepted ends the accept span, the connection is ready for lines.
+func (ct *connTrace) accepted() {
+	if ct != nil {
+		ct.child(ct.root.ID, "accept", ct.root.Start, time.Now(), nil)
+	}
+}
+
+// traceLine reports whether the connection's next line gets spans.
+func (ct *connTrace) traceLine() bool {
+	return ct != nil && ct.lines < otelLines
+}
+
+// line exports the spans of a line handled with the request span s:
+// the line, and under it a span for each stage s marked, in order.
+func (ct *connTrace) line(s *span, line string, err error) {
+	ct.lines++
+	attrs := map[string]interface{}{"line": line, "decision": s.decision}
+	id := ct.child(ct.root.ID, "line", s.start, time.Now(), attrs)
+
+	at := s.start
+	for _, st := range s.stages {
+		end := at.Add(time.Duration(st.Ns))
+		ct.child(id, st.Name, at, end, nil)
+		at = end
+	}
+	if err != nil && ct.root.Err == "" {
+		ct.root.Err = err.Error()
+	}
+}
+
+// end exports the connection span once it's closed.
+func (ct *connTrace) end(stats *connStats) {
+	if ct == nil {
+		return
+	}
+	ct.root.End = time.Now()
+	ct.root.Attrs["values"] = stats.values
+	ct.root.Attrs["unique"] = stats.uniques
+	ct.root.Attrs["malformed"] = stats.malformed
+	ct.root.Attrs["bytes"] = stats.bytes
+	ct.exp.Export(ct.root)
+}
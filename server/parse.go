@@ -0,0 +1,98 @@
+package server
+
+import "errors"
+
+// Why ParseLine rejects a line.
+var (
+	ErrBadLength   = errors.New("invalid length")
+	ErrNotNumber   = errors.New("not a number")
+	ErrTooSmall    = errors.New("less than the minimum")
+	ErrTooLarge    = errors.New("more than the maximum")
+	ErrLeadingZero = errors.New("leading zero")
+)
+
+// What leading zeros do, see Config.LeadingZeros.
+const (
+	// zerosAccept takes zero padded values whatever their number.
+	zerosAccept = "accept"
+	// zerosReject takes no values starting with a zero.
+	zerosReject = "reject"
+)
+
+// ValueValidator decides what values are valid in place of the
+// digit rules of Config.ValueLen, MinValue, MaxValue and LeadingZeros,
+// see Config.ValueValidator. Validate returns the number of value, the
+// bytes of a value without its line ending, or why it's malformed.
+// stream is the name of the value's stream, data for the main one.
+// It's called on the connections' goroutines and must be safe for
+// concurrent use, value is only valid until it returns.
+type ValueValidator interface {
+	Validate(stream string, value []byte) (int, error)
+}
+
+// ParseLine validates a line of the main stream's default profile:
+// exactly ValidLen digits, and at least MinValue. A trailing "\n" or
+// "\r\n" doesn't count towards the length. It returns the number,
+// an int because ValidLen digits don't fit in 32 bits.
+//
+// It has no state, so clients like the bench subcommand can check what
+// they send, and it can be fuzzed on its own.
+func ParseLine(line []byte) (int, error) {
+	return defaultProfile.parseLine(line)
+}
+
+// parseLine is ParseLine with the profile's validation.
+func (p valueProfile) parseLine(line []byte) (int, error) {
+	n := len(line)
+	if n > 0 && line[n-1] == '\n' {
+		n--
+		if n > 0 && line[n-1] == '\r' {
+			n--
+		}
+	}
+	return p.validate(line[:n])
+}
+
+// validate returns the number of a value line without its line ending,
+// or why it's malformed. It checks and converts the digits in one pass,
+// without allocating, unlike strconv.Atoi it takes no sign.
+func (p valueProfile) validate(b []byte) (int, error) {
+	if len(b) != p.length {
+		return 0, ErrBadLength
+	}
+
+	// At most 18 digits, see check, num can't overflow.
+	num := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, ErrNotNumber
+		}
+		num = num*10 + int(c-'0')
+	}
+
+	switch {
+	case b[0] == '0' && p.zeros == zerosReject:
+		return 0, ErrLeadingZero
+	case num < p.min && !(b[0] == '0' && p.zeros == zerosAccept):
+		return 0, ErrTooSmall
+	case p.upper > 0 && num > p.upper:
+		return 0, ErrTooLarge
+	}
+
+	return num, nil
+}
+
+// validate returns the number of a value of the Counter's stream,
+// a line without its line ending, or why it's malformed.
+func (c *Counter) validate(b []byte) (int, error) {
+	if c.validator != nil {
+		return c.validator.Validate(streamOf(c), b)
+	}
+	return c.profile.validate(b)
+}
+
+// parse validates a value of the Counter's stream, and returns its number.
+func (c *Counter) parse(s string) (num int, ok bool) {
+	num, err := c.validate([]byte(s))
+	return num, err == nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	upper := valueProfile{length: ValidLen, min: MinValue, upper: 5000000000}
+	reject := valueProfile{length: ValidLen, min: MinValue, zeros: zerosReject}
+	accept := valueProfile{length: ValidLen, min: MinValue, zeros: zerosAccept}
+
+	tests := []struct {
+		name string
+		p    valueProfile
+		line string
+		num  int
+		err  error
+	}{
+		{"newline", defaultProfile, "1234567890\n", 1234567890, nil},
+		{"crlf", defaultProfile, "1234567890\r\n", 1234567890, nil},
+		{"no line ending", defaultProfile, "1234567890", 1234567890, nil},
+		{"minimum", defaultProfile, "0001000000\n", MinValue, nil},
+		{"maximum", defaultProfile, "9999999999\n", MaxValue, nil},
+		{"too short", defaultProfile, "123456789\n", 0, ErrBadLength},
+		{"too long", defaultProfile, "12345678901\n", 0, ErrBadLength},
+		{"empty", defaultProfile, "\n", 0, ErrBadLength},
+		{"only cr", defaultProfile, "1234567890\r", 0, ErrBadLength},
+		{"trailing space", defaultProfile, "123456789 \n", 0, ErrNotNumber},
+		{"sign", defaultProfile, "+123456789\n", 0, ErrNotNumber},
+		{"letters", defaultProfile, "12345abcde\n", 0, ErrNotNumber},
+		{"leading zeros below minimum", defaultProfile, "0000999999\n", 0, ErrTooSmall},
+		{"over the maximum", upper, "5000000001\n", 0, ErrTooLarge},
+		{"at the maximum", upper, "5000000000\n", 5000000000, nil},
+		{"leading zero rejected", reject, "0123456789\n", 0, ErrLeadingZero},
+		{"leading zeros accepted", accept, "0000000042\n", 42, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			num, err := tt.p.parseLine([]byte(tt.line))
+			if err != tt.err || num != tt.num {
+				t.Errorf("parseLine(%q) = %d, %v, want %d, %v", tt.line, num, err, tt.num, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range []string{
+		"1234567890\n",
+		"1234567890\r\n",
+		"0001000000\n",
+		"0000999999\n",
+		"123456789\n",
+		"12345678901\n",
+		"\r\n",
+		"12345abcde\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		num, err := ParseLine(line)
+		if err != nil {
+			switch err {
+			case ErrBadLength, ErrNotNumber, ErrTooSmall:
+			default:
+				t.Fatalf("ParseLine(%q) failed with %v, not one of its errors", line, err)
+			}
+			if num != 0 {
+				t.Fatalf("ParseLine(%q) = %d with error %v", line, num, err)
+			}
+			return
+		}
+
+		if num < MinValue || num > MaxValue {
+			t.Fatalf("ParseLine(%q) = %d, out of range", line, num)
+		}
+		value := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if want := fmt.Sprintf("%0*d", ValidLen, num); string(value) != want {
+			t.Fatalf("ParseLine(%q) = %d, want the value of %q", line, num, value)
+		}
+	})
+}
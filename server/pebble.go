@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/cockroachdb/pebble/v2/bloom"
+)
+
+// pebbleLocks is how many locks the values of a pebble store are spread
+// across, the check and the write of a value happen under its lock.
+const pebbleLocks = 256
+
+// pebbleCountKey holds the number of values while the database is
+// closed, the values' keys are 8 bytes so it can't be one of them.
+var pebbleCountKey = []byte("count")
+
+// pebbleStore keeps the values in a Pebble database of the stream's
+// under Config.PebbleDir, an LSM tree on local disk that takes high write
+// rates and sets too large for memory, kept across restarts. Every
+// table has a bloom filter, so looking up a new value mostly skips the
+// tables that don't have it without reading them.
+type pebbleStore struct {
+	db    *pebble.DB
+	write *pebble.WriteOptions
+	locks [pebbleLocks]sync.Mutex
+	n     atomic.Int64
+
+	stalls     atomic.Int64
+	stallNanos atomic.Int64
+	stalled    atomic.Int64
+}
+
+// openPebbleStore opens the database of stream, creating it if need be.
+// The count of values left on Close is read and deleted, so a database
+// that wasn't closed is counted again.
+func openPebbleStore(cfg Config, stream string, log *slog.Logger) (Store, error) {
+	dir := filepath.Join(cfg.PebbleDir, streamBase(stream))
+	p := &pebbleStore{write: pebble.NoSync}
+	if cfg.LogSync == "always" {
+		// A value acknowledged as logged must still be a duplicate
+		// after a crash.
+		p.write = pebble.Sync
+	}
+	opts := &pebble.Options{
+		Logger: pebbleLogger{log.With("stream", streamBase(stream))},
+		// Large memtables and a deep L0 take bursts of new values
+		// without stalling, compactions catch up in between.
+		MemTableSize:          64 << 20,
+		L0CompactionThreshold: 4,
+		L0StopWritesThreshold: 1000,
+		LBaseMaxBytes:         256 << 20,
+		EventListener: &pebble.EventListener{
+			WriteStallBegin: func(pebble.WriteStallBeginInfo) {
+				p.stalls.Add(1)
+				p.stalled.Store(time.Now().UnixNano())
+			},
+			WriteStallEnd: func() {
+				if since := p.stalled.Swap(0); since != 0 {
+					p.stallNanos.Add(time.Now().UnixNano() - since)
+				}
+			},
+		},
+	}
+	for i := range opts.Levels {
+		opts.Levels[i].FilterPolicy = bloom.FilterPolicy(10)
+	}
+	db, err := pebble.Open(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the pebble database %s: %v", dir, err)
+	}
+	p.db = db
+	n, err := p.count()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not count the values of the pebble database %s: %v", dir, err)
+	}
+	p.n.Store(n)
+	return p, nil
+}
+
+// count returns the count left by Close and deletes it, or counts the
+// values if there is none.
+func (p *pebbleStore) count() (int64, error) {
+	v, closer, err := p.db.Get(pebbleCountKey)
+	if err == nil {
+		n, perr := strconv.ParseInt(string(v), 10, 64)
+		closer.Close()
+		if perr == nil {
+			return n, p.db.Delete(pebbleCountKey, pebble.Sync)
+		}
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return 0, err
+	}
+	it, err := p.db.NewIter(nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for it.First(); it.Valid(); it.Next() {
+		if len(it.Key()) == 8 {
+			n++
+		}
+	}
+	if err = it.Close(); err != nil {
+		return 0, err
+	}
+	return n, p.db.Delete(pebbleCountKey, pebble.Sync)
+}
+
+func pebbleKey(num int) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), uint64(num))
+}
+
+func (p *pebbleStore) lock(num int) *sync.Mutex {
+	return &p.locks[uint(num)%pebbleLocks]
+}
+
+func (p *pebbleStore) has(key []byte) (bool, error) {
+	_, closer, err := p.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func (p *pebbleStore) Has(num int) (bool, error) { return p.has(pebbleKey(num)) }
+
+func (p *pebbleStore) Add(num int) (bool, error) {
+	mu := p.lock(num)
+	mu.Lock()
+	defer mu.Unlock()
+	key := pebbleKey(num)
+	if ok, err := p.has(key); ok || err != nil {
+		return false, err
+	}
+	if err := p.db.Set(key, nil, p.write); err != nil {
+		return false, err
+	}
+	p.n.Add(1)
+	return true, nil
+}
+
+// AddBatch writes the new values of nums in one batch, one commit for
+// the lot, holding the locks of all of them in order.
+func (p *pebbleStore) AddBatch(nums []int) ([]bool, error) {
+	var idx []int
+	seen := make(map[int]bool)
+	for _, num := range nums {
+		if i := int(uint(num) % pebbleLocks); !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		p.locks[i].Lock()
+		defer p.locks[i].Unlock()
+	}
+
+	uniq := make([]bool, len(nums))
+	b := p.db.NewBatch()
+	defer b.Close()
+	added := make(map[int]bool)
+	for i, num := range nums {
+		if added[num] {
+			continue
+		}
+		key := pebbleKey(num)
+		ok, err := p.has(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			uniq[i], added[num] = true, true
+			b.Set(key, nil, nil)
+		}
+	}
+	if len(added) == 0 {
+		return uniq, nil
+	}
+	if err := b.Commit(p.write); err != nil {
+		return nil, err
+	}
+	p.n.Add(int64(len(added)))
+	return uniq, nil
+}
+
+func (p *pebbleStore) Remove(num int) error {
+	mu := p.lock(num)
+	mu.Lock()
+	defer mu.Unlock()
+	key := pebbleKey(num)
+	ok, err := p.has(key)
+	if !ok || err != nil {
+		return err
+	}
+	if err = p.db.Delete(key, p.write); err != nil {
+		return err
+	}
+	p.n.Add(-1)
+	return nil
+}
+
+func (p *pebbleStore) Len() (int, error) { return int(p.n.Load()), nil }
+
+// Close leaves the count in the database for the next open.
+func (p *pebbleStore) Close() error {
+	err := p.db.Set(pebbleCountKey, strconv.AppendInt(nil, p.n.Load(), 10), pebble.Sync)
+	if cerr := p.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *pebbleStore) metrics() []storeMetric {
+	m := p.db.Metrics()
+	return []storeMetric{
+		{"simple_tcp_server_pebble_compactions_total", "Compactions of the pebble dedup.", "counter", float64(m.Compact.Count)},
+		{"simple_tcp_server_pebble_compaction_seconds_total", "Time the pebble dedup spent compacting.", "counter", m.Compact.Duration.Seconds()},
+		{"simple_tcp_server_pebble_compactions_running", "Compactions of the pebble dedup in progress.", "gauge", float64(m.Compact.NumInProgress)},
+		{"simple_tcp_server_pebble_compaction_debt_bytes", "Bytes the pebble dedup has to compact to settle.", "gauge", float64(m.Compact.EstimatedDebt)},
+		{"simple_tcp_server_pebble_read_amplification", "Tables a pebble dedup lookup may have to read.", "gauge", float64(m.ReadAmp())},
+		{"simple_tcp_server_pebble_write_stalls_total", "Times the pebble dedup held up writes for compactions to catch up.", "counter", float64(p.stalls.Load())},
+		{"simple_tcp_server_pebble_write_stall_seconds_total", "Time writes to the pebble dedup were held up.", "counter", time.Duration(p.stallNanos.Load()).Seconds()},
+		{"simple_tcp_server_pebble_filter_hits_total", "Tables the bloom filters of the pebble dedup skipped reading.", "counter", float64(m.Filter.Hits)},
+	}
+}
+
+// pebbleLogger logs Pebble's messages to the server's logger, the
+// informational ones at debug level.
+type pebbleLogger struct{ log *slog.Logger }
+
+func (l pebbleLogger) Infof(format string, args ...interface{}) {
+	l.log.Debug("pebble: " + fmt.Sprintf(format, args...))
+}
+
+func (l pebbleLogger) Errorf(format string, args ...interface{}) {
+	l.log.Error("pebble: " + fmt.Sprintf(format, args...))
+}
+
+// Fatalf exits, as Pebble's own logger does.
+func (l pebbleLogger) Fatalf(format string, args ...interface{}) {
+	l.log.Error("pebble: " + fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
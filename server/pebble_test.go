@@ -0,0 +1,80 @@
+package server
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func openTestPebble(t *testing.T, cfg Config) *pebbleStore {
+	t.Helper()
+	store, err := openPebbleStore(cfg, "", slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*pebbleStore)
+}
+
+func TestPebbleStore(t *testing.T) {
+	cfg := testConfig(t).withDefaults()
+	store := openTestPebble(t, cfg)
+
+	for i, want := range []bool{true, false} {
+		if uniq, err := store.Add(MinValue); err != nil || uniq != want {
+			t.Errorf("Add #%d = %v, %v, want %v", i+1, uniq, err, want)
+		}
+	}
+	if has, err := store.Has(MinValue); err != nil || !has {
+		t.Errorf("Has = %v, %v, want true", has, err)
+	}
+	if err := store.Remove(MinValue); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := store.Has(MinValue); err != nil || has {
+		t.Errorf("Has after Remove = %v, %v, want false", has, err)
+	}
+
+	store.Add(MinValue + 1)
+	uniq, err := store.AddBatch([]int{MinValue, MinValue + 1, MinValue, MinValue + 2})
+	if want := []bool{true, false, false, true}; err != nil || !reflect.DeepEqual(uniq, want) {
+		t.Errorf("AddBatch = %v, %v, want %v", uniq, err, want)
+	}
+	if n, err := store.Len(); err != nil || n != 3 {
+		t.Errorf("Len = %d, %v, want 3", n, err)
+	}
+	if m := store.metrics(); len(m) == 0 {
+		t.Error("no metrics")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The values and their count are there after a restart.
+	store = openTestPebble(t, cfg)
+	if n, err := store.Len(); err != nil || n != 3 {
+		t.Errorf("Len after reopening = %d, %v, want 3", n, err)
+	}
+	if uniq, err := store.Add(MinValue + 2); err != nil || uniq {
+		t.Errorf("Add after reopening = %v, %v, want a duplicate", uniq, err)
+	}
+	store.Add(MinValue + 3)
+
+	// A database that wasn't closed is counted again.
+	if err := store.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = openTestPebble(t, cfg)
+	defer store.Close()
+	if n, err := store.Len(); err != nil || n != 4 {
+		t.Errorf("Len after a crash = %d, %v, want 4", n, err)
+	}
+}
+
+func TestPebbleNoRestart(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Dedup = "pebble"
+	srv, _ := serveTest(t, cfg)
+	if err := srv.Restart(t.Context(), nil); err == nil {
+		t.Error("Restart handed over the pebble dedup")
+	}
+}
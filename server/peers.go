@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// peerMaxBackoff caps the wait between attempts to reach a peer.
+	peerMaxBackoff = time.Minute
+	// peerTimeout bounds dialing a peer and every write to it, a peer
+	// that takes longer is reconnected to.
+	peerTimeout = 10 * time.Second
+)
+
+// errPeerBehind ends a peer session that fell behind, the values it
+// missed are caught up with replaying the log on the next.
+var errPeerBehind = errors.New("fell behind, values were dropped")
+
+// replicator keeps the dedup sets of a cluster in step, see
+// Config.Peers: every value a Counter logs is sent to each peer, which
+// adds it to the set of the same stream without logging it, and the
+// values the peers log are added here.
+type replicator struct {
+	srv   *Server
+	links []*peerLink
+	stop  chan bool
+	// received counts the values the peers sent.
+	received int64
+}
+
+// peerLink sends the values logged here to one peer.
+type peerLink struct {
+	addr  string
+	queue chan peerValue
+	// up is 1 while connected, behind is 1 from a value dropped for a
+	// full queue to the next session, which replays the log.
+	up, behind int32
+	sent       int64
+	dropped    int64
+}
+
+// peerValue is a value logged to a stream, "" for the main one.
+type peerValue struct {
+	stream string
+	num    int
+}
+
+func newReplicator(s *Server) (*replicator, error) {
+	if s.cfg.PeerQueue < 1 {
+		return nil, errors.New("the peer queue must be at least 1")
+	}
+	r := &replicator{srv: s, stop: make(chan bool)}
+	for _, addr := range s.cfg.Peers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("bad peer %q: %v", addr, err)
+		}
+		r.links = append(r.links, &peerLink{addr: addr, queue: make(chan peerValue, s.cfg.PeerQueue)})
+	}
+	return r, nil
+}
+
+// send queues a value logged to stream for every peer, without
+// waiting: a peer whose queue is full misses it until it's caught up.
+// It's called with the Counter's lock held.
+func (r *replicator) send(stream string, num int) {
+	for _, l := range r.links {
+		select {
+		case l.queue <- peerValue{stream, num}:
+		default:
+			atomic.AddInt64(&l.dropped, 1)
+			atomic.StoreInt32(&l.behind, 1)
+		}
+	}
+}
+
+// Run keeps a connection to every peer until Stop is called.
+func (r *replicator) Run() {
+	for _, l := range r.links {
+		go r.connect(l)
+	}
+}
+
+// connect keeps the link connected, reconnecting with exponential
+// backoff, until Stop is called. Must be run on go routine.
+func (r *replicator) connect(l *peerLink) {
+	backoff := time.Second
+	for {
+		connected, err := r.session(l)
+		if connected {
+			backoff = time.Second
+		}
+
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		r.srv.log.Warn("peer disconnected, retrying", "peer", l.addr, "in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-r.stop:
+			return
+		}
+		if backoff *= 2; backoff > peerMaxBackoff {
+			backoff = peerMaxBackoff
+		}
+	}
+}
+
+// session runs a single connection to a peer until it breaks: it
+// replays the log of every stream, so the peer has whatever it missed
+// since the last one, then sends the values as they're logged.
+// It reports whether it got connected.
+func (r *replicator) session(l *peerLink) (connected bool, err error) {
+	conn, err := net.DialTimeout("tcp", l.addr, peerTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-r.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	atomic.StoreInt32(&l.up, 1)
+	defer atomic.StoreInt32(&l.up, 0)
+	r.srv.log.Info("peer connected", "peer", l.addr)
+
+	w := bufio.NewWriter(&peerWriter{conn})
+	if token := r.srv.cfg.AuthToken; token != "" {
+		w.WriteString(authCmd + " " + token + "\n")
+	}
+
+	// What's queued now is in the log by the time it's replayed,
+	// the queue only needs what's logged from here on.
+	atomic.StoreInt32(&l.behind, 0)
+	for len(l.queue) > 0 {
+		<-l.queue
+	}
+	for _, c := range r.srv.counters() {
+		if err = r.replay(w, l, c); err != nil {
+			return true, err
+		}
+	}
+
+	for {
+		if atomic.LoadInt32(&l.behind) == 1 {
+			w.Flush()
+			return true, errPeerBehind
+		}
+		if len(l.queue) == 0 {
+			if err = w.Flush(); err != nil {
+				return true, err
+			}
+		}
+		select {
+		case v := <-l.queue:
+			writePeerValue(w, v)
+			atomic.AddInt64(&l.sent, 1)
+		case <-r.stop:
+			return true, w.Flush()
+		}
+	}
+}
+
+// replay sends the values of c's log segments, as far back as its
+// set goes. A segment that can't be read is skipped, its values reach
+// the peer only as they're sent again.
+func (r *replicator) replay(w *bufio.Writer, l *peerLink, c *Counter) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	segs, err := LogSegments(r.srv.cfg.LogDir, streamBase(c.name))
+	if err != nil {
+		return err
+	}
+	if r.srv.cfg.DedupWindow > 0 {
+		segs = writtenSince(segs, time.Now().Add(-r.srv.cfg.DedupWindow))
+	}
+
+	for _, seg := range segs {
+		if seg.Seg < c.firstSeg {
+			continue
+		}
+		f, err := OpenLogReader(seg.Path, r.srv.keys.current())
+		if err != nil {
+			r.srv.log.Warn("could not replay segment to peer", "peer", l.addr, "file", seg.Path, "err", err)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			num, err := strconv.Atoi(scanner.Text())
+			if err != nil || !c.profile.inRange(num) {
+				continue
+			}
+			if err = writePeerValue(w, peerValue{c.name, num}); err != nil {
+				f.Close()
+				return err
+			}
+			atomic.AddInt64(&l.sent, 1)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// writePeerValue writes a value line: the value of the main stream,
+// or the stream name, a space and the value.
+func writePeerValue(w *bufio.Writer, v peerValue) error {
+	if v.stream != "" {
+		w.WriteString(v.stream)
+		w.WriteByte(' ')
+	}
+	w.WriteString(strconv.Itoa(v.num))
+	return w.WriteByte('\n')
+}
+
+// peerWriter gives every write to a peer peerTimeout.
+type peerWriter struct {
+	conn net.Conn
+}
+
+func (p *peerWriter) Write(b []byte) (int, error) {
+	p.conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+	return p.conn.Write(b)
+}
+
+// Stop disconnects from the peers for good.
+func (r *replicator) Stop() {
+	close(r.stop)
+}
+
+func (r *replicator) report() string {
+	var up int
+	var sent, dropped int64
+	for _, l := range r.links {
+		up += int(atomic.LoadInt32(&l.up))
+		sent += atomic.LoadInt64(&l.sent)
+		dropped += atomic.LoadInt64(&l.dropped)
+	}
+	return fmt.Sprintf("Peers       : %d/%d up, %d sent, %d received, %d dropped\n",
+		up, len(r.links), sent, atomic.LoadInt64(&r.received), dropped)
+}
+
+// servePeers listens for the values of the peers on addr, until Shutdown.
+func (s *Server) servePeers(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	go s.acceptPeers(l)
+	s.log.Info("listening", "addr", l.Addr().String(), "for", "peers")
+	return nil
+}
+
+// acceptPeers serves every peer connection on its own goroutine,
+// they don't count against the connection limits.
+// Must be run on go routine.
+func (s *Server) acceptPeers(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing() {
+				return
+			}
+			s.log.Error("could not accept peer connection", "err", err)
+			continue
+		}
+		go s.handlePeer(conn)
+	}
+}
+
+// handlePeer adds the values a peer sends to the sets of their
+// streams, until it hangs up or the server shuts down. Lines that
+// aren't a value of a stream here are skipped.
+func (s *Server) handlePeer(conn net.Conn) {
+	defer conn.Close()
+	hungUp := make(chan bool)
+	defer close(hungUp)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-hungUp:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	if s.cfg.AuthToken != "" && !s.authenticate(conn, r) {
+		return
+	}
+
+	var skipped int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		counter, value := s.counter, scanner.Text()
+		if i := strings.IndexByte(value, ' '); i >= 0 {
+			counter, value = s.streamCounter(value[:i]), value[i+1:]
+		}
+		num, err := strconv.Atoi(value)
+		if counter == nil || err != nil || !counter.profile.inRange(num) {
+			skipped++
+			continue
+		}
+		if err = counter.replicate(num); err != nil {
+			s.log.Error("could not add peer value", "stream", counter.name, "value", num, "err", err)
+			return
+		}
+		atomic.AddInt64(&s.peers.received, 1)
+	}
+	if skipped > 0 {
+		s.log.Warn("skipped peer values", "remote", conn.RemoteAddr().String(), "skipped", skipped)
+	}
+	if err := scanner.Err(); err != nil && !s.closing() {
+		s.log.Warn("peer connection failed", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// replicate adds num, logged by a peer, to the set without logging or
+// counting it, so it's a duplicate here from now on.
+func (c *Counter) replicate(num int) (err error) {
+	if !c.locked {
+		_, err = c.set.Add(num)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.set.Add(num)
+	return
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func listenPipe(name, sddl string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW    = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = kernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = kernel32.NewProc("DisconnectNamedPipe")
+	procCancelIoEx          = kernel32.NewProc("CancelIoEx")
+	procLocalFree           = kernel32.NewProc("LocalFree")
+	procConvertSDDL         = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	pipeAccessDuplex       = 0x3
+	pipeTypeByte           = 0x0
+	pipeWait               = 0x0
+	pipeUnlimitedInstances = 255
+	fileFlagFirstInstance  = 0x00080000
+	sddlRevision1          = 1
+	errorPipeConnected     = syscall.Errno(535)
+	errorNoData            = syscall.Errno(232)
+	pipeBufferSize         = 64 * 1024
+)
+
+// pipeAddr is the net.Addr of both ends of a named pipe.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeListener accepts connections on a named pipe.
+// Every Accept creates a new pipe instance and waits for a client on it,
+// which is how Windows hands out connections to pipe servers.
+type pipeListener struct {
+	name string
+	sa   *syscall.SecurityAttributes
+
+	mu      sync.Mutex
+	closed  bool
+	pending syscall.Handle
+	// first is the instance created up front, so a second server on
+	// the same name fails at startup rather than on the first client.
+	first syscall.Handle
+}
+
+// listenPipe creates the named pipe name, secured by the SDDL sddl,
+// or by the default descriptor if sddl is empty.
+func listenPipe(name, sddl string) (net.Listener, error) {
+	l := &pipeListener{name: name, pending: syscall.InvalidHandle}
+
+	if sddl != "" {
+		s, err := syscall.UTF16PtrFromString(sddl)
+		if err != nil {
+			return nil, err
+		}
+		var sd uintptr
+		if r, _, err := procConvertSDDL.Call(uintptr(unsafe.Pointer(s)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0); r == 0 {
+			return nil, err
+		}
+		l.sa = &syscall.SecurityAttributes{SecurityDescriptor: sd}
+		l.sa.Length = uint32(unsafe.Sizeof(*l.sa))
+	}
+
+	h, err := l.instance(true)
+	if err != nil {
+		l.free()
+		return nil, err
+	}
+	l.first = h
+	return l, nil
+}
+
+func (l *pipeListener) instance(first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(l.name)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+
+	mode := uint32(pipeAccessDuplex)
+	if first {
+		mode |= fileFlagFirstInstance
+	}
+
+	h, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)),
+		uintptr(mode),
+		pipeTypeByte|pipeWait,
+		pipeUnlimitedInstances,
+		pipeBufferSize,
+		pipeBufferSize,
+		0,
+		uintptr(unsafe.Pointer(l.sa)))
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return syscall.Handle(h), nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+
+	h := l.first
+	l.first = syscall.InvalidHandle
+	if h == syscall.InvalidHandle {
+		var err error
+		if h, err = l.instance(false); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+	l.pending = h
+	l.mu.Unlock()
+
+	// Blocks until a client opens the pipe.
+	r, _, err := procConnectNamedPipe.Call(uintptr(h), 0)
+
+	l.mu.Lock()
+	l.pending = syscall.InvalidHandle
+	closed := l.closed
+	l.mu.Unlock()
+
+	if closed {
+		syscall.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+	if r == 0 && err != errorPipeConnected {
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+
+	return &pipeConn{h: h, addr: pipeAddr(l.name)}, nil
+}
+
+// Close stops the listener.
+// A blocked Accept is released by connecting to the pipe ourselves.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	pending := l.pending
+	if l.first != syscall.InvalidHandle {
+		syscall.CloseHandle(l.first)
+		l.first = syscall.InvalidHandle
+	}
+	l.mu.Unlock()
+
+	if pending != syscall.InvalidHandle {
+		if name, err := syscall.UTF16PtrFromString(l.name); err == nil {
+			h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0)
+			if err == nil {
+				syscall.CloseHandle(h)
+			}
+		}
+	}
+
+	l.free()
+	return nil
+}
+
+func (l *pipeListener) free() {
+	if l.sa != nil {
+		procLocalFree.Call(l.sa.SecurityDescriptor)
+		l.sa = nil
+	}
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.name) }
+
+// pipeConn is the server end of a connected pipe instance.
+// I/O is synchronous, so deadlines aren't supported.
+type pipeConn struct {
+	h    syscall.Handle
+	addr pipeAddr
+	once sync.Once
+}
+
+var errPipeDeadline = errors.New("deadlines are not supported on named pipes")
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	var n uint32
+	err := syscall.ReadFile(c.h, p, &n, nil)
+	if err == syscall.ERROR_BROKEN_PIPE || (err == nil && n == 0 && len(p) > 0) {
+		return 0, io.EOF
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	var n uint32
+	err := syscall.WriteFile(c.h, p, &n, nil)
+	if err == errorNoData || err == syscall.ERROR_BROKEN_PIPE {
+		return int(n), io.ErrClosedPipe
+	}
+	return int(n), err
+}
+
+// Close cancels I/O blocked in other goroutines before closing the handle,
+// or closing would wait for that I/O to finish.
+func (c *pipeConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		procCancelIoEx.Call(uintptr(c.h), 0)
+		procDisconnectNamedPipe.Call(uintptr(c.h))
+		err = syscall.CloseHandle(c.h)
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return errPipeDeadline }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return errPipeDeadline }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return errPipeDeadline }
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validator is extra validation for values that are well formed.
+// Returning an error rejects the value as malformed, with the error
+// as the reason. stream is the name of the value's stream, data for
+// the main one.
+type Validator func(stream string, num int) error
+
+// Sink receives every unique value once it's been logged.
+type Sink interface {
+	Write(stream string, num int) error
+	Close() error
+}
+
+// Extensions are compiled in: a file of the command, usually behind
+// its own build tag so it stays out of the open source build, registers
+// them in its init function,
+//
+//	//go:build acme
+//
+//	func init() {
+//		server.RegisterValidator("luhn", func(server.Config) (server.Validator, error) { return checkLuhn, nil })
+//		server.RegisterSink("warehouse", openWarehouseSink)
+//	}
+//
+// and Config.Validators and Config.Sinks pick the ones a server runs with.
+// For logic that can't be linked in, the sidecar extension talks to
+// an external process instead, see sidecar.go.
+var (
+	validatorRegistry = make(map[string]func(Config) (Validator, error))
+	sinkRegistry      = make(map[string]func(Config) (Sink, error))
+)
+
+// RegisterValidator makes a validator available to Config.Validators.
+// open is called by New, with its Config, if the validator is enabled.
+// Like registerCommand, registering a name twice panics.
+func RegisterValidator(name string, open func(Config) (Validator, error)) {
+	if _, ok := validatorRegistry[name]; ok {
+		panic(fmt.Sprintf("validator %s registered twice", name))
+	}
+	validatorRegistry[name] = open
+}
+
+// RegisterSink makes a sink available to Config.Sinks.
+// open is called by New, with its Config, if the sink is enabled.
+func RegisterSink(name string, open func(Config) (Sink, error)) {
+	if _, ok := sinkRegistry[name]; ok {
+		panic(fmt.Sprintf("sink %s registered twice", name))
+	}
+	sinkRegistry[name] = open
+}
+
+// enableExtensions opens the validators and sinks named by the Config.
+func (s *Server) enableExtensions() error {
+	for _, name := range s.cfg.Validators {
+		open, ok := validatorRegistry[name]
+		if !ok {
+			var names []string
+			for n := range validatorRegistry {
+				names = append(names, n)
+			}
+			return fmt.Errorf("unknown validator %q, registered: %s", name, joinNames(names))
+		}
+		v, err := open(s.cfg)
+		if err != nil {
+			return fmt.Errorf("could not open validator %s: %v", name, err)
+		}
+		s.validators = append(s.validators, v)
+	}
+
+	for _, name := range s.cfg.Sinks {
+		open, ok := sinkRegistry[name]
+		if !ok {
+			var names []string
+			for n := range sinkRegistry {
+				names = append(names, n)
+			}
+			return fmt.Errorf("unknown sink %q, registered: %s", name, joinNames(names))
+		}
+		sink, err := open(s.cfg)
+		if err != nil {
+			return fmt.Errorf("could not open sink %s: %v", name, err)
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+	return nil
+}
+
+// joinNames lists registered names for error messages.
+func joinNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// streamOf is the stream name extensions see for the counter's values.
+func streamOf(counter *Counter) string {
+	if counter.name == "" {
+		return "data"
+	}
+	return counter.name
+}
+
+// validate runs a well formed value past the enabled validators.
+func (s *Server) validate(counter *Counter, num int) error {
+	for _, v := range s.validators {
+		if err := v(streamOf(counter), num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitUnique hands a new value to the enabled sinks.
+// A failing sink is reported but never fails the value,
+// it's already counted and logged.
+func (s *Server) emitUnique(counter *Counter, num int) {
+	for _, sink := range s.sinks {
+		if err := sink.Write(streamOf(counter), num); err != nil {
+			s.log.Error("could not write to sink", "stream", counter.name, "value", num, "err", err)
+		}
+	}
+}
+
+// closeSinks closes the enabled sinks on shutdown.
+func (s *Server) closeSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			s.log.Error("could not close sink", "err", err)
+		}
+	}
+}
+
+// errRejected is the reason given when a validator rejects without one.
+var errRejected = errors.New("rejected")
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultWorkerQueue is how many connections wait for a worker
+// if Config.WorkerQueue is 0.
+const DefaultWorkerQueue = 1024
+
+// workerPool serves connections on a fixed number of goroutines, for
+// high connection churn: the goroutines are started once instead of
+// one per connection. Accepted connections queue up for the next free
+// worker, with the queue full they're turned away as busy.
+//
+// A worker serves one connection until it closes, so the pool suits
+// short lived connections; long lived ones each hold a worker.
+type workerPool struct {
+	size  int
+	queue chan incoming
+	// busy counts the workers serving a connection.
+	busy int64
+}
+
+func newWorkerPool(size, queue int) *workerPool {
+	if size == 0 {
+		return nil
+	}
+	if queue == 0 {
+		queue = DefaultWorkerQueue
+	}
+	return &workerPool{size: size, queue: make(chan incoming, queue)}
+}
+
+// start starts the workers, they exit on Shutdown.
+func (p *workerPool) start(s *Server) {
+	for i := 0; i < p.size; i++ {
+		go p.work(s)
+	}
+}
+
+// work serves queued connections until Shutdown.
+// Must be run on go routine.
+func (p *workerPool) work(s *Server) {
+	for {
+		select {
+		case in := <-p.queue:
+			atomic.AddInt64(&p.busy, 1)
+			s.runConn(in)
+			atomic.AddInt64(&p.busy, -1)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// drop closes the connections still queued on Shutdown, they weren't
+// greeted yet and would wait for a worker that's serving to the end
+// of the grace period.
+func (p *workerPool) drop(s *Server) {
+	if p == nil {
+		return
+	}
+	for {
+		select {
+		case in := <-p.queue:
+			in.conn.Close()
+			s.connDone(in)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue queues in for a worker, it reports false if the queue is full.
+func (p *workerPool) enqueue(in incoming) bool {
+	select {
+	case p.queue <- in:
+		return true
+	default:
+		return false
+	}
+}
+
+// report is the pool's line of the interval output.
+func (p *workerPool) report() string {
+	return fmt.Sprintf("Workers     : %d busy of %d, %d queued\n",
+		atomic.LoadInt64(&p.busy), p.size, len(p.queue))
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a connection has to send its PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyHandshakes is how many PROXY headers are read at once, accepting
+// waits for one to finish beyond that.
+const proxyHandshakes = 1024
+
+// proxyV1Sig and proxyV2Sig start every PROXY header of their version.
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyListener reads the HAProxy PROXY protocol header, version 1 or 2,
+// off every accepted connection, so behind a load balancer RemoteAddr
+// is the real client. See
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// Headers are read on a goroutine per connection, up to proxyHandshakes
+// at once, a client slow to send one doesn't hold up accepting the
+// others. Connections without a valid header are closed, the header is
+// mandatory once it's turned on, and so are those from outside the
+// trusted ranges, if there are any, before anything is read.
+type proxyListener struct {
+	net.Listener
+	conns   chan net.Conn
+	errs    chan error
+	done    chan struct{}
+	close   sync.Once
+	srv     *Server
+	trusted []*net.IPNet
+	// slots holds a token for every header being read.
+	slots chan struct{}
+}
+
+func newProxyListener(l net.Listener, s *Server) *proxyListener {
+	p := &proxyListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+		srv:      s,
+		trusted:  s.proxyTrusted,
+		slots:    make(chan struct{}, proxyHandshakes),
+	}
+	go p.run()
+	return p
+}
+
+// run accepts from the wrapped listener until it's closed.
+// Must be run on go routine.
+func (p *proxyListener) run() {
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			select {
+			case p.errs <- err:
+			case <-p.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !p.trusts(conn.RemoteAddr()) {
+			p.srv.audit.Record(auditBadProxy, conn.RemoteAddr().String(), "not a trusted proxy")
+			conn.Close()
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			conn.Close()
+			return
+		}
+		go p.handshake(conn)
+	}
+}
+
+// trusts reports whether the peer at addr may send PROXY headers, any
+// may without trusted ranges, and so may those without an IP.
+func (p *proxyListener) trusts(addr net.Addr) bool {
+	if len(p.trusted) == 0 {
+		return true
+	}
+	ip := net.ParseIP(hostOf(addr.String()))
+	return ip == nil || contains(p.trusted, ip)
+}
+
+// handshake reads the header of conn and hands it to Accept.
+// Must be run on go routine.
+func (p *proxyListener) handshake(conn net.Conn) {
+	pc, err := readProxyHeader(conn)
+	<-p.slots
+	if err != nil {
+		p.srv.audit.Record(auditBadProxy, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	select {
+	case p.conns <- pc:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (p *proxyListener) Close() error {
+	p.close.Do(func() { close(p.done) })
+	return p.Listener.Close()
+}
+
+// proxied wraps l to read PROXY headers if the server is configured to.
+func (s *Server) proxied(l net.Listener) net.Listener {
+	if !s.cfg.ProxyProtocol {
+		return l
+	}
+	return newProxyListener(l, s)
+}
+
+// proxyConn is a connection with its PROXY header read.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+	// remote is the client the header names, nil if it named none,
+	// e.g. for the load balancer's own health checks.
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY header of either version.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	// The first byte tells the versions apart, only as much as the
+	// signature of the one it starts is waited for: a v1 header may be
+	// all a health check sends.
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("could not read PROXY header: %v", err)
+	}
+	var sig []byte
+	var read func(*bufio.Reader) (net.Addr, error)
+	switch first[0] {
+	case proxyV1Sig[0]:
+		sig, read = proxyV1Sig, readProxyV1
+	case proxyV2Sig[0]:
+		sig, read = proxyV2Sig, readProxyV2
+	default:
+		return nil, errors.New("no PROXY header")
+	}
+	got, err := c.r.Peek(len(sig))
+	if !bytes.Equal(got, sig) {
+		if err != nil {
+			return nil, fmt.Errorf("could not read PROXY header: %v", err)
+		}
+		return nil, errors.New("no PROXY header")
+	}
+	if c.remote, err = read(c.r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readProxyV1 reads the text header, e.g.
+//
+//	PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid header is 107 bytes.
+	var line []byte
+	for len(line) < 108 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("could not read PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY header too long or not CRLF terminated")
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY source %s %s", f[2], f[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header: the signature, version and
+// command, address family, length, and the addresses followed by
+// TLVs, which are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("could not read PROXY header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("could not read PROXY addresses: %v", err)
+	}
+
+	switch cmd := hdr[12] & 0xf; cmd {
+	case 0:
+		// LOCAL, e.g. a health check by the proxy itself.
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", cmd)
+	}
+
+	short := errors.New("PROXY addresses too short")
+	switch hdr[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, short
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, short
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	case 3:
+		if len(body) < 216 {
+			return nil, short
+		}
+		return &net.UnixAddr{Name: string(bytes.TrimRight(body[:108], "\x00")), Net: "unix"}, nil
+	}
+	// UNSPEC, nothing to go by.
+	return nil, nil
+}
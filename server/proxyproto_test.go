@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a version 2 header of cmd and family with body.
+func proxyV2(ver, cmd, family byte, body []byte) string {
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, ver<<4|cmd, family<<4|1)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := append(net.IPv4(203, 0, 113, 7).To4(), 10, 0, 0, 5, 0xc8, 0x22, 0x0c, 0xd0)
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v6[32:], 51234)
+
+	tests := []struct {
+		name   string
+		header string
+		// remote is the client's address, "" if the header names none.
+		remote string
+		err    string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r\n", "203.0.113.7:51234", ""},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 51234 3280\r\n", "[2001:db8::7]:51234", ""},
+		// Shorter than the v2 signature, and all a health check sends.
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", ""},
+		{"v1 bad address", "PROXY TCP4 nowhere 10.0.0.5 51234 3280\r\n", "", "malformed PROXY source"},
+		{"v1 bad protocol", "PROXY UDP4 203.0.113.7 10.0.0.5 51234 3280\r\n", "", "malformed PROXY header"},
+		{"v1 no crlf", "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\n", "", "not CRLF terminated"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "too long"},
+		{"v2 tcp4", proxyV2(2, 1, 1, v4), "203.0.113.7:51234", ""},
+		{"v2 tcp6", proxyV2(2, 1, 2, v6), "[2001:db8::7]:51234", ""},
+		{"v2 local", proxyV2(2, 0, 0, nil), "", ""},
+		{"v2 unspec", proxyV2(2, 1, 0, nil), "", ""},
+		{"v2 short", proxyV2(2, 1, 1, v4[:8]), "", "too short"},
+		{"v2 version", proxyV2(3, 1, 1, v4), "", "unsupported PROXY version"},
+		{"v2 command", proxyV2(2, 2, 1, v4), "", "unsupported PROXY command"},
+		{"none", "1234567890\r\n", "", "no PROXY header"},
+		{"almost v1", "PROXZ TCP4\r\n", "", "no PROXY header"},
+		{"cut short", "PRO", "", "could not read PROXY header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.header)
+				// A cut short header ends with the connection, the
+				// others wait for more like a client would.
+				if tt.name == "cut short" {
+					client.Close()
+				}
+			}()
+			defer client.Close()
+
+			pc, err := readProxyHeader(server)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := ""
+			if pc.remote != nil {
+				remote = pc.remote.String()
+			}
+			if remote != tt.remote {
+				t.Errorf("remote = %q, want %q", remote, tt.remote)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderKeepsData(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.WriteString(client, "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r\n1234567890\n")
+	defer client.Close()
+	pc, err := readProxyHeader(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(pc).ReadString('\n')
+	if err != nil || line != "1234567890\n" {
+		t.Errorf("read %q, %v after the header, want the value", line, err)
+	}
+}
+
+func TestProxyHandshakeBound(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProxyListener(l, &Server{})
+	defer p.Close()
+	for range proxyHandshakes {
+		p.slots <- struct{}{}
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r\n")
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := p.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("a header was read with every handshake slot taken")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-p.slots
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+			t.Errorf("RemoteAddr = %s, want the header's", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not accepted once a slot was free")
+	}
+}
+
+func TestProxyTrusted(t *testing.T) {
+	// Serve doesn't read headers off the listener it's given, those
+	// of Config.Listen do.
+	cfg := testConfig(t)
+	addr := freeAddr(t)
+	cfg.ProxyProtocol, cfg.ProxyTrusted, cfg.Listen = true, []string{"192.0.2.0/24"}, []string{addr}
+	_, main := serveTest(t, cfg)
+	// Once the main listener answers, the others are up.
+	send(t, main)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r\n"+pingCmd+"\n")
+	if got, _ := io.ReadAll(c); len(got) != 0 {
+		t.Errorf("a connection from outside the trusted ranges got %q", got)
+	}
+
+	cfg = testConfig(t)
+	addr = freeAddr(t)
+	cfg.ProxyProtocol, cfg.ProxyTrusted, cfg.Listen = true, []string{"127.0.0.1"}, []string{addr}
+	_, main = serveTest(t, cfg)
+	send(t, main)
+	send(t, addr, "PROXY TCP4 203.0.113.7 10.0.0.5 51234 3280\r", "1234567890")
+
+	cfg.ProxyProtocol = false
+	if _, err := New(cfg); err == nil {
+		t.Error("New took trusted proxies without the PROXY protocol")
+	}
+	cfg.ProxyProtocol, cfg.ProxyTrusted = true, []string{"10.0.0.0/33"}
+	if _, err := New(cfg); err == nil {
+		t.Error("New took a bad trusted range")
+	}
+}
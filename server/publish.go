@@ -0,0 +1,311 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/amqp"
+	"github.com/chandanws/go-simple-tcp-server/internal/kafka"
+	"github.com/chandanws/go-simple-tcp-server/internal/nats"
+	"github.com/chandanws/go-simple-tcp-server/internal/pubsub"
+)
+
+// The kafka, nats, pubsub and amqp sinks publish every unique value to
+// a broker, for consumers that would otherwise tail the log: kafka
+// produces it to Config.KafkaTopic keyed by its stream, nats publishes
+// it on Config.NATSSubject followed by a dot and the stream, pubsub to
+// Config.PubSubTopic with the stream as its ordering key, amqp to
+// Config.AMQPExchange with the routing key Config.AMQPRoutingKey or the
+// stream. Values are sent in batches, see publisher.
+func init() {
+	RegisterSink("kafka", func(cfg Config) (Sink, error) {
+		if len(cfg.KafkaBrokers) == 0 || cfg.KafkaTopic == "" {
+			return nil, errors.New("brokers and a topic are required")
+		}
+		opts := kafka.Options{ClientID: cfg.Name}
+		return startPublisher("kafka", cfg, func() (publishConn, error) {
+			p, err := kafka.Dial(cfg.KafkaBrokers, cfg.KafkaTopic, opts)
+			if err != nil {
+				return nil, err
+			}
+			return kafkaConn{p}, nil
+		})
+	})
+	RegisterSink("nats", func(cfg Config) (Sink, error) {
+		if cfg.NATSAddr == "" || cfg.NATSSubject == "" {
+			return nil, errors.New("a server and a subject are required")
+		}
+		opts := nats.Options{Name: cfg.Name, User: cfg.NATSUser, Password: cfg.NATSPassword}
+		return startPublisher("nats", cfg, func() (publishConn, error) {
+			c, err := nats.Dial(cfg.NATSAddr, opts)
+			if err != nil {
+				return nil, err
+			}
+			return natsConn{c, cfg.NATSSubject}, nil
+		})
+	})
+	RegisterSink("pubsub", func(cfg Config) (Sink, error) {
+		if cfg.PubSubProject == "" || cfg.PubSubTopic == "" {
+			return nil, errors.New("a project and a topic are required")
+		}
+		opts := pubsub.Options{Endpoint: cfg.PubSubEndpoint, Credentials: cfg.PubSubCredentials}
+		return startPublisher("pubsub", cfg, func() (publishConn, error) {
+			p, err := pubsub.Dial(cfg.PubSubProject, cfg.PubSubTopic, opts)
+			if err != nil {
+				return nil, err
+			}
+			return pubsubConn{p}, nil
+		})
+	})
+	RegisterSink("amqp", func(cfg Config) (Sink, error) {
+		if cfg.AMQPURL == "" {
+			return nil, errors.New("a broker URL is required")
+		}
+		opts := amqp.Options{Password: cfg.AMQPPassword, Name: cfg.Name}
+		return startPublisher("amqp", cfg, func() (publishConn, error) {
+			p, err := amqp.Dial(cfg.AMQPURL, cfg.AMQPExchange, opts)
+			if err != nil {
+				return nil, err
+			}
+			return amqpConn{p, cfg.AMQPRoutingKey}, nil
+		})
+	})
+}
+
+// publishMaxBackoff caps the wait between attempts to publish a batch.
+const publishMaxBackoff = 30 * time.Second
+
+// errPublishQueueFull is a value a publisher had no room for.
+var errPublishQueueFull = errors.New("queue full, value dropped")
+
+// sinkValue is a unique value of a stream, as sinks see it.
+type sinkValue struct {
+	stream string
+	num    int
+}
+
+// publishConn is a connection to a broker that takes batches.
+type publishConn interface {
+	publish(batch []sinkValue) error
+	Close() error
+}
+
+// publisher is a Sink that sends the values in batches over a
+// connection of its own: a batch goes out once it has Config.SinkBatch
+// values, or its first has waited Config.SinkLinger. A batch that
+// fails is sent again on a new connection, backing off, until it goes
+// through. Meanwhile up to Config.SinkQueue values wait, more are
+// dropped.
+type publisher struct {
+	name    string
+	connect func() (publishConn, error)
+	queue   chan sinkValue
+	batch   int
+	linger  time.Duration
+	log     *slog.Logger
+	stop    chan bool
+	done    chan bool
+	dropped int64
+}
+
+func startPublisher(name string, cfg Config, connect func() (publishConn, error)) (Sink, error) {
+	if cfg.SinkBatch < 0 || cfg.SinkLinger < 0 || cfg.SinkQueue < 0 {
+		return nil, errors.New("the batch, linger and queue can't be negative")
+	}
+	p := &publisher{
+		name:    name,
+		connect: connect,
+		queue:   make(chan sinkValue, cfg.SinkQueue),
+		batch:   cfg.SinkBatch,
+		linger:  cfg.SinkLinger,
+		log:     cfg.Logger.With("sink", name),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Write queues a value for the next batch, without waiting.
+func (p *publisher) Write(stream string, num int) error {
+	select {
+	case p.queue <- sinkValue{stream, num}:
+		return nil
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+		return errPublishQueueFull
+	}
+}
+
+// Close sends what's queued, one attempt per batch, and disconnects.
+func (p *publisher) Close() error {
+	close(p.stop)
+	<-p.done
+	if n := atomic.LoadInt64(&p.dropped); n > 0 {
+		p.log.Warn("values dropped for a full queue", "dropped", n)
+	}
+	return nil
+}
+
+// run sends the batches until Close. Must be run on go routine.
+func (p *publisher) run() {
+	defer close(p.done)
+	var conn publishConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	batch := make([]sinkValue, 0, p.batch)
+	for {
+		var stopped bool
+		select {
+		case v := <-p.queue:
+			batch = append(batch[:0], v)
+			stopped = p.fill(&batch)
+		case <-p.stop:
+			// Whatever's still queued goes out in last batches.
+			batch = batch[:0]
+			for len(p.queue) > 0 && len(batch) < p.batch {
+				batch = append(batch, <-p.queue)
+			}
+			if len(batch) == 0 {
+				return
+			}
+			stopped = true
+		}
+
+		backoff := time.Second
+		for {
+			var err error
+			if conn == nil {
+				conn, err = p.connect()
+			}
+			if err == nil {
+				if err = conn.publish(batch); err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+			if err == nil {
+				break
+			}
+			if stopped {
+				// The broker's gone, the rest of the queue won't fare better.
+				p.log.Error("could not publish, values dropped", "values", len(batch)+len(p.queue), "err", err)
+				return
+			}
+			p.log.Warn("could not publish, retrying", "values", len(batch), "in", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				stopped = true
+			}
+			if backoff *= 2; backoff > publishMaxBackoff {
+				backoff = publishMaxBackoff
+			}
+		}
+	}
+}
+
+// fill adds queued values to batch until it's full or has lingered.
+// It reports whether Close was called meanwhile.
+func (p *publisher) fill(batch *[]sinkValue) bool {
+	if len(*batch) >= p.batch {
+		return false
+	}
+	linger := time.NewTimer(p.linger)
+	defer linger.Stop()
+	for len(*batch) < p.batch {
+		select {
+		case v := <-p.queue:
+			*batch = append(*batch, v)
+		case <-linger.C:
+			return false
+		case <-p.stop:
+			return true
+		}
+	}
+	return false
+}
+
+type kafkaConn struct {
+	p *kafka.Producer
+}
+
+func (k kafkaConn) publish(batch []sinkValue) error {
+	records := make([]kafka.Record, len(batch))
+	for i, v := range batch {
+		records[i] = kafka.Record{Key: []byte(v.stream), Value: strconv.AppendInt(nil, int64(v.num), 10)}
+	}
+	return k.p.Produce(records)
+}
+
+func (k kafkaConn) Close() error { return k.p.Close() }
+
+type natsConn struct {
+	c       *nats.Client
+	subject string
+}
+
+func (n natsConn) publish(batch []sinkValue) error {
+	var buf []byte
+	for _, v := range batch {
+		buf = strconv.AppendInt(buf[:0], int64(v.num), 10)
+		if err := n.c.Publish(n.subject+"."+v.stream, buf); err != nil {
+			return err
+		}
+	}
+	return n.c.Flush()
+}
+
+func (n natsConn) Close() error { return n.c.Close() }
+
+type pubsubConn struct {
+	p *pubsub.Publisher
+}
+
+// publish sends the values with their stream as the ordering key and
+// an attribute, so the values of a stream are delivered in order.
+func (p pubsubConn) publish(batch []sinkValue) error {
+	msgs := make([]pubsub.Message, len(batch))
+	for i, v := range batch {
+		msgs[i] = pubsub.Message{
+			Data:        strconv.AppendInt(nil, int64(v.num), 10),
+			OrderingKey: v.stream,
+			Attributes:  map[string]string{"stream": v.stream},
+		}
+	}
+	return p.p.Publish(msgs)
+}
+
+func (p pubsubConn) Close() error { return p.p.Close() }
+
+type amqpConn struct {
+	p   *amqp.Publisher
+	key string
+}
+
+// publish returns once the broker has confirmed every value, a batch
+// it nacked is sent again like one that failed.
+func (a amqpConn) publish(batch []sinkValue) error {
+	msgs := make([]amqp.Message, len(batch))
+	for i, v := range batch {
+		key := a.key
+		if key == "" {
+			key = v.stream
+		}
+		msgs[i] = amqp.Message{
+			RoutingKey: key,
+			Body:       strconv.AppendInt(nil, int64(v.num), 10),
+			Headers:    map[string]string{"stream": v.stream},
+		}
+	}
+	return a.p.Publish(msgs)
+}
+
+func (a amqpConn) Close() error { return a.p.Close() }
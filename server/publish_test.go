@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePubSub is a Pub/Sub emulator that keeps what's published.
+type fakePubSub struct {
+	mu       sync.Mutex
+	path     string
+	messages []map[string]interface{}
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path = r.URL.Path
+	ids := make([]string, len(req.Messages))
+	for i, m := range req.Messages {
+		ids[i] = fmt.Sprint(len(f.messages))
+		f.messages = append(f.messages, m)
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"messageIds": ids})
+}
+
+func TestPubSubSink(t *testing.T) {
+	f := &fakePubSub{}
+	emulator := httptest.NewServer(f)
+	defer emulator.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(emulator.URL, "http://"))
+
+	cfg := testConfig(t)
+	cfg.Sinks = []string{"pubsub"}
+	cfg.PubSubProject = "acme"
+	cfg.PubSubTopic = "numbers"
+	srv, addr := serveTest(t, cfg)
+	send(t, addr, "1234567890", "1234567890", "2345678901")
+	srv.Shutdown(context.Background())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if want := "/v1/projects/acme/topics/numbers:publish"; f.path != want {
+		t.Errorf("published to %s, want %s", f.path, want)
+	}
+	var got []string
+	for _, m := range f.messages {
+		data, _ := base64.StdEncoding.DecodeString(m["data"].(string))
+		got = append(got, fmt.Sprintf("%s %s", m["orderingKey"], data))
+	}
+	if want := []string{"data 1234567890", "data 2345678901"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("published %q, want %q", got, want)
+	}
+}
+
+// fakeAMQP is an AMQP broker that takes any login and confirms every
+// message, it keeps the routing key and body of each.
+type fakeAMQP struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (f *fakeAMQP) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeAMQP) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	start := []byte{0, 9}
+	start = binary.BigEndian.AppendUint32(start, 0)
+	start = binary.BigEndian.AppendUint32(start, 5)
+	start = append(start, "PLAIN"...)
+	start = binary.BigEndian.AppendUint32(start, 5)
+	start = append(start, "en_US"...)
+	amqpMethod(conn, 0, 10, 10, start)
+	amqpRead(r) // start-ok
+	amqpMethod(conn, 0, 10, 30, []byte{0, 0, 0, 2, 0, 0, 0, 0})
+	amqpRead(r) // tune-ok
+	amqpRead(r) // open
+	amqpMethod(conn, 0, 10, 41, []byte{0})
+	amqpRead(r) // channel open
+	amqpMethod(conn, 1, 20, 11, []byte{0, 0, 0, 0})
+	amqpRead(r) // confirm select
+	amqpMethod(conn, 1, 85, 11, nil)
+
+	var tag uint64
+	for {
+		method, err := amqpRead(r)
+		if err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(method) != 60<<16|40 {
+			continue
+		}
+		exchange := method[7 : 7+method[6]]
+		key := method[8+len(exchange) : 8+len(exchange)+int(method[7+len(exchange)])]
+		amqpRead(r) // content header
+		body, err := amqpRead(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.published = append(f.published, fmt.Sprintf("%s %s %s", exchange, key, body))
+		f.mu.Unlock()
+		tag++
+		amqpMethod(conn, 1, 60, 80, append(binary.BigEndian.AppendUint64(nil, tag), 0))
+	}
+}
+
+func amqpMethod(conn net.Conn, channel uint16, class, method uint16, args []byte) {
+	payload := binary.BigEndian.AppendUint16(nil, class)
+	payload = append(binary.BigEndian.AppendUint16(payload, method), args...)
+	frame := binary.BigEndian.AppendUint16([]byte{1}, channel)
+	frame = append(binary.BigEndian.AppendUint32(frame, uint32(len(payload))), payload...)
+	conn.Write(append(frame, 0xce))
+}
+
+// amqpRead reads a frame, it returns its payload.
+func amqpRead(r *bufio.Reader) ([]byte, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload[:len(payload)-1], nil
+}
+
+func TestAMQPSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := &fakeAMQP{}
+	go f.serve(l)
+
+	cfg := testConfig(t)
+	cfg.Sinks = []string{"amqp"}
+	cfg.AMQPURL = "amqp://numbers@" + l.Addr().String() + "/analytics"
+	cfg.AMQPExchange = "numbers"
+	srv, addr := serveTest(t, cfg)
+	send(t, addr, "1234567890", "1234567890", "2345678901")
+	srv.Shutdown(context.Background())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if want := []string{"numbers data 1234567890", "numbers data 2345678901"}; fmt.Sprint(f.published) != fmt.Sprint(want) {
+		t.Errorf("published %q, want %q", f.published, want)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol QUIC clients have to ask for.
+const quicALPN = "numbers"
+
+// quicIdleTimeout closes a QUIC connection nothing was heard from for as long.
+const quicIdleTimeout = 30 * time.Second
+
+// quicMaxStreams is how many streams a QUIC client may have open at once.
+const quicMaxStreams = 100
+
+// listenQUIC listens on the UDP address addr for QUIC connections served
+// the store's key pair, each stream is accepted like a connection.
+func (s *Server) listenQUIC(addr string) (net.Listener, error) {
+	l, err := quic.ListenAddr(addr, &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		MinVersion:     tls.VersionTLS13,
+		NextProtos:     []string{quicALPN},
+	}, &quic.Config{
+		MaxIdleTimeout:     quicIdleTimeout,
+		MaxIncomingStreams: quicMaxStreams,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ql := &quicListener{
+		l:       l,
+		streams: make(chan *quicStream),
+		done:    make(chan struct{}),
+		conns:   make(map[*quic.Conn]int),
+	}
+	go ql.acceptConns()
+	return ql, nil
+}
+
+// quicListener accepts the streams of a QUIC listener's connections,
+// each a net.Conn. Closing it stops new connections and streams, those
+// open are served until they're over, and their connections closed then.
+type quicListener struct {
+	l       *quic.Listener
+	streams chan *quicStream
+	done    chan struct{}
+	close   sync.Once
+
+	mu sync.Mutex
+	// conns are the connections and how many of their streams are open.
+	conns   map[*quic.Conn]int
+	closing bool
+}
+
+// acceptConns accepts the streams of every new connection until the
+// listener is closed.
+// Must be run on go routine.
+func (ql *quicListener) acceptConns() {
+	for {
+		conn, err := ql.l.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		ql.mu.Lock()
+		if ql.closing {
+			ql.mu.Unlock()
+			conn.CloseWithError(0, "")
+			return
+		}
+		ql.conns[conn] = 0
+		ql.mu.Unlock()
+		go ql.acceptStreams(conn)
+	}
+}
+
+// acceptStreams hands the streams conn opens to Accept, until the
+// connection or the listener is closed.
+// Must be run on go routine.
+func (ql *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		st, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			// The connection is gone, and its streams with it.
+			ql.mu.Lock()
+			delete(ql.conns, conn)
+			ql.mu.Unlock()
+			return
+		}
+		ql.mu.Lock()
+		if ql.closing {
+			idle := ql.conns[conn] <= 0
+			ql.mu.Unlock()
+			st.CancelRead(0)
+			st.CancelWrite(0)
+			if idle {
+				conn.CloseWithError(0, "")
+			}
+			return
+		}
+		ql.conns[conn]++
+		ql.mu.Unlock()
+
+		s := &quicStream{Stream: st, conn: conn, ql: ql}
+		select {
+		case ql.streams <- s:
+		case <-ql.done:
+			s.Close()
+			return
+		}
+	}
+}
+
+// streamDone counts a stream of conn as over, and closes conn after
+// its last stream once the listener is closed.
+func (ql *quicListener) streamDone(conn *quic.Conn) {
+	ql.mu.Lock()
+	n, ok := ql.conns[conn]
+	if ok {
+		ql.conns[conn] = n - 1
+	}
+	idle := ok && ql.closing && n <= 1
+	ql.mu.Unlock()
+	if idle {
+		conn.CloseWithError(0, "")
+	}
+}
+
+// Accept returns the next stream a client opened.
+func (ql *quicListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-ql.streams:
+		return s, nil
+	case <-ql.done:
+		return nil, &net.OpError{Op: "accept", Net: "quic", Addr: ql.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting, the connections are closed once their streams
+// are over.
+func (ql *quicListener) Close() error {
+	var err error
+	ql.close.Do(func() {
+		close(ql.done)
+		ql.mu.Lock()
+		ql.closing = true
+		var idle []*quic.Conn
+		for conn, n := range ql.conns {
+			if n <= 0 {
+				idle = append(idle, conn)
+			}
+		}
+		ql.mu.Unlock()
+		err = ql.l.Close()
+		for _, conn := range idle {
+			conn.CloseWithError(0, "")
+		}
+	})
+	return err
+}
+
+func (ql *quicListener) Addr() net.Addr { return ql.l.Addr() }
+
+// quicStream is a QUIC stream served like a connection.
+type quicStream struct {
+	*quic.Stream
+	conn  *quic.Conn
+	ql    *quicListener
+	close sync.Once
+}
+
+// Close ends the stream both ways, the data written is still sent.
+func (s *quicStream) Close() error {
+	err := s.Stream.Close()
+	s.close.Do(func() {
+		s.CancelRead(0)
+		s.ql.streamDone(s.conn)
+	})
+	return err
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
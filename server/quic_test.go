@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// writeTestCert writes a self-signed key pair for localhost and returns
+// its files and a client config that trusts it.
+func writeTestCert(t *testing.T) (certFile, keyFile string, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for name, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(name, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{quicALPN}}
+}
+
+func TestQUIC(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	cfg := testConfig(t)
+	cfg.QUICAddr = addr
+	if _, err := New(cfg); err == nil {
+		t.Fatal("QUIC without a certificate")
+	}
+	var clientConf *tls.Config
+	cfg.TLSCert, cfg.TLSKey, clientConf = writeTestCert(t)
+	cfg.TLSAddr = "127.0.0.1:0"
+	srv, main := serveTest(t, cfg)
+	// Once the main listener answers, QUIC is up.
+	send(t, main)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, clientConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// Newline separated values on one stream.
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(s, "1234567890\n1234567891\n"+pingCmd+"\n")
+	if reply, err := bufio.NewReader(s).ReadString('\n'); err != nil || reply != pongReply {
+		t.Fatalf("reply %q, %v, want PONG", reply, err)
+	}
+	s.Close()
+
+	// And a value a stream, Close only ends what's sent.
+	for _, value := range []string{"1234567892\n", "1234567890\n"} {
+		s, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(s, value)
+		s.Close()
+		if _, err := io.ReadAll(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.Shutdown(context.Background())
+	if uniq, total, _ := srv.counter.Counts(); uniq != 3 || total != 4 {
+		t.Errorf("%d unique of %d, want 3 of 4", uniq, total)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// usageRecord is a line of Config.UsageFile, what a stream took in over
+// a period, a UTC day, for chargeback. A period has a record from every
+// run of the server that saw it, written when the day or the run ends,
+// add them up.
+type usageRecord struct {
+	Stream string `json:"stream"`
+	Period string `json:"period"`
+	// Accepted is the values let in under the quota, Unique those of
+	// them that were new, Rejected those refused over the quota.
+	Accepted int64 `json:"accepted"`
+	Unique   int64 `json:"unique"`
+	Rejected int64 `json:"rejected"`
+}
+
+// usageLog appends the usage records to Config.UsageFile.
+//
+// A nil *usageLog writes nothing.
+type usageLog struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+	log  *slog.Logger
+	// today is what the file had for the day it was opened, by stream,
+	// the quotas carry on from there after a restart.
+	today map[string]usageRecord
+}
+
+// openUsageLog opens the usage file name for appending, and sums up its
+// records of the current period.
+func openUsageLog(name string) (*usageLog, error) {
+	u := &usageLog{name: name, log: slog.Default(), today: make(map[string]usageRecord)}
+	if err := u.readToday(usagePeriod(usageDay(time.Now()))); err != nil {
+		return nil, fmt.Errorf("could not read usage file: %v", err)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open usage file: %v", err)
+	}
+	u.f = f
+	return u, nil
+}
+
+func (u *usageLog) readToday(period string) error {
+	f, err := os.Open(u.name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r usageRecord
+		// A line cut short by a crash is skipped.
+		if json.Unmarshal(sc.Bytes(), &r) != nil || r.Period != period {
+			continue
+		}
+		t := u.today[r.Stream]
+		t.Accepted += r.Accepted
+		t.Unique += r.Unique
+		t.Rejected += r.Rejected
+		u.today[r.Stream] = t
+	}
+	return sc.Err()
+}
+
+func (u *usageLog) write(r usageRecord) error {
+	if u == nil {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err = u.f.Write(append(b, '\n'))
+	return err
+}
+
+// Reopen closes the usage file and opens it again by name, so an
+// external logrotate can move it away.
+func (u *usageLog) Reopen() (err error) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err = u.f.Close(); err != nil {
+		return fmt.Errorf("could not close usage file: %v", err)
+	}
+	u.f, err = os.OpenFile(u.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	return
+}
+
+func (u *usageLog) Close() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.f.Close()
+}
+
+// usageDay is the UTC day of t, counted from the epoch.
+func usageDay(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// usagePeriod is the period of a usage record of day, e.g. 2026-10-15.
+func usagePeriod(day int64) string {
+	return time.Unix(day*int64(24*time.Hour/time.Second), 0).UTC().Format(time.DateOnly)
+}
+
+// quota counts what a stream takes in each day, against its daily quota
+// of accepted values if it has one, and writes it to the usage file as
+// the day ends. The counts are atomic, taking a value never locks
+// unless the day ended.
+//
+// A nil *quota lets every value in and counts nothing.
+type quota struct {
+	// limit is the values let in a day, 0 for any number.
+	limit  int64
+	stream string
+	usage  *usageLog
+	// mu serializes ending a day.
+	mu       sync.Mutex
+	day      atomic.Int64
+	accepted atomic.Int64
+	unique   atomic.Int64
+	rejected atomic.Int64
+}
+
+// newQuota returns the quota of stream, carrying on from the counts the
+// usage file has of the day, nil without a limit or a usage file.
+func newQuota(stream string, limit int, usage *usageLog) *quota {
+	if limit == 0 && usage == nil {
+		return nil
+	}
+	q := &quota{limit: int64(limit), stream: streamBase(stream), usage: usage}
+	q.day.Store(usageDay(time.Now()))
+	if usage != nil {
+		t := usage.today[q.stream]
+		q.accepted.Store(t.Accepted)
+		q.unique.Store(t.Unique)
+		q.rejected.Store(t.Rejected)
+	}
+	return q
+}
+
+// take lets up to n values in, it returns how many: all of them unless
+// the quota runs out, then those that still fit. The rest are counted
+// as rejected.
+func (q *quota) take(n int) int {
+	if q == nil {
+		return n
+	}
+	q.roll(time.Now())
+	if q.limit == 0 {
+		q.accepted.Add(int64(n))
+		return n
+	}
+	// The values over the limit are given back, a take that saw the
+	// count over it before they were lets nothing in, so no more than
+	// the limit are ever let in.
+	before := q.accepted.Add(int64(n)) - int64(n)
+	ok := min(max(q.limit-before, 0), int64(n))
+	if ok < int64(n) {
+		q.accepted.Add(ok - int64(n))
+		q.rejected.Add(int64(n) - ok)
+	}
+	return int(ok)
+}
+
+// sawUnique counts a value let in that was new.
+func (q *quota) sawUnique() {
+	if q != nil {
+		q.unique.Add(1)
+	}
+}
+
+// roll ends the day, if now is in the next one: its record is written
+// and the counts start over.
+func (q *quota) roll(now time.Time) {
+	day := usageDay(now)
+	// A clock set back doesn't go back to an ended day.
+	if day <= q.day.Load() {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day <= q.day.Load() {
+		return
+	}
+	r := q.record()
+	q.accepted.Store(0)
+	q.unique.Store(0)
+	q.rejected.Store(0)
+	q.day.Store(day)
+	if err := q.usage.write(r); err != nil {
+		q.usage.log.Error("could not write usage record", "stream", q.stream, "period", r.Period, "err", err)
+	}
+}
+
+// record is the usage of the current day so far.
+func (q *quota) record() usageRecord {
+	return usageRecord{
+		Stream:   q.stream,
+		Period:   usagePeriod(q.day.Load()),
+		Accepted: q.accepted.Load(),
+		Unique:   q.unique.Load(),
+		Rejected: q.rejected.Load(),
+	}
+}
+
+// flush writes the record of the current day so far, as the server
+// shuts down.
+func (q *quota) flush() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage.write(q.record())
+}
+
+// rollUsage ends the day of the streams that take no values, so every
+// day has its usage records, until ctx is done.
+// Must be run on go routine.
+func (s *Server) rollUsage(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			for _, c := range s.counters() {
+				if c.quota != nil {
+					c.quota.roll(now)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readUsage returns the records of the usage file name.
+func readUsage(t *testing.T, name string) []usageRecord {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs []usageRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r usageRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("usage record %q: %v", line, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestQuotaTake(t *testing.T) {
+	q := newQuota("", 100, nil)
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				taken.Add(int64(q.take(3)))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := taken.Load(); n != 100 {
+		t.Errorf("took %d values, want the quota of 100", n)
+	}
+	if r := q.record(); r.Accepted != 100 || r.Rejected != 8*50*3-100 {
+		t.Errorf("record = %+v, want 100 accepted, %d rejected", r, 8*50*3-100)
+	}
+
+	// The next day starts over.
+	q.roll(time.Now().Add(24 * time.Hour))
+	if n := q.take(3); n != 3 {
+		t.Errorf("took %d values the next day, want 3", n)
+	}
+
+	if newQuota("", 0, nil) != nil {
+		t.Error("a quota of no limit and no usage file counts")
+	}
+}
+
+func TestUsageRoll(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "usage.jsonl")
+	u, err := openUsageLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	q := newQuota("orders", 0, u)
+	q.take(5)
+	q.sawUnique()
+	now := time.Now()
+	q.roll(now.Add(24 * time.Hour))
+	q.take(1)
+	if err := q.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []usageRecord{
+		{Stream: "orders", Period: now.UTC().Format(time.DateOnly), Accepted: 5, Unique: 1},
+		{Stream: "orders", Period: now.Add(24 * time.Hour).UTC().Format(time.DateOnly), Accepted: 1},
+	}
+	if got := readUsage(t, name); !reflect.DeepEqual(got, want) {
+		t.Errorf("usage records = %+v, want %+v", got, want)
+	}
+}
+
+// overQuota sends line and checks the reply is quotaExceededReply
+// before the hang up.
+func overQuota(t *testing.T, addr, line string) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(c, line)
+	if got, _ := io.ReadAll(c); string(got) != quotaExceededReply {
+		t.Errorf("%s got %q, want %q", line, got, quotaExceededReply)
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DailyQuota, cfg.MaxBatch = 3, 10
+	cfg.UsageFile = filepath.Join(t.TempDir(), "usage.jsonl")
+	cfg.Streams = []string{"orders:prefix=ORD,quota=0"}
+	srv, addr := serveTest(t, cfg)
+
+	send(t, addr, "1234567890")
+	// Of a batch the values that fit are recorded.
+	overQuota(t, addr, "1234567891,1234567892,1234567893")
+	overQuota(t, addr, "1234567894")
+	if uniq, total, _ := srv.Counts(); uniq != 3 || total != 3 {
+		t.Errorf("Counts() = %d unique, %d total, want 3, 3", uniq, total)
+	}
+	// A stream without a quota takes values still.
+	if got := send(t, addr, "ORD 1234567895", "ORD 1234567895"); len(got) != 0 {
+		t.Errorf("replies to a stream without a quota: %q", got)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	period := time.Now().UTC().Format(time.DateOnly)
+	want := []usageRecord{
+		{Stream: "data", Period: period, Accepted: 3, Unique: 3, Rejected: 2},
+		{Stream: "orders", Period: period, Accepted: 2, Unique: 1},
+	}
+	if got := readUsage(t, cfg.UsageFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("usage records = %+v, want %+v", got, want)
+	}
+
+	// The day's quota is still used up after a restart.
+	_, addr = serveTest(t, cfg)
+	overQuota(t, addr, "1234567896")
+}
+
+func TestDailyQuotaConfig(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DailyQuota = -1
+	if _, err := New(cfg); err == nil {
+		t.Error("New took a negative daily quota")
+	}
+	cfg.DailyQuota = 0
+	cfg.Streams = []string{"orders:prefix=ORD,quota=-1"}
+	if _, err := New(cfg); err == nil {
+		t.Error("New took a stream with a negative quota")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxIdleBuckets is how many buckets of addresses without connections
+// are kept before full ones are swept.
+const maxIdleBuckets = 4096
+
+// limiterShards is how many shards the addresses of an ipLimiter are
+// spread across by hash, each with a lock of its own.
+const limiterShards = 64
+
+// ipLimiter keeps one client from taking all the connection slots or
+// flooding the counter: it limits the connections open per remote IP,
+// and the lines they send with a token bucket per IP, shared by all of
+// its connections. Pipe and Unix socket peers have no IP and are exempt.
+// The open connections are counted with the limit off too, so Reload
+// can turn it on or change it, see set.
+//
+// The addresses are spread across limiterShards shards, so lines of
+// different clients mostly don't wait on each other's lock.
+type ipLimiter struct {
+	// limits are the current limits, swapped whole by set.
+	limits atomic.Pointer[ipLimits]
+	shards [limiterShards]limiterShard
+}
+
+// ipLimits are the limits of an ipLimiter, see set.
+type ipLimits struct {
+	maxConns int
+	rate     float64
+	burst    float64
+}
+
+// limiterShard are the counts of the addresses of one shard.
+type limiterShard struct {
+	mu    sync.Mutex
+	conns map[string]int
+	lines map[string]*bucket
+}
+
+// bucket holds tokens for lines, refilled at rate up to burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPLimiter(maxConns int, rate float64, burst int) *ipLimiter {
+	l := &ipLimiter{}
+	for i := range l.shards {
+		l.shards[i].conns = make(map[string]int)
+		l.shards[i].lines = make(map[string]*bucket)
+	}
+	l.set(maxConns, rate, burst)
+	return l
+}
+
+// set changes the limits: maxConns 0 or rate 0 turn that limit off,
+// burst 0 is one second's worth. The connections open count against
+// the new connection limit, an IP over it can't open more until enough
+// of them hung up.
+func (l *ipLimiter) set(maxConns int, rate float64, burst int) {
+	lim := &ipLimits{maxConns: maxConns, rate: rate, burst: float64(burst)}
+	if lim.burst == 0 {
+		lim.burst = rate
+	}
+	if lim.burst < 1 {
+		lim.burst = 1
+	}
+	l.limits.Store(lim)
+}
+
+// shard returns the shard of ip, by its FNV-1a hash.
+func (l *ipLimiter) shard(ip string) *limiterShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(ip); i++ {
+		h = (h ^ uint32(ip[i])) * 16777619
+	}
+	return &l.shards[h%limiterShards]
+}
+
+// limitedIP is the IP of addr the limits apply to, "" if there's none.
+func limitedIP(addr net.Addr) string {
+	ip := hostOf(addr.String())
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+// acquire takes a connection slot of ip, see limitedIP,
+// it reports false if the IP has all of its own open.
+func (l *ipLimiter) acquire(ip string) bool {
+	if ip == "" {
+		return true
+	}
+
+	maxConns := l.limits.Load().maxConns
+	sh := l.shard(ip)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if maxConns > 0 && sh.conns[ip] >= maxConns {
+		return false
+	}
+	sh.conns[ip]++
+	return true
+}
+
+// release frees a slot taken with acquire.
+func (l *ipLimiter) release(ip string) {
+	if ip == "" {
+		return
+	}
+
+	sh := l.shard(ip)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.conns[ip]--; sh.conns[ip] <= 0 {
+		delete(sh.conns, ip)
+	}
+}
+
+// allow takes a token for one line from ip,
+// it reports false if the bucket is empty.
+func (l *ipLimiter) allow(ip string) bool {
+	lim := l.limits.Load()
+	if lim.rate == 0 || ip == "" {
+		return true
+	}
+
+	sh := l.shard(ip)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	now := time.Now()
+	b, ok := sh.lines[ip]
+	if !ok {
+		if len(sh.lines) >= maxIdleBuckets/limiterShards {
+			sh.sweep(now, lim)
+		}
+		b = &bucket{tokens: lim.burst, last: now}
+		sh.lines[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * lim.rate
+	if b.tokens > lim.burst {
+		b.tokens = lim.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets of the shard that refilled since their last
+// line, they're no different from new ones.
+func (sh *limiterShard) sweep(now time.Time, lim *ipLimits) {
+	for ip, b := range sh.lines {
+		if b.tokens+now.Sub(b.last).Seconds()*lim.rate >= lim.burst {
+			delete(sh.lines, ip)
+		}
+	}
+}
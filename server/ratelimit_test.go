@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterConns(t *testing.T) {
+	l := newIPLimiter(2, 0, 0)
+	for i, want := range []bool{true, true, false} {
+		if got := l.acquire("192.0.2.1"); got != want {
+			t.Errorf("acquire #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.acquire("192.0.2.2") {
+		t.Error("another IP was turned away")
+	}
+	if !l.acquire("") {
+		t.Error("a peer without an IP was turned away")
+	}
+	l.release("192.0.2.1")
+	if !l.acquire("192.0.2.1") {
+		t.Error("turned away after a release")
+	}
+
+	// A lower limit holds once enough connections hung up.
+	l.set(1, 0, 0)
+	l.release("192.0.2.1")
+	if l.acquire("192.0.2.1") {
+		t.Error("acquired with the IP still at the new limit")
+	}
+	l.release("192.0.2.1")
+	if !l.acquire("192.0.2.1") {
+		t.Error("turned away under the new limit")
+	}
+	l.set(0, 0, 0)
+	for range 10 {
+		if !l.acquire("192.0.2.1") {
+			t.Fatal("turned away with the limit off")
+		}
+	}
+}
+
+func TestIPLimiterBurst(t *testing.T) {
+	l := newIPLimiter(0, 10, 3)
+	for i, want := range []bool{true, true, true, false} {
+		if got := l.allow("192.0.2.1"); got != want {
+			t.Errorf("allow #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.allow("192.0.2.2") {
+		t.Error("another IP shares the bucket")
+	}
+	if !l.allow("") {
+		t.Error("a peer without an IP was limited")
+	}
+
+	// A tenth of a second refills a token at 10 a second.
+	sh := l.shard("192.0.2.1")
+	sh.mu.Lock()
+	sh.lines["192.0.2.1"].last = sh.lines["192.0.2.1"].last.Add(-100 * time.Millisecond)
+	sh.mu.Unlock()
+	for i, want := range []bool{true, false} {
+		if got := l.allow("192.0.2.1"); got != want {
+			t.Errorf("allow #%d after refilling = %v, want %v", i+1, got, want)
+		}
+	}
+
+	l.set(0, 0, 0)
+	if !l.allow("192.0.2.1") {
+		t.Error("limited with the rate off")
+	}
+	// Burst 0 is a second's worth.
+	l = newIPLimiter(0, 5, 0)
+	n := 0
+	for l.allow("192.0.2.1") && n < 100 {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("a burst of %d, want 5", n)
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	l := newIPLimiter(0, 1000, 1)
+	for i := range maxIdleBuckets * 2 {
+		l.allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	time.Sleep(5 * time.Millisecond)
+	l.allow("192.0.2.1")
+	sh := l.shard("192.0.2.1")
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if n := len(sh.lines); n > maxIdleBuckets/limiterShards {
+		t.Errorf("%d buckets in a shard, want the refilled ones swept", n)
+	}
+}
+
+func TestIPLimiterConcurrent(t *testing.T) {
+	const rate, burst = 1000, 100
+	l := newIPLimiter(4, rate, burst)
+	var allowed, acquired atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every other goroutine is another client, the rest
+			// share one IP.
+			other := fmt.Sprintf("10.0.0.%d", i)
+			for range 200 {
+				if l.allow("192.0.2.1") {
+					allowed.Add(1)
+				}
+				l.allow(other)
+				if l.acquire("192.0.2.1") {
+					acquired.Add(1)
+					l.release("192.0.2.1")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, most := allowed.Load(), burst+int64(time.Since(start).Seconds()*rate)+1; n < burst || n > most {
+		t.Errorf("%d lines allowed, want between the burst of %d and %d", n, burst, most)
+	}
+	if acquired.Load() == 0 {
+		t.Error("no connection slot acquired")
+	}
+	sh := l.shard("192.0.2.1")
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if n := sh.conns["192.0.2.1"]; n != 0 {
+		t.Errorf("%d slots left taken, want all released", n)
+	}
+}
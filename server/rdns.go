@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rdnsConcurrency caps the lookups in flight,
+// so a flood of new addresses can't turn into a flood of DNS queries.
+const rdnsConcurrency = 8
+
+// reverseDNS is an asynchronous, caching reverse DNS resolver.
+// Callers only ever read the cache; a miss starts a lookup in the
+// background and the name shows up in later log lines.
+// The hot path never waits on DNS.
+type reverseDNS struct {
+	mu      sync.Mutex
+	entries map[string]*rdnsEntry
+	sem     chan bool
+	timeout time.Duration
+	ttl     time.Duration
+}
+
+type rdnsEntry struct {
+	// name is "" while the lookup is in flight or if it failed.
+	name    string
+	expires time.Time
+}
+
+func newReverseDNS(timeout, ttl time.Duration) *reverseDNS {
+	return &reverseDNS{
+		entries: make(map[string]*rdnsEntry),
+		sem:     make(chan bool, rdnsConcurrency),
+		timeout: timeout,
+		ttl:     ttl,
+	}
+}
+
+// hostOf strips the port off a remote address.
+func hostOf(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+// warm starts resolving addr unless it's cached already.
+// It's called on accept, so the name is usually there by the time
+// the connection does something worth logging.
+func (r *reverseDNS) warm(addr net.Addr) {
+	if r != nil {
+		r.lookup(hostOf(addr.String()))
+	}
+}
+
+// name returns the cached host name of a remote address, or "" if it
+// isn't known (yet).
+func (r *reverseDNS) name(remote string) string {
+	if r == nil || remote == "" {
+		return ""
+	}
+	return r.lookup(hostOf(remote))
+}
+
+func (r *reverseDNS) lookup(ip string) string {
+	// Pipe and socket peers have no address to resolve.
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	e, ok := r.entries[ip]
+	if ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.name
+	}
+
+	// Keep serving a stale name while it's refreshed.
+	stale := ""
+	if ok {
+		stale = e.name
+	}
+
+	select {
+	case r.sem <- true:
+	default:
+		// Too many lookups in flight, try again next time.
+		r.mu.Unlock()
+		return stale
+	}
+
+	// Claim the entry until the lookup finishes, so it runs only once.
+	r.entries[ip] = &rdnsEntry{name: stale, expires: now.Add(r.timeout)}
+	r.mu.Unlock()
+
+	go func() {
+		defer func() { <-r.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+
+		name := ""
+		if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+
+		r.mu.Lock()
+		r.entries[ip] = &rdnsEntry{name: name, expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}()
+
+	return stale
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recoverProgress is how often a recovery reports how far it got.
+const recoverProgress = time.Second
+
+// LogSegment is a file of a log segment, see LogSegments.
+type LogSegment struct {
+	// Seg is the rotation number of the segment.
+	Seg int
+	// Part is the partition, -1 if the segment isn't partitioned.
+	Part int
+	Path string
+}
+
+// segmentFile matches log segments of base and their partitions,
+// compressed or not, e.g. data.3.log, data.3.p1.log and data.3.log.gz.
+func segmentFile(base string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(base) + `\.(\d+)(?:\.p(\d+))?\.log(?:\.gz)?$`)
+}
+
+// LogSegments returns the log segment files of stream base in dir,
+// data for the main stream, ordered by segment and then by partition.
+func LogSegments(dir, base string) ([]LogSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list log directory: %v", err)
+	}
+
+	re := segmentFile(base)
+	var segs []LogSegment
+	for _, e := range entries {
+		m := re.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		s := LogSegment{Path: filepath.Join(dir, e.Name()), Part: -1}
+		s.Seg, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			s.Part, _ = strconv.Atoi(m[2])
+		}
+		segs = append(segs, s)
+	}
+
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].Seg != segs[j].Seg {
+			return segs[i].Seg < segs[j].Seg
+		}
+		return segs[i].Part < segs[j].Part
+	})
+	return segs, nil
+}
+
+// recoverable returns the segments of a stream's earlier runs, when
+// Config.Recover is on, and the segment to carry on logging in. After
+// a Restart that's the one the old process handed over, with or
+// without Recover, it never writes to it.
+// With a Config.DedupWindow segments last written before the window
+// are left out, their values have expired.
+func (s *Server) recoverable(name string) (segs []LogSegment, next int, err error) {
+	handed, handedOver := handedOverSegment(streamBase(name))
+	if !s.cfg.Recover {
+		return nil, handed, nil
+	}
+	if segs, err = LogSegments(s.cfg.LogDir, streamBase(name)); err != nil {
+		return nil, 0, err
+	}
+	if len(segs) > 0 {
+		next = segs[len(segs)-1].Seg + 1
+	}
+	if handedOver && handed > next {
+		next = handed
+	}
+	if s.cfg.DedupWindow > 0 {
+		segs = writtenSince(segs, time.Now().Add(-s.cfg.DedupWindow))
+	}
+	return
+}
+
+// writtenSince returns the segments last modified at or after t.
+func writtenSince(segs []LogSegment, t time.Time) []LogSegment {
+	var recent []LogSegment
+	for _, seg := range segs {
+		if fi, err := os.Stat(seg.Path); err == nil && !fi.ModTime().Before(t) {
+			recent = append(recent, seg)
+		}
+	}
+	return recent
+}
+
+// streamBase is the name a stream's log segments start with.
+func streamBase(name string) string {
+	if name == "" {
+		return "data"
+	}
+	return name
+}
+
+// recovery is how far a stream got replaying its log, see
+// Config.RecoverBackground.
+type recovery struct {
+	// size is the bytes of the segments, read those replayed so far.
+	// Compressed segments count by what's decompressed, up to their size.
+	size int64
+	read atomic.Int64
+	// done is set once every value is in the set.
+	done atomic.Bool
+
+	mu sync.Mutex
+	// err is why the replay failed, the stream stays recovering.
+	err error
+}
+
+// newRecovery sizes up the replay of segs.
+func newRecovery(segs []LogSegment) *recovery {
+	r := &recovery{}
+	for _, seg := range segs {
+		if fi, err := os.Stat(seg.Path); err == nil {
+			r.size += fi.Size()
+		}
+	}
+	return r
+}
+
+// percent is how much of the log was replayed, 100 once it's done and
+// for a nil recovery, a stream with nothing to replay.
+func (r *recovery) percent() int {
+	if r == nil || r.done.Load() {
+		return 100
+	}
+	if r.size == 0 {
+		return 0
+	}
+	// Not done yet isn't 100, even if only the last line is left.
+	return min(int(r.read.Load()*100/r.size), 99)
+}
+
+// fail records why the replay stopped short.
+func (r *recovery) fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+}
+
+// failed returns why the replay stopped short, nil if it didn't.
+func (r *recovery) failed() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// recoverBackground replays segs into the unique set of c, which takes
+// values meanwhile, see Counter.recordRecovering. It gives up when the
+// server is released, and leaves c recovering if the replay fails.
+// Must be run on go routine.
+func (s *Server) recoverBackground(c *Counter, segs []LogSegment) {
+	defer s.recovering.Done()
+	err := s.recoverLog(s.ctx, c, segs, c.recovery)
+	switch {
+	case err == context.Canceled:
+	case err != nil:
+		c.recovery.fail(err)
+		s.log.Error("could not recover, new values are refused", "stream", streamBase(c.name), "err", err)
+	default:
+		c.recovery.done.Store(true)
+	}
+}
+
+// recoverLog adds the values logged in segs to the unique set of c,
+// counting what it read in r. Lines that aren't valid values, e.g. the
+// torn last line of a crash, are skipped and counted. It stops with
+// ctx's error once ctx is done.
+func (s *Server) recoverLog(ctx context.Context, c *Counter, segs []LogSegment, r *recovery) error {
+	base := streamBase(c.name)
+	s.log.Info("recovering", "stream", base, "files", len(segs), "kib", r.size>>10)
+
+	start := time.Now()
+	last := start
+	var values, skipped int
+	var done int64
+	for i, seg := range segs {
+		var size int64
+		if fi, err := os.Stat(seg.Path); err == nil {
+			size = fi.Size()
+		}
+		f, err := OpenLogReader(seg.Path, s.keys.current())
+		if err != nil {
+			return fmt.Errorf("could not recover %s: %v", base, err)
+		}
+
+		var read int64
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			read = min(read+int64(len(scanner.Bytes())+1), size)
+			r.read.Store(done + read)
+			num, err := strconv.Atoi(scanner.Text())
+			if err != nil || !c.profile.inRange(num) {
+				skipped++
+				continue
+			}
+			if err = c.replay(num); err != nil {
+				f.Close()
+				return fmt.Errorf("could not recover %s: %v", base, err)
+			}
+			values++
+
+			if values%4096 == 0 {
+				if err = ctx.Err(); err != nil {
+					f.Close()
+					return err
+				}
+				if time.Since(last) >= recoverProgress {
+					last = time.Now()
+					s.log.Info("recovering", "stream", base, "file", i+1, "files", len(segs), "values", values,
+						"percent", r.percent())
+				}
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("could not recover %s from %s: %v", base, seg.Path, err)
+		}
+		done += size
+		r.read.Store(done)
+	}
+
+	s.log.Info("recovered", "stream", base, "unique", c.Snapshot().Unique, "values", values,
+		"took", time.Since(start).Round(time.Millisecond))
+	if skipped > 0 {
+		s.log.Warn("skipped corrupt lines recovering", "stream", base, "skipped", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+)
+
+// backgroundConfig is testConfig recovering the main stream's earlier
+// segment of values in the background.
+func backgroundConfig(t *testing.T, values ...int) Config {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.Recover, cfg.RecoverBackground = true, true
+	var b strings.Builder
+	for _, v := range values {
+		fmt.Fprintf(&b, "%0*d\n", ValidLen, v)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.LogDir, "data.0.log"), []byte(b.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// waitRecovery waits until the main stream's recovery is over, done or
+// failed.
+func waitRecovery(t *testing.T, srv *Server) {
+	t.Helper()
+	r := srv.counter.recovery
+	for deadline := time.Now().Add(5 * time.Second); !r.done.Load() && r.failed() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("still recovering at %d%%", r.percent())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// refused sends value and checks it's refused as still recovering.
+func refused(t *testing.T, addr string, value int) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "%0*d\n", ValidLen, value)
+	if got, _ := io.ReadAll(c); string(got) != recoveringReply {
+		t.Errorf("%d got %q, want %q", value, got, recoveringReply)
+	}
+}
+
+func TestRecoverBackground(t *testing.T) {
+	cfg := backgroundConfig(t, 1234567890, 1234567891)
+	srv, addr := serveTest(t, cfg)
+	waitRecovery(t, srv)
+
+	if why := srv.notReady(); why != "" {
+		t.Errorf("not ready after recovering: %s", why)
+	}
+	if got := srv.Stats()[""].Recovered; got != 100 {
+		t.Errorf("Recovered = %d, want 100", got)
+	}
+	send(t, addr, "1234567891", "1234567892")
+	if uniq, total, _ := srv.Counts(); uniq != 3 || total != 2 {
+		t.Errorf("Counts() = %d unique, %d total, want 3 of 2", uniq, total)
+	}
+}
+
+func TestRecoverBackgroundRefuses(t *testing.T) {
+	// The recovery fails after the first value, the stream is left
+	// recovering halfway through.
+	failpoint.Enable(fpRecover, failpoint.Action{Err: errors.New("disk gone"), Count: 1})
+	t.Cleanup(func() { failpoint.Disable(fpRecover) })
+
+	cfg := backgroundConfig(t, 1234567890, 1234567891)
+	srv, addr := serveTest(t, cfg)
+	waitRecovery(t, srv)
+
+	if why := srv.notReady(); !strings.Contains(why, "disk gone") {
+		t.Errorf("notReady() = %q, want the recovery's error", why)
+	}
+	if got := srv.Stats()[""].Recovered; got != 50 {
+		t.Errorf("Recovered = %d, want 50", got)
+	}
+
+	// What's recovered is a duplicate, the rest may be in the log.
+	send(t, addr, "1234567890")
+	refused(t, addr, 1234567891)
+	refused(t, addr, 1234567892)
+	if uniq, total, _ := srv.Counts(); uniq != 1 || total != 1 {
+		t.Errorf("Counts() = %d unique, %d total, want 1 of 1", uniq, total)
+	}
+}
+
+func TestRecoverBackgroundNeedsRecover(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RecoverBackground = true
+	if _, err := New(cfg); err == nil {
+		t.Error("New took RecoverBackground without Recover")
+	}
+}
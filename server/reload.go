@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+)
+
+// reloadable are the Config fields Reload applies to a running server.
+var reloadable = map[string]bool{
+	"MaxConns":       true,
+	"OutputInterval": true,
+	"LogInterval":    true,
+	"LogDir":         true,
+	"AuditLog":       true,
+	"Listen":         true,
+	"TLSCert":        true,
+	"TLSKey":         true,
+	"TLSAddr":        true,
+	"QUICAddr":       true,
+	"MaxConnsPerIP":  true,
+	"RateLimit":      true,
+	"RateBurst":      true,
+}
+
+// Reload applies the settings of cfg that can change while the server
+// runs: the connection limits, the intervals, where the logs go, and
+// the Listen, TLS and QUIC listeners. Open connections are kept,
+// lowering MaxConns or MaxConnsPerIP below them only turns new ones
+// away until enough hung up. A new LogDir rotates every stream's log
+// into it, a new AuditLog carries the chain on in the new file;
+// turning the audit log on or off needs a restart. New listeners are
+// listened on before those they replace are closed, the connections
+// those accepted are served until they're over, see reloadListeners.
+//
+// Changes to any other field need a restart, their names are returned
+// in restart and otherwise ignored.
+func (s *Server) Reload(cfg Config) (restart []string, err error) {
+	cfg = cfg.withDefaults()
+	if s.closing() {
+		return nil, ErrServerClosed
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old := s.config()
+
+	if cfg.MaxConns < 1 {
+		return nil, fmt.Errorf("invalid connection limit %d, must be at least 1", cfg.MaxConns)
+	}
+	if cfg.MaxConnsPerIP < 0 || cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		return nil, fmt.Errorf("per IP limits can't be negative")
+	}
+	if err = checkTLS(cfg); err != nil {
+		return nil, err
+	}
+
+	v, ov := reflect.ValueOf(cfg), reflect.ValueOf(old)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		switch name {
+		case "BaseContext", "Output", "ErrorLog", "Logger", "ErrorHandler", "Handler", "Middleware", "NewStore", "ValueValidator":
+			continue
+		}
+		if !reloadable[name] && !reflect.DeepEqual(v.Field(i).Interface(), ov.Field(i).Interface()) {
+			restart = append(restart, name)
+		}
+	}
+	if (cfg.AuditLog == "") != (old.AuditLog == "") {
+		restart = append(restart, "AuditLog")
+		cfg.AuditLog = old.AuditLog
+	}
+
+	if err = s.reloadListeners(old, cfg); err != nil {
+		return nil, err
+	}
+	s.limits.set(cfg.MaxConnsPerIP, cfg.RateLimit, cfg.RateBurst)
+
+	if cfg.LogDir != old.LogDir {
+		if err = os.MkdirAll(cfg.LogDir, 0777); err != nil {
+			return nil, fmt.Errorf("could not create log directory: %v", err)
+		}
+		for _, c := range s.counters() {
+			if err = c.relocate(logFormat(cfg.LogDir, c.name)); err != nil {
+				return nil, fmt.Errorf("could not move log to %s: %v", cfg.LogDir, err)
+			}
+		}
+	}
+	if cfg.AuditLog != old.AuditLog {
+		if err = s.audit.move(cfg.AuditLog); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range s.counters() {
+		c.sem.resize(cfg.MaxConns)
+		c.setIntervals(cfg.OutputInterval, cfg.LogInterval)
+	}
+
+	s.mu.Lock()
+	s.cfg.MaxConns = cfg.MaxConns
+	s.cfg.OutputInterval, s.cfg.LogInterval = cfg.OutputInterval, cfg.LogInterval
+	s.cfg.LogDir, s.cfg.AuditLog = cfg.LogDir, cfg.AuditLog
+	s.cfg.Listen = cfg.Listen
+	s.cfg.TLSCert, s.cfg.TLSKey, s.cfg.TLSAddr, s.cfg.QUICAddr = cfg.TLSCert, cfg.TLSKey, cfg.TLSAddr, cfg.QUICAddr
+	s.cfg.MaxConnsPerIP, s.cfg.RateLimit, s.cfg.RateBurst = cfg.MaxConnsPerIP, cfg.RateLimit, cfg.RateBurst
+	s.mu.Unlock()
+	return restart, nil
+}
+
+// reloadListeners brings the Listen, TLS and QUIC listeners in line
+// with cfg, from those of old. The new ones are listened on first, if
+// one can't be nothing changes. Then a new key pair is loaded, it's
+// used for the handshakes from then on, and the listeners replaced or
+// gone are closed: their connections are kept, those of a QUIC
+// listener until their streams are over. Before the server started,
+// it's left to start the listeners of cfg.
+func (s *Server) reloadListeners(old, cfg Config) error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+
+	type listener struct {
+		key, what string
+		l         net.Listener
+	}
+	var add []listener
+	var drop []string
+	fail := func(err error) error {
+		for _, a := range add {
+			a.l.Close()
+		}
+		return err
+	}
+	if started {
+		for _, spec := range cfg.Listen {
+			if slices.Contains(old.Listen, spec) {
+				continue
+			}
+			l, err := s.listen(spec)
+			if err != nil {
+				return fail(fmt.Errorf("could not listen on %s: %v", spec, err))
+			}
+			add = append(add, listener{boundListen + spec, "", l})
+		}
+		for _, spec := range old.Listen {
+			if !slices.Contains(cfg.Listen, spec) {
+				drop = append(drop, boundListen+spec)
+			}
+		}
+
+		switch {
+		case cfg.TLSCert != "" && (old.TLSCert == "" || cfg.TLSAddr != old.TLSAddr):
+			l, err := s.listenTLS(cfg.TLSAddr)
+			if err != nil {
+				return fail(fmt.Errorf("could not listen for TLS: %v", err))
+			}
+			add = append(add, listener{boundTLS, "TLS", l})
+		case cfg.TLSCert == "" && old.TLSCert != "":
+			drop = append(drop, boundTLS)
+		}
+
+		switch {
+		case cfg.QUICAddr != "" && cfg.QUICAddr != old.QUICAddr:
+			l, err := s.listenQUIC(cfg.QUICAddr)
+			if err != nil {
+				return fail(fmt.Errorf("could not listen for QUIC: %v", err))
+			}
+			add = append(add, listener{boundQUIC, "QUIC", l})
+		case cfg.QUICAddr == "" && old.QUICAddr != "":
+			drop = append(drop, boundQUIC)
+		}
+	}
+
+	if cfg.TLSCert != old.TLSCert || cfg.TLSKey != old.TLSKey {
+		if err := s.certs.use(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return fail(err)
+		}
+	}
+	for i, a := range add {
+		if err := s.bind(a.key, a.l, a.what); err != nil {
+			add = add[i+1:]
+			return fail(err)
+		}
+	}
+	for _, key := range drop {
+		s.unbind(key)
+	}
+	return nil
+}
+
+// config returns the server's current Config, Reload changes it.
+func (s *Server) config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback TCP address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// ping sends a value and a PING on conn and waits for the PONG.
+func ping(t *testing.T, conn net.Conn, r *bufio.Reader, value int) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%0*d\n%s\n", ValidLen, value, pingCmd)
+	if reply, err := r.ReadString('\n'); err != nil || reply != pongReply {
+		t.Fatalf("reply %q, %v, want PONG", reply, err)
+	}
+}
+
+func TestReloadListeners(t *testing.T) {
+	cfg := testConfig(t)
+	first := freeAddr(t)
+	cfg.Listen = []string{first}
+	srv, addr := serveTest(t, cfg)
+	// Once the main listener answers, the others are up.
+	send(t, addr)
+
+	conn, err := net.Dial("tcp", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ping(t, conn, r, MinValue)
+
+	// Move the listener, and turn TLS and a per IP limit on.
+	second := freeAddr(t)
+	cfg.Listen = []string{second}
+	var clientConf *tls.Config
+	cfg.TLSCert, cfg.TLSKey, clientConf = writeTestCert(t)
+	cfg.TLSAddr = freeAddr(t)
+	cfg.MaxConnsPerIP = 2
+	// BaseContext isn't a setting, one the server didn't start with
+	// needs no restart.
+	cfg.BaseContext = context.Background()
+	restart, err := srv.Reload(cfg)
+	if err != nil || len(restart) != 0 {
+		t.Fatalf("Reload = %v, %v, want nothing to restart", restart, err)
+	}
+
+	// The connection of the old listener is kept.
+	ping(t, conn, r, MinValue+1)
+	if c, err := net.Dial("tcp", first); err == nil {
+		c.Close()
+		t.Error("the old listener still accepts")
+	}
+	tc, err := tls.Dial("tcp", cfg.TLSAddr, clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	ping(t, tc, bufio.NewReader(tc), MinValue+2)
+
+	// It counts against the new limit with the TLS one.
+	c, err := net.Dial("tcp", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := io.ReadAll(c); string(got) != rateLimitedReply {
+		t.Errorf("third connection got %q, want %q", got, rateLimitedReply)
+	}
+
+	if uniq, total, _ := srv.Counts(); uniq != 3 || total != 3 {
+		t.Errorf("Counts() = %d unique, %d total, want 3 of 3", uniq, total)
+	}
+	if got := srv.config(); !reflect.DeepEqual(got.Listen, cfg.Listen) || got.MaxConnsPerIP != 2 {
+		t.Errorf("config after Reload has Listen %q and MaxConnsPerIP %d", got.Listen, got.MaxConnsPerIP)
+	}
+}
+
+func TestReloadListenerFails(t *testing.T) {
+	cfg := testConfig(t)
+	srv, addr := serveTest(t, cfg)
+	send(t, addr)
+
+	// The main listener has the address, the reload changes nothing.
+	cfg.Listen = []string{freeAddr(t), addr}
+	if _, err := srv.Reload(cfg); err == nil {
+		t.Fatal("Reload onto a taken address succeeded")
+	}
+	if got := srv.config().Listen; len(got) != 0 {
+		t.Errorf("Listen is %q after the failed Reload", got)
+	}
+	if c, err := net.Dial("tcp", cfg.Listen[0]); err == nil {
+		c.Close()
+		t.Error("listening on an address of the failed Reload")
+	}
+}
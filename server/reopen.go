@@ -0,0 +1,40 @@
+package server
+
+import "fmt"
+
+// Reopen reopens the unique logs and the audit log, so they can be
+// rotated by an external logrotate: move the files away, then call
+// Reopen (the command does on SIGHUP) and the server starts new ones
+// in place. It also reloads the TLS key pair.
+// It carries on past a failure, returning the first one.
+func (s *Server) Reopen() (err error) {
+	keep := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// Pick up a rotated log encryption key first,
+	// so the reopened segment is already sealed with it.
+	if e := s.loadLogKeys(); e != nil {
+		keep(fmt.Errorf("could not reload log keys: %v", e))
+	}
+	if e := s.counter.Reopen(); e != nil {
+		keep(fmt.Errorf("could not reopen log: %v", e))
+	}
+	for _, st := range s.streams {
+		if e := st.counter.Reopen(); e != nil {
+			keep(fmt.Errorf("could not reopen log of stream %s: %v", st.name, e))
+		}
+	}
+	if e := s.certs.load(); e != nil {
+		keep(e)
+	}
+	if e := s.audit.Reopen(); e != nil {
+		keep(fmt.Errorf("could not reopen audit log: %v", e))
+	}
+	if e := s.usage.Reopen(); e != nil {
+		keep(fmt.Errorf("could not reopen usage file: %v", e))
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// handoverEnv names the process that handed its sockets over to a new
+// one with Restart, which takes them like socket activation.
+const handoverEnv = "SIMPLE_TCP_SERVER_HANDOVER_PID"
+
+// handoverSegsEnv tells the new process of a Restart the segment each
+// stream carries on logging in, e.g. "data=4,orders=2", see
+// handedOverSegment.
+const handoverSegsEnv = "SIMPLE_TCP_SERVER_HANDOVER_SEGMENTS"
+
+// handedOverSegment returns the segment a Restart handed the log of
+// stream base over at, and whether it did.
+func handedOverSegment(base string) (next int, ok bool) {
+	for _, kv := range strings.Split(os.Getenv(handoverSegsEnv), ",") {
+		name, seg, found := strings.Cut(kv, "=")
+		if !found || name != base {
+			continue
+		}
+		if next, err := strconv.Atoi(seg); err == nil && next >= 0 {
+			return next, true
+		}
+	}
+	return 0, false
+}
+
+// inheritable is a listener Restart hands over, of the main stream or
+// a named one.
+type inheritable struct {
+	stream string
+	l      net.Listener
+}
+
+// handOver adds a listener of stream for Restart to hand over.
+func (s *Server) handOver(stream string, l net.Listener) {
+	s.mu.Lock()
+	s.inheritable = append(s.inheritable, inheritable{stream: stream, l: l})
+	s.mu.Unlock()
+}
+
+// handoverFiles dups the sockets of the listeners to hand over,
+// with their stream as FileDescriptorName.
+func (s *Server) handoverFiles() (files []*os.File, names []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, in := range s.inheritable {
+		l := in.l
+		if p, ok := l.(*proxyListener); ok {
+			l = p.Listener
+		}
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("could not get the socket of %s: %v", in.l.Addr(), err)
+		}
+		// The new process serves on the socket file from now on.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		files = append(files, f)
+		names = append(names, in.stream)
+	}
+	return files, names, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Restart hands the listening sockets of the main stream and the
+// streams' ports over to a new process and shuts down like Shutdown.
+// The server stops accepting, starts cmd with the sockets from fd 3 on,
+// which it serves with Config.SocketActivation, and then drains its own
+// connections. The other listeners are closed before cmd starts, so it
+// can listen on them itself.
+//
+// The new process must carry on with the unique set, so it needs
+// Config.Recover or a redis, postgres or dynamodb dedup. The pebble dedup
+// and a bitset in files can't be handed over, they're locked until the
+// old process has closed them. Before it starts the logs are
+// flushed and closed and their intervals stopped, and the new process
+// is told the segment each stream carries on in, so only one process
+// ever writes a segment. From then on draining connections' values
+// are refused and the clients hung up on, gRPC calls fail with
+// UNAVAILABLE: the values are sent again to the new process and logged
+// by it. Until Restart has stopped accepting its errors leave the
+// server running, after that they're returned once it's shut down.
+func (s *Server) Restart(ctx context.Context, cmd *exec.Cmd) error {
+	if s.cfg.Dedup == "pebble" {
+		return fmt.Errorf("the pebble databases stay locked until this process exits, restarting can't hand them over")
+	}
+	if s.cfg.BitSetDir != "" {
+		return fmt.Errorf("the bitset files stay locked until this process exits, restarting can't hand them over")
+	}
+	if !s.cfg.Recover && s.cfg.Dedup != "redis" && s.cfg.Dedup != "postgres" && s.cfg.Dedup != "dynamodb" {
+		return fmt.Errorf("the new process would start over, restarting needs recovery or a redis, postgres or dynamodb dedup")
+	}
+	files, names, err := s.handoverFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	if len(files) == 0 {
+		return fmt.Errorf("no listener to hand over")
+	}
+
+	if !s.stopAccepting() {
+		return ErrServerClosed
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+	s.mu.Lock()
+	running := s.started
+	s.mu.Unlock()
+	var segs []string
+	for _, c := range s.counters() {
+		next, err := c.handOver(running)
+		if err != nil {
+			c.logFailed(err)
+		}
+		segs = append(segs, streamBase(c.name)+"="+strconv.Itoa(next))
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = nil
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, handoverEnv+"=") && !strings.HasPrefix(kv, handoverSegsEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		handoverEnv+"="+strconv.Itoa(os.Getpid()),
+		handoverSegsEnv+"="+strings.Join(segs, ","))
+	cmd.ExtraFiles = files
+
+	startErr := cmd.Start()
+	if startErr != nil {
+		s.log.Error("could not start the new process, shutting down", "err", startErr)
+	} else {
+		s.log.Info("handed over listeners", "pid", cmd.Process.Pid, "listeners", len(files))
+	}
+
+	err = s.drain(ctx)
+	if startErr != nil {
+		return fmt.Errorf("could not start the new process: %v", startErr)
+	}
+	return err
+}
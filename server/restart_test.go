@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandOver(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCounter(1, filepath.Join(dir, "data.%d.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Record(MinValue); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := c.handOver(false)
+	if err != nil || next != 1 {
+		t.Fatalf("handOver = %d, %v, want 1, nil", next, err)
+	}
+	if _, err := c.Record(MinValue + 1); err != errHandedOver {
+		t.Errorf("Record after the handover = %v, want %v", err, errHandedOver)
+	}
+	if c.HasValue(MinValue + 1) {
+		t.Error("value refused after the handover left in the unique set")
+	}
+	if _, total, _ := c.Counts(); total != 1 {
+		t.Errorf("%d values counted, want the 1 before the handover", total)
+	}
+
+	logged, err := os.ReadFile(filepath.Join(dir, "data.0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintln(MinValue); string(logged) != want {
+		t.Errorf("log is %q, want %q", logged, want)
+	}
+}
+
+func TestRecoverableHandedOver(t *testing.T) {
+	t.Setenv(handoverSegsEnv, "data=3,orders=7")
+
+	for _, recover := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.Recover = recover
+		s := &Server{cfg: cfg}
+		if _, next, err := s.recoverable(""); err != nil || next != 3 {
+			t.Errorf("Recover %v: main stream carries on in %d, %v, want 3", recover, next, err)
+		}
+		if _, next, err := s.recoverable("orders"); err != nil || next != 7 {
+			t.Errorf("Recover %v: orders carries on in %d, %v, want 7", recover, next, err)
+		}
+		if _, next, err := s.recoverable("other"); err != nil || next != 0 {
+			t.Errorf("Recover %v: stream not handed over carries on in %d, %v, want 0", recover, next, err)
+		}
+	}
+}
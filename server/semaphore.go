@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// semaphore limits the connections served at once.
+// Unlike a buffered channel its limit can change while slots are held,
+// lowering it below the slots in use turns new connections away until
+// enough of the open ones hung up, it never drops any.
+//
+// Connections can wait for a slot, see acquire, they get freed slots
+// in the order they started waiting.
+type semaphore struct {
+	mu   sync.Mutex
+	used int
+	max  int
+	// waiters are closed when they're handed a slot, oldest first.
+	waiters []chan struct{}
+}
+
+func newSemaphore(max int) *semaphore {
+	return &semaphore{max: max}
+}
+
+// tryAcquire takes a slot, it reports false if none is free.
+func (s *semaphore) tryAcquire() bool {
+	return s.acquire(context.Background(), 0, 0)
+}
+
+// acquire takes a slot, waiting up to wait for one with fewer than
+// queue others waiting already. It reports false if it didn't get one.
+func (s *semaphore) acquire(ctx context.Context, wait time.Duration, queue int) bool {
+	s.mu.Lock()
+	// Waiting connections go first.
+	if s.used < s.max && len(s.waiters) == 0 {
+		s.used++
+		s.mu.Unlock()
+		return true
+	}
+	if wait <= 0 || len(s.waiters) >= queue {
+		s.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == ch {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return false
+		}
+	}
+	// Handed a slot while giving up, it's ours.
+	return true
+}
+
+// release frees a slot taken with acquire,
+// handing it to the oldest waiter if there are any.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.used--
+	s.wake()
+	s.mu.Unlock()
+}
+
+// wake hands the free slots to waiters, s.mu must be held.
+func (s *semaphore) wake() {
+	for s.used < s.max && len(s.waiters) > 0 {
+		s.used++
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
+
+// resize changes the number of slots.
+func (s *semaphore) resize(max int) {
+	s.mu.Lock()
+	s.max = max
+	s.wake()
+	s.mu.Unlock()
+}
+
+// inUse returns the slots taken and the limit.
+func (s *semaphore) inUse() (used, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used, s.max
+}
+
+// waiting returns how many connections wait for a slot.
+func (s *semaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
@@ -0,0 +1,1973 @@
+// Package server is the unique number server: it accepts connections,
+// validates the values they send, counts and deduplicates them, and
+// writes every unique value to a rotating log.
+//
+// The command in the repository root is a thin CLI around it,
+// embedding the server in another program looks the same:
+//
+//	srv, err := server.New(server.Config{Addr: ":3280"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	go srv.ListenAndServe()
+//	...
+//	srv.Shutdown(ctx)
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/failpoint"
+)
+
+const (
+	// DefaultPort is the port the server listens on unless Config.Addr says otherwise.
+	DefaultPort = 3280
+	// DefaultMaxConns is the connection limit unless Config.MaxConns says otherwise.
+	DefaultMaxConns = 6
+	// DefaultBusyQueue is how many connections wait for a slot at once
+	// with a Config.BusyWait, unless Config.BusyQueue says otherwise.
+	DefaultBusyQueue = 64
+	// ValidLen is the number of digits of a valid value.
+	ValidLen = 10
+	// MinValue is the smallest valid value.
+	MinValue = 1000000
+	// DefaultOutputInterval is how often the counters are reported
+	// unless Config.OutputInterval says otherwise.
+	DefaultOutputInterval = 5 * time.Second
+	// DefaultLogInterval is how often the log is rotated
+	// unless Config.LogInterval says otherwise.
+	DefaultLogInterval = 10 * time.Second
+	// DefaultLogBuffer is how many bytes of values a log file buffers
+	// unless Config.LogBuffer says otherwise.
+	DefaultLogBuffer = 64 << 10
+	// DefaultLogFlush is how often the log buffers are written out
+	// unless Config.LogFlush says otherwise.
+	DefaultLogFlush = time.Second
+	// DefaultLogSyncInterval is how often the log is fsynced with
+	// Config.LogSync interval, unless Config.LogSyncInterval says otherwise.
+	DefaultLogSyncInterval = 100 * time.Millisecond
+)
+
+// MaxValue is the largest number that fits in ValidLen digits.
+var MaxValue = int(math.Pow10(ValidLen)) - 1
+
+// Failpoints compiled into the server, see internal/failpoint.
+const (
+	// fpAccept fails the accept call itself.
+	fpAccept = "accept"
+	// fpBusy treats the connection as over the limit regardless of free slots.
+	fpBusy = "accept.busy"
+	// fpRecord fails recording a unique value.
+	fpRecord = "counter.record"
+	// fpFlush stalls or fails flushing the log to disk.
+	fpFlush = "log.flush"
+	// fpLogWrite fails writing a unique value to the log.
+	fpLogWrite = "log.write"
+	// fpRecover stalls or fails recovering a value after adding it to the set.
+	fpRecover = "log.recover"
+	// fpRead stalls or fails every read of a client connection.
+	fpRead = "conn.read"
+	// fpDrop hangs up on a client halfway through what it sent.
+	fpDrop = "conn.drop"
+)
+
+// hangupWait is how long Shutdown waits for the handlers of the
+// connections it hung up on after the grace period.
+const hangupWait = time.Second
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// Config is everything a Server is set up with.
+// The zero value is a plain server on DefaultPort logging to ./logs,
+// every feature is off until its field is set.
+//
+// The diagnostic dump lists the fields, secrets are tagged diag:"secret"
+// to be redacted from it, and what isn't configuration diag:"-".
+type Config struct {
+	// Addr is the TCP address to listen on, ":3280" if empty.
+	Addr string
+	// MaxConns is how many connections are served at once,
+	// connections over the limit are turned away. DefaultMaxConns if 0.
+	MaxConns int
+	// BusyWait is how long connections over MaxConns wait for a free
+	// slot before they're turned away, up to BusyQueue of them at once,
+	// DefaultBusyQueue if 0. 0 turns them away right away.
+	BusyWait  time.Duration
+	BusyQueue int
+	// ValueLen, MinValue, MaxValue and LeadingZeros are the validation
+	// of the main stream, and the default of named ones: values are
+	// exactly ValueLen digits, at least MinValue and at most MaxValue,
+	// the largest of ValueLen digits if 0. ValidLen and MinValue if
+	// ValueLen is 0. LeadingZeros is what values starting with 0 are:
+	// valid if they're at least MinValue if empty, valid whatever their
+	// number with accept, e.g. 000123456 as the classic spec has it,
+	// or malformed with reject.
+	ValueLen     int
+	MinValue     int
+	MaxValue     int
+	LeadingZeros string
+	// ValueValidator, if set, decides what values are valid instead,
+	// for every stream. Binary values and JSON numbers are still
+	// checked against the range above.
+	ValueValidator ValueValidator `diag:"-"`
+	// Dedup is how each stream keeps its set of unique values: map (the
+	// default) grows with the values seen, bitset takes a bit for every
+	// valid value up front, about 1.25 GB for the default 10 digits and
+	// 125 MB for 9, and dedups lock free, redis keeps them in a Redis set
+	// at RedisAddr shared by every server using it, and across restarts,
+	// postgres likewise in a table of the database at PostgresURL, pebble
+	// in a Pebble database on local disk under PebbleDir, kept across
+	// restarts and not held in memory, dynamodb in the DynamoDB table
+	// DynamoTable, shared like redis.
+	Dedup string
+	// DedupShards splits the set of the map dedup into shards by value,
+	// each with its own lock, so connections recording new values don't
+	// all wait on the Counter's. GOMAXPROCS if 0, 1 keeps a single map
+	// under the Counter's lock, Counter.Uniq.
+	DedupShards int
+	// DedupAffine has a worker of its own do the lookups of each shard of
+	// the map dedup, locked to an OS thread, and on linux that thread to
+	// a CPU, so the shard's map stays in that core's cache. It pays off
+	// with about as many busy connections as cores on big hosts, see
+	// BenchmarkRecordUniqAffineParallel, and costs a thread per shard.
+	DedupAffine bool
+	// DedupWindow only keeps values unique for this long with the map
+	// dedup, e.g. 24h for daily IDs: after that they expire from the
+	// set, somewhere within a 24th of the window more, and are logged
+	// again when they're sent again. The unique counts are of the
+	// values within the window. 0 keeps them unique forever.
+	DedupWindow time.Duration
+	// TopDuplicates counts how often each duplicate value is resubmitted,
+	// to find producers that keep resending the same ones, and reports
+	// this many most resubmitted of every stream in the interval
+	// output and the admin TOPDUPS. The counts of values resubmitted
+	// rarely are approximate, memory stays flat. 0 turns it off.
+	TopDuplicates int
+	// RedisAddr is the host:port of the Redis server, RedisDB the database
+	// and RedisKey the prefix of the stream's keys, "go-simple-tcp-server"
+	// if empty.
+	RedisAddr     string
+	RedisPassword string `diag:"secret"`
+	RedisDB       int
+	RedisKey      string
+	// RedisShards are more Redis servers to split the sets across, for
+	// value spaces too large for one: each value is kept on RedisAddr
+	// or one of them, picked by RedisShardBy. hash, the default, spreads
+	// the values evenly, range gives each server a slice of the valid
+	// values in turn. Every server sharing the sets must list the same
+	// ones in the same order, and the list can't change without
+	// losing track of the values kept.
+	RedisShards  []string
+	RedisShardBy string
+	// PostgresURL is the postgres:// URL of the database of the postgres
+	// dedup, e.g. postgres://numbers@db:5432/numbers?sslmode=require,
+	// PostgresPassword its password if the URL has none. PostgresTable
+	// is the table the values are kept in, created if it doesn't exist,
+	// "go_simple_tcp_server" if empty.
+	PostgresURL      string `diag:"secret"`
+	PostgresPassword string `diag:"secret"`
+	PostgresTable    string
+	// MemcachedAddrs are memcached servers (host:port) caching the
+	// values known to be in the sets of the redis or postgres dedup, so
+	// duplicates found there cost no round trip to the database. Only
+	// values in the set are cached, for MemcachedTTL, 1h if 0, under
+	// MemcachedKey, "go-simple-tcp-server" if empty, followed by the
+	// stream and the value. The values are spread across the servers
+	// by their hash, and a server that fails is taken for a miss.
+	// Off if empty.
+	MemcachedAddrs []string
+	MemcachedTTL   time.Duration
+	MemcachedKey   string
+	// BitSetDir, if set, keeps the bitset dedup of each stream in a file
+	// there named after its log, e.g. data.bits, mapped into memory, so
+	// it's kept across restarts. BitSetSync is how often it's written
+	// back to disk, 0 leaves that to the OS, and it's always written on
+	// shutdown. A process crash loses nothing, a power failure the
+	// values set since the last write back, see mappedBitSet.
+	BitSetDir  string
+	BitSetSync time.Duration
+	// PebbleDir is where the pebble dedup keeps a database for each
+	// stream, named after its log, <LogDir>/pebble if empty.
+	PebbleDir string
+	// DynamoTable is the DynamoDB table of the dynamodb dedup, with the
+	// string partition key stream and the number sort key value, in
+	// DynamoRegion, or the region of the AWS configuration if empty.
+	// The credentials are the AWS SDK's default ones: the environment,
+	// the shared files or the instance's role. DynamoEndpoint, if set,
+	// is the URL of the DynamoDB API instead of AWS's, e.g. of DynamoDB
+	// Local. DynamoCache is how many values known to be in the table
+	// are kept locally, so resending them costs no call, 65536 if 0,
+	// none if negative.
+	DynamoTable    string
+	DynamoRegion   string
+	DynamoEndpoint string
+	DynamoCache    int
+	// NewStore, if set, opens the Store of each stream instead of Dedup,
+	// stream is "" for the main one. A BatchStore takes the values of a
+	// batch line in one AddBatch.
+	NewStore func(stream string) (Store, error) `diag:"-"`
+	// Peers are the PeerAddr of the other servers of a cluster, e.g.
+	// two behind a load balancer: every value logged here is sent to
+	// each of them, and added to the set of its stream there, so it's a
+	// duplicate there too. On every connection the log is replayed, so
+	// a peer that was down or fell behind catches up, as far as the
+	// segments still in LogDir go. A value sent to two servers at the
+	// same time can still be logged by both. AuthToken, if set, must
+	// be the same on every server.
+	Peers []string
+	// PeerAddr receives the values the peers log on this address,
+	// host:port. Off if empty.
+	PeerAddr string
+	// PeerQueue is how many values wait to be sent to a peer, one
+	// that falls further behind is reconnected to, 65536 if 0.
+	PeerQueue int
+	// LogDir is where log segments and diagnostic dumps are written, "logs" if empty.
+	LogDir string
+	// OutputInterval is how often the counters are reported, DefaultOutputInterval if 0.
+	OutputInterval time.Duration
+	// LogInterval is how often the log is rotated, DefaultLogInterval if 0.
+	LogInterval time.Duration
+	// Output receives the counter reports, os.Stdout if nil.
+	Output io.Writer `diag:"-"`
+	// ErrorLog is where the default Logger writes, os.Stderr if nil.
+	ErrorLog io.Writer `diag:"-"`
+	// Logger receives status messages and operational errors, a text
+	// logger on ErrorLog if nil. Messages about a connection carry its
+	// remote address, and every connection is logged at debug level when
+	// it's closed, with how long it was open and what it sent.
+	Logger *slog.Logger `diag:"-"`
+	// ErrorHandler is called with every error that costs a connection or
+	// a value, instead of it being written to ErrorLog, so embedders can
+	// set their own policy, e.g. retry the log write or alert. It's called
+	// on the goroutine that hit the error, see OpError.
+	ErrorHandler func(*OpError) `diag:"-"`
+	// Handler handles the lines clients send, DefaultHandler if nil.
+	Handler Handler `diag:"-"`
+	// Middleware wraps the serving of every connection, the first one
+	// outermost, inside the connection limits and deadlines.
+	Middleware []Middleware `diag:"-"`
+
+	// Name is announced in the connection greeting, "go-simple-tcp-server" if empty.
+	Name string
+	// NoGreeting skips the greeting, for throughput sensitive producers.
+	NoGreeting bool
+	// AuthToken is the shared secret clients must send as their first line,
+	// AUTH <token>, before the server takes anything else from them.
+	AuthToken string `diag:"secret"`
+	// IdleTimeout closes connections that send nothing for this long,
+	// ReadTimeout ones that take longer than this to send a whole line.
+	// Both free up the connection's slot, 0 turns them off.
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+	// ErrorReplies answers every invalid value with an error reply,
+	// ERR 001 malformed, ERR 002 out-of-range or ERR 007 rejected, see
+	// the README for every code, before hanging up. Without it the
+	// client is hung up on without one.
+	ErrorReplies bool
+	// Quiet hangs up on clients that send invalid input without a word,
+	// as the classic spec has it: an invalid value, a line too long or
+	// a batch too large, even with SkipInvalid or in a batch or json
+	// session.
+	Quiet bool
+	// SkipInvalid counts invalid lines and carries on with the
+	// connection. Without it a connection ends at its first invalid
+	// line, except the values of a batch and a json session's requests,
+	// which are answered their own way.
+	SkipInvalid bool
+	// StrictLines takes lines byte for byte, only the newline ends them:
+	// a trailing CR or space makes a value malformed. Without it they're
+	// taken off, as telnet and Windows clients send them.
+	StrictLines bool
+	// MaxBatch lets clients send up to this many comma separated values
+	// on one line, each validated and recorded like a line of its own,
+	// answered with a summary of how many were new, duplicates and
+	// malformed. 0 turns batches off, their lines are malformed.
+	MaxBatch int
+	// Terminate lets clients stop the server with the terminate command,
+	// for test harnesses, see Terminated. Without it the line is malformed.
+	Terminate bool
+
+	// Recover rebuilds the unique set from the log segments of earlier runs
+	// on startup, before taking any values, and logging carries on in a new
+	// segment after them. Without it data.0.log is started over.
+	Recover bool
+	// RecoverBackground starts listening right away and recovers in the
+	// background, with Recover. Meanwhile the values recovered already
+	// are answered as duplicates, and the others are refused and their
+	// clients hung up on, they may still turn up in the log. The stats
+	// have the progress, and the server isn't ready until it's done.
+	RecoverBackground bool
+	// LogBuffer is how many bytes of unique values each log file batches
+	// before writing them out, DefaultLogBuffer if 0. Encrypted logs
+	// always batch a whole frame.
+	LogBuffer int
+	// LogFlush is how often the batched values are written out all the same,
+	// DefaultLogFlush if 0. They're also written out on every report,
+	// rotation and shutdown.
+	LogFlush time.Duration
+	// LogSync is when the log is fsynced: none (the default) leaves it to
+	// the OS, interval syncs every LogSyncInterval, DefaultLogSyncInterval
+	// if 0, and always syncs every unique value before it's acknowledged.
+	// Segments are synced on rotation and shutdown with either of the two.
+	LogSync         string
+	LogSyncInterval time.Duration
+	// LogMaxSize rotates a segment early once this many bytes of values
+	// were written to it, 0 rotates by LogInterval only.
+	LogMaxSize int64
+	// LogCompress gzips rotated segments, data.3.log becomes data.3.log.gz.
+	LogCompress bool
+	// LogRetain keeps only the newest this many rotated segments,
+	// older ones are deleted. 0 keeps them all.
+	LogRetain int
+
+	// LogPartitions splits every log segment into this many files,
+	// each with its own writer goroutine.
+	LogPartitions int
+	// LogPartitionBy is how values are assigned to partitions: hash (the default) or range.
+	LogPartitionBy string
+	// LogQueue is how many values each partition buffers, 4096 if 0.
+	LogQueue int
+	// LogQueuePolicy is what happens when a partition's queue is full:
+	// block (the default) or drop.
+	LogQueuePolicy string
+	// LogKeyFile encrypts log segments with the newest key in this file,
+	// it's reread by Reopen.
+	LogKeyFile string
+
+	// AuditLog appends security relevant events to this hash chained file.
+	AuditLog string
+	// AuditMalformed is how many malformed lines on one connection count
+	// as a flood in the audit log, 100 if 0. Only connections that carry
+	// on past one, see SkipInvalid, get to a flood.
+	AuditMalformed int
+
+	// DailyQuota is how many values each stream takes in a UTC day, a
+	// stream's quota setting overrides it. Values over it are refused
+	// with quotaExceededReply and the client hung up on, HTTPIngest
+	// requests get a 429. 0 is no limit.
+	DailyQuota int
+	// UsageFile appends a usageRecord of every stream for every UTC day
+	// to this file, when the day ends and on shutdown. The quotas carry
+	// on from the day's records after a restart.
+	UsageFile string
+
+	// RDNS resolves remote addresses for the audit log, asynchronously.
+	RDNS bool
+	// RDNSTimeout is the timeout of a single lookup, 2s if 0.
+	RDNSTimeout time.Duration
+	// RDNSTTL is how long lookups are cached, 10m if 0.
+	RDNSTTL time.Duration
+
+	// GeoIP are MaxMind databases to break the stats down by origin.
+	GeoIP []string
+
+	// MQTTBroker is a broker address (host:port) to ingest values from.
+	MQTTBroker string
+	// MQTTTopics are the topic filters subscribed to, required with MQTTBroker.
+	MQTTTopics []string
+	// MQTTQoS is the subscription QoS, 0 or 1.
+	MQTTQoS int
+	// MQTTClientID is the MQTT client id, "go-simple-tcp-server" if empty.
+	MQTTClientID string
+	MQTTUser     string
+	MQTTPassword string `diag:"secret"`
+
+	// Capture records inbound traffic to this file.
+	Capture string
+
+	// TLSCert and TLSKey are the key pair to also serve over TLS with,
+	// on TLSAddr, ":3443" if empty. The files are reloaded when they
+	// change and on Reopen.
+	TLSCert string
+	TLSKey  string
+	TLSAddr string
+	// QUICAddr also serves QUIC on this UDP address with the TLS key
+	// pair, for the ALPN protocol "numbers". Every stream a client
+	// opens is served like a TCP connection, a lost packet only holds
+	// up its own stream. Off if empty.
+	QUICAddr string
+
+	// Listen are more addresses served like Addr, e.g. on a second
+	// interface: host:port for TCP or unix:<path> for a Unix socket.
+	Listen []string
+
+	// UDPAddr also receives values in UDP datagrams on this address,
+	// newline separated, nothing is sent back. Off if empty.
+	UDPAddr string
+
+	// GRPCAddr also serves the Numbers service of numbers.proto on this
+	// address, over HTTP/2 without TLS. Off if empty.
+	GRPCAddr string
+	// GRPCAckWindow is how many values a SubmitAcked call reads ahead
+	// of their acks, 1024 if 0.
+	GRPCAckWindow int
+
+	// Allow and Deny are CIDR ranges, or single IPs, checked on accept:
+	// Deny always wins, and with any Allow ranges only those get in.
+	// Turned away peers are hung up on without a word, and recorded in
+	// the audit log with LogDenied.
+	Allow     []string
+	Deny      []string
+	LogDenied bool
+	// Tarpit holds the connections Deny turns away open this long
+	// instead, trickling a busy reply a byte a second, to slow scanners
+	// down. They take no slot of the connection limits. At most
+	// TarpitMax are held at once, 256 if 0, the others are hung up on.
+	// Off if 0.
+	Tarpit    time.Duration
+	TarpitMax int
+
+	// MaxConnsPerIP limits the connections one remote IP has open at
+	// once, RateLimit the lines per second it sends over all of them,
+	// with bursts of up to RateBurst, one second's worth if 0.
+	// Clients over either get rateLimitedReply and are hung up on,
+	// HTTPIngest requests a 429. 0 turns a limit off.
+	MaxConnsPerIP int
+	RateLimit     float64
+	RateBurst     int
+
+	// Workers serves connections on a fixed pool of this many goroutines
+	// instead of one goroutine per connection, for high connection churn.
+	// Connections wait for a free worker in a queue of WorkerQueue,
+	// DefaultWorkerQueue if 0, and are turned away as busy with it full.
+	// 0 turns the pool off.
+	Workers     int
+	WorkerQueue int
+
+	// ProxyProtocol reads a HAProxy PROXY header, version 1 or 2, off
+	// every connection before anything else, so behind a load balancer
+	// the audit log, reverse DNS and GeoIP see the real client.
+	// Connections without one are closed. ProxyTrusted are the CIDR
+	// ranges, or single IPs, of the load balancers, connections from
+	// elsewhere are closed too. Any may send one if it's empty.
+	ProxyProtocol bool
+	ProxyTrusted  []string
+
+	// Unix also listens on this Unix domain socket, for co-located
+	// producers. With NoTCP ListenAndServe listens on it instead of Addr.
+	Unix  string
+	NoTCP bool
+
+	// Pipe also listens on this Windows named pipe.
+	Pipe string
+	// PipeSDDL is the security descriptor of the pipe, the default grants
+	// the creator and local system full access.
+	PipeSDDL string
+
+	// SocketActivation serves on the listening sockets systemd passes
+	// when the process is socket activated, see sd_listen_fds(3), or an
+	// old process hands over with Restart, instead
+	// of listening itself: sockets named after a stream serve it instead
+	// of its port, the others the main stream instead of Addr, or Unix
+	// with NoTCP, with ListenAndServe. Without them it listens as usual.
+	SocketActivation bool
+
+	// BusyPoll spins this long polling for connections and input before
+	// parking, linux only.
+	BusyPoll time.Duration
+
+	// Instrument starts with request instrumentation on, see SetInstrumented.
+	Instrument bool
+	// InstrumentSlow logs instrumented requests slower than this, 1ms if 0.
+	InstrumentSlow time.Duration
+
+	// TraceFile writes sampled request traces to this file as JSON lines.
+	TraceFile string
+	// TraceRate is the fraction of requests to trace (0-1),
+	// connections can also opt in with the trace capability.
+	TraceRate float64
+
+	// OTLPEndpoint exports OpenTelemetry traces of the connections to
+	// this URL as OTLP/HTTP JSON, e.g. http://localhost:4318/v1/traces,
+	// sending OTLPHeaders along. Every connection is a trace: its accept,
+	// then each of its first lines with the validation, dedup lookup and
+	// log write. OTLPSampleRatio is the fraction of connections traced
+	// (0-1), every one if 0, and OTLPService the service.name, Name if empty.
+	OTLPEndpoint    string
+	OTLPHeaders     map[string]string `diag:"secret"`
+	OTLPService     string
+	OTLPSampleRatio float64
+
+	// MaintenanceFile puts the server in maintenance mode while it exists.
+	MaintenanceFile string
+	// MaintenanceDrain is how long entering maintenance waits for
+	// open connections to finish, 30s if 0.
+	MaintenanceDrain time.Duration
+
+	// Streams are named value streams, see the README for the spec format.
+	Streams []string
+
+	// Validators and Sinks are the registered extensions to enable.
+	Validators []string
+	Sinks      []string
+	// Sidecar is the command of the process behind the sidecar extension.
+	Sidecar string
+	// KafkaBrokers are the bootstrap brokers (host:port) of the kafka
+	// sink, which produces every unique value to KafkaTopic, keyed by
+	// its stream.
+	KafkaBrokers []string
+	KafkaTopic   string
+	// NATSAddr is the server (host:port) of the nats sink, which
+	// publishes every unique value on NATSSubject followed by a dot and
+	// its stream, e.g. numbers.data.
+	NATSAddr     string
+	NATSSubject  string
+	NATSUser     string
+	NATSPassword string `diag:"secret"`
+	// PubSubProject and PubSubTopic are the Google Cloud Pub/Sub topic
+	// of the pubsub sink, which publishes every unique value to it with
+	// its stream as the ordering key. PubSubCredentials is the path of a
+	// service account key file, GOOGLE_APPLICATION_CREDENTIALS or the
+	// instance's service account if empty, PubSubEndpoint the API's URL,
+	// e.g. a regional one, the global one if empty.
+	PubSubProject     string
+	PubSubTopic       string
+	PubSubCredentials string
+	PubSubEndpoint    string
+	// AMQPURL is the amqp:// or amqps:// URL of the broker of the amqp
+	// sink, e.g. RabbitMQ, AMQPPassword its password if the URL has none.
+	// The sink publishes every unique value to AMQPExchange, the default
+	// exchange if empty, with the routing key AMQPRoutingKey, or the
+	// value's stream if empty, and waits for the broker's confirms.
+	AMQPURL        string `diag:"secret"`
+	AMQPPassword   string `diag:"secret"`
+	AMQPExchange   string
+	AMQPRoutingKey string
+	// SinkBatch is how many values the broker sinks send at once,
+	// 100 if 0, SinkLinger how long a value waits for a batch to fill,
+	// 100ms if 0, and SinkQueue how many wait while the broker can't be
+	// reached, 65536 if 0, more are dropped.
+	SinkBatch  int
+	SinkLinger time.Duration
+	SinkQueue  int
+
+	// BaseContext is the parent of the contexts connections are served
+	// with, so their ConnHandlers see its values. Once it's done the
+	// server shuts down as if Shutdown's grace period was over: it stops
+	// accepting, hangs up on the open connections and flushes the logs,
+	// see Server.Done. Never done if nil.
+	BaseContext context.Context `diag:"-"`
+
+	// MetricsAddr serves Prometheus metrics over HTTP on this address,
+	// at /metrics, with the liveness and readiness probes at /healthz
+	// and /readyz. Off if empty.
+	MetricsAddr string
+	// HTTPIngest also takes values at /numbers on MetricsAddr: POSTed
+	// one per line, with the stream parameter naming a named stream,
+	// and answered with a JSON result for every value.
+	HTTPIngest bool
+	// AdminAddr serves the admin protocol on this address, host:port
+	// for TCP or unix:<path> for a Unix socket. Anyone who connects can
+	// reconfigure and stop the server, so with AuthToken set they must
+	// authenticate first. Off if empty.
+	AdminAddr string
+}
+
+// withDefaults fills in the zero fields that have a default.
+func (cfg Config) withDefaults() Config {
+	if cfg.Addr == "" {
+		cfg.Addr = fmt.Sprintf(":%d", DefaultPort)
+	}
+	if cfg.MaxConns == 0 {
+		cfg.MaxConns = DefaultMaxConns
+	}
+	if cfg.Dedup == "" {
+		cfg.Dedup = "map"
+	}
+	if cfg.DedupShards == 0 {
+		cfg.DedupShards = runtime.GOMAXPROCS(0)
+	}
+	if cfg.RedisKey == "" {
+		cfg.RedisKey = "go-simple-tcp-server"
+	}
+	if cfg.RedisShardBy == "" {
+		cfg.RedisShardBy = "hash"
+	}
+	if cfg.PostgresTable == "" {
+		cfg.PostgresTable = "go_simple_tcp_server"
+	}
+	if cfg.MemcachedTTL == 0 {
+		cfg.MemcachedTTL = time.Hour
+	}
+	if cfg.MemcachedKey == "" {
+		cfg.MemcachedKey = "go-simple-tcp-server"
+	}
+	if cfg.PeerQueue == 0 {
+		cfg.PeerQueue = 65536
+	}
+	if cfg.BusyQueue == 0 {
+		cfg.BusyQueue = DefaultBusyQueue
+	}
+	if cfg.ValueLen == 0 {
+		cfg.ValueLen, cfg.MinValue = ValidLen, MinValue
+	}
+	if cfg.LogDir == "" {
+		cfg.LogDir = "logs"
+	}
+	if cfg.DynamoCache == 0 {
+		cfg.DynamoCache = 65536
+	}
+	if cfg.PebbleDir == "" {
+		cfg.PebbleDir = filepath.Join(cfg.LogDir, "pebble")
+	}
+	if cfg.OutputInterval == 0 {
+		cfg.OutputInterval = DefaultOutputInterval
+	}
+	if cfg.LogInterval == 0 {
+		cfg.LogInterval = DefaultLogInterval
+	}
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	if cfg.ErrorLog == nil {
+		cfg.ErrorLog = os.Stderr
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(cfg.ErrorLog, nil))
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = DefaultHandler
+	}
+	if cfg.Name == "" {
+		cfg.Name = "go-simple-tcp-server"
+	}
+	if cfg.LogQueue == 0 {
+		cfg.LogQueue = 4096
+	}
+	if cfg.LogBuffer == 0 {
+		cfg.LogBuffer = DefaultLogBuffer
+	}
+	if cfg.LogFlush == 0 {
+		cfg.LogFlush = DefaultLogFlush
+	}
+	if cfg.LogSync == "" {
+		cfg.LogSync = "none"
+	}
+	if cfg.LogSyncInterval == 0 {
+		cfg.LogSyncInterval = DefaultLogSyncInterval
+	}
+	if cfg.AuditMalformed == 0 {
+		cfg.AuditMalformed = 100
+	}
+	if cfg.TarpitMax == 0 {
+		cfg.TarpitMax = 256
+	}
+	if cfg.RDNSTimeout == 0 {
+		cfg.RDNSTimeout = 2 * time.Second
+	}
+	if cfg.RDNSTTL == 0 {
+		cfg.RDNSTTL = 10 * time.Minute
+	}
+	if cfg.TLSAddr == "" {
+		cfg.TLSAddr = fmt.Sprintf(":%d", DefaultTLSPort)
+	}
+	if cfg.MQTTClientID == "" {
+		cfg.MQTTClientID = "go-simple-tcp-server"
+	}
+	if cfg.SinkBatch == 0 {
+		cfg.SinkBatch = 100
+	}
+	if cfg.SinkLinger == 0 {
+		cfg.SinkLinger = 100 * time.Millisecond
+	}
+	if cfg.SinkQueue == 0 {
+		cfg.SinkQueue = 65536
+	}
+	if cfg.GRPCAckWindow == 0 {
+		cfg.GRPCAckWindow = 1024
+	}
+	if cfg.InstrumentSlow == 0 {
+		cfg.InstrumentSlow = time.Millisecond
+	}
+	if cfg.MaintenanceDrain == 0 {
+		cfg.MaintenanceDrain = 30 * time.Second
+	}
+	return cfg
+}
+
+// Server is a unique number server, created with New.
+type Server struct {
+	cfg Config
+	out io.Writer
+	// log is Config.Logger, it remembers the last warnings and errors
+	// in recent for the diagnostic dump.
+	log    *slog.Logger
+	recent *recentLines
+	// errors counts the OpErrors, see opError.
+	errors int64
+
+	// profile validates the values of the main stream.
+	profile  valueProfile
+	counter  *Counter
+	streams  []*stream
+	prefixes map[string]*stream
+	// commands are the in-band commands, the built-in ones and those
+	// of RegisterCommand.
+	commands map[string]commandFunc
+	seg      *segmentOptions
+	keys     logKeys
+	// lineLimit is the longest line taken, maxLine or a whole batch.
+	lineLimit int
+
+	// The optional features, nil when disabled.
+	certs *certStore
+	acl   *ipACL
+	// proxyTrusted are the parsed Config.ProxyTrusted.
+	proxyTrusted []*net.IPNet
+	tarpit       *tarpit
+	limits       *ipLimiter
+	audit        *AuditLog
+	usage        *usageLog
+	rdns         *reverseDNS
+	geo          *geoResolver
+	bridge       *mqttBridge
+	udp          *udpReceiver
+	grpc         *grpcReceiver
+	peers        *replicator
+	recorder     *Recorder
+	tracer       *requestTracer
+	otel         *otelTracer
+	pool         *workerPool
+	metrics      *metrics
+	// http is the listener of the metrics and health probes.
+	http net.Listener
+	// activated are the sockets systemd passed by stream, "" is the main
+	// one, see openActivated.
+	activated map[string][]net.Listener
+	// inheritable are the listeners Restart hands over.
+	inheritable []inheritable
+
+	validators []Validator
+	sinks      []Sink
+
+	// instrumented and maintenance are 1 while they're on.
+	instrumented int32
+	maintenance  int32
+	reqStats     requestStats
+
+	// conns receives accepted connections from every listener.
+	conns chan incoming
+	start sync.Once
+	// startErr is what went wrong starting the listeners and intervals.
+	startErr error
+
+	// reloadMu serializes Reload with itself and with starting the
+	// listeners.
+	reloadMu sync.Mutex
+
+	// terminated is closed once a client sent terminate.
+	terminated    chan struct{}
+	terminateOnce sync.Once
+
+	mu      sync.Mutex
+	closed  bool
+	started bool
+	done    chan struct{}
+	// stopped is closed once drain is done, see Done.
+	stopped chan struct{}
+	// ctx is the server's own, the intervals run until release cancels
+	// it. It isn't Config.BaseContext's, the logs stay open until the
+	// connections are done.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// connCtx is cancelled by hangup when Shutdown hangs up on the open
+	// connections, it's the parent of their ConnHandler contexts.
+	connCtx   context.Context
+	hangup    context.CancelFunc
+	listeners []net.Listener
+	active    map[net.Conn]bool
+	handlers  sync.WaitGroup
+	// recovering are the streams' recoveries in the background, release
+	// stops them with ctx.
+	recovering sync.WaitGroup
+
+	// bound are the listeners Reload replaces as the Config changes, by
+	// what they are, see bind.
+	bound map[string]net.Listener
+}
+
+// New sets up a server from cfg: it opens the log, the configured
+// features and extensions, but doesn't listen yet, see ListenAndServe.
+func New(cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	recent := newRecentHandler(cfg.Logger.Handler(), recentErrors)
+	// Extensions log through the Config too.
+	cfg.Logger = slog.New(recent)
+	s := &Server{
+		cfg:      cfg,
+		out:      cfg.Output,
+		log:      cfg.Logger,
+		recent:   recent.recent,
+		prefixes: make(map[string]*stream),
+		commands: make(map[string]commandFunc, len(commands)),
+		conns:    make(chan incoming),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		active:   make(map[net.Conn]bool),
+		bound:    make(map[string]net.Listener),
+
+		terminated: make(chan struct{}),
+	}
+	for verb, fn := range commands {
+		s.commands[verb] = fn
+	}
+	base := cfg.BaseContext
+	if base == nil {
+		base = context.Background()
+	}
+	s.connCtx, s.hangup = context.WithCancel(base)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.setInstrumented(cfg.Instrument)
+
+	if cfg.MetricsAddr != "" {
+		s.metrics = &metrics{}
+		if err := s.serveMetrics(cfg.MetricsAddr); err != nil {
+			return nil, fmt.Errorf("could not listen for metrics: %v", err)
+		}
+	}
+	if err := s.open(); err != nil {
+		// Don't leave files open if a later feature failed.
+		s.release()
+		return nil, err
+	}
+	if base.Done() != nil {
+		go s.stopWith(base)
+	}
+	return s, nil
+}
+
+// stopWith shuts the server down once ctx is done, with no grace
+// period left, unless it's shut down before.
+// Must be run on go routine.
+func (s *Server) stopWith(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.log.Info("shutting down server", "reason", context.Cause(ctx))
+		s.Shutdown(ctx)
+	case <-s.done:
+	}
+}
+
+// open opens the log and every configured feature.
+func (s *Server) open() (err error) {
+	cfg := s.cfg
+	if cfg.MaxConns < 1 {
+		return fmt.Errorf("the connection limit must be at least 1")
+	}
+	if cfg.NoTCP && cfg.Unix == "" {
+		return fmt.Errorf("without TCP a Unix socket to listen on is needed")
+	}
+	s.profile = valueProfile{length: cfg.ValueLen, min: cfg.MinValue, upper: cfg.MaxValue, zeros: cfg.LeadingZeros}
+	if err = s.profile.check(); err != nil {
+		return fmt.Errorf("bad value validation: %v", err)
+	}
+	if err = s.checkDedup(s.profile); err != nil {
+		return err
+	}
+	if cfg.Dedup == "redis" && cfg.RedisAddr == "" {
+		return fmt.Errorf("the redis dedup needs a redis address")
+	}
+	if cfg.Dedup == "postgres" && cfg.PostgresURL == "" {
+		return fmt.Errorf("the postgres dedup needs a postgres URL")
+	}
+	if cfg.Dedup == "dynamodb" && cfg.DynamoTable == "" {
+		return fmt.Errorf("the dynamodb dedup needs a dynamodb table")
+	}
+	if cfg.DedupShards < 0 {
+		return fmt.Errorf("dedup shards can't be negative")
+	}
+	if cfg.MaxBatch < 0 {
+		return fmt.Errorf("the batch size can't be negative")
+	}
+	if cfg.TopDuplicates < 0 {
+		return fmt.Errorf("the top duplicates can't be negative")
+	}
+	if cfg.HTTPIngest && cfg.MetricsAddr == "" {
+		return fmt.Errorf("taking values over HTTP needs a metrics address")
+	}
+	if cfg.RecoverBackground && !cfg.Recover {
+		return fmt.Errorf("recovering in the background needs recovery on")
+	}
+
+	if err = os.MkdirAll(cfg.LogDir, 0777); err != nil {
+		return fmt.Errorf("could not create log directory: %v", err)
+	}
+
+	if err = s.enableExtensions(); err != nil {
+		return fmt.Errorf("could not enable extensions: %v", err)
+	}
+
+	if err = s.loadLogKeys(); err != nil {
+		return fmt.Errorf("could not load log keys: %v", err)
+	}
+
+	if err = checkTLS(cfg); err != nil {
+		return
+	}
+	s.certs = &certStore{}
+	if err = s.certs.use(cfg.TLSCert, cfg.TLSKey); err != nil {
+		return
+	}
+
+	if cfg.LogBuffer < 0 || cfg.LogFlush < 0 {
+		return fmt.Errorf("the log buffering can't be negative")
+	}
+	switch cfg.LogSync {
+	case "none", "interval":
+	case "always":
+		// Partitions write asynchronously, after the value is acknowledged.
+		if cfg.LogPartitions > 1 {
+			return fmt.Errorf("syncing every value needs an unpartitioned log")
+		}
+	default:
+		return fmt.Errorf("unknown log sync %q, want none, interval or always", cfg.LogSync)
+	}
+	if cfg.LogSyncInterval < 0 {
+		return fmt.Errorf("the log sync interval can't be negative")
+	}
+	if cfg.LogMaxSize < 0 || cfg.LogRetain < 0 {
+		return fmt.Errorf("the log rotation can't be negative")
+	}
+	if cfg.LogCompress && cfg.LogKeyFile != "" {
+		return fmt.Errorf("encrypted logs don't compress, compress or encrypt them")
+	}
+	s.seg = &segmentOptions{
+		partitions: cfg.LogPartitions,
+		by:         cfg.LogPartitionBy,
+		queue:      cfg.LogQueue,
+		drop:       cfg.LogQueuePolicy == "drop",
+		buffer:     cfg.LogBuffer,
+		flush:      cfg.LogFlush,
+		sync:       cfg.LogSync,
+		syncEvery:  cfg.LogSyncInterval,
+		maxSize:    cfg.LogMaxSize,
+		compress:   cfg.LogCompress,
+		retain:     cfg.LogRetain,
+		keys:       s.keys.current,
+		log:        s.log,
+	}
+	if len(cfg.Peers) > 0 || cfg.PeerAddr != "" {
+		if s.peers, err = newReplicator(s); err != nil {
+			return fmt.Errorf("could not set up peers: %v", err)
+		}
+	}
+	if cfg.DailyQuota < 0 {
+		return fmt.Errorf("the daily quota can't be negative")
+	}
+	if cfg.UsageFile != "" {
+		if s.usage, err = openUsageLog(cfg.UsageFile); err != nil {
+			return
+		}
+		s.usage.log = s.log
+	}
+	if s.counter, err = s.newCounter("", logFormat(cfg.LogDir, ""), s.profile); err != nil {
+		return err
+	}
+
+	if s.acl, err = parseACL(cfg.Allow, cfg.Deny); err != nil {
+		return fmt.Errorf("bad allow or deny list: %v", err)
+	}
+	if s.proxyTrusted, err = parseNets(cfg.ProxyTrusted); err != nil {
+		return fmt.Errorf("bad trusted proxies: %v", err)
+	}
+	if len(cfg.ProxyTrusted) > 0 && !cfg.ProxyProtocol {
+		return fmt.Errorf("trusted proxies need the PROXY protocol")
+	}
+	if cfg.LogDenied && cfg.AuditLog == "" {
+		return fmt.Errorf("logging denied peers needs an audit log")
+	}
+	if cfg.Tarpit < 0 || cfg.TarpitMax < 0 {
+		return fmt.Errorf("the tarpit can't be negative")
+	}
+	s.tarpit = newTarpit(cfg.Tarpit, cfg.TarpitMax, s.done)
+	if cfg.GRPCAckWindow < 0 {
+		return fmt.Errorf("the gRPC ack window can't be negative")
+	}
+
+	if cfg.MaxConnsPerIP < 0 || cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		return fmt.Errorf("per IP limits can't be negative")
+	}
+	s.limits = newIPLimiter(cfg.MaxConnsPerIP, cfg.RateLimit, cfg.RateBurst)
+
+	if cfg.BusyWait < 0 || cfg.BusyQueue < 0 {
+		return fmt.Errorf("the busy wait can't be negative")
+	}
+	if cfg.Workers < 0 || cfg.WorkerQueue < 0 {
+		return fmt.Errorf("the worker pool can't be negative")
+	}
+	s.pool = newWorkerPool(cfg.Workers, cfg.WorkerQueue)
+
+	if cfg.RDNS {
+		s.rdns = newReverseDNS(cfg.RDNSTimeout, cfg.RDNSTTL)
+	}
+
+	if cfg.AuditLog != "" {
+		if s.audit, err = OpenAuditLog(cfg.AuditLog); err != nil {
+			return
+		}
+		s.audit.hosts = s.rdns
+		s.audit.log = s.log
+	}
+
+	if len(cfg.GeoIP) > 0 {
+		if s.geo, err = openGeo(cfg.GeoIP); err != nil {
+			return fmt.Errorf("could not open geoip databases: %v", err)
+		}
+	}
+
+	if cfg.MQTTBroker != "" {
+		if s.bridge, err = newMQTTBridge(s); err != nil {
+			return fmt.Errorf("could not start MQTT bridge: %v", err)
+		}
+	}
+
+	if cfg.TraceFile != "" {
+		if s.tracer, err = openTracer(cfg.TraceFile, cfg.TraceRate); err != nil {
+			return fmt.Errorf("could not start tracing: %v", err)
+		}
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		if s.otel, err = openOTel(cfg); err != nil {
+			return fmt.Errorf("could not start OpenTelemetry tracing: %v", err)
+		}
+	}
+
+	if cfg.Capture != "" {
+		if s.recorder, err = NewRecorder(cfg.Capture); err != nil {
+			return
+		}
+	}
+
+	if err = s.openStreams(); err != nil {
+		return fmt.Errorf("could not open streams: %v", err)
+	}
+	if s.lineLimit, err = s.batchLimit(); err != nil {
+		return err
+	}
+
+	if cfg.SocketActivation {
+		if err = s.openActivated(); err != nil {
+			return fmt.Errorf("could not take the sockets systemd passed: %v", err)
+		}
+	}
+	return nil
+}
+
+// newCounter constructs a Counter of the server, logging to segments named after format.
+func (s *Server) newCounter(name, format string, p valueProfile) (*Counter, error) {
+	segs, next, err := s.recoverable(name)
+	if err != nil {
+		return nil, err
+	}
+	store, err := s.openStore(name, p)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newStreamCounter(name, s.cfg.MaxConns, format, next, p, s.seg, s.out)
+	if err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
+	}
+	if store != nil {
+		c.Uniq, c.set, c.locked = nil, store, false
+	}
+	if len(segs) > 0 && !s.cfg.RecoverBackground {
+		if err = s.recoverLog(context.Background(), c, segs, newRecovery(segs)); err != nil {
+			c.FlushClose()
+			c.set.Close()
+			return nil, err
+		}
+	}
+	c.validator = s.cfg.ValueValidator
+	c.peers = s.peers
+	c.firstSeg = next
+	if len(segs) > 0 {
+		c.firstSeg = segs[0].Seg
+	}
+	c.dups = newDupTracker(s.cfg.TopDuplicates)
+	c.quota = newQuota(name, s.cfg.DailyQuota, s.usage)
+	c.extra = s.report
+	c.failed = func(err error) {
+		// Rotations that can't open the next segment say so themselves.
+		var oe *OpError
+		if !errors.As(err, &oe) {
+			oe = &OpError{Op: "flush", Stream: name, Err: err}
+		}
+		s.opError(oe)
+	}
+	c.serve = s.chain(c)
+	if len(segs) > 0 && s.cfg.RecoverBackground {
+		c.recovery = newRecovery(segs)
+		s.recovering.Add(1)
+		go s.recoverBackground(c, segs)
+	}
+	return c, nil
+}
+
+// logFormat is the name pattern of a stream's log segments in dir,
+// the main stream's are data.%d.log.
+func logFormat(dir, stream string) string {
+	return filepath.Join(dir, streamBase(stream)+".%d.log")
+}
+
+// report returns the server wide lines of a Counter's interval output.
+func (s *Server) report() string {
+	var b strings.Builder
+	if s.geo != nil {
+		b.WriteString(s.geo.report())
+	}
+	if s.instrumentOn() {
+		b.WriteString(s.reqStats.report())
+	}
+	if s.acl != nil {
+		b.WriteString(s.acl.report())
+	}
+	if s.tarpit != nil {
+		b.WriteString(s.tarpit.report())
+	}
+	if s.udp != nil {
+		b.WriteString(s.udp.report())
+	}
+	if s.grpc != nil {
+		b.WriteString(s.grpc.report())
+	}
+	if s.pool != nil {
+		b.WriteString(s.pool.report())
+	}
+	if s.peers != nil {
+		b.WriteString(s.peers.report())
+	}
+	if n := s.Errors(); n > 0 {
+		fmt.Fprintf(&b, "Errors      : %d\n", n)
+	}
+	if s.inMaintenance() {
+		b.WriteString("State       : maintenance\n")
+	}
+	return b.String()
+}
+
+// ListenAndServe listens on Config.Addr, or the Unix socket with
+// NoTCP, or takes the socket systemd passed with SocketActivation,
+// and serves connections until Shutdown, when it returns
+// ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if ls := s.activated[""]; len(ls) > 0 {
+		l, err := s.inherited(ls[0])
+		if err != nil {
+			return err
+		}
+		return s.Serve(l)
+	}
+
+	if s.cfg.NoTCP {
+		l, err := s.listenUnix(s.cfg.Unix)
+		if err != nil {
+			return fmt.Errorf("could not listen: %v", err)
+		}
+		return s.Serve(l)
+	}
+
+	l, err := s.listenTCP(s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen: %v", err)
+	}
+	return s.Serve(l)
+}
+
+// listenTCP listens on addr, busy polling and reading PROXY headers
+// if configured.
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.BusyPoll > 0 {
+		if l, err = busyPollListener(l, s.cfg.BusyPoll); err != nil {
+			return nil, fmt.Errorf("could not enable busy polling: %v", err)
+		}
+	}
+	return s.proxied(l), nil
+}
+
+// listenUnix listens on the Unix socket path,
+// reading PROXY headers if configured.
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	l, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.proxied(l), nil
+}
+
+// listen listens on one of Config.Listen,
+// host:port for TCP or unix:<path> for a Unix socket.
+func (s *Server) listen(spec string) (net.Listener, error) {
+	if path := strings.TrimPrefix(spec, "unix:"); path != spec {
+		return s.listenUnix(path)
+	}
+	return s.listenTCP(spec)
+}
+
+// Serve serves connections accepted on l until Shutdown,
+// when it returns ErrServerClosed. The first call also starts the
+// Listen, stream, TLS, UDP, Unix socket, peer and pipe listeners, the
+// MQTT bridge, the peer connections and the intervals.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	s.start.Do(func() { s.startErr = s.startBackground() })
+	if s.startErr != nil {
+		return s.startErr
+	}
+
+	s.handOver("", l)
+	s.log.Info("server started", "network", l.Addr().Network(), "addr", l.Addr().String())
+
+	go s.acceptConns(l, s.counter)
+
+	for {
+		select {
+		case in := <-s.conns:
+			s.serveConn(in)
+		case <-s.done:
+			return ErrServerClosed
+		}
+	}
+}
+
+// startBackground starts everything besides the main listener.
+func (s *Server) startBackground() error {
+	// The listeners are started from the Config as Reload left it.
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.pool != nil {
+		s.pool.start(s)
+	}
+
+	for _, st := range s.streams {
+		if ls := s.activated[st.name]; len(ls) > 0 {
+			if err := s.acceptActivated(ls, st.counter); err != nil {
+				return fmt.Errorf("stream %s: %v", st.name, err)
+			}
+			continue
+		}
+		if st.port == 0 {
+			continue
+		}
+		l, err := s.listenTCP(fmt.Sprintf(":%d", st.port))
+		if err != nil {
+			return fmt.Errorf("stream %s: could not listen: %v", st.name, err)
+		}
+		s.handOver(st.name, l)
+		if err = s.acceptOn(l, st.counter, "stream "+st.name); err != nil {
+			return err
+		}
+	}
+
+	// The first of the main stream's is served by ListenAndServe.
+	if ls := s.activated[""]; len(ls) > 1 {
+		if err := s.acceptActivated(ls[1:], s.counter); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range s.cfg.Listen {
+		l, err := s.listen(spec)
+		if err != nil {
+			return fmt.Errorf("could not listen on %s: %v", spec, err)
+		}
+		if err = s.bind(boundListen+spec, l, ""); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.TLSCert != "" {
+		l, err := s.listenTLS(s.cfg.TLSAddr)
+		if err != nil {
+			return fmt.Errorf("could not listen for TLS: %v", err)
+		}
+		if err = s.bind(boundTLS, l, "TLS"); err != nil {
+			return err
+		}
+	}
+	// Reload may turn TLS on later.
+	go s.watchCerts()
+
+	if s.cfg.QUICAddr != "" {
+		l, err := s.listenQUIC(s.cfg.QUICAddr)
+		if err != nil {
+			return fmt.Errorf("could not listen for QUIC: %v", err)
+		}
+		if err = s.bind(boundQUIC, l, "QUIC"); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.UDPAddr != "" {
+		if err := s.listenUDP(s.cfg.UDPAddr); err != nil {
+			return fmt.Errorf("could not listen for UDP: %v", err)
+		}
+	}
+
+	if s.cfg.GRPCAddr != "" {
+		if err := s.serveGRPC(s.cfg.GRPCAddr); err != nil {
+			return fmt.Errorf("could not listen for gRPC: %v", err)
+		}
+	}
+
+	if s.cfg.Unix != "" && !s.cfg.NoTCP {
+		l, err := s.listenUnix(s.cfg.Unix)
+		if err != nil {
+			return fmt.Errorf("could not listen on Unix socket: %v", err)
+		}
+		if err = s.acceptOn(l, s.counter, ""); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.AdminAddr != "" {
+		if err := s.serveAdmin(s.cfg.AdminAddr); err != nil {
+			return fmt.Errorf("could not listen for admin: %v", err)
+		}
+	}
+
+	if s.cfg.PeerAddr != "" {
+		if err := s.servePeers(s.cfg.PeerAddr); err != nil {
+			return fmt.Errorf("could not listen for peers: %v", err)
+		}
+	}
+
+	if s.cfg.Pipe != "" {
+		pipe, err := listenPipe(s.cfg.Pipe, s.cfg.PipeSDDL)
+		if err != nil {
+			return fmt.Errorf("could not listen on pipe: %v", err)
+		}
+		if err = s.acceptOn(pipe, s.counter, ""); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+
+	cfg := s.config()
+	for _, c := range s.counters() {
+		go c.RunOutputInterval(s.ctx, cfg.OutputInterval)
+		go c.RunLogInterval(s.ctx, cfg.LogInterval)
+	}
+
+	if s.bridge != nil {
+		go s.bridge.Run()
+	}
+	if s.peers != nil {
+		s.peers.Run()
+	}
+	if s.cfg.MaintenanceFile != "" {
+		go s.watchMaintenance(s.cfg.MaintenanceFile)
+	}
+	if s.usage != nil {
+		go s.rollUsage(s.ctx)
+	}
+	return nil
+}
+
+// acceptOn starts accepting connections on one more listener,
+// all of them feed the same handlers. what describes the listener
+// in the startup message, if it's not a plain one.
+func (s *Server) acceptOn(l net.Listener, counter *Counter, what string) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	args := []interface{}{"addr", l.Addr().String()}
+	if what != "" {
+		args = append(args, "for", what)
+	}
+	s.log.Info("listening", args...)
+	go s.acceptConns(l, counter)
+	return nil
+}
+
+// The listeners Reload replaces: boundListen is followed by the
+// Config.Listen spec of one.
+const (
+	boundListen = "listen "
+	boundTLS    = "tls"
+	boundQUIC   = "quic"
+)
+
+// bind is acceptOn for the main stream, with the listener known as key
+// from then on. A listener bound as key before is closed, the
+// connections it accepted are kept.
+func (s *Server) bind(key string, l net.Listener, what string) error {
+	if err := s.acceptOn(l, s.counter, what); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old := s.bound[key]
+	s.bound[key] = l
+	s.mu.Unlock()
+	if old != nil {
+		s.retire(old)
+	}
+	return nil
+}
+
+// unbind closes the listener known as key, if there is one, the
+// connections it accepted are kept.
+func (s *Server) unbind(key string) {
+	s.mu.Lock()
+	l := s.bound[key]
+	delete(s.bound, key)
+	s.mu.Unlock()
+	if l != nil {
+		s.retire(l)
+	}
+}
+
+// retire stops accepting on l and closes it, a QUIC listener once its
+// connections are over.
+func (s *Server) retire(l net.Listener) {
+	s.mu.Lock()
+	s.listeners = slices.DeleteFunc(s.listeners, func(x net.Listener) bool { return x == l })
+	s.mu.Unlock()
+	l.Close()
+	s.log.Info("stopped listening", "addr", l.Addr().String())
+}
+
+// tracked reports whether l is still one of the server's listeners,
+// it's not once retired.
+func (s *Server) tracked(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.listeners, l)
+}
+
+// counters returns the Counter of the main stream and of every named one.
+func (s *Server) counters() []*Counter {
+	cs := []*Counter{s.counter}
+	for _, st := range s.streams {
+		cs = append(cs, st.counter)
+	}
+	return cs
+}
+
+// track adds a listener to be closed on Shutdown,
+// it returns false if the server is shut down already.
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+// closing reports whether Shutdown was called.
+func (s *Server) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// incoming is an accepted connection and the Counter of the stream
+// it was accepted for, accepted is when, only with OpenTelemetry tracing.
+type incoming struct {
+	conn     net.Conn
+	counter  *Counter
+	accepted time.Time
+}
+
+// acceptConns turns away the connections that may not connect at all,
+// the others get sent on s.conns, the connection limits are up to the
+// counter's ConnHandler.
+// Must be run on go routine.
+func (s *Server) acceptConns(l net.Listener, counter *Counter) {
+	for {
+		conn, err := l.Accept()
+		if err == nil {
+			if err = failpoint.Eval(fpAccept); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			if s.closing() || !s.tracked(l) {
+				return
+			}
+			s.log.Error("could not accept connection", "err", err)
+			continue
+		}
+
+		if !s.acl.permits(conn.RemoteAddr()) {
+			if s.cfg.LogDenied {
+				s.audit.Record(auditDenied, conn.RemoteAddr().String(), "not allowed by the allow and deny lists")
+			}
+			if !s.tarpit.trap(conn) {
+				conn.Close()
+			}
+			continue
+		}
+		s.rdns.warm(conn.RemoteAddr())
+
+		if s.inMaintenance() {
+			rejectMaintenance(conn)
+			continue
+		}
+
+		in := incoming{conn: conn, counter: counter}
+		if s.otel != nil {
+			in.accepted = time.Now()
+		}
+		select {
+		case s.conns <- in:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// rejectRateLimited turns away a client over its per IP limits.
+func (s *Server) rejectRateLimited(conn net.Conn, why string) {
+	s.audit.Record(auditRateLimited, conn.RemoteAddr().String(), why)
+	io.WriteString(conn, rateLimitedReply)
+	conn.Close()
+}
+
+// rejectBusy turns away a connection over the connection limit.
+func (s *Server) rejectBusy(conn net.Conn) {
+	s.audit.Record(auditBusy, conn.RemoteAddr().String(), "connection limit reached")
+	s.metrics.sawBusy()
+	fmt.Fprintf(conn, "Server busy.")
+	conn.Close()
+}
+
+// serveConn starts the ConnHandler of an accepted connection,
+// tracking it so Shutdown can hang up on it.
+func (s *Server) serveConn(in incoming) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		in.conn.Close()
+		return
+	}
+	s.active[in.conn] = true
+	s.handlers.Add(1)
+	// Queued under the lock, so no connection is queued
+	// once Shutdown dropped the queued ones.
+	if s.pool != nil {
+		queued := s.pool.enqueue(in)
+		s.mu.Unlock()
+		if !queued {
+			s.rejectBusy(in.conn)
+			s.connDone(in)
+		}
+		return
+	}
+	s.mu.Unlock()
+
+	go s.runConn(in)
+}
+
+// runConn serves a connection started with serveConn until it's closed.
+func (s *Server) runConn(in incoming) {
+	ctx := s.connCtx
+	if !in.accepted.IsZero() {
+		ctx = context.WithValue(ctx, acceptedKey{}, in.accepted)
+	}
+	conn := in.conn
+	if failpoint.Active() {
+		conn = chaosConn{conn}
+	}
+	in.counter.serve(ctx, s.recorder.Wrap(conn))
+	// In case a Middleware turned it away.
+	in.conn.Close()
+	s.connDone(in)
+}
+
+// connDone stops tracking a connection started with serveConn.
+func (s *Server) connDone(in incoming) {
+	s.mu.Lock()
+	delete(s.active, in.conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// Handles incoming requests.
+// Input is parsed and written to log if unique.
+// Handles closing of the connection.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, counter *Counter) {
+	// Track liveness, so idle producers that keep pinging
+	// can be told apart from dead ones.
+	stats := newConnStats()
+	stats.origin = s.geo.resolve(conn.RemoteAddr())
+	// Cancelling the connection's context, with Shutdown's hangup, the
+	// admin DISCONNECT or a Middleware's own, hangs up on it.
+	ctx, stats.cancel = context.WithCancel(ctx)
+	defer stats.cancel()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	stats.remote = conn.RemoteAddr().String()
+	counter.track(stats)
+	log := s.log.With("remote", conn.RemoteAddr().String())
+	trace := s.otel.startConn(ctx, conn.RemoteAddr(), counter)
+	var bufs connBuffers
+
+	// Defer all close logic.
+	// Using a closure makes it easy to group logic as well as execute serially
+	// and avoid the deferred LIFO exec order.
+	defer func() {
+		// Since handleConnection is run in a go routine,
+		// it manages the closing of our net.Conn.
+		conn.Close()
+		bufs.release()
+		counter.untrack(stats)
+		log.Debug("connection closed", "stream", counter.name, "duration", time.Since(stats.opened),
+			"bytes", stats.bytes, "values", stats.values, "unique", stats.uniques, "malformed", stats.malformed)
+		trace.end(stats)
+	}()
+
+	if !s.cfg.NoGreeting {
+		if _, err := io.WriteString(conn, s.greeting(counter)); err != nil {
+			return
+		}
+	}
+
+	r := bufs.reader(conn)
+	cl := &client{srv: s, conn: conn, out: bufs.writer(conn), counter: counter, stats: stats, sess: v1, log: log, otel: trace,
+		authed: s.cfg.AuthToken == ""}
+	cl.ctx = context.WithValue(ctx, clientKey{}, cl)
+	if !cl.authed && s.authenticateClient(cl, r) != nil {
+		return
+	}
+
+	sess, in, err := handshake(&bufs, conn)
+	if err != nil {
+		if isTimeout(err) {
+			s.audit.Record(auditTimeout, conn.RemoteAddr().String(), err.Error())
+		} else if err == errLineTooLong {
+			s.audit.Record(auditOversized, conn.RemoteAddr().String(), err.Error())
+			if !s.cfg.Quiet {
+				io.WriteString(conn, lineTooLongReply)
+			}
+		}
+		return
+	}
+	if dc, _ := ctx.Value(deadlinesKey{}).(*deadlineConn); dc != nil && (sess.caps["deflate"] || sess.binary) {
+		dc.plain = false
+	}
+	scanSize, bufTotal := sess.bufSizes()
+	stats.setReadBuf(bufTotal)
+	trace.accepted()
+
+	cl.sess = sess
+	ip := limitedIP(conn.RemoteAddr())
+
+	if sess.binary {
+		s.readFailed(cl, s.serveBinary(cl, flushReader{cl: cl, r: in}, bufs.scanBuf(scanSize), ip))
+		return
+	}
+
+	scanner := bufio.NewScanner(flushReader{cl: cl, r: in})
+	scanner.Buffer(bufs.scanBuf(scanSize), bufio.MaxScanTokenSize)
+	limit := s.lineLimit
+	if sess.caps["json"] && limit < maxJSONLine {
+		limit = maxJSONLine
+	}
+	scanner.Split(scanLines(limit, s.cfg.StrictLines))
+	for scanner.Scan() {
+		if !s.limits.allow(ip) {
+			s.audit.Record(auditRateLimited, conn.RemoteAddr().String(), "per IP line rate exceeded")
+			cl.reply(rateLimitedReply)
+			cl.flush()
+			return
+		}
+
+		var err error
+		start := s.metrics.start()
+		switch {
+		case s.tracer.sampled(cl):
+			err = tracedDispatch(cl, scanner.Bytes(), true)
+		case trace.traceLine():
+			err = tracedDispatch(cl, scanner.Bytes(), false)
+		case s.instrumentOn():
+			err = instrumentedDispatch(cl, scanner.Bytes())
+		default:
+			err = cl.handle(scanner.Bytes())
+		}
+		s.metrics.handled(start)
+		if err != nil {
+			return
+		}
+	}
+
+	s.readFailed(cl, scanner.Err())
+}
+
+// readFailed handles what ended reading a connection's input,
+// nil for the client hanging up.
+func (s *Server) readFailed(cl *client, err error) {
+	conn := cl.conn
+	// The client stopped sending, it may still read the replies to its
+	// last lines: a deflate stream's end comes with them, there's no
+	// read after them to flush them.
+	if err == nil {
+		cl.flush()
+		return
+	}
+
+	// A broken compressed stream or a line too long to buffer
+	// is on the client, we just hang up on it.
+	if badStream(err) {
+		s.audit.Record(auditBadStream, conn.RemoteAddr().String(), err.Error())
+		return
+	} else if err == errLineTooLong {
+		s.audit.Record(auditOversized, conn.RemoteAddr().String(), err.Error())
+		if !s.cfg.Quiet {
+			cl.reply(lineTooLongReply)
+			cl.flush()
+		}
+		return
+	}
+
+	// A stalled client runs out of time, its slot is free again.
+	if isTimeout(err) {
+		s.audit.Record(auditTimeout, conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	// So is a peer resetting the connection,
+	// e.g. hanging up without reading the greeting,
+	// or Shutdown hanging up on it.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || s.closing() {
+		return
+	}
+
+	// Any other failure to read input is probably my bad,
+	// but it's only this connection's, the others go on.
+	s.opError(&OpError{Op: "read", Remote: conn.RemoteAddr().String(), Stream: cl.counter.name, Err: err})
+}
+
+// Counts returns a consistent snapshot of the main stream's counters:
+// the unique values, all valid values, and those of the current interval.
+func (s *Server) Counts() (uniq, total, intvl int) {
+	return s.counter.counts()
+}
+
+// Stats returns a snapshot of every stream's counts by stream name,
+// "" for the main stream.
+func (s *Server) Stats() map[string]Stats {
+	stats := make(map[string]Stats)
+	for _, c := range s.counters() {
+		stats[c.name] = c.Snapshot()
+	}
+	return stats
+}
+
+// streamStats is Stats by the streams' log names, "data" for the main
+// stream, as the stats endpoint and the admin STATS JSON serve it.
+func (s *Server) streamStats() map[string]Stats {
+	stats := make(map[string]Stats)
+	for _, c := range s.counters() {
+		stats[streamBase(c.name)] = c.Snapshot()
+	}
+	return stats
+}
+
+// Terminated is closed once a client sent the terminate command,
+// the server keeps running until the owner calls Shutdown.
+func (s *Server) Terminated() <-chan struct{} {
+	return s.terminated
+}
+
+// Done is closed once the server is shut down completely, by Shutdown,
+// Restart or Config.BaseContext: its connections are closed, its logs
+// flushed and its features closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// Closed reports whether Shutdown or Restart stopped the server.
+func (s *Server) Closed() bool {
+	return s.closing()
+}
+
+// Shutdown stops accepting connections and waits for the open ones
+// to finish, then flushes the logs, prints the final counts and closes
+// every feature. Clients keep being served until they hang up or ctx
+// expires, which is the grace period: then Shutdown hangs up on the
+// rest, waits up to hangupWait for their handlers, flushes regardless,
+// and returns ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.stopAccepting() {
+		return nil
+	}
+	return s.drain(ctx)
+}
+
+// stopAccepting closes the listeners, it returns false if the server
+// was shut down already.
+func (s *Server) stopAccepting() bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.closed = true
+	close(s.done)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.pool.drop(s)
+	return true
+}
+
+// drain waits for the open connections to finish, up to ctx, hangs up
+// on the rest and releases everything.
+func (s *Server) drain(ctx context.Context) error {
+	s.mu.Lock()
+	open := len(s.active)
+	s.mu.Unlock()
+
+	if s.bridge != nil {
+		s.bridge.Stop()
+	}
+	if s.peers != nil {
+		s.peers.Stop()
+	}
+	if s.grpc != nil {
+		// Sends the clients a GOAWAY, the calls in flight are waited
+		// for with the connections.
+		go s.grpc.hs.Shutdown(context.Background())
+	}
+
+	drained := make(chan bool)
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	if open > 0 {
+		s.log.Info("draining connections", "open", open)
+	}
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		s.mu.Lock()
+		if len(s.active) > 0 {
+			s.log.Warn("hanging up on connections still open after the grace period", "open", len(s.active))
+		}
+		for conn := range s.active {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		if s.grpc != nil {
+			s.grpc.hs.Close()
+		}
+		s.hangup()
+
+		select {
+		case <-drained:
+		case <-time.After(hangupWait):
+		}
+	}
+
+	s.hangup()
+	// Before release closes the Stores the unique counts come from.
+	for _, c := range s.counters() {
+		c.outputFinal()
+	}
+	s.release()
+	close(s.stopped)
+	return err
+}
+
+// release flushes the logs and closes every feature that's open.
+func (s *Server) release() {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+
+	// Stops the intervals, Close waits for their final flush, and the
+	// recoveries before their stores are closed.
+	s.cancel()
+	s.recovering.Wait()
+	for _, c := range s.counters() {
+		if c == nil {
+			continue
+		}
+		// Without the log interval running there's nobody to stop,
+		// flush directly.
+		if started {
+			c.Close()
+		} else if err := c.FlushClose(); err != nil {
+			s.log.Error("could not flush log to disk", "stream", c.name, "err", err)
+		}
+	}
+	if err := s.recorder.Close(); err != nil {
+		s.log.Error("could not close capture", "err", err)
+	}
+	s.closeSinks()
+	s.audit.Close()
+	for _, c := range s.counters() {
+		if c == nil {
+			continue
+		}
+		if err := c.quota.flush(); err != nil {
+			s.log.Error("could not write usage record", "stream", c.name, "err", err)
+		}
+	}
+	s.usage.Close()
+	s.tracer.Close()
+	s.otel.Close()
+	if s.http != nil {
+		s.http.Close()
+	}
+	for _, ls := range s.activated {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+	for _, c := range s.counters() {
+		if c == nil {
+			continue
+		}
+		if err := c.set.Close(); err != nil {
+			s.log.Error("could not close store", "dedup", s.cfg.Dedup, "stream", c.name, "err", err)
+		}
+	}
+}
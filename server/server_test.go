@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig is a Config for a server on a free loopback port, logging
+// to a temporary directory and reporting nowhere.
+func testConfig(t *testing.T) Config {
+	return Config{
+		Addr:           "127.0.0.1:0",
+		LogDir:         t.TempDir(),
+		NoGreeting:     true,
+		Output:         io.Discard,
+		ErrorLog:       io.Discard,
+		OutputInterval: time.Hour,
+		LogInterval:    time.Hour,
+	}
+}
+
+// serveTest starts a server from cfg on a loopback listener, it's shut
+// down when the test ends unless the test did.
+func serveTest(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return srv, serveOn(t, srv)
+}
+
+// serveOn is serveTest for a server made by the test, it returns the
+// address it's served on.
+func serveOn(t *testing.T, srv *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Shutdown(context.Background())
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	})
+	return l.Addr().String()
+}
+
+// send writes lines to the server at addr and waits for the PONG of a
+// PING after them, so every line was handled by then. It returns the
+// replies before the PONG.
+func send(t *testing.T, addr string, lines ...string) []string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, strings.Join(append(lines, pingCmd), "\n")+"\n")
+	var replies []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if scanner.Text()+"\n" == pongReply {
+			return replies
+		}
+		replies = append(replies, scanner.Text())
+	}
+	t.Fatalf("no PONG, got %q: %v", replies, scanner.Err())
+	return nil
+}
+
+func TestServeShutdown(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SkipInvalid = true
+	srv, addr := serveTest(t, cfg)
+
+	send(t, addr, "1234567890", "1234567890", "0000001234", "12345", "2345678901")
+	uniq, total, _ := srv.Counts()
+	if uniq != 2 || total != 3 {
+		t.Errorf("Counts() = %d unique, %d total, want 2, 3", uniq, total)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-srv.Done():
+	default:
+		t.Error("Done not closed after Shutdown")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("still accepting after Shutdown")
+	}
+
+	logged, err := os.ReadFile(filepath.Join(cfg.LogDir, "data.0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1234567890\n2345678901\n"; string(logged) != want {
+		t.Errorf("log is %q, want %q", logged, want)
+	}
+	if n := srv.Errors(); n != 0 {
+		t.Errorf("Errors() = %d, want 0", n)
+	}
+}
+
+func TestShutdownHangsUp(t *testing.T) {
+	srv, addr := serveTest(t, testConfig(t))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send(t, addr, "1234567890")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with an open connection = %v, want %v", err, context.DeadlineExceeded)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after the grace period")
+	}
+}
+
+func TestNewLogOpenError(t *testing.T) {
+	cfg := testConfig(t)
+	// The first segment can't be opened as a file.
+	if err := os.Mkdir(filepath.Join(cfg.LogDir, "data.0.log"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(cfg)
+	var oe *OpError
+	if !errors.As(err, &oe) || oe.Op != "open" {
+		t.Fatalf("New = %v, want an open OpError", err)
+	}
+}
+
+func TestRotateOpenError(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCounter(1, filepath.Join(dir, "data.%d.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.FlushClose()
+
+	blocker := filepath.Join(dir, "data.1.log")
+	if err := os.Mkdir(blocker, 0777); err != nil {
+		t.Fatal(err)
+	}
+	err = c.FlushRotate()
+	var oe *OpError
+	if !errors.As(err, &oe) || oe.Op != "open" {
+		t.Fatalf("FlushRotate = %v, want an open OpError", err)
+	}
+	if _, err := c.Record(MinValue); err == nil {
+		t.Fatal("Record logged to a segment that didn't open")
+	}
+	if c.HasValue(MinValue) {
+		t.Error("unlogged value left in the unique set")
+	}
+
+	// The next rotation opens the segment that failed.
+	os.Remove(blocker)
+	if err := c.FlushRotate(); err != nil {
+		t.Fatalf("FlushRotate after the failure: %v", err)
+	}
+	if uniq, err := c.Record(MinValue); !uniq || err != nil {
+		t.Fatalf("Record = %v, %v, want a new value", uniq, err)
+	}
+	if c.Log.Cnt != 1 {
+		t.Errorf("rotated into segment %d, want 1", c.Log.Cnt)
+	}
+}
+
+func TestBaseContextHangsUp(t *testing.T) {
+	cfg := testConfig(t)
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg.BaseContext = base
+	srv, addr := serveTest(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send(t, addr, "1234567890")
+
+	cancel()
+	select {
+	case <-srv.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not shut down after BaseContext was cancelled")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after BaseContext was cancelled")
+	}
+	logged, err := os.ReadFile(filepath.Join(cfg.LogDir, "data.0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1234567890\n"; string(logged) != want {
+		t.Errorf("log is %q, want %q", logged, want)
+	}
+}
+
+func TestLogIntervalStopsWithContext(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCounter(1, filepath.Join(dir, "data.%d.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.RunOutputInterval(ctx, time.Hour)
+	go c.RunLogInterval(ctx, time.Hour)
+	if _, err := c.Record(MinValue); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-c.intvl.logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("log interval still running after its context was cancelled")
+	}
+	logged, err := os.ReadFile(filepath.Join(dir, "data.0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintln(MinValue); string(logged) != want {
+		t.Errorf("log is %q, want %q", logged, want)
+	}
+	// Close after the context is fine, the intervals are gone already.
+	c.Close()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// The sidecar extension runs Config.Sidecar as a child process and talks to it
+// over a line protocol on its stdin and stdout:
+//
+//	> CHECK <stream> <value>
+//	< OK
+//	< REJECT <reason>
+//	> UNIQUE <stream> <value>
+//
+// CHECK is sent for the sidecar validator and waits for the answer,
+// UNIQUE is sent for the sidecar sink and isn't answered.
+// The process is shared, so enabling both costs one process.
+func init() {
+	RegisterValidator("sidecar", func(cfg Config) (Validator, error) {
+		s, err := theSidecar(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s.check, nil
+	})
+	RegisterSink("sidecar", func(cfg Config) (Sink, error) {
+		return theSidecar(cfg)
+	})
+}
+
+var (
+	sidecarOnce sync.Once
+	sidecarProc *sidecar
+	sidecarErr  error
+)
+
+// theSidecar starts the sidecar process the first time it's needed,
+// there's one per process.
+func theSidecar(cfg Config) (*sidecar, error) {
+	sidecarOnce.Do(func() {
+		sidecarProc, sidecarErr = startSidecar(cfg.Sidecar, cfg.Logger)
+	})
+	return sidecarProc, sidecarErr
+}
+
+type sidecar struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	w      *bufio.Writer
+	r      *bufio.Reader
+	closed bool
+	// log is where a failing sidecar is reported.
+	log *slog.Logger
+}
+
+func startSidecar(command string, log *slog.Logger) (*sidecar, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("a sidecar command is required by the sidecar extension")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not start sidecar: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not start sidecar: %v", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not start sidecar: %v", err)
+	}
+
+	return &sidecar{
+		cmd:   cmd,
+		stdin: stdin,
+		w:     bufio.NewWriter(stdin),
+		r:     bufio.NewReader(stdout),
+		log:   log,
+	}, nil
+}
+
+// check asks the sidecar whether to accept a value.
+// A sidecar that doesn't answer properly fails closed, the value is rejected.
+func (s *sidecar) check(stream string, num int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.w, "CHECK %s %d\n", stream, num)
+	if err := s.w.Flush(); err != nil {
+		s.log.Error("sidecar failed", "err", err)
+		return fmt.Errorf("sidecar: %v", err)
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.log.Error("sidecar failed", "err", err)
+		return fmt.Errorf("sidecar: %v", err)
+	}
+
+	switch line = strings.TrimRight(line, "\r\n"); {
+	case line == "OK":
+		return nil
+	case line == "REJECT":
+		return errRejected
+	case strings.HasPrefix(line, "REJECT "):
+		return errors.New(strings.TrimPrefix(line, "REJECT "))
+	}
+	return fmt.Errorf("sidecar: unexpected answer %q", line)
+}
+
+func (s *sidecar) Write(stream string, num int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.w, "UNIQUE %s %d\n", stream, num)
+	return s.w.Flush()
+}
+
+// Close ends the sidecar's input and waits for it to exit.
+func (s *sidecar) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	s.w.Flush()
+	s.stdin.Close()
+	return s.cmd.Wait()
+}
@@ -0,0 +1,816 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/postgres"
+	"github.com/chandanws/go-simple-tcp-server/internal/redis"
+)
+
+// maxBitSetBits keeps a bitset within 16 GiB.
+const maxBitSetBits = 1 << 37
+
+// Store keeps a stream's set of unique values, see Config.Dedup and
+// Config.NewStore. The Counter checks and adds values through it and
+// reports its Len as the unique count.
+//
+// A Store other than the default map must be safe for concurrent use,
+// the Counter only holds its lock around Store calls to write the log.
+type Store interface {
+	// Add adds num, it reports false if it was there already. With an
+	// error num isn't logged, so it must not be left in the set if Add
+	// put it there. A shared Store that can't tell whether it did, e.g.
+	// after a timeout, leaves it be: another server may have added and
+	// logged it, taken out it would be logged twice.
+	Add(num int) (bool, error)
+	Has(num int) (bool, error)
+	// Remove takes num out again, after it couldn't be logged.
+	Remove(num int) error
+	Len() (int, error)
+	Close() error
+}
+
+// A BatchStore is a Store that also adds the values of a batch line in
+// one go, under one lock or in one round trip, instead of one Add
+// after the other, see Config.MaxBatch.
+type BatchStore interface {
+	Store
+	// AddBatch adds nums, uniq[i] reports whether nums[i] was new, a
+	// value twice in nums is new the first time only. With an error
+	// none of nums it added must be left in the set, like with Add.
+	AddBatch(nums []int) (uniq []bool, err error)
+}
+
+// addBatch adds nums to s, with AddBatch if it's a BatchStore.
+func addBatch(s Store, nums []int) ([]bool, error) {
+	if bs, ok := s.(BatchStore); ok {
+		return bs.AddBatch(nums)
+	}
+	uniq := make([]bool, len(nums))
+	for i, num := range nums {
+		var err error
+		if uniq[i], err = s.Add(num); err != nil {
+			return nil, removeNew(s, nums[:i], uniq[:i], err)
+		}
+	}
+	return uniq, nil
+}
+
+// removeNew takes the values of nums that were new out of s again,
+// after err kept the batch from being added as a whole.
+func removeNew(s Store, nums []int, uniq []bool, err error) error {
+	for i, num := range nums {
+		if !uniq[i] {
+			continue
+		}
+		if rerr := s.Remove(num); rerr != nil {
+			return fmt.Errorf("%v, and could not remove the value %d again: %v", err, num, rerr)
+		}
+	}
+	return err
+}
+
+// windowGens is how many generations a windowSet splits its window
+// into, one more is kept so values live a whole window at least.
+const windowGens = 24
+
+// checkDedup reports what's wrong with Config.Dedup for the values of p.
+func (s *Server) checkDedup(p valueProfile) error {
+	if s.cfg.DedupWindow < 0 {
+		return fmt.Errorf("the dedup window can't be negative")
+	}
+	if s.cfg.DedupWindow > 0 && s.cfg.Dedup != "map" {
+		return fmt.Errorf("a dedup window needs the map dedup")
+	}
+	if s.cfg.DedupAffine && (s.cfg.Dedup != "map" || s.cfg.DedupWindow > 0) {
+		return fmt.Errorf("affine dedup shards need the map dedup without a window")
+	}
+	if len(s.cfg.MemcachedAddrs) > 0 && s.cfg.Dedup != "redis" && s.cfg.Dedup != "postgres" && s.cfg.Dedup != "dynamodb" {
+		return fmt.Errorf("a memcached cache needs the redis, postgres or dynamodb dedup")
+	}
+	if s.cfg.BitSetDir != "" && s.cfg.Dedup != "bitset" {
+		return fmt.Errorf("a bitset directory needs the bitset dedup")
+	}
+	if s.cfg.BitSetSync < 0 {
+		return fmt.Errorf("the bitset sync interval can't be negative")
+	}
+	if s.cfg.MemcachedTTL < 0 {
+		return fmt.Errorf("the memcached TTL can't be negative")
+	}
+	if strings.ContainsAny(s.cfg.MemcachedKey, " \t\r\n") {
+		return fmt.Errorf("bad memcached key %q, can't have spaces", s.cfg.MemcachedKey)
+	}
+	switch s.cfg.Dedup {
+	case "map":
+		return nil
+	case "redis":
+		if by := s.cfg.RedisShardBy; by != "hash" && by != "range" {
+			return fmt.Errorf("unknown redis sharding %q, must be hash or range", by)
+		}
+		if s.cfg.RedisShardBy == "range" && p.max()-p.lowest() < len(s.cfg.RedisShards) {
+			return fmt.Errorf("too few values to split into %d ranges", len(s.cfg.RedisShards)+1)
+		}
+		return nil
+	case "postgres":
+		if !postgresName.MatchString(s.cfg.PostgresTable) {
+			return fmt.Errorf("bad postgres table %q, must be a lower case SQL name", s.cfg.PostgresTable)
+		}
+		return nil
+	case "bitset":
+		return bitSetFits(p)
+	case "pebble", "dynamodb":
+		return nil
+	}
+	return fmt.Errorf("unknown dedup %q, must be map, bitset, redis, postgres, pebble or dynamodb", s.cfg.Dedup)
+}
+
+// openStore opens the Store of a stream, as Config.NewStore or Dedup say.
+// It returns nil for the map in one shard, which is Counter.Uniq.
+func (s *Server) openStore(stream string, p valueProfile) (Store, error) {
+	if s.cfg.NewStore != nil {
+		return s.cfg.NewStore(stream)
+	}
+	switch s.cfg.Dedup {
+	case "bitset":
+		if s.cfg.BitSetDir != "" {
+			return openMappedBitSet(s.cfg, stream, p)
+		}
+		return newBitSet(p), nil
+	case "redis", "postgres", "dynamodb":
+		return s.openSharedStore(stream, p)
+	case "pebble":
+		return openPebbleStore(s.cfg, stream, s.log)
+	}
+	if s.cfg.DedupWindow > 0 {
+		return newWindowSet(s.cfg.DedupWindow, s.cfg.DedupShards), nil
+	}
+	if s.cfg.DedupAffine {
+		return newAffineSet(s.cfg.DedupShards)
+	}
+	if s.cfg.DedupShards > 1 {
+		return newShardedSet(s.cfg.DedupShards), nil
+	}
+	return nil, nil
+}
+
+// openSharedStore opens the redis, postgres or dynamodb Store of a
+// stream, behind the memcached cache if there is one.
+func (s *Server) openSharedStore(stream string, p valueProfile) (Store, error) {
+	var st Store
+	var err error
+	switch s.cfg.Dedup {
+	case "redis":
+		st, err = openRedisStore(s.cfg, stream, p)
+	case "postgres":
+		st, err = openPostgresStore(s.cfg, stream)
+	default:
+		st, err = openDynamoStore(s.cfg, stream)
+	}
+	if err != nil || len(s.cfg.MemcachedAddrs) == 0 {
+		return st, err
+	}
+	cached, err := newCachedStore(s.cfg, stream, st)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return cached, nil
+}
+
+// mapSet is the default set, it grows with the values seen.
+// It's Counter.Uniq, and only safe under the Counter's lock.
+type mapSet map[int]bool
+
+func (m mapSet) Has(num int) (bool, error) { return m[num], nil }
+
+func (m mapSet) Add(num int) (bool, error) {
+	if m[num] {
+		return false, nil
+	}
+	m[num] = true
+	return true, nil
+}
+
+func (m mapSet) Remove(num int) error { delete(m, num); return nil }
+func (m mapSet) Len() (int, error)    { return len(m), nil }
+func (m mapSet) Close() error         { return nil }
+
+// shardedSet is the map dedup split into shards by value, each under
+// a lock of its own, so it's safe for concurrent use and connections
+// only wait on each other when their values land in the same shard.
+type shardedSet struct {
+	shards []mapShard
+}
+
+type mapShard struct {
+	mu sync.RWMutex
+	m  map[int]bool
+	// Keep every shard on a cache line of its own, so locking one
+	// doesn't slow down the cores working on its neighbours.
+	_ [32]byte
+}
+
+func newShardedSet(n int) *shardedSet {
+	s := &shardedSet{shards: make([]mapShard, n)}
+	for i := range s.shards {
+		s.shards[i].m = make(map[int]bool)
+	}
+	return s
+}
+
+// shard returns the shard of num, values are spread by their remainder.
+func (s *shardedSet) shard(num int) *mapShard {
+	return &s.shards[uint(num)%uint(len(s.shards))]
+}
+
+func (s *shardedSet) Has(num int) (bool, error) {
+	sh := s.shard(num)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.m[num], nil
+}
+
+func (s *shardedSet) Add(num int) (bool, error) {
+	sh := s.shard(num)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.m[num] {
+		return false, nil
+	}
+	sh.m[num] = true
+	return true, nil
+}
+
+// AddBatch locks every shard nums land in once.
+func (s *shardedSet) AddBatch(nums []int) ([]bool, error) {
+	uniq := make([]bool, len(nums))
+	done := make([]bool, len(nums))
+	for i := range nums {
+		if done[i] {
+			continue
+		}
+		sh := s.shard(nums[i])
+		sh.mu.Lock()
+		for j := i; j < len(nums); j++ {
+			if num := nums[j]; !done[j] && s.shard(num) == sh {
+				uniq[j], sh.m[num], done[j] = !sh.m[num], true, true
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return uniq, nil
+}
+
+func (s *shardedSet) Remove(num int) error {
+	sh := s.shard(num)
+	sh.mu.Lock()
+	delete(sh.m, num)
+	sh.mu.Unlock()
+	return nil
+}
+
+// Len adds up the shards one after the other, values added meanwhile
+// may or may not be counted.
+func (s *shardedSet) Len() (int, error) {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n, nil
+}
+
+func (s *shardedSet) Close() error { return nil }
+
+// windowSet is the map dedup of Config.DedupWindow: values are only
+// unique within the window, then they expire and are new again. Each
+// shard keeps windowGens+1 generations of values, a value is added to
+// the newest and is a duplicate while it's in any of them, and every
+// window/windowGens the oldest generation is dropped as a whole, so
+// values live between one window and one generation longer.
+// Generations move on lazily, whenever a shard is used.
+type windowSet struct {
+	// span is how long a generation takes new values.
+	span   time.Duration
+	shards []windowShard
+}
+
+type windowShard struct {
+	mu sync.Mutex
+	// gens are the generations in a ring by epoch, nil until they
+	// take a value.
+	gens [windowGens + 1]map[int]bool
+	// epoch is the number of the newest generation, the spans since
+	// the Unix epoch.
+	epoch int64
+}
+
+func newWindowSet(window time.Duration, shards int) *windowSet {
+	if shards < 1 {
+		shards = 1
+	}
+	span := window / windowGens
+	if span <= 0 {
+		span = 1
+	}
+	return &windowSet{span: span, shards: make([]windowShard, shards)}
+}
+
+// shard returns the shard of num with its generations moved on to
+// now, locked.
+func (w *windowSet) shard(num int) *windowShard {
+	sh := w.at(num)
+	sh.mu.Lock()
+	w.expire(sh)
+	return sh
+}
+
+// at returns the shard of num, values are spread by their remainder.
+func (w *windowSet) at(num int) *windowShard {
+	return &w.shards[uint(num)%uint(len(w.shards))]
+}
+
+// expire drops the generations of sh that fell out of the window,
+// sh.mu must be held.
+func (w *windowSet) expire(sh *windowShard) {
+	epoch := time.Now().UnixNano() / int64(w.span)
+	for e := sh.epoch + 1; e <= epoch && e <= sh.epoch+int64(len(sh.gens)); e++ {
+		sh.gens[e%int64(len(sh.gens))] = nil
+	}
+	if epoch > sh.epoch {
+		sh.epoch = epoch
+	}
+}
+
+// has reports whether num is in any generation of sh, sh.mu must be held.
+func (sh *windowShard) has(num int) bool {
+	for _, g := range sh.gens {
+		if g[num] {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *windowSet) Has(num int) (bool, error) {
+	sh := w.shard(num)
+	defer sh.mu.Unlock()
+	return sh.has(num), nil
+}
+
+// add adds num to the newest generation of sh unless it's in any,
+// sh.mu must be held.
+func (sh *windowShard) add(num int) bool {
+	if sh.has(num) {
+		return false
+	}
+	i := sh.epoch % int64(len(sh.gens))
+	if sh.gens[i] == nil {
+		sh.gens[i] = make(map[int]bool)
+	}
+	sh.gens[i][num] = true
+	return true
+}
+
+func (w *windowSet) Add(num int) (bool, error) {
+	sh := w.shard(num)
+	defer sh.mu.Unlock()
+	return sh.add(num), nil
+}
+
+// AddBatch locks every shard nums land in once, like shardedSet's.
+func (w *windowSet) AddBatch(nums []int) ([]bool, error) {
+	uniq := make([]bool, len(nums))
+	done := make([]bool, len(nums))
+	for i := range nums {
+		if done[i] {
+			continue
+		}
+		sh := w.shard(nums[i])
+		for j := i; j < len(nums); j++ {
+			if num := nums[j]; !done[j] && w.at(num) == sh {
+				uniq[j], done[j] = sh.add(num), true
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return uniq, nil
+}
+
+func (w *windowSet) Remove(num int) error {
+	sh := w.shard(num)
+	for _, g := range sh.gens {
+		delete(g, num)
+	}
+	sh.mu.Unlock()
+	return nil
+}
+
+// Len is the values within the window, it adds up the shards one
+// after the other like shardedSet's.
+func (w *windowSet) Len() (int, error) {
+	n := 0
+	for i := range w.shards {
+		sh := &w.shards[i]
+		sh.mu.Lock()
+		w.expire(sh)
+		for _, g := range sh.gens {
+			n += len(g)
+		}
+		sh.mu.Unlock()
+	}
+	return n, nil
+}
+
+func (w *windowSet) Close() error { return nil }
+
+// bitSet has a bit for every valid value of a stream, it takes
+// (max-min+1)/8 bytes up front and never grows, about 1.25 GB for the
+// default 10 digits from MinValue, 125 MB for 9.
+// It's safe for concurrent use, every bit is set and cleared with a
+// compare-and-swap.
+type bitSet struct {
+	min   int
+	words []uint64
+	n     int64
+}
+
+// bitSetFits reports whether a bitset of the values of p stays small enough.
+func bitSetFits(p valueProfile) error {
+	if bits := p.max() - p.lowest() + 1; bits > maxBitSetBits {
+		return fmt.Errorf("a bitset of %d digit values from %d takes %d MiB, over the limit of %d MiB",
+			p.length, p.lowest(), bits>>23, maxBitSetBits>>23)
+	}
+	return nil
+}
+
+// newBitSet returns a bitset of the values of p, which must fit, see bitSetFits.
+func newBitSet(p valueProfile) *bitSet {
+	bits := p.max() - p.lowest() + 1
+	return &bitSet{min: p.lowest(), words: make([]uint64, (bits+63)/64)}
+}
+
+// bit returns the word and mask of num, the word is -1 if num's out of range.
+func (b *bitSet) bit(num int) (word int, mask uint64) {
+	i := num - b.min
+	if i < 0 || i/64 >= len(b.words) {
+		return -1, 0
+	}
+	return i / 64, 1 << uint(i%64)
+}
+
+func (b *bitSet) Has(num int) (bool, error) {
+	w, mask := b.bit(num)
+	return w >= 0 && atomic.LoadUint64(&b.words[w])&mask != 0, nil
+}
+
+func (b *bitSet) Add(num int) (bool, error) {
+	w, mask := b.bit(num)
+	if w < 0 {
+		return false, fmt.Errorf("value %d is outside the bitset's range", num)
+	}
+	for {
+		old := atomic.LoadUint64(&b.words[w])
+		if old&mask != 0 {
+			return false, nil
+		}
+		if atomic.CompareAndSwapUint64(&b.words[w], old, old|mask) {
+			atomic.AddInt64(&b.n, 1)
+			return true, nil
+		}
+	}
+}
+
+func (b *bitSet) Remove(num int) error {
+	w, mask := b.bit(num)
+	if w < 0 {
+		return nil
+	}
+	for {
+		old := atomic.LoadUint64(&b.words[w])
+		if old&mask == 0 {
+			return nil
+		}
+		if atomic.CompareAndSwapUint64(&b.words[w], old, old&^mask) {
+			atomic.AddInt64(&b.n, -1)
+			return nil
+		}
+	}
+}
+
+func (b *bitSet) Len() (int, error) { return int(atomic.LoadInt64(&b.n)), nil }
+func (b *bitSet) Close() error      { return nil }
+
+// redisStore keeps the values in a Redis set, shared by every server
+// pointed at it, and kept across restarts. The key is Config.RedisKey
+// followed by the stream, e.g. go-simple-tcp-server:data.
+type redisStore struct {
+	c   *redis.Client
+	key string
+}
+
+func openRedisStore(cfg Config, stream string, p valueProfile) (Store, error) {
+	if stream == "" {
+		stream = "data"
+	}
+	addrs := append([]string{cfg.RedisAddr}, cfg.RedisShards...)
+	shards := make([]Store, 0, len(addrs))
+	for _, addr := range addrs {
+		c, err := redis.Dial(addr, redis.Options{Password: cfg.RedisPassword, DB: cfg.RedisDB})
+		if err != nil {
+			for _, sh := range shards {
+				sh.Close()
+			}
+			return nil, fmt.Errorf("could not connect to redis at %s: %v", addr, err)
+		}
+		shards = append(shards, &redisStore{c: c, key: cfg.RedisKey + ":" + stream})
+	}
+	if len(shards) == 1 {
+		return shards[0], nil
+	}
+	return newRoutedStore(shards, cfg.RedisShardBy, p), nil
+}
+
+// Add leaves num be if Redis may have added it without replying, see
+// Store: if it did, num is a duplicate from now on without being logged,
+// the OpError of the failure has it.
+func (r *redisStore) Add(num int) (bool, error) {
+	n, err := r.c.Int("SADD", r.key, strconv.Itoa(num))
+	return n == 1, err
+}
+
+// redisAddBatch adds every argument to the set of the key one after
+// the other, it returns what each SADD returned.
+const redisAddBatch = `local r = {} for i, v in ipairs(ARGV) do r[i] = redis.call('SADD', KEYS[1], v) end return r`
+
+// AddBatch runs the SADDs of nums in a script, one round trip that no
+// other client's commands interleave with. Like Add, it leaves nums be
+// if Redis may have run it without replying.
+func (r *redisStore) AddBatch(nums []int) ([]bool, error) {
+	args := append(make([]string, 0, 3+len(nums)), "EVAL", redisAddBatch, "1", r.key)
+	for _, num := range nums {
+		args = append(args, strconv.Itoa(num))
+	}
+	reply, err := r.c.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	added, ok := reply.([]interface{})
+	if !ok || len(added) != len(nums) {
+		return nil, fmt.Errorf("redis: EVAL replied %T, not an array of %d", reply, len(nums))
+	}
+	uniq := make([]bool, len(nums))
+	for i, a := range added {
+		uniq[i] = a == int64(1)
+	}
+	return uniq, nil
+}
+
+func (r *redisStore) Has(num int) (bool, error) {
+	n, err := r.c.Int("SISMEMBER", r.key, strconv.Itoa(num))
+	return n == 1, err
+}
+
+func (r *redisStore) Remove(num int) error {
+	_, err := r.c.Int("SREM", r.key, strconv.Itoa(num))
+	return err
+}
+
+func (r *redisStore) Len() (int, error) {
+	n, err := r.c.Int("SCARD", r.key)
+	return int(n), err
+}
+
+func (r *redisStore) Close() error { return r.c.Close() }
+
+// postgresName is what Config.PostgresTable may be, it goes into the
+// statements as is.
+var postgresName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// postgresStore keeps the values in a PostgreSQL table, shared by every
+// server pointed at it, and kept across restarts. The table is
+// Config.PostgresTable, one row per stream and value with the time it
+// was added, the history of what was logged.
+type postgresStore struct {
+	c      *postgres.Client
+	stream string
+	add    string
+	has    string
+	remove string
+	// addBatch takes the values as an array, e.g. {1,2}.
+	addBatch string
+	// n is the stream's rows counted when the store was opened, and
+	// those added and removed here since. Counting the table is a scan
+	// of the stream's rows, too slow for every report and STATUS, so
+	// the values other servers add meanwhile aren't in it.
+	n atomic.Int64
+}
+
+func openPostgresStore(cfg Config, stream string) (Store, error) {
+	if stream == "" {
+		stream = "data"
+	}
+	c, err := postgres.Dial(cfg.PostgresURL, postgres.Options{Password: cfg.PostgresPassword})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to postgres: %v", err)
+	}
+	t := cfg.PostgresTable
+	_, err = c.Exec("CREATE TABLE IF NOT EXISTS " + t + " (" +
+		"stream text NOT NULL, value bigint NOT NULL, added timestamptz NOT NULL DEFAULT now(), " +
+		"PRIMARY KEY (stream, value))")
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not create the postgres table %s: %v", t, err)
+	}
+	res, err := c.Exec("SELECT count(*) FROM "+t+" WHERE stream = $1", stream)
+	if err == nil && (len(res.Rows) != 1 || len(res.Rows[0]) != 1) {
+		err = fmt.Errorf("postgres: no count of %s", stream)
+	}
+	var n int
+	if err == nil {
+		n, err = strconv.Atoi(res.Rows[0][0])
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not count the values in the postgres table %s: %v", t, err)
+	}
+	p := &postgresStore{
+		c:      c,
+		stream: stream,
+		add:    "INSERT INTO " + t + " (stream, value) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		has:    "SELECT 1 FROM " + t + " WHERE stream = $1 AND value = $2",
+		remove: "DELETE FROM " + t + " WHERE stream = $1 AND value = $2",
+
+		addBatch: "INSERT INTO " + t + " (stream, value) SELECT $1, unnest($2::bigint[]) " +
+			"ON CONFLICT DO NOTHING RETURNING value",
+	}
+	p.n.Store(int64(n))
+	return p, nil
+}
+
+// Add leaves num be if the insert may have been committed without an
+// answer, like the redis store.
+func (p *postgresStore) Add(num int) (bool, error) {
+	res, err := p.c.Exec(p.add, p.stream, strconv.Itoa(num))
+	added := err == nil && res.Affected() == 1
+	if added {
+		p.n.Add(1)
+	}
+	return added, err
+}
+
+// AddBatch inserts nums in one statement, the values it returns are
+// those that were new. Like Add, it leaves them be if it may have been
+// committed without an answer.
+// The values go in as an array parameter rather than with COPY: COPY
+// can't skip the values already in the table nor say which were new,
+// it would take a temporary table and a second statement for that,
+// while a batch is at most Config.MaxBatch values of one line.
+func (p *postgresStore) AddBatch(nums []int) ([]bool, error) {
+	array := make([]byte, 0, 1+11*len(nums))
+	array = append(array, '{')
+	for i, num := range nums {
+		if i > 0 {
+			array = append(array, ',')
+		}
+		array = strconv.AppendInt(array, int64(num), 10)
+	}
+	array = append(array, '}')
+
+	res, err := p.c.Exec(p.addBatch, p.stream, string(array))
+	if err != nil {
+		return nil, err
+	}
+	added := make(map[int]bool, len(res.Rows))
+	for _, row := range res.Rows {
+		if len(row) != 1 {
+			return nil, fmt.Errorf("postgres: insert returned a row of %d columns", len(row))
+		}
+		num, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("postgres: insert returned %q: %v", row[0], err)
+		}
+		added[num] = true
+	}
+	p.n.Add(int64(len(added)))
+	uniq := make([]bool, len(nums))
+	for i, num := range nums {
+		// Only the first of a value twice in nums is new.
+		uniq[i] = added[num]
+		delete(added, num)
+	}
+	return uniq, nil
+}
+
+func (p *postgresStore) Has(num int) (bool, error) {
+	res, err := p.c.Exec(p.has, p.stream, strconv.Itoa(num))
+	return len(res.Rows) == 1, err
+}
+
+func (p *postgresStore) Remove(num int) error {
+	res, err := p.c.Exec(p.remove, p.stream, strconv.Itoa(num))
+	p.n.Add(-int64(res.Affected()))
+	return err
+}
+
+// Len is the count kept by the store, see postgresStore.n, it doesn't
+// query the table.
+func (p *postgresStore) Len() (int, error) {
+	return int(p.n.Load()), nil
+}
+
+func (p *postgresStore) Close() error { return p.c.Close() }
+
+// routedStore splits a set across Stores, each value is kept in the
+// one route picks, see Config.RedisShards. Its Len is theirs added up.
+type routedStore struct {
+	shards []Store
+	route  func(num int) int
+}
+
+// newRoutedStore splits the values of p across shards, by their hash
+// or into ranges of the valid values as even as they go.
+func newRoutedStore(shards []Store, by string, p valueProfile) *routedStore {
+	n := len(shards)
+	r := &routedStore{shards: shards}
+	if by == "range" {
+		low, span := p.lowest(), (p.max()-p.lowest())/n+1
+		r.route = func(num int) int {
+			if i := (num - low) / span; i >= 0 && i < n {
+				return i
+			}
+			return 0
+		}
+		return r
+	}
+	r.route = func(num int) int {
+		// Fibonacci hashing, so runs of values with a common step
+		// don't all land on the same shards.
+		return int((uint64(num) * 0x9E3779B97F4A7C15 >> 32) % uint64(n))
+	}
+	return r
+}
+
+func (r *routedStore) Add(num int) (bool, error) { return r.shards[r.route(num)].Add(num) }
+func (r *routedStore) Has(num int) (bool, error) { return r.shards[r.route(num)].Has(num) }
+func (r *routedStore) Remove(num int) error      { return r.shards[r.route(num)].Remove(num) }
+
+// AddBatch adds the values of every shard in one batch of their own.
+// If a shard fails, the new values the others took are removed again.
+func (r *routedStore) AddBatch(nums []int) ([]bool, error) {
+	idx := make([][]int, len(r.shards))
+	for i, num := range nums {
+		sh := r.route(num)
+		idx[sh] = append(idx[sh], i)
+	}
+	uniq := make([]bool, len(nums))
+	var added []int
+	var addedUniq []bool
+	for sh, is := range idx {
+		if len(is) == 0 {
+			continue
+		}
+		part := make([]int, len(is))
+		for k, i := range is {
+			part[k] = nums[i]
+		}
+		u, err := addBatch(r.shards[sh], part)
+		if err != nil {
+			return nil, removeNew(r, added, addedUniq, err)
+		}
+		for k, i := range is {
+			uniq[i] = u[k]
+		}
+		added, addedUniq = append(added, part...), append(addedUniq, u...)
+	}
+	return uniq, nil
+}
+
+func (r *routedStore) Len() (int, error) {
+	total := 0
+	for _, sh := range r.shards {
+		n, err := sh.Len()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (r *routedStore) Close() (err error) {
+	for _, sh := range r.shards {
+		if cerr := sh.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/internal/postgres"
+	"github.com/chandanws/go-simple-tcp-server/internal/redis"
+)
+
+// fakeRedis is a Redis server of one set that runs SADD, and the EVAL
+// of AddBatch, without ever replying, like a server whose reply is lost.
+type fakeRedis struct {
+	mu  sync.Mutex
+	set map[string]bool
+}
+
+func (f *fakeRedis) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "SADD":
+			f.set[args[2]] = true
+		case "EVAL":
+			for _, v := range args[4:] {
+				f.set[v] = true
+			}
+		case "SREM":
+			for _, v := range args[2:] {
+				delete(f.set, v)
+			}
+			fmt.Fprint(conn, ":1\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisAddNoReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Another server added and logged the value, its reply was lost.
+	f := &fakeRedis{set: map[string]bool{strconv.Itoa(MinValue): true}}
+	go f.serve(l)
+
+	c, err := redis.Dial(l.Addr().String(), redis.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &redisStore{c: c, key: "test:data"}
+	defer store.Close()
+
+	uniq, err := store.Add(MinValue)
+	var uncertain *redis.UncertainError
+	if !errors.As(err, &uncertain) || uniq {
+		t.Fatalf("Add = %v, %v, want an UncertainError", uniq, err)
+	}
+	f.mu.Lock()
+	if !f.set[strconv.Itoa(MinValue)] {
+		t.Error("another server's value taken out of the set")
+	}
+	f.mu.Unlock()
+
+	if _, err := store.AddBatch([]int{MinValue, MinValue + 1}); !errors.As(err, &uncertain) {
+		t.Fatalf("AddBatch = %v, want an UncertainError", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.set[strconv.Itoa(MinValue)] {
+		t.Error("another server's value taken out of the set")
+	}
+}
+
+// fakePostgres is a PostgreSQL server of one table of values that
+// trusts everyone and only knows the statements of the postgres store.
+// With silent it runs inserts without ever answering them.
+type fakePostgres struct {
+	silent bool
+
+	mu     sync.Mutex
+	values map[string]bool
+	// counts are the count(*) statements run.
+	counts int
+}
+
+func (f *fakePostgres) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakePostgres) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, binary.BigEndian.Uint32(size[:])-4)); err != nil {
+		return
+	}
+	pgSend(conn, 'R', []byte{0, 0, 0, 0})
+	pgSend(conn, 'Z', []byte{'I'})
+
+	prepared := make(map[string]string)
+	var query string
+	var args []string
+	for {
+		var hdr [5]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(hdr[1:])-4)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		switch hdr[0] {
+		case 'P':
+			name, rest, _ := strings.Cut(string(msg), "\x00")
+			prepared[name], _, _ = strings.Cut(rest, "\x00")
+			pgSend(conn, '1', nil)
+		case 'B':
+			_, rest, _ := strings.Cut(string(msg), "\x00")
+			name, rest, _ := strings.Cut(rest, "\x00")
+			query = prepared[name]
+			b := []byte(rest)[2:]
+			args = make([]string, binary.BigEndian.Uint16(b))
+			b = b[2:]
+			for i := range args {
+				n := binary.BigEndian.Uint32(b)
+				args[i], b = string(b[4:4+n]), b[4+n:]
+			}
+			pgSend(conn, '2', nil)
+		case 'E':
+			if !f.execute(conn, query, args) {
+				return
+			}
+		case 'S':
+			pgSend(conn, 'Z', []byte{'I'})
+		case 'X':
+			return
+		}
+	}
+}
+
+// execute runs a statement, it reports false if it wasn't answered.
+func (f *fakePostgres) execute(conn net.Conn, query string, args []string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The batch statements take an array of values, e.g. {1,2}.
+	var key string
+	var values []string
+	if len(args) == 2 {
+		key = args[0] + ":" + args[1]
+		if array, ok := strings.CutPrefix(args[1], "{"); ok {
+			values = strings.Split(strings.TrimSuffix(array, "}"), ",")
+		}
+	}
+	switch {
+	case strings.HasPrefix(query, "CREATE"):
+		pgSend(conn, 'C', []byte("CREATE TABLE\x00"))
+	case strings.HasPrefix(query, "INSERT") && values != nil:
+		var added []string
+		for _, v := range values {
+			if !f.values[args[0]+":"+v] {
+				f.values[args[0]+":"+v] = true
+				added = append(added, v)
+			}
+		}
+		if f.silent {
+			return false
+		}
+		for _, v := range added {
+			pgSend(conn, 'D', pgRow(v))
+		}
+		pgSend(conn, 'C', []byte(fmt.Sprintf("INSERT 0 %d\x00", len(added))))
+	case strings.HasPrefix(query, "INSERT"):
+		n := 0
+		if !f.values[key] {
+			f.values[key] = true
+			n = 1
+		}
+		if f.silent {
+			return false
+		}
+		pgSend(conn, 'C', []byte(fmt.Sprintf("INSERT 0 %d\x00", n)))
+	case strings.HasPrefix(query, "DELETE") && values != nil:
+		for _, v := range values {
+			delete(f.values, args[0]+":"+v)
+		}
+		pgSend(conn, 'C', []byte(fmt.Sprintf("DELETE %d\x00", len(values))))
+	case strings.HasPrefix(query, "DELETE"):
+		n := 0
+		if f.values[key] {
+			delete(f.values, key)
+			n = 1
+		}
+		pgSend(conn, 'C', []byte(fmt.Sprintf("DELETE %d\x00", n)))
+	case strings.HasPrefix(query, "SELECT count"):
+		f.counts++
+		n := 0
+		for k := range f.values {
+			if strings.HasPrefix(k, args[0]+":") {
+				n++
+			}
+		}
+		pgSend(conn, 'D', pgRow(strconv.Itoa(n)))
+		pgSend(conn, 'C', []byte("SELECT 1\x00"))
+	case strings.HasPrefix(query, "SELECT"):
+		n := 0
+		if f.values[key] {
+			pgSend(conn, 'D', pgRow("1"))
+			n = 1
+		}
+		pgSend(conn, 'C', []byte(fmt.Sprintf("SELECT %d\x00", n)))
+	}
+	return true
+}
+
+func pgSend(conn net.Conn, typ byte, body []byte) {
+	msg := append([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	conn.Write(append(msg, body...))
+}
+
+// pgRow is a DataRow of one text column.
+func pgRow(col string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, 1)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(col)))
+	return append(b, col...)
+}
+
+func servePostgres(t *testing.T, f *fakePostgres) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if f.values == nil {
+		f.values = make(map[string]bool)
+	}
+	go f.serve(l)
+	return "postgres://numbers@" + l.Addr().String() + "/numbers"
+}
+
+func TestPostgresStore(t *testing.T) {
+	cfg := testConfig(t)
+	f := &fakePostgres{}
+	cfg.PostgresURL = servePostgres(t, f)
+	cfg.PostgresTable = "numbers"
+	store, err := openPostgresStore(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i, want := range []bool{true, false} {
+		if uniq, err := store.Add(MinValue); err != nil || uniq != want {
+			t.Errorf("Add #%d = %v, %v, want %v", i+1, uniq, err, want)
+		}
+	}
+	if has, err := store.Has(MinValue); err != nil || !has {
+		t.Errorf("Has = %v, %v, want true", has, err)
+	}
+	if n, err := store.Len(); err != nil || n != 1 {
+		t.Errorf("Len = %d, %v, want 1", n, err)
+	}
+	if err := store.Remove(MinValue); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := store.Has(MinValue); err != nil || has {
+		t.Errorf("Has after Remove = %v, %v, want false", has, err)
+	}
+
+	store.Add(MinValue + 1)
+	uniq, err := store.(BatchStore).AddBatch([]int{MinValue, MinValue + 1, MinValue, MinValue + 2})
+	if want := []bool{true, false, false, true}; err != nil || !reflect.DeepEqual(uniq, want) {
+		t.Errorf("AddBatch = %v, %v, want %v", uniq, err, want)
+	}
+	if n, err := store.Len(); err != nil || n != 3 {
+		t.Errorf("Len after AddBatch = %d, %v, want 3", n, err)
+	}
+	f.mu.Lock()
+	if f.counts != 1 {
+		t.Errorf("the table was counted %d times, want once on open", f.counts)
+	}
+	f.mu.Unlock()
+
+	// Another server's store counts what's there, only its stream's.
+	other, err := openPostgresStore(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if n, err := other.Len(); err != nil || n != 3 {
+		t.Errorf("Len of a store opened later = %d, %v, want 3", n, err)
+	}
+	orders, err := openPostgresStore(cfg, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orders.Close()
+	if n, err := orders.Len(); err != nil || n != 0 {
+		t.Errorf("Len of another stream = %d, %v, want 0", n, err)
+	}
+}
+
+func TestPostgresAddNoReply(t *testing.T) {
+	// Another server added and logged the value, its answer was lost.
+	key := "data:" + strconv.Itoa(MinValue)
+	f := &fakePostgres{silent: true, values: map[string]bool{key: true}}
+	c, err := postgres.Dial(servePostgres(t, f), postgres.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &postgresStore{c: c, stream: "data",
+		add:      "INSERT INTO numbers (stream, value) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		remove:   "DELETE FROM numbers WHERE stream = $1 AND value = $2",
+		addBatch: "INSERT INTO numbers (stream, value) SELECT $1, unnest($2::bigint[]) ON CONFLICT DO NOTHING RETURNING value"}
+	defer store.Close()
+
+	uniq, err := store.Add(MinValue)
+	var uncertain *postgres.UncertainError
+	if !errors.As(err, &uncertain) || uniq {
+		t.Fatalf("Add = %v, %v, want an UncertainError", uniq, err)
+	}
+	f.mu.Lock()
+	if !f.values[key] {
+		t.Error("another server's value deleted from the table")
+	}
+	f.mu.Unlock()
+
+	if _, err := store.AddBatch([]int{MinValue, MinValue + 1}); !errors.As(err, &uncertain) {
+		t.Fatalf("AddBatch = %v, want an UncertainError", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.values[key] {
+		t.Error("another server's value deleted from the table")
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+	p := defaultProfile
+	stores := map[string]func(t *testing.T) Store{
+		"sharded": func(*testing.T) Store { return newShardedSet(4) },
+		"window":  func(*testing.T) Store { return newWindowSet(time.Hour, 4) },
+		"bitset":  func(*testing.T) Store { return newBitSet(p) },
+		"affine":  openAffineSet,
+		"routed": func(*testing.T) Store {
+			return newRoutedStore([]Store{newShardedSet(2), newBitSet(p), newShardedSet(1)}, "hash", p)
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			store.Add(MinValue + 1)
+			nums := []int{MinValue, MinValue + 1, MinValue + 5, MinValue, MinValue + 2}
+			uniq, err := addBatch(store, nums)
+			if want := []bool{true, false, true, false, true}; err != nil || !reflect.DeepEqual(uniq, want) {
+				t.Errorf("addBatch = %v, %v, want %v", uniq, err, want)
+			}
+			if n, err := store.Len(); err != nil || n != 4 {
+				t.Errorf("Len = %d, %v, want 4", n, err)
+			}
+
+			// A value the bitset can't take fails the batch, the new
+			// values before it are taken out again.
+			if name == "bitset" {
+				if _, err := addBatch(store, []int{MinValue + 3, p.max() + 1}); err == nil {
+					t.Error("added a value out of range")
+				}
+				if has, _ := store.Has(MinValue + 3); has {
+					t.Error("value of a failed batch left in the set")
+				}
+			}
+		})
+	}
+}
+
+// openAffineSet returns an affineSet of 4 shards, it's closed when the
+// test ends.
+func openAffineSet(t *testing.T) Store {
+	s, err := newAffineSet(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAffineSet(t *testing.T) {
+	s := openAffineSet(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s.Add(MinValue + i)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := s.Len(); err != nil || n != 100 {
+		t.Errorf("Len = %d, %v, want 100", n, err)
+	}
+	if err := s.Remove(MinValue); err != nil {
+		t.Fatal(err)
+	}
+	for num, want := range map[int]bool{MinValue: false, MinValue + 1: true, MinValue + 100: false} {
+		if has, err := s.Has(num); err != nil || has != want {
+			t.Errorf("Has(%d) = %v, %v, want %v", num, has, err, want)
+		}
+	}
+
+	s.Close()
+	if _, err := s.Add(MinValue); err == nil {
+		t.Error("added to a closed set")
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// streamName keeps stream names safe to use in log file names.
+var streamName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// stream is a named stream of values, counted, deduplicated and logged
+// separately from the main one and from other streams.
+// Values reach it on connections to its own port, or as
+// "<prefix> <value>" lines on any connection.
+type stream struct {
+	name    string
+	port    int
+	prefix  string
+	counter *Counter
+}
+
+// parseStream parses a stream spec: the name, then optionally a colon
+// and comma separated key=value settings, e.g.
+//
+//	orders:port=3281,len=9,min=100000000
+func (s *Server) parseStream(spec string) (st *stream, err error) {
+	name, settings := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, settings = spec[:i], spec[i+1:]
+	}
+	if !streamName.MatchString(name) {
+		return nil, fmt.Errorf("stream name %q must be lower case letters, digits, - and _", name)
+	}
+	if name == "data" || name == "diag" {
+		// Those are the main log and the diagnostic dumps.
+		return nil, fmt.Errorf("stream name %q is reserved", name)
+	}
+
+	st = &stream{name: name}
+	p := s.profile
+	limit := s.cfg.DailyQuota
+	for _, kv := range strings.Split(settings, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("stream %s: setting %q isn't key=value", name, kv)
+		}
+
+		switch k {
+		case "port":
+			st.port, err = strconv.Atoi(v)
+		case "prefix":
+			st.prefix = v
+		case "len":
+			p.length, err = strconv.Atoi(v)
+		case "min":
+			p.min, err = strconv.Atoi(v)
+		case "max":
+			p.upper, err = strconv.Atoi(v)
+		case "zeros":
+			p.zeros = v
+		case "quota":
+			if limit, err = strconv.Atoi(v); err == nil && limit < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		default:
+			return nil, fmt.Errorf("stream %s: unknown setting %q", name, k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: bad %s: %v", name, k, err)
+		}
+	}
+
+	if st.port == 0 && st.prefix == "" {
+		return nil, fmt.Errorf("stream %s: needs a port or a prefix to receive values on", name)
+	}
+	if err = p.check(); err != nil {
+		return nil, fmt.Errorf("stream %s: %v", name, err)
+	}
+	if err = s.checkDedup(p); err != nil {
+		return nil, fmt.Errorf("stream %s: %v", name, err)
+	}
+	// A prefixed value line must stay within maxLine.
+	if len(st.prefix)+1+p.length > maxLine {
+		return nil, fmt.Errorf("stream %s: prefix %s is too long", name, st.prefix)
+	}
+
+	if st.counter, err = s.newCounter(name, logFormat(s.cfg.LogDir, name), p); err != nil {
+		return nil, fmt.Errorf("stream %s: %v", name, err)
+	}
+	st.counter.quota = newQuota(name, limit, s.usage)
+	return st, nil
+}
+
+// openStreams sets up every stream of the Config and claims their prefixes,
+// Serve listens on their ports.
+func (s *Server) openStreams() error {
+	for _, spec := range s.cfg.Streams {
+		st, err := s.parseStream(spec)
+		if err != nil {
+			return err
+		}
+		// Keep it before checking the prefix, so it's closed on failure.
+		s.streams = append(s.streams, st)
+
+		if st.prefix != "" {
+			if _, taken := s.commands[st.prefix]; taken {
+				return fmt.Errorf("stream %s: prefix %s is already a command", st.name, st.prefix)
+			}
+			if other, taken := s.prefixes[st.prefix]; taken {
+				return fmt.Errorf("stream %s: prefix %s is already used by stream %s", st.name, st.prefix, other.name)
+			}
+			s.prefixes[st.prefix] = st
+		}
+	}
+	return nil
+}
+
+// handle records the value of a "<prefix> <value>" line, or the values
+// of a batch.
+func (st *stream) handle(cl *client, args []byte) error {
+	return recordLine(cl, st.counter, args)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+const (
+	// subscribeCmd pushes the interval reports of the connection's
+	// stream to it until it hangs up: "SUBSCRIBE stats" the report
+	// lines, "SUBSCRIBE stats json" a Stats object per line.
+	// The server answers with subscribedReply.
+	subscribeCmd    = "SUBSCRIBE"
+	subscribedReply = "SUBSCRIBED\n"
+)
+
+// subscriber is a connection the interval reports are pushed to.
+// Reports go through ch to a goroutine of its own, which writes them
+// to the connection, so a slow reader doesn't hold up the reports.
+type subscriber struct {
+	json bool
+	ch   chan string
+}
+
+func handleSubscribe(cl *client, args string) error {
+	var asJSON bool
+	switch strings.TrimSpace(args) {
+	case "stats":
+	case "stats json":
+		asJSON = true
+	default:
+		return cl.malformed(malformedReply)
+	}
+	// The reply goes out first, the first report may be right behind.
+	if err := cl.reply(subscribedReply); err != nil {
+		return err
+	}
+	if err := cl.flush(); err != nil {
+		return err
+	}
+	cl.counter.subscribe(cl.stats, cl.conn, asJSON)
+	return nil
+}
+
+// subscribe pushes the reports to w until the connection of cs is
+// untracked. Subscribing again only switches the format.
+// A report the subscriber isn't done writing by the next one is
+// dropped for it.
+func (c *Counter) subscribe(cs *connStats, w io.Writer, asJSON bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.conns[cs]; !ok {
+		return
+	}
+	if sub := c.subs[cs]; sub != nil {
+		sub.json = asJSON
+		return
+	}
+	sub := &subscriber{json: asJSON, ch: make(chan string, 1)}
+	c.subs[cs] = sub
+	go func() {
+		for report := range sub.ch {
+			if _, err := io.WriteString(w, report); err != nil {
+				// Drain until untracked, the handler sees the error too.
+				for range sub.ch {
+				}
+			}
+		}
+	}()
+}
+
+// publish pushes an interval report and its stats to the subscribers.
+func (c *Counter) publish(report string, st Stats) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var line string
+	for _, sub := range c.subs {
+		msg := report
+		if sub.json {
+			if line == "" {
+				b, _ := json.Marshal(st)
+				line = string(b) + "\n"
+			}
+			msg = line
+		}
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tarpitDrip is how often a tarpitted connection gets its next byte.
+const tarpitDrip = time.Second
+
+// tarpitReply is what tarpitted connections get, a byte at a time.
+const tarpitReply = "Server busy."
+
+// tarpit holds the connections of denied peers open for a while,
+// trickling tarpitReply, so scanners are slowed down instead of being
+// told right away. Held connections take no slot of the connection
+// limits, nor a goroutine of the worker pool.
+type tarpit struct {
+	hold time.Duration
+	max  int64
+	// done closes the held connections on shutdown.
+	done <-chan struct{}
+
+	// held are the connections held now, trapped all that ever were.
+	held    int64
+	trapped int64
+}
+
+// newTarpit returns nil if hold is 0.
+func newTarpit(hold time.Duration, max int, done <-chan struct{}) *tarpit {
+	if hold == 0 {
+		return nil
+	}
+	return &tarpit{hold: hold, max: int64(max), done: done}
+}
+
+// trap holds conn open on its own goroutine, it reports false if the
+// tarpit is full, or off, and conn is left to the caller.
+func (t *tarpit) trap(conn net.Conn) bool {
+	if t == nil {
+		return false
+	}
+	if atomic.AddInt64(&t.held, 1) > t.max {
+		atomic.AddInt64(&t.held, -1)
+		return false
+	}
+	atomic.AddInt64(&t.trapped, 1)
+	go t.drip(conn)
+	return true
+}
+
+// drip writes tarpitReply to conn a byte every tarpitDrip, over and
+// over, until the hold is up or the server shuts down.
+// Must be run on go routine.
+func (t *tarpit) drip(conn net.Conn) {
+	defer atomic.AddInt64(&t.held, -1)
+	defer conn.Close()
+
+	tick := time.NewTicker(tarpitDrip)
+	defer tick.Stop()
+	end := time.NewTimer(t.hold)
+	defer end.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-tick.C:
+			// A peer that doesn't read isn't waited for.
+			conn.SetWriteDeadline(time.Now().Add(tarpitDrip))
+			if _, err := conn.Write([]byte{tarpitReply[i%len(tarpitReply)]}); err != nil {
+				return
+			}
+		case <-end.C:
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// report is the interval output line of the tarpit.
+func (t *tarpit) report() string {
+	return fmt.Sprintf("Tarpit      : %d held, %d trapped\n",
+		atomic.LoadInt64(&t.held), atomic.LoadInt64(&t.trapped))
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTarpit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Deny = []string{"127.0.0.1"}
+	cfg.Tarpit = time.Minute
+	cfg.MaxConns = 1
+	srv, addr := serveTest(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != tarpitReply[:2] {
+		t.Fatalf("read %q, %v, want the reply trickling in", b, err)
+	}
+	if n := atomic.LoadInt64(&srv.tarpit.held); n != 1 {
+		t.Errorf("%d connections held, want 1", n)
+	}
+	// The held connection doesn't take the only slot.
+	if used, _ := srv.counter.sem.inUse(); used != 0 {
+		t.Errorf("%d slots taken by the tarpit", used)
+	}
+
+	srv.Shutdown(context.Background())
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("held connection not closed on shutdown: %v", err)
+	}
+}
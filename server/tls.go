@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTLSPort is where Config.TLSAddr listens if only the port is missing.
+const DefaultTLSPort = 3443
+
+// certPoll is how often the certificate files are checked for changes.
+const certPoll = 10 * time.Second
+
+// certStore serves the current key pair to TLS handshakes, so a
+// certificate rotated by an ACME client is picked up without a restart.
+// Without TLS it has no files and no key pair, until Reload sets them.
+type certStore struct {
+	mu                sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	// mtimes are the modification times of the loaded files.
+	mtimes [2]time.Time
+}
+
+// files returns the names of the key pair's files.
+func (c *certStore) files() (certFile, keyFile string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.certFile, c.keyFile
+}
+
+// load reads the key pair, keeping the current one if it's broken,
+// e.g. half written.
+func (c *certStore) load() error {
+	certFile, keyFile := c.files()
+	if certFile == "" {
+		return nil
+	}
+
+	mtimes, err := statCerts(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS key pair: %v", err)
+	}
+
+	c.mu.Lock()
+	// Unless use switched to other files meanwhile.
+	if c.certFile == certFile && c.keyFile == keyFile {
+		c.cert, c.mtimes = &cert, mtimes
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// use switches to the key pair in certFile and keyFile, it keeps the
+// current one if they can't be loaded. Empty names drop the key pair.
+func (c *certStore) use(certFile, keyFile string) error {
+	next := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := next.load(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.certFile, c.keyFile, c.cert, c.mtimes = certFile, keyFile, next.cert, next.mtimes
+	c.mu.Unlock()
+	return nil
+}
+
+func statCerts(certFile, keyFile string) (mtimes [2]time.Time, err error) {
+	for i, name := range []string{certFile, keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return mtimes, fmt.Errorf("could not stat TLS key pair: %v", err)
+		}
+		mtimes[i] = fi.ModTime()
+	}
+	return
+}
+
+// changed reports whether either file was modified since it was loaded.
+func (c *certStore) changed() bool {
+	certFile, keyFile := c.files()
+	if certFile == "" {
+		return false
+	}
+	mtimes, err := statCerts(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return mtimes != c.mtimes
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// checkTLS reports what's wrong with the TLS settings of cfg.
+func checkTLS(cfg Config) error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	if cfg.QUICAddr != "" && cfg.TLSCert == "" {
+		return fmt.Errorf("QUIC needs a TLS certificate and key")
+	}
+	return nil
+}
+
+// listenTLS listens on addr for TLS connections served the store's key pair.
+func (s *Server) listenTLS(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The PROXY header comes before the TLS handshake.
+	return tls.NewListener(s.proxied(l), &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}), nil
+}
+
+// watchCerts reloads the key pair whenever its files change, until Shutdown.
+// Must be run on go routine.
+func (s *Server) watchCerts() {
+	tick := time.NewTicker(certPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-s.done:
+			return
+		}
+
+		if !s.certs.changed() {
+			continue
+		}
+		if err := s.certs.load(); err != nil {
+			s.log.Error("could not reload TLS certificate", "err", err)
+			continue
+		}
+		s.log.Info("reloaded TLS certificate")
+	}
+}
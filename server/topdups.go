@@ -0,0 +1,142 @@
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dupTrackFactor is how many more values a dupTracker keeps than it
+// reports, the more it keeps the likelier the top ones are exact.
+const dupTrackFactor = 10
+
+// dupTracker counts how often duplicate values are resubmitted, to find
+// the producers that keep resending the same ones, see
+// Config.TopDuplicates. It's the Space-Saving algorithm: it keeps at
+// most size values, and a value it doesn't keep takes the place of the
+// least resubmitted one, so memory stays flat however many values
+// repeat. A value that took another's place counts from that one's
+// count, over counting by at most its err.
+//
+// A nil *dupTracker tracks nothing.
+type dupTracker struct {
+	mu sync.Mutex
+	// n is how many values are reported, size how many are kept.
+	n      int
+	size   int
+	byNum  map[int]*dupCount
+	counts dupHeap
+}
+
+// dupCount is a tracked value and how often it was resubmitted.
+type dupCount struct {
+	num   int
+	count int
+	err   int
+	// i is the index in the heap.
+	i int
+}
+
+func newDupTracker(top int) *dupTracker {
+	if top == 0 {
+		return nil
+	}
+	size := top * dupTrackFactor
+	return &dupTracker{n: top, size: size, byNum: make(map[int]*dupCount, size)}
+}
+
+// saw counts a resubmission of num.
+func (t *dupTracker) saw(num int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.byNum[num]; ok {
+		d.count++
+		heap.Fix(&t.counts, d.i)
+		return
+	}
+	if len(t.counts) < t.size {
+		d := &dupCount{num: num, count: 1}
+		t.byNum[num] = d
+		heap.Push(&t.counts, d)
+		return
+	}
+
+	// Take the place of the least resubmitted value.
+	d := t.counts[0]
+	delete(t.byNum, d.num)
+	d.num, d.err = num, d.count
+	d.count++
+	t.byNum[num] = d
+	heap.Fix(&t.counts, 0)
+}
+
+// top returns the n values resubmitted most often, most first,
+// as many as are reported if n is 0.
+func (t *dupTracker) top(n int) []dupCount {
+	if t == nil {
+		return nil
+	}
+	if n == 0 {
+		n = t.n
+	}
+	t.mu.Lock()
+	top := make([]dupCount, len(t.counts))
+	for i, d := range t.counts {
+		top[i] = *d
+	}
+	t.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+		return top[i].num < top[j].num
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// formatDups formats counts as space separated value=count pairs,
+// with a ~ before counts that may be over counted.
+func formatDups(counts []dupCount) string {
+	pairs := make([]string, len(counts))
+	for i, d := range counts {
+		approx := ""
+		if d.err > 0 {
+			approx = "~"
+		}
+		pairs[i] = fmt.Sprintf("%d=%s%d", d.num, approx, d.count)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// dupHeap is a min heap of the tracked values by count.
+type dupHeap []*dupCount
+
+func (h dupHeap) Len() int           { return len(h) }
+func (h dupHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h dupHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+
+func (h *dupHeap) Push(x interface{}) {
+	d := x.(*dupCount)
+	d.i = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *dupHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
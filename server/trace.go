@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTracer records detailed timings and decisions of sampled requests.
+// Only the sampled subset pays for it, everything else costs a nil check,
+// or a random draw while a sampling rate is set.
+type requestTracer struct {
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	rate float64
+}
+
+// openTracer creates (or truncates) the trace file at name.
+func openTracer(name string, rate float64) (*requestTracer, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("trace rate must be between 0 and 1")
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("could not open trace file: %v", err)
+	}
+	return &requestTracer{f: f, enc: json.NewEncoder(f), rate: rate}, nil
+}
+
+// sampled decides whether the client's next request is traced.
+func (t *requestTracer) sampled(cl *client) bool {
+	if t == nil {
+		return false
+	}
+	return cl.sess.caps["trace"] || (t.rate > 0 && rand.Float64() < t.rate)
+}
+
+// Close closes the trace file.
+func (t *requestTracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+// traceRecord is one traced request, as written to the trace file.
+type traceRecord struct {
+	Time     time.Time    `json:"time"`
+	Remote   string       `json:"remote"`
+	Line     string       `json:"line"`
+	Decision string       `json:"decision"`
+	TotalNs  int64        `json:"total_ns"`
+	Stages   []traceStage `json:"stages,omitempty"`
+}
+
+type traceStage struct {
+	Name string `json:"name"`
+	Ns   int64  `json:"ns"`
+}
+
+// span collects what happens to a traced request. Handlers mark the
+// stages they go through and the decision they came to, every method
+// is a no-op on the nil span of requests that aren't traced.
+type span struct {
+	start    time.Time
+	last     time.Time
+	decision string
+	stages   []traceStage
+}
+
+// mark ends a stage, timed from the previous mark.
+func (s *span) mark(stage string) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.stages = append(s.stages, traceStage{Name: stage, Ns: int64(now.Sub(s.last))})
+	s.last = now
+}
+
+// decide records what the request amounted to.
+func (s *span) decide(decision string) {
+	if s != nil {
+		s.decision = decision
+	}
+}
+
+// tracedDispatch is handing a line to the Handler with a span attached
+// to the client for the duration of the request. The span goes to the
+// trace file if toFile, and to the connection's OpenTelemetry trace
+// while it takes lines.
+func tracedDispatch(cl *client, b []byte, toFile bool) error {
+	now := time.Now()
+	cl.span = &span{start: now, last: now}
+	line := string(b)
+
+	var err error
+	if cl.srv.instrumentOn() {
+		err = instrumentedDispatch(cl, b)
+	} else {
+		err = cl.handle(b)
+	}
+
+	s := cl.span
+	cl.span = nil
+	if s.decision == "" {
+		verb := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb = line[:i]
+		}
+		s.decision = strings.ToLower(verb)
+	}
+
+	if cl.otel.traceLine() {
+		cl.otel.line(s, line, err)
+	}
+	if !toFile {
+		return err
+	}
+
+	r := traceRecord{
+		Time:     s.start.UTC(),
+		Remote:   cl.conn.RemoteAddr().String(),
+		Line:     line,
+		Decision: s.decision,
+		TotalNs:  int64(time.Since(s.start)),
+		Stages:   s.stages,
+	}
+
+	tracer := cl.srv.tracer
+	tracer.mu.Lock()
+	// Like captures, traces are a debugging aid and never fail a request.
+	if werr := tracer.enc.Encode(r); werr != nil {
+		cl.log.Error("could not write trace", "err", werr)
+	}
+	tracer.mu.Unlock()
+
+	return err
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// maxDatagram is the largest UDP payload there is.
+const maxDatagram = 64 << 10
+
+// udpReceiver takes values from fire-and-forget senders: every datagram
+// carries one or more newline separated values, which go through the
+// same validation and dedup as values sent over TCP. Nothing is sent
+// back, malformed values are dropped and only counted.
+type udpReceiver struct {
+	pc      net.PacketConn
+	srv     *Server
+	counter *Counter
+
+	// datagrams and malformed are totals for the interval output.
+	datagrams int64
+	malformed int64
+}
+
+// serve reads datagrams until the PacketConn is closed by Shutdown.
+// Must be run on go routine.
+func (u *udpReceiver) serve() {
+	defer u.srv.handlers.Done()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			if u.srv.closing() {
+				return
+			}
+			u.srv.log.Error("could not read datagram", "err", err)
+			continue
+		}
+
+		// Like connections, datagrams are turned away during maintenance
+		// and from peers the allow and deny lists keep out.
+		if u.srv.inMaintenance() || !u.srv.acl.permits(from) {
+			continue
+		}
+		atomic.AddInt64(&u.datagrams, 1)
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if !u.srv.cfg.StrictLines {
+				line = strings.TrimRight(line, lineSpace)
+			}
+			if line != "" {
+				u.handle(line, from)
+			}
+		}
+	}
+}
+
+func (u *udpReceiver) handle(line string, from net.Addr) {
+	u.srv.metrics.sawLine()
+	num, ok := u.counter.parse(line)
+	if !ok || u.srv.validate(u.counter, num) != nil {
+		atomic.AddInt64(&u.malformed, 1)
+		u.srv.metrics.sawMalformed()
+		return
+	}
+
+	// Same policy as TCP values, logging is part of our reqs.
+	uniq, err := u.counter.Record(num)
+	if err == errHandedOver || err == errRecovering || err == errQuotaExceeded {
+		return
+	}
+	if err != nil {
+		u.srv.opError(&OpError{Op: "log", Remote: from.String(), Stream: u.counter.name, Value: num, Err: err})
+		return
+	}
+	u.srv.metrics.sawValue(uniq)
+	if uniq {
+		u.srv.emitUnique(u.counter, num)
+	}
+}
+
+// report is the receiver's line of the interval output.
+func (u *udpReceiver) report() string {
+	return fmt.Sprintf("UDP         : %d datagrams, %d malformed\n",
+		atomic.LoadInt64(&u.datagrams), atomic.LoadInt64(&u.malformed))
+}
+
+// listenUDP starts receiving datagrams on addr, until Shutdown.
+func (s *Server) listenUDP(addr string) error {
+	if s.closing() {
+		return ErrServerClosed
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.udp = &udpReceiver{pc: pc, srv: s, counter: s.counter}
+	s.handlers.Add(1)
+	go s.udp.serve()
+	go func() {
+		<-s.done
+		pc.Close()
+	}()
+	s.log.Info("listening", "addr", pc.LocalAddr().String(), "for", "UDP")
+	return nil
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnix listens on the Unix domain socket path.
+// A socket file left behind by a server that died is replaced,
+// one a running server still answers on is not.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket: %v", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "context"
+
+// runService is a no-op, services are a Windows thing; under systemd
+// and the like the server runs as a plain process.
+func runService(ctx context.Context) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
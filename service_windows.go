@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var windowsService = flag.Bool("windows-service", false, "run as a Windows service, started and stopped by the service control manager")
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcherW = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus            = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceRunning     = 4
+	serviceStopPending = 3
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented = 120
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service is the server running under the service control manager.
+type service struct {
+	handle  uintptr
+	cancel  context.CancelFunc
+	running chan bool
+	// stopped is closed once the server shut down,
+	// dispatched once the dispatcher returned.
+	stopped    chan bool
+	dispatched chan error
+}
+
+// runService connects to the service control manager with
+// -windows-service. The returned context is done once the service is
+// asked to stop, and stop reports it stopped once the server shut down.
+func runService(ctx context.Context) (context.Context, func(), error) {
+	if !*windowsService {
+		return ctx, func() {}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	svc := &service{
+		cancel:     cancel,
+		running:    make(chan bool),
+		stopped:    make(chan bool),
+		dispatched: make(chan error, 1),
+	}
+	go func() {
+		// The dispatcher runs the service on this thread until it stops.
+		runtime.LockOSThread()
+		name, _ := syscall.UTF16PtrFromString("")
+		table := []serviceTableEntry{{name: name, proc: syscall.NewCallback(svc.main)}, {}}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			svc.dispatched <- err
+			return
+		}
+		svc.dispatched <- nil
+	}()
+
+	select {
+	case <-svc.running:
+	case err := <-svc.dispatched:
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, func() {
+		close(svc.stopped)
+		<-svc.dispatched
+	}, nil
+}
+
+// main is the ServiceMain of the service.
+func (svc *service) main(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString("")
+	svc.handle, _, _ = procRegisterServiceCtrlHandlerW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(svc.control), 0)
+	svc.setStatus(serviceRunning)
+	close(svc.running)
+
+	<-svc.stopped
+	svc.setStatus(serviceStopped)
+	return 0
+}
+
+// control is the HandlerEx of the service.
+func (svc *service) control(ctrl, event, data, ctx uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		svc.setStatus(serviceStopPending)
+		svc.cancel()
+	case serviceControlInterrogate:
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+func (svc *service) setStatus(state uint32) {
+	st := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state}
+	switch state {
+	case serviceRunning:
+		st.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case serviceStopPending:
+		// Draining takes up to the grace period.
+		st.WaitHint = uint32((*shutdownGrace + 5*time.Second) / time.Millisecond)
+	}
+	procSetServiceStatus.Call(svc.handle, uintptr(unsafe.Pointer(&st)))
+}
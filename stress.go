@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// runStress implements the "stress" subcommand.
+// It hammers a Counter from many goroutines with a deliberately small
+// keyspace, so the same value regularly arrives on several goroutines
+// at once, while rotating the log and reading snapshots concurrently.
+// Afterwards it checks the invariants documented on Counter.
+// Build with -race to have the race detector watch the run as well.
+func runStress(args []string) (err error) {
+	fs := flag.NewFlagSet("stress", flag.ExitOnError)
+	workers := fs.Int("workers", 500, "goroutines submitting values")
+	perWorker := fs.Int("n", 20000, "values submitted by each goroutine")
+	keys := fs.Int("keys", 50000, "size of the keyspace values are drawn from")
+	rotate := fs.Duration("rotate", 5*time.Millisecond, "log rotation interval during the run")
+	fs.Parse(args)
+
+	dir, err := os.MkdirTemp("", "counter-stress")
+	if err != nil {
+		return fmt.Errorf("could not create log directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := server.NewCounter(1, filepath.Join(dir, "data.%d.log"))
+	if err != nil {
+		return err
+	}
+
+	var (
+		violations []string
+		vmu        sync.Mutex
+		reported   int64
+		seen       = make([]int32, *keys)
+	)
+	violate := func(format string, a ...interface{}) {
+		vmu.Lock()
+		violations = append(violations, fmt.Sprintf(format, a...))
+		vmu.Unlock()
+	}
+
+	done := make(chan bool)
+	var bg sync.WaitGroup
+
+	// Rotate the log as fast as we're allowed to.
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		for {
+			select {
+			case <-time.After(*rotate):
+				if err := c.FlushRotate(); err != nil {
+					violate("rotate: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Snapshots must never see more uniques than totals,
+	// nor totals going backwards.
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		last := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+			uniq, total, intvl := c.Counts()
+			if uniq > total || intvl > total || total < last {
+				violate("inconsistent snapshot: uniq=%d total=%d intvl=%d last=%d", uniq, total, intvl, last)
+			}
+			last = total
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < *perWorker; i++ {
+				k := rnd.Intn(*keys)
+				uniq, err := c.Record(server.MinValue + k)
+				if err != nil {
+					violate("record: %v", err)
+					return
+				}
+				atomic.StoreInt32(&seen[k], 1)
+				if uniq {
+					atomic.AddInt64(&reported, 1)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(done)
+	bg.Wait()
+
+	if err = c.FlushClose(); err != nil {
+		return
+	}
+
+	distinct := 0
+	for _, s := range seen {
+		distinct += int(s)
+	}
+
+	total := *workers * *perWorker
+	uniq, cnt, _ := c.Counts()
+	if cnt != total {
+		violate("total is %d, want %d", cnt, total)
+	}
+	if uniq != distinct {
+		violate("unique set has %d values, want %d", uniq, distinct)
+	}
+	if int(reported) != distinct {
+		violate("Record reported %d new values, want %d", reported, distinct)
+	}
+
+	logged, err := countSegments(dir)
+	if err != nil {
+		return
+	}
+	for v, n := range logged {
+		if n != 1 {
+			violate("%d logged %d times", v, n)
+		}
+	}
+	if len(logged) != distinct {
+		violate("%d values logged, want %d", len(logged), distinct)
+	}
+
+	fmt.Printf(
+		"%d goroutines, %d values (%d distinct) in %v, %d log segments, %.0f values/sec\n",
+		*workers, total, distinct, elapsed, c.Log.Cnt+1, float64(total)/elapsed.Seconds())
+
+	if len(violations) > 0 {
+		for _, v := range violations {
+			fmt.Fprintln(os.Stderr, "violation:", v)
+		}
+		return fmt.Errorf("%d invariant violations", len(violations))
+	}
+
+	fmt.Println("All invariants held.")
+	return nil
+}
+
+// countSegments tallies how often each value appears across the log segments in dir.
+func countSegments(dir string) (map[int]int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	logged := make(map[int]int)
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not open log file: %v", err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			v, err := strconv.Atoi(scanner.Text())
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("corrupt line %q in %s", scanner.Text(), name)
+			}
+			logged[v]++
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("could not read log file: %v", err)
+		}
+	}
+
+	return logged, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+var (
+	gcPercent  = flag.String("gcpercent", "", "garbage collection target percentage, like GOGC; \"off\" disables the collector")
+	memLimit   = flag.String("memlimit", "", "soft memory limit, like GOMEMLIMIT, e.g. 1536MiB or 2GiB")
+	ballastLen = flag.String("ballast", "", "size of a heap ballast allocated at startup, e.g. 256MiB")
+	maxProcs   = flag.Int("maxprocs", 0, "GOMAXPROCS override, 0 keeps the runtime default")
+)
+
+// ballast is never read or written.
+// It only inflates the heap size the collector paces itself against,
+// so small heaps don't collect constantly. Its pages are never touched,
+// so it doesn't take up resident memory.
+var ballast []byte
+
+// applyTuning applies the runtime tuning flags.
+// Unset flags leave the runtime (and its environment variables) alone.
+func applyTuning() error {
+	if *maxProcs > 0 {
+		runtime.GOMAXPROCS(*maxProcs)
+	}
+
+	if *gcPercent != "" {
+		pct := -1
+		if *gcPercent != "off" {
+			var err error
+			if pct, err = strconv.Atoi(*gcPercent); err != nil || pct < 0 {
+				return fmt.Errorf("invalid -gcpercent %q", *gcPercent)
+			}
+		}
+		debug.SetGCPercent(pct)
+	}
+
+	if *memLimit != "" {
+		n, err := parseSize(*memLimit)
+		if err != nil {
+			return fmt.Errorf("invalid -memlimit: %v", err)
+		}
+		debug.SetMemoryLimit(n)
+	}
+
+	if *ballastLen != "" {
+		n, err := parseSize(*ballastLen)
+		if err != nil {
+			return fmt.Errorf("invalid -ballast: %v", err)
+		}
+		ballast = make([]byte, n)
+	}
+
+	return nil
+}
+
+// sizeUnits are the suffixes accepted by parseSize, longest first.
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses a byte size such as 512MiB, 2G or 1048576.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSpace(s)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			mult, num = u.mult, strings.TrimSpace(strings.TrimSuffix(num, u.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chandanws/go-simple-tcp-server/server"
+)
+
+// replayTimeout is how long verify -replay waits for the server to
+// have taken every value it sent.
+const replayTimeout = time.Minute
+
+// runVerify implements the "verify" subcommand.
+// It audits a stream's log for the unique guarantee: every value logged
+// once, every line a valid value. The unique values can then be written
+// to a fresh segment the server recovers from, or sent to a server.
+func runVerify(args []string) (err error) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("logs", "logs", "log directory to verify, unless files are given")
+	base := fs.String("stream", "data", "stream whose log to verify, data is the main one")
+	keyFile := fs.String("key", "", "key file to decrypt encrypted segments with")
+	valueLen := fs.Int("value-len", server.ValidLen, "digits of a valid value")
+	minValue := fs.Int("min-value", server.MinValue, "smallest valid value")
+	maxValue := fs.Int("max-value", 0, "largest valid value, the largest of -value-len digits if 0")
+	out := fs.String("o", "", "write every unique valid value to this file, a segment to -recover from, e.g. fresh/data.0.log")
+	replay := fs.String("replay", "", "send every unique valid value to the server at this address, zero padded to -value-len")
+	show := fs.Int("show", 10, "how many problems of each kind to list")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags] [log file]...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Without files the segments of -stream in -logs are verified, oldest first.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *maxValue == 0 {
+		*maxValue = int(math.Pow10(*valueLen)) - 1
+	}
+
+	var keys *server.Keyring
+	if *keyFile != "" {
+		if keys, err = server.LoadKeyring(*keyFile); err != nil {
+			return
+		}
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		segs, err := server.LogSegments(*dir, *base)
+		if err != nil {
+			return err
+		}
+		for _, s := range segs {
+			files = append(files, s.Path)
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no segments of %s in %s", *base, *dir)
+	}
+
+	// Every unique value goes to both, in the order it was logged.
+	var seg *bufio.Writer
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("could not create segment: %v", err)
+		}
+		defer f.Close()
+		seg = bufio.NewWriter(f)
+	}
+	var rp *replayer
+	if *replay != "" {
+		if rp, err = dialReplay(*replay); err != nil {
+			return err
+		}
+		defer rp.conn.Close()
+	}
+
+	v := logVerifier{first: make(map[int]int32), min: *minValue, max: *maxValue, show: *show}
+	for i, name := range files {
+		f, err := server.OpenLogReader(name, keys)
+		if err != nil {
+			return err
+		}
+		err = v.verify(f, i, files, func(num int) {
+			if seg != nil {
+				// As the server logs it.
+				seg.WriteString(strconv.Itoa(num) + "\n")
+			}
+			if rp != nil {
+				fmt.Fprintf(rp.w, "%0*d\n", *valueLen, num)
+			}
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", name, err)
+		}
+	}
+
+	if seg != nil {
+		if err = seg.Flush(); err != nil {
+			return fmt.Errorf("could not write segment: %v", err)
+		}
+	}
+	v.report(len(files))
+	if rp != nil {
+		if err = rp.finish(); err != nil {
+			return err
+		}
+		fmt.Printf("replayed    : %d values to %s, %d errors\n", v.unique, *replay, rp.errors)
+	}
+
+	if n := v.duplicates + v.corrupt + v.outOfRange; n > 0 {
+		return fmt.Errorf("unique guarantee broken, %d bad lines", n)
+	}
+	return nil
+}
+
+// logVerifier tallies the lines of a stream's log files.
+type logVerifier struct {
+	// first is the index of the file a value was first logged in.
+	first    map[int]int32
+	min, max int
+	show     int
+
+	lines, unique, duplicates, corrupt, outOfRange, torn int
+}
+
+// verify reads the log file files[i], calling unique with every value
+// not seen in it or the files before.
+func (v *logVerifier) verify(r io.Reader, i int, files []string, unique func(int)) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := br.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		v.lines++
+		at := fmt.Sprintf("%s:%d", files[i], line)
+
+		num, perr := strconv.Atoi(strings.TrimSuffix(text, "\n"))
+		switch {
+		case err == io.EOF:
+			// A last line without its newline, a crash cut it short.
+			v.torn++
+			v.problem(v.torn, "torn line %q at %s", text, at)
+		case perr != nil:
+			v.corrupt++
+			v.problem(v.corrupt, "corrupt line %q at %s", strings.TrimSuffix(text, "\n"), at)
+		case num < v.min || num > v.max:
+			v.outOfRange++
+			v.problem(v.outOfRange, "out of range value %d at %s", num, at)
+		default:
+			if first, ok := v.first[num]; ok {
+				v.duplicates++
+				v.problem(v.duplicates, "duplicate %d at %s, first in %s", num, at, filepath.Base(files[first]))
+				break
+			}
+			v.first[num] = int32(i)
+			v.unique++
+			unique(num)
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// problem lists the nth problem of its kind, up to show of them.
+func (v *logVerifier) problem(n int, format string, args ...any) {
+	if n <= v.show {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+func (v *logVerifier) report(files int) {
+	fmt.Printf("files       : %d\n", files)
+	fmt.Printf("lines       : %d\n", v.lines)
+	fmt.Printf("unique      : %d\n", v.unique)
+	fmt.Printf("duplicates  : %d\n", v.duplicates)
+	fmt.Printf("corrupt     : %d\n", v.corrupt)
+	fmt.Printf("out of range: %d\n", v.outOfRange)
+	fmt.Printf("torn        : %d\n", v.torn)
+}
+
+// replayer sends values to a server over the line protocol and counts
+// the error replies it gets back.
+type replayer struct {
+	conn   net.Conn
+	w      *bufio.Writer
+	done   chan error
+	errors int
+}
+
+// dialReplay connects to the server at addr, authenticating with the
+// token in AUTH_TOKEN, if any.
+func dialReplay(addr string) (*replayer, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to replay: %v", err)
+	}
+	rp := &replayer{conn: conn, w: bufio.NewWriter(conn), done: make(chan error, 1)}
+	if token := os.Getenv(authTokenEnv); token != "" {
+		rp.w.WriteString("AUTH " + token + "\n")
+	}
+
+	// Replies are read as they come, so a server answering errors
+	// never blocks on a full socket while the values are sent.
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			switch line := scanner.Text(); {
+			case line == "PONG":
+				rp.done <- nil
+				return
+			case strings.HasPrefix(line, "ERR"), strings.HasPrefix(line, "Server busy"):
+				rp.errors++
+			}
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		rp.done <- fmt.Errorf("server hung up before taking every value: %v", err)
+	}()
+	return rp, nil
+}
+
+// finish sends a PING and waits for its PONG, the server took every
+// value sent before it by then.
+func (rp *replayer) finish() error {
+	rp.w.WriteString("PING\n")
+	if err := rp.w.Flush(); err != nil {
+		return fmt.Errorf("could not replay: %v", err)
+	}
+	select {
+	case err := <-rp.done:
+		return err
+	case <-time.After(replayTimeout):
+		return fmt.Errorf("server didn't answer within %v", replayTimeout)
+	}
+}